@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ayushn2/distri_vault.git/vault"
+)
+
+const usage = `usage: distri_vault <command> [flags] [args]
+
+commands:
+  node                 run a node
+  put <key> [file]     store a file, read from stdin without a file or with -
+  get <key>            print a file, or write it to -o
+  rm <key>             delete a file with all its versions
+  ls [prefix]          list files
+  stat <key>           describe a file
+  peers                list the nodes this node knows
+
+Run distri_vault <command> -h for the flags of a command. The client commands
+reach the node over its control socket, -socket or $DISTRI_VAULT_SOCKET.
+`
+
+// cli runs one command, its exit code is the result
+type cli struct{
+	stdin io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	json bool
+}
+
+func runCLI(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int{
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr}
+
+	if len(args) == 0{
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	var err error
+	switch cmd, args := args[0], args[1:]; cmd{
+	case "node":
+		err = c.node(args)
+	case "put":
+		err = c.put(args)
+	case "get":
+		err = c.get(args)
+	case "rm":
+		err = c.rm(args)
+	case "ls":
+		err = c.ls(args)
+	case "stat":
+		err = c.stat(args)
+	case "peers":
+		err = c.peers(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", cmd, usage)
+		return 2
+	}
+
+	if errors.Is(err, flag.ErrHelp){
+		return 0
+	}
+	var usageErr usageError
+	if errors.As(err, &usageErr){
+		fmt.Fprintln(c.stderr, usageErr)
+		return 2
+	}
+	if err != nil{
+		c.fail(err)
+		return 1
+	}
+	return 0
+}
+
+type usageError string
+
+func (e usageError) Error() string{
+	return string(e)
+}
+
+// fail reports err, as a JSON object in JSON mode so scripts can tell errors apart by their code
+func (c *cli) fail(err error){
+	if !c.json{
+		fmt.Fprintf(c.stderr, "error: %s\n", err)
+		return
+	}
+
+	code := "internal"
+	var ctlErr *vault.ControlError
+	if errors.As(err, &ctlErr){
+		code = ctlErr.Code
+	}
+	json.NewEncoder(c.stderr).Encode(vault.ControlResponse{Error: err.Error(), Code: code})
+}
+
+// flags returns the flag set of a command, with the flags every command has
+func (c *cli) flags(name string, socket *string) *flag.FlagSet{
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+
+	def := os.Getenv("DISTRI_VAULT_SOCKET")
+	if len(def) == 0{
+		def = vault.DefaultControlSocket
+	}
+	fs.StringVar(socket, "socket", def, "control socket of the node")
+	fs.BoolVar(&c.json, "json", false, "print JSON instead of text")
+	return fs
+}
+
+// parse parses the flags of a command that takes between min and max arguments
+func parse(fs *flag.FlagSet, args []string, min int, max int, names string) ([]string, error){
+	if err := fs.Parse(args); err != nil{
+		return nil, err
+	}
+	if fs.NArg() < min || fs.NArg() > max{
+		return nil, usageError(fmt.Sprintf("usage: distri_vault %s [flags] %s", fs.Name(), names))
+	}
+	return fs.Args(), nil
+}
+
+func (c *cli) printJSON(v any) error{
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (c *cli) node(args []string) error{
+	var (
+		configPath, listen, root, bootstrap, id, advertise, cluster, logLevel, logLevels, logFormat, httpAddr, s3Addr, adminAddr, traceExporter, traceEndpoint string
+		replication int
+		antiEntropy time.Duration
+		socket string
+	)
+	fs := c.flags("node", &socket)
+	fs.StringVar(&configPath, "config", os.Getenv(vault.EnvPrefix+"CONFIG"), "TOML, YAML or JSON config file")
+	fs.StringVar(&listen, "listen", "", "address to accept peers on (default :3000)")
+	fs.StringVar(&root, "root", "", "storage root, <listen>_network if not set")
+	fs.StringVar(&bootstrap, "bootstrap", "", "comma separated addresses of nodes to join")
+	fs.StringVar(&id, "id", "", "owner ID, generated on first start if not set")
+	fs.StringVar(&advertise, "advertise", "", "address peers reach us on, the listen address if not set")
+	fs.StringVar(&cluster, "cluster", "", "find nodes of this cluster on the LAN")
+	fs.IntVar(&replication, "replication", 0, "number of replicas of every file, zero replicates to every peer")
+	fs.DurationVar(&antiEntropy, "anti-entropy", 0, "how often to sync with peers, zero disables it")
+	fs.StringVar(&logLevel, "log-level", "", "debug, info, warn or error")
+	fs.StringVar(&logLevels, "log-levels", "", "comma separated component=level pairs, like raft=debug")
+	fs.StringVar(&logFormat, "log-format", "", "text or json")
+	fs.StringVar(&httpAddr, "http", "", "address to serve the HTTP gateway on")
+	fs.StringVar(&s3Addr, "s3", "", "address to serve the S3 front-end on, access keys come from s3_keys")
+	fs.StringVar(&adminAddr, "admin", "", "address to serve the Prometheus metrics on")
+	fs.StringVar(&traceExporter, "trace", "", "export the spans of Store and Get to stdout or otlp")
+	fs.StringVar(&traceEndpoint, "trace-endpoint", "", "URL the otlp exporter posts to, like http://localhost:4318/v1/traces")
+	if _, err := parse(fs, args, 0, 0, ""); err != nil{
+		return err
+	}
+
+	// Flags that were given win over the config file and the environment
+	load := func() (vault.Config, error){
+		cfg, err := vault.LoadConfig(configPath)
+		if err != nil{
+			return cfg, err
+		}
+		fs.Visit(func(f *flag.Flag){
+			switch f.Name{
+			case "socket":
+				cfg.ControlSocket = socket
+			case "listen":
+				cfg.Listen = listen
+			case "root":
+				cfg.StorageRoot = root
+			case "bootstrap":
+				cfg.Bootstrap = commaList(bootstrap)
+			case "id":
+				cfg.ID = id
+			case "advertise":
+				cfg.Advertise = advertise
+			case "cluster":
+				cfg.Cluster = cluster
+			case "replication":
+				cfg.ReplicationFactor = replication
+			case "anti-entropy":
+				cfg.AntiEntropyInterval = vault.Duration(antiEntropy)
+			case "log-level":
+				cfg.LogLevel = logLevel
+			case "log-levels":
+				cfg.LogLevels = commaList(logLevels)
+			case "log-format":
+				cfg.LogFormat = logFormat
+			case "http":
+				cfg.HTTPAddr = httpAddr
+			case "s3":
+				cfg.S3Addr = s3Addr
+			case "admin":
+				cfg.AdminAddr = adminAddr
+			case "trace":
+				cfg.TraceExporter = traceExporter
+			case "trace-endpoint":
+				cfg.TraceEndpoint = traceEndpoint
+			}
+		})
+		return cfg, cfg.Validate()
+	}
+
+	cfg, err := load()
+	if err != nil{
+		return err
+	}
+
+	n, err := vault.NewNode(vault.WithConfig(cfg))
+	if err != nil{
+		return err
+	}
+	if err := n.Start(); err != nil{
+		return err
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	for sig := range sigs{
+		if sig != syscall.SIGHUP{
+			break
+		}
+
+		next, err := load()
+		if err != nil{
+			fmt.Fprintf(c.stderr, "reload failed, keeping the running config: %s\n", err)
+			continue
+		}
+		if changed := cfg.RestartRequired(next); len(changed) != 0{
+			fmt.Fprintf(c.stderr, "reload: %s only change after a restart\n", strings.Join(changed, ", "))
+		}
+		opts, _ := next.Options()
+		n.Server().Reload(opts)
+		cfg = next
+		fmt.Fprintln(c.stderr, "reloaded config")
+	}
+	return n.Close()
+}
+
+func (c *cli) put(args []string) error{
+	var socket string
+	fs := c.flags("put", &socket)
+	args, err := parse(fs, args, 1, 2, "<key> [file]")
+	if err != nil{
+		return err
+	}
+
+	body := c.stdin
+	if len(args) == 2 && args[1] != "-"{
+		f, err := os.Open(args[1])
+		if err != nil{
+			return err
+		}
+		defer f.Close()
+		body = f
+	}
+
+	client := &vault.ControlClient{Socket: socket}
+	resp, err := client.Call(vault.ControlRequest{Op: vault.ControlPut, Key: args[0]}, body)
+	if err != nil{
+		return err
+	}
+	if c.json{
+		return c.printJSON(resp.Object)
+	}
+	fmt.Fprintf(c.stdout, "stored %s (%d bytes, version %s)\n", resp.Object.Key, resp.Object.Size, resp.Object.Version)
+	return nil
+}
+
+func (c *cli) get(args []string) error{
+	var socket, out string
+	fs := c.flags("get", &socket)
+	fs.StringVar(&out, "o", "", "write the file here instead of to stdout")
+	args, err := parse(fs, args, 1, 1, "<key>")
+	if err != nil{
+		return err
+	}
+
+	client := &vault.ControlClient{Socket: socket}
+	resp, body, err := client.Do(vault.ControlRequest{Op: vault.ControlGet, Key: args[0]}, nil)
+	if err != nil{
+		return err
+	}
+	defer body.Close()
+
+	if len(out) == 0{
+		_, err = io.Copy(c.stdout, body)
+		return err
+	}
+
+	f, err := os.Create(out)
+	if err != nil{
+		return err
+	}
+	n, err := io.Copy(f, body)
+	if cerr := f.Close(); err == nil{
+		err = cerr
+	}
+	if err != nil{
+		return err
+	}
+
+	if c.json{
+		return c.printJSON(resp.Object)
+	}
+	fmt.Fprintf(c.stdout, "wrote %d bytes of %s to %s\n", n, args[0], out)
+	return nil
+}
+
+func (c *cli) rm(args []string) error{
+	var socket string
+	fs := c.flags("rm", &socket)
+	args, err := parse(fs, args, 1, 1, "<key>")
+	if err != nil{
+		return err
+	}
+
+	client := &vault.ControlClient{Socket: socket}
+	if _, err := client.Call(vault.ControlRequest{Op: vault.ControlDelete, Key: args[0]}, nil); err != nil{
+		return err
+	}
+	if c.json{
+		return c.printJSON(map[string]any{"Key": args[0], "Deleted": true})
+	}
+	fmt.Fprintf(c.stdout, "deleted %s\n", args[0])
+	return nil
+}
+
+func (c *cli) ls(args []string) error{
+	var socket string
+	fs := c.flags("ls", &socket)
+	args, err := parse(fs, args, 0, 1, "[prefix]")
+	if err != nil{
+		return err
+	}
+
+	prefix := ""
+	if len(args) == 1{
+		prefix = args[0]
+	}
+	client := &vault.ControlClient{Socket: socket}
+	resp, err := client.Call(vault.ControlRequest{Op: vault.ControlList, Prefix: prefix}, nil)
+	if err != nil{
+		return err
+	}
+	if c.json{
+		if resp.Objects == nil{
+			resp.Objects = []vault.ObjectInfo{}
+		}
+		return c.printJSON(resp.Objects)
+	}
+
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SIZE\tMODIFIED\tKEY")
+	for _, o := range resp.Objects{
+		key := o.Key
+		if o.Conflict{
+			key += " (conflict)"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", o.Size, o.ModTime.Format(time.DateTime), key)
+	}
+	return w.Flush()
+}
+
+func (c *cli) stat(args []string) error{
+	var socket string
+	fs := c.flags("stat", &socket)
+	args, err := parse(fs, args, 1, 1, "<key>")
+	if err != nil{
+		return err
+	}
+
+	client := &vault.ControlClient{Socket: socket}
+	resp, err := client.Call(vault.ControlRequest{Op: vault.ControlStat, Key: args[0]}, nil)
+	if err != nil{
+		return err
+	}
+	if c.json{
+		return c.printJSON(resp.Object)
+	}
+
+	o := resp.Object
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "key:\t%s\n", o.Key)
+	fmt.Fprintf(w, "size:\t%d\n", o.Size)
+	fmt.Fprintf(w, "modified:\t%s\n", o.ModTime.Format(time.RFC3339))
+	fmt.Fprintf(w, "sha256:\t%s\n", o.Digest)
+	if len(o.Version) != 0{
+		fmt.Fprintf(w, "version:\t%s (%d kept)\n", o.Version, o.Versions)
+	}
+	if o.Conflict{
+		fmt.Fprintf(w, "conflict:\tconcurrent versions, store the key again to resolve\n")
+	}
+	return w.Flush()
+}
+
+func (c *cli) peers(args []string) error{
+	var socket string
+	fs := c.flags("peers", &socket)
+	if _, err := parse(fs, args, 0, 0, ""); err != nil{
+		return err
+	}
+
+	client := &vault.ControlClient{Socket: socket}
+	resp, err := client.Call(vault.ControlRequest{Op: vault.ControlPeers}, nil)
+	if err != nil{
+		return err
+	}
+	if c.json{
+		if resp.Peers == nil{
+			resp.Peers = []vault.PeerStatus{}
+		}
+		return c.printJSON(resp.Peers)
+	}
+
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADDRESS\tSTATE\tCONNECTED")
+	for _, p := range resp.Peers{
+		state := p.State
+		if len(state) == 0{
+			state = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\n", p.ID, p.Addr, state, p.Connected)
+	}
+	return w.Flush()
+}
+
+// commaList splits a comma separated flag value, ignoring empty items
+func commaList(v string) []string{
+	items := []string{}
+	for _, item := range strings.Split(v, ","){
+		if item = strings.TrimSpace(item); len(item) != 0{
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ayushn2/distri_vault.git/vault"
+)
+
+func startControlNode(t *testing.T) string{
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "node.sock")
+	cfg := vault.DefaultConfig()
+	cfg.Listen = ":0"
+	cfg.StorageRoot = filepath.Join(dir, "root")
+	cfg.ControlSocket = socket
+	n, err := vault.NewNode(vault.WithConfig(cfg))
+	if err != nil{
+		t.Fatal(err)
+	}
+	if err := n.Start(); err != nil{
+		t.Fatal(err)
+	}
+	t.Cleanup(func(){ n.Close() })
+	return socket
+}
+
+// run runs the command line client and returns its exit code, stdout and stderr
+func run(stdin string, args ...string) (int, string, string){
+	var stdout, stderr bytes.Buffer
+	code := runCLI(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCLI(t *testing.T){
+	socket := startControlNode(t)
+
+	if code, out, errOut := run("hello world", "put", "-socket", socket, "docs/a.txt"); code != 0 || !strings.Contains(out, "stored docs/a.txt (11 bytes"){
+		t.Fatalf("put failed with %d: %s%s", code, out, errOut)
+	}
+	run("other", "put", "-socket", socket, "pics/b.jpg", "-")
+
+	if code, out, _ := run("", "get", "-socket", socket, "docs/a.txt"); code != 0 || out != "hello world"{
+		t.Errorf("get returned %d %q", code, out)
+	}
+
+	code, out, _ := run("", "ls", "-socket", socket, "-json", "docs/")
+	var objects []vault.ObjectInfo
+	if err := json.Unmarshal([]byte(out), &objects); err != nil || code != 0{
+		t.Fatalf("ls returned %d %q: %v", code, out, err)
+	}
+	if len(objects) != 1 || objects[0].Key != "docs/a.txt" || objects[0].Size != 11 || objects[0].Versions != 1{
+		t.Errorf("unexpected listing %+v", objects)
+	}
+
+	if code, out, _ := run("", "stat", "-socket", socket, "pics/b.jpg"); code != 0 || !strings.Contains(out, "size:      5\n"){
+		t.Errorf("stat returned %d %q", code, out)
+	}
+
+	if code, out, _ := run("", "rm", "-socket", socket, "docs/a.txt"); code != 0 || out != "deleted docs/a.txt\n"{
+		t.Errorf("rm returned %d %q", code, out)
+	}
+	code, _, errOut := run("", "stat", "-socket", socket, "-json", "docs/a.txt")
+	var resp vault.ControlResponse
+	if err := json.Unmarshal([]byte(errOut), &resp); err != nil || code != 1 || resp.Code != "deleted"{
+		t.Errorf("expected stat of a deleted file to fail with code deleted, have %d %q", code, errOut)
+	}
+
+	if code, out, _ := run("", "peers", "-socket", socket, "-json"); code != 0 || strings.TrimSpace(out) != "[]"{
+		t.Errorf("peers returned %d %q", code, out)
+	}
+}
+
+func TestCLIUsage(t *testing.T){
+	if code, _, _ := run("", "put"); code != 2{
+		t.Errorf("expected a usage error for put without a key, have %d", code)
+	}
+	if code, _, _ := run("", "frobnicate"); code != 2{
+		t.Errorf("expected a usage error for an unknown command, have %d", code)
+	}
+	if code, _, errOut := run("", "ls", "-socket", filepath.Join(t.TempDir(), "none.sock")); code != 1 || !strings.Contains(errOut, "no node listening"){
+		t.Errorf("expected ls without a node to fail, have %d %q", code, errOut)
+	}
+}
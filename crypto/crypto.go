@@ -0,0 +1,140 @@
+// Package crypto holds the keys, IDs and stream ciphers of distri_vault. Files are encrypted with AES in CTR mode, the
+// IV is written in front of the ciphertext.
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+)
+
+// GenerateID returns a random node ID
+func GenerateID() string{
+	buf := make([]byte, 32)
+	io.ReadFull(rand.Reader, buf)
+	return hex.EncodeToString(buf)
+}
+
+// ValidID reports whether id has the form of a node ID, which makes it safe to use as a path element
+func ValidID(id string) bool{
+	if len(id) != 64{
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// HashKey is the name a key is stored under on the nodes holding a replica of it
+func HashKey(key string) string{
+	hash := md5.Sum([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// ValidHashedKey reports whether key has the form HashKey gives
+func ValidHashedKey(key string) bool{
+	if len(key) != 2*md5.Size{
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+// NewEncryptionKey returns a random AES-256 key
+func NewEncryptionKey() []byte{
+	keyBuf := make([]byte,32)
+	io.ReadFull(rand.Reader, keyBuf)
+	return keyBuf
+}
+
+// NewSigningKey generates the key a node signs its deletes with, peers learn the public half from its hello
+func NewSigningKey() ed25519.PrivateKey{
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil{
+		panic(err)
+	}
+	return priv
+}
+
+func copyStream(stream cipher.Stream,blockSize int ,src io.Reader, dst io.Writer)(int, error){
+	var (
+		buf = make([]byte, 32*1024) // max amount we are gonna copy to memory
+		nw = blockSize
+	)
+	for{
+		n, err := src.Read(buf)
+		
+		if n > 0{
+			stream.XORKeyStream(buf, buf[:n])
+			nn, err := dst.Write(buf[:n])
+			if err != nil {
+				return 0, err
+			}
+			nw += nn
+		}
+		if err == io.EOF{
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return nw, nil
+}
+
+// CopyDecrypt decrypts src, IV first, into dst
+func CopyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// Read the IV from the given io.Reader which in our case should be the block.BlockSize() byes we read
+	iv := make([]byte, block.BlockSize())
+	if _, err := src.Read(iv); err != nil {
+		return 0, err
+	}
+
+	stream := cipher.NewCTR(block, iv)
+	return copyStream(stream, block.BlockSize(), src, dst)
+}
+
+// CopyEncrypt encrypts src into dst with a random IV and returns the bytes written, IV included
+func CopyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error){
+	iv := make([]byte, aes.BlockSize) //16 bytes ig
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil{
+		return 0, err
+	}
+	return copyEncryptIV(key, iv, src, dst)
+}
+
+// CopyEncryptConvergent encrypts with an IV derived from the digest of the plaintext, so every copy of the same
+// content encrypts to the same ciphertext wherever and whenever it is sent. That is what lets a node fetch the chunks
+// of one object from several replicas. Different content never shares an IV.
+func CopyEncryptConvergent(key []byte, digest string, src io.Reader, dst io.Writer) (int, error){
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(digest))
+	return copyEncryptIV(key, mac.Sum(nil)[:aes.BlockSize], src, dst)
+}
+
+func copyEncryptIV(key []byte, iv []byte, src io.Reader, dst io.Writer) (int, error){
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// prepend the IV to the file.
+	if _,err := dst.Write(iv); err != nil{
+		return 0, err
+	}
+
+	stream := cipher.NewCTR(block, iv)
+	return copyStream(stream, block.BlockSize(), src, dst)
+	}
+	
@@ -0,0 +1,39 @@
+package p2p
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BindContext makes a connection deadline follow ctx: set, one of the SetDeadline methods of a net.Conn, is given the
+// deadline of ctx and a deadline in the past once ctx is cancelled, so a read or write blocked on the connection
+// returns right away. The returned stop clears the deadline again and has to be called once the call ctx bounds is
+// done, the connection is shared with every other message to the same peer.
+func BindContext(ctx context.Context, set func(time.Time) error) (stop func()){
+	if ctx.Done() == nil{
+		return func(){}
+	}
+	if deadline, ok := ctx.Deadline(); ok{
+		set(deadline)
+	}
+
+	var (
+		mu sync.Mutex
+		stopped bool
+	)
+	cancel := context.AfterFunc(ctx, func(){
+		mu.Lock()
+		defer mu.Unlock()
+		if !stopped{
+			set(time.Unix(1, 0))
+		}
+	})
+	return func(){
+		cancel()
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		set(time.Time{})
+	}
+}
@@ -0,0 +1,171 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+)
+
+const (
+	DefaultDiscoveryGroup = "239.255.77.77:7946"
+	defaultDiscoveryInterval = 5 * time.Second
+	maxAnnouncementSize = 1024
+)
+
+// DiscoveryOpts configures LAN discovery. Nodes only pay attention to announcements carrying the same ClusterName,
+// so separate vaults on the same network don't join each other.
+type DiscoveryOpts struct{
+	ClusterName string
+	ID string
+	// ListenAddr is the address announced to the others, a missing host is filled in with the source of the packet
+	ListenAddr string
+	// GroupAddr is the UDP multicast group announcements are sent to
+	GroupAddr string
+	// Interface to join the group on, nil lets the system pick one
+	Interface *net.Interface
+	Interval time.Duration
+	// Logger is where discovery logs to, slog.Default() if not set
+	Logger *slog.Logger
+	// OnDiscover is called for every announcement of another node of the cluster
+	OnDiscover func(id string, addr string)
+}
+
+type announcement struct{
+	Cluster string
+	ID string
+	Addr string
+}
+
+// Discovery announces a node over UDP multicast and reports the other nodes it hears about
+type Discovery struct{
+	DiscoveryOpts
+	conn *net.UDPConn
+	// announcements go out on their own socket, ListenMulticastUDP turns off multicast loopback on its connection
+	// which would hide nodes running on the same host
+	sender *net.UDPConn
+	quitch chan struct{}
+}
+
+func NewDiscovery(opts DiscoveryOpts) *Discovery{
+	if len(opts.GroupAddr) == 0{
+		opts.GroupAddr = DefaultDiscoveryGroup
+	}
+	if opts.Interval <= 0{
+		opts.Interval = defaultDiscoveryInterval
+	}
+	if opts.Logger == nil{
+		opts.Logger = slog.Default()
+	}
+	return &Discovery{
+		DiscoveryOpts: opts,
+		quitch: make(chan struct{}),
+	}
+}
+
+// Start joins the multicast group and starts announcing ourselves and listening for the others
+func (d *Discovery) Start() error{
+	group, err := net.ResolveUDPAddr("udp4", d.GroupAddr)
+	if err != nil{
+		return err
+	}
+	d.conn, err = net.ListenMulticastUDP("udp4", d.Interface, group)
+	if err != nil{
+		return err
+	}
+
+	d.sender, err = net.DialUDP("udp4", nil, group)
+	if err != nil{
+		// Close has nothing to close then
+		d.conn.Close()
+		d.conn = nil
+		return err
+	}
+
+	go d.readLoop()
+	go d.announceLoop()
+
+	return nil
+}
+
+func (d *Discovery) Close() error{
+	close(d.quitch)
+	if d.conn == nil{
+		return nil
+	}
+	return errors.Join(d.conn.Close(), d.sender.Close())
+}
+
+func (d *Discovery) announceLoop(){
+	b, err := json.Marshal(announcement{
+		Cluster: d.ClusterName,
+		ID: d.ID,
+		Addr: d.ListenAddr,
+	})
+	if err != nil{
+		d.Logger.Error("discovery encode error", "err", err)
+		return
+	}
+
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+
+	for{
+		if _, err := d.sender.Write(b); errors.Is(err, net.ErrClosed){
+			return
+		}else if err != nil{
+			d.Logger.Warn("discovery announce error", "err", err)
+		}
+
+		select{
+		case <-ticker.C:
+		case <-d.quitch:
+			return
+		}
+	}
+}
+
+func (d *Discovery) readLoop(){
+	buf := make([]byte, maxAnnouncementSize)
+
+	for{
+		n, src, err := d.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed){
+			return
+		}
+		if err != nil{
+			d.Logger.Warn("discovery read error", "err", err)
+			continue
+		}
+
+		var a announcement
+		if err := json.Unmarshal(buf[:n], &a); err != nil{
+			continue
+		}
+		if a.Cluster != d.ClusterName || a.ID == d.ID || len(a.Addr) == 0{
+			continue
+		}
+
+		if d.OnDiscover != nil{
+			d.OnDiscover(a.ID, ResolveAdvertisedAddr(a.Addr, src.String()))
+		}
+	}
+}
+
+// ResolveAdvertisedAddr fills in the host of an advertised address like ":3000" with the host of the remote address
+// the advertisement came from
+func ResolveAdvertisedAddr(advertised string, remote string) string{
+	host, port, err := net.SplitHostPort(advertised)
+	if err != nil{
+		return advertised
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()){
+		return advertised
+	}
+	remoteHost, _, err := net.SplitHostPort(remote)
+	if err != nil{
+		return advertised
+	}
+	return net.JoinHostPort(remoteHost, port)
+}
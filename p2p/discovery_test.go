@@ -0,0 +1,65 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscovery(t *testing.T){
+	const group = "239.255.77.77:17946"
+
+	found := make(chan [2]string, 16)
+	a := NewDiscovery(DiscoveryOpts{
+		ClusterName: "lab",
+		ID: "a",
+		ListenAddr: ":3000",
+		GroupAddr: group,
+		Interval: 50 * time.Millisecond,
+		OnDiscover: func(id string, addr string){
+			found <- [2]string{id, addr}
+		},
+	})
+	b := NewDiscovery(DiscoveryOpts{
+		ClusterName: "lab",
+		ID: "b",
+		ListenAddr: "127.0.0.1:4000",
+		GroupAddr: group,
+		Interval: 50 * time.Millisecond,
+	})
+	other := NewDiscovery(DiscoveryOpts{
+		ClusterName: "office",
+		ID: "c",
+		ListenAddr: "127.0.0.1:5000",
+		GroupAddr: group,
+		Interval: 50 * time.Millisecond,
+	})
+
+	for _, d := range []*Discovery{a, b, other}{
+		if err := d.Start(); err != nil{
+			t.Skipf("multicast not available: %s", err)
+		}
+		defer d.Close()
+	}
+
+	timeout := time.After(2 * time.Second)
+	for{
+		select{
+		case f := <-found:
+			assert.NotEqual(t, "c", f[0], "discovered a node of another cluster")
+			if f[0] == "b"{
+				assert.Equal(t, "127.0.0.1:4000", f[1])
+				return
+			}
+		case <-timeout:
+			t.Fatal("node b was never discovered")
+		}
+	}
+}
+
+func TestResolveAdvertisedAddr(t *testing.T){
+	assert.Equal(t, "10.0.0.7:3000", ResolveAdvertisedAddr(":3000", "10.0.0.7:53122"))
+	assert.Equal(t, "10.0.0.7:3000", ResolveAdvertisedAddr("0.0.0.0:3000", "10.0.0.7:53122"))
+	assert.Equal(t, "vault-1:3000", ResolveAdvertisedAddr("vault-1:3000", "10.0.0.7:53122"))
+}
@@ -1,10 +1,15 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"io"
 )
 
+// MaxMessageSize caps the payload of a single framed message so a corrupt length prefix can't make us allocate arbitrary amounts of memory
+const MaxMessageSize = 16 << 20
+
 type Decoder interface{
 	Decode(io.Reader,*RPC) error
 }
@@ -32,13 +37,30 @@ func (dec DefaultDecoder) Decode(r io.Reader,msg *RPC) error{
 		return nil
 	}
 
-	buf := make([]byte,1028)
-	n, err := r.Read(buf)
-	if err != nil{
+	// Messages are framed with a uint32 length prefix so payloads larger than a single read (merkle nodes, entry lists) arrive whole
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil{
+		return err
+	}
+	if size > MaxMessageSize{
+		return fmt.Errorf("message of %d bytes exceeds max message size", size)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil{
 		return err
 	}
 
-	msg.Payload = buf[:n]
+	msg.Payload = buf
 
 	return nil
-}
\ No newline at end of file
+}
+
+// EncodeFrame prepends the IncomingMessage byte and the length prefix to payload, so the whole frame can go out in a single write
+func EncodeFrame(payload []byte) []byte{
+	frame := make([]byte, 5+len(payload))
+	frame[0] = IncomingMessage
+	binary.LittleEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	copy(frame[5:], payload)
+	return frame
+}
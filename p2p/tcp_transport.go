@@ -1,11 +1,13 @@
 package p2p
 
 import (
+	"context"
 	"errors"
-	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"os"
 	"sync"
+	"time"
 )
 
 // TCPPeer represenst the remote node over TCP established  connection
@@ -18,6 +20,10 @@ type TCPPeer struct{
 	outbound bool
 
 	wg *sync.WaitGroup
+
+	// writing is held across every write to the connection, a write deadline set for one send must not cut short
+	// another send to the same peer
+	writing chan struct{}
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer{
@@ -25,15 +31,61 @@ func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer{
 		Conn: conn,
 		outbound: outbound,
 		wg:  &sync.WaitGroup{},
+		writing: make(chan struct{}, 1),
 	}
 }
 
+// Outbound reports whether we dialed the connection
+func (p *TCPPeer) Outbound() bool{
+	return p.outbound
+}
+
 func (p *TCPPeer) CloseStream(){
 	p.wg.Done()
 }
 
 func (p *TCPPeer) Send(b []byte) error{
-	_, err := p.Conn.Write(b)
+	_, err := p.Write(b)
+	return err
+}
+
+// Write writes b once no other write to the peer is in progress
+func (p *TCPPeer) Write(b []byte) (int, error){
+	p.writing <- struct{}{}
+	defer func(){ <-p.writing }()
+	return p.Conn.Write(b)
+}
+
+// SendContext writes b with the deadline of ctx. A frame that was only partly written when ctx ran out leaves the
+// other end mid message, so the connection is closed rather than left out of sync. Waiting for another send to the
+// peer to finish counts against ctx too.
+func (p *TCPPeer) SendContext(ctx context.Context, b []byte) error{
+	if err := ctx.Err(); err != nil{
+		return err
+	}
+	select{
+	case p.writing <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func(){ <-p.writing }()
+
+	stop := BindContext(ctx, p.Conn.SetWriteDeadline)
+	n, err := p.Conn.Write(b)
+	stop()
+	if err == nil{
+		return nil
+	}
+	if n > 0{
+		p.Conn.Close()
+	}
+	if ctx.Err() != nil{
+		return ctx.Err()
+	}
+	// The deadline of the connection can go off a moment before ctx reports it
+	if deadline, ok := ctx.Deadline(); ok && errors.Is(err, os.ErrDeadlineExceeded) && !time.Now().Before(deadline){
+		return context.DeadlineExceeded
+	}
 	return err
 }
 
@@ -42,6 +94,12 @@ type TCPTransportOpts struct{
 	HandshakeFunc HandshakeFunc
 	Decoder Decoder 
 	OnPeer func(Peer) error
+	// OnPeerDisconnect is called once the connection of a peer that was handed to OnPeer is gone
+	OnPeerDisconnect func(Peer)
+	// WrapConn, if set, wraps every connection before it is used, to count its bytes for instance
+	WrapConn func(net.Conn) net.Conn
+	// Logger is where the transport logs to, slog.Default() if not set
+	Logger *slog.Logger
 }
 
 type TCPTransport struct{
@@ -54,6 +112,9 @@ type TCPTransport struct{
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport{
+	if opts.Logger == nil{
+		opts.Logger = slog.Default()
+	}
 	return &TCPTransport{
 		TCPTransportOpts: opts,
 		rpcch: make(chan RPC,1024),
@@ -72,12 +133,22 @@ func (t *TCPTransport) Consume() <-chan RPC{
 
 // Close implements the Transport interface
 func (t *TCPTransport) Close() error{
+	// A transport that never listened has nothing to close
+	if t.listener == nil{
+		return nil
+	}
 	return t.listener.Close()
 }
 
 // Dial implements the transport interface
 func (t *TCPTransport) Dial(addr string) error{
-	conn, err := net.Dial("tcp", addr)
+	return t.DialContext(context.Background(), addr)
+}
+
+// DialContext implements the transport interface, ctx bounds the connect only
+func (t *TCPTransport) DialContext(ctx context.Context, addr string) error{
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
 	if err!= nil{
 		return err
 	}
@@ -97,7 +168,7 @@ func (t *TCPTransport) ListenAndAccept() error{
 
 	go t.startAcceptLoop()
 
-	log.Printf("TCP transport listening on port  %s\n", t.ListenAddr)
+	t.Logger.Info("tcp transport listening", "addr", t.listener.Addr().String())
 
 	return nil
 }
@@ -109,10 +180,11 @@ func (t *TCPTransport) startAcceptLoop(){
 			return
 		}
 		if err!= nil{
-			fmt.Printf("TCP accept error : %s\n",err)
+			t.Logger.Error("tcp accept error", "err", err)
+			continue
 		}
 
-		fmt.Printf("new incoming connection %v\n",conn)
+		t.Logger.Debug("new incoming connection", "peer", conn.RemoteAddr().String())
 
 		go t.handleConn(conn, false)
 	}
@@ -125,9 +197,12 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool){
 	var err error
 
 	defer func(){
-		fmt.Printf("dropping peer connection: %s",err)
+		t.Logger.Debug("dropping peer connection", "peer", conn.RemoteAddr().String(), "err", err)
 		conn.Close()
 	}()
+	if t.WrapConn != nil{
+		conn = t.WrapConn(conn)
+	}
 	peer := NewTCPPeer(conn,outbound)//Outbound peer becoz we are accepting (incoming connection)
 
 	if err = t.HandshakeFunc(peer); err != nil{
@@ -139,6 +214,10 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool){
 			return
 		}
 	}
+
+	if t.OnPeerDisconnect != nil{
+		defer t.OnPeerDisconnect(peer)
+	}
 	
 	// Read loop
 	
@@ -154,9 +233,9 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool){
 
 		if rpc.Stream{
 			peer.wg.Add(1)
-			fmt.Printf("[%s] incoming stream,  waiting...\n",conn.RemoteAddr())
+			t.Logger.Debug("incoming stream, waiting", "peer", rpc.From)
 			peer.wg.Wait()
-			fmt.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
+			t.Logger.Debug("stream closed, resuming read loop", "peer", rpc.From)
 			continue
 		}
 
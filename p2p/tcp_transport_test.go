@@ -1,7 +1,11 @@
 package p2p
 
 import (
+	"context"
+	"io"
+	"net"
 	"testing"
+	"time"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,4 +23,94 @@ func TestTCPTransport(t *testing.T){
 	// Server
 	assert.Nil(t,tr.ListenAndAccept())
 
-}
\ No newline at end of file
+}
+func TestTCPTransportOnPeerDisconnect(t *testing.T){
+	connected := make(chan Peer, 1)
+	disconnected := make(chan Peer, 1)
+
+	server := NewTCPTransport(TCPTransportOpts{
+		ListenAddr: "127.0.0.1:0",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder: DefaultDecoder{},
+		OnPeer: func(p Peer) error{
+			connected <- p
+			return nil
+		},
+		OnPeerDisconnect: func(p Peer){
+			disconnected <- p
+		},
+	})
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+
+	client := NewTCPTransport(TCPTransportOpts{
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder: DefaultDecoder{},
+		OnPeer: func(p Peer) error{
+			// Drop the connection right away, the server must notice
+			return p.Close()
+		},
+	})
+	assert.Nil(t, client.Dial(server.listener.Addr().String()))
+
+	p := <-connected
+	assert.False(t, p.Outbound())
+	assert.Equal(t, p, <-disconnected)
+}
+
+func TestSendContext(t *testing.T){
+	a, b := net.Pipe()
+	defer b.Close()
+	p := NewTCPPeer(a, true)
+
+	// Nobody reads the other end, the write can only end with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, p.SendContext(ctx, []byte("hello")), context.DeadlineExceeded)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	assert.ErrorIs(t, p.SendContext(ctx, []byte("hello")), context.Canceled)
+
+	// Nothing was written, the connection is still good and has no deadline left
+	go p.SendContext(context.Background(), []byte("hello"))
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(b, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestSendContextConcurrent(t *testing.T){
+	a, b := net.Pipe()
+	defer b.Close()
+	p := NewTCPPeer(a, true)
+
+	// The first send waits for a slow reader, a second one with a short deadline gives up without cutting it short
+	first := make(chan error, 1)
+	go func(){
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		first <- p.SendContext(ctx, []byte("first"))
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	second := make(chan error, 1)
+	go func(){
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		second <- p.SendContext(ctx, []byte("second"))
+	}()
+	select{
+	case err := <-second:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("expected the second send to give up at its deadline")
+	}
+
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(b, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", string(buf))
+	assert.Nil(t, <-first)
+}
@@ -1,18 +1,25 @@
 package p2p
 
-import "net"
+import (
+	"context"
+	"net"
+)
 
 // Peer is an interface that represents the remote node
 type Peer interface{
 	net.Conn
 	Send(data []byte) error
+	// SendContext is Send giving up once ctx is done, see BindContext
+	SendContext(ctx context.Context, data []byte) error
 	CloseStream()
+	Outbound() bool
 }
 
 // Transport is anything that handles the communictaion between nodes in the network. This can be of the form (TCP, UDP, websockets, ...)
 type Transport interface{
 	Addr() string
 	Dial(string) error
+	DialContext(context.Context, string) error
 	ListenAndAccept() error
 	Consume() <-chan RPC
 	Close() error
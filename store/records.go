@@ -0,0 +1,69 @@
+package store
+
+import "time"
+
+// The records the store keeps next to the files: the version index of every key and the erasure coding of an object.
+
+// Version describes one stored version of a key
+type Version struct{
+	ID string
+	// Key is the key the version was stored under, Digest the sha256 of its contents
+	Key string `json:",omitempty"`
+	Digest string `json:",omitempty"`
+	Size int64
+	ModTime time.Time
+	// Node is the node that wrote the version, Clock its causal history
+	Node string
+	Clock VectorClock
+	// Erasure is set when the version is erasure coded, so it can be rebuilt even if our copy is gone with its meta
+	Erasure *ErasureInfo `json:",omitempty"`
+}
+
+// VectorClock counts the writes every node has made to a key, it tells whether two versions are causally related or concurrent
+type VectorClock map[string]uint64
+
+// Descends reports whether c has seen every write other has seen
+func (c VectorClock) Descends(other VectorClock) bool{
+	for node, n := range other{
+		if c[node] < n{
+			return false
+		}
+	}
+	return true
+}
+
+// Concurrent reports whether neither clock has seen all the writes of the other
+func (c VectorClock) Concurrent(other VectorClock) bool{
+	return !c.Descends(other) && !other.Descends(c)
+}
+
+// Merge returns a clock that descends from c and every other clock
+func (c VectorClock) Merge(others ...VectorClock) VectorClock{
+	merged := make(VectorClock, len(c))
+	for node, n := range c{
+		merged[node] = n
+	}
+	for _, other := range others{
+		for node, n := range other{
+			if n > merged[node]{
+				merged[node] = n
+			}
+		}
+	}
+	return merged
+}
+
+// ErasureInfo describes the shards of an erasure coded object
+type ErasureInfo struct{
+	DataShards int
+	ParityShards int
+	// Size is the length of the ciphertext the shards were cut from
+	Size int64
+	// Shard is the index of the shard held, -1 on the owner's whole copy
+	Shard int
+}
+
+// TotalShards is the number of shards the object was cut into
+func (info ErasureInfo) TotalShards() int{
+	return info.DataShards + info.ParityShards
+}
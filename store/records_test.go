@@ -0,0 +1,23 @@
+package store
+
+import "testing"
+
+func TestVectorClockConcurrent(t *testing.T){
+	base := VectorClock{"a": 1}
+	a := base.Merge()
+	a["a"]++
+	b := base.Merge()
+	b["b"]++
+
+	if !a.Descends(base) || !b.Descends(base){
+		t.Errorf("expected both writes to descend from their parent")
+	}
+	if !a.Concurrent(b){
+		t.Errorf("expected %v and %v to be concurrent", a, b)
+	}
+
+	merged := a.Merge(b)
+	if !merged.Descends(a) || !merged.Descends(b) || merged.Concurrent(a){
+		t.Errorf("expected %v to resolve the conflict", merged)
+	}
+}
@@ -0,0 +1,475 @@
+// Package store keeps the files of a node on disk, each under the ID of the node that owns it, with a meta record next
+// to it and a version index per key.
+package store
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+)
+
+// filename => clown.jpg
+// pat =>
+
+const DefaultRootFolderName = "nainwalnetwork"
+
+func CASPathTransformFunc(key string) PathKey{
+	hash := sha1.Sum([]byte(key))// [20]byte => []byte => [:]
+	hashStr := hex.EncodeToString(hash[:])
+	blocksize := 5
+	sliceLen := len(hashStr) / blocksize
+
+	paths := make([]string,sliceLen)
+
+	for i :=0 ; i < sliceLen ; i++{
+		from, to := i * blocksize, (i * blocksize) + blocksize
+		paths[i] = hashStr[from:to]
+	}
+
+	return PathKey{
+		Pathname : strings.Join(paths,"/"),
+		Filename :  hashStr,
+	}
+}
+
+type PathTransformFunc func(string) PathKey
+
+type PathKey struct{
+	Pathname string
+	Filename string
+}
+
+func (p  PathKey) FirstPathName() string{
+	paths := strings.Split(p.Pathname, "/")
+	if len(paths) == 0{
+		return ""
+	}
+	return paths[0]
+}
+
+func (p PathKey) FullPath() string{
+	return fmt.Sprintf("%s/%s",p.Pathname,p.Filename)
+}
+
+type StoreOpts struct{
+	// Root is the folder name of the root , containing all the folders/files of the system 
+	Root string
+	PathTransformFunc PathTransformFunc
+	// Logger is where the store logs to, slog.Default() if not set
+	Logger *slog.Logger
+}
+
+var DefaultTransformFunc = func(key string) PathKey{
+	return PathKey{
+		Pathname: key,
+		Filename: key,
+	}
+}
+
+type Store struct{
+	StoreOpts
+}
+
+func NewStore(opts StoreOpts) *Store{
+	if opts.PathTransformFunc == nil{
+		opts.PathTransformFunc = DefaultTransformFunc
+	}
+	if len (opts.Root) == 0{
+		opts.Root = DefaultRootFolderName
+	}
+	if opts.Logger == nil{
+		opts.Logger = slog.Default()
+	}
+
+	return &Store{
+		StoreOpts: opts,
+	}
+}
+
+func (s *Store) Has(id string,key string) bool{
+	pathKey := s.PathTransformFunc(key)
+	fullPathWithRoot := fmt.Sprintf("%s/%s/%s",s.Root,id,pathKey.FullPath())
+
+	_, err := os.Stat(fullPathWithRoot)
+
+	return !errors.Is(err,os.ErrNotExist)
+}
+
+func (s *Store) Clear() error{
+	return os.RemoveAll(s.Root)
+}
+
+func (s *Store) Delete(id string, key string) error{
+	pathKey := s.PathTransformFunc(key)
+	
+	defer func(){
+		s.Logger.Debug("deleted from disk", "owner", id, "key", key, "path", pathKey.FirstPathName())
+	}()
+
+	firstPathNameWithRoot := fmt.Sprintf("%s/%s/%s",s.Root,id,pathKey.FirstPathName())
+
+	return os.RemoveAll(firstPathNameWithRoot)
+}
+
+// tmpDir holds the writes in progress, Inventory skips it like every dot directory
+const tmpDir = ".tmp"
+
+func (s *Store) Write(id string, key string, r io.Reader) (int64, error){
+	return s.WriteContext(context.Background(), id, key, r)
+}
+
+// WriteContext writes r under key. The file only replaces what key held once all of r is written, a write that fails
+// or is cancelled through ctx leaves nothing behind.
+func (s *Store) WriteContext(ctx context.Context, id string, key string, r io.Reader) (int64, error){
+	return s.writeAtomic(id, key, func(w io.Writer) (int64, error){
+		return io.Copy(w, contextReader{ctx, r})
+	})
+}
+
+func (s *Store) WriteDecrypt(id string,encKey []byte, key string, r io.Reader)(int64, error){
+	return s.WriteDecryptContext(context.Background(), id, encKey, key, r)
+}
+
+// WriteDecryptContext is WriteContext for a ciphertext r that is stored decrypted with encKey
+func (s *Store) WriteDecryptContext(ctx context.Context, id string, encKey []byte, key string, r io.Reader) (int64, error){
+	return s.writeAtomic(id, key, func(w io.Writer) (int64, error){
+		n, err := crypto.CopyDecrypt(encKey, contextReader{ctx, r}, w)
+		return int64(n), err
+	})
+}
+
+// writeAtomic writes the file with write into a temporary file and moves it under key once write succeeded
+func (s *Store) writeAtomic(id string, key string, write func(io.Writer) (int64, error)) (int64, error){
+	dir := filepath.Join(s.Root, tmpDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil{
+		return 0, err
+	}
+	f, err := os.CreateTemp(dir, "write-*")
+	if err != nil{
+		return 0, err
+	}
+
+	n, err := write(f)
+	if cerr := f.Close(); err == nil{
+		err = cerr
+	}
+	if err == nil{
+		_, err = s.Move(id, key, f.Name())
+	}
+	if err != nil{
+		os.Remove(f.Name())
+		return n, err
+	}
+	return n, nil
+}
+
+// contextReader stops reading once ctx is done
+type contextReader struct{
+	ctx context.Context
+	r io.Reader
+}
+
+func (r contextReader) Read(b []byte) (int, error){
+	if err := r.ctx.Err(); err != nil{
+		return 0, err
+	}
+	return r.r.Read(b)
+}
+
+// Move puts the file at path into the store under key, the file has to be on the same filesystem as the store
+func (s *Store) Move(id string, key string, path string) (int64, error){
+	pathKey := s.PathTransformFunc(key)
+	if err := os.MkdirAll(fmt.Sprintf("%s/%s/%s",s.Root,id,pathKey.Pathname), os.ModePerm); err != nil{
+		return 0, err
+	}
+
+	fullPathWithRoot := fmt.Sprintf("%s/%s/%s",s.Root,id,pathKey.FullPath())
+	if err := os.Rename(path, fullPathWithRoot); err != nil{
+		return 0, err
+	}
+	fi, err := os.Stat(fullPathWithRoot)
+	if err != nil{
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Digest returns the hex encoded sha256 of the object as it sits on disk
+func (s *Store) Digest(id string, key string) (string, error){
+	_, r, err := s.ReadStream(id, key)
+	if err != nil{
+		return "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil{
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FIXME: Instead of copying directly to a reader , we first copy this into a buffer. Maybe just return the file from the readstream? (Fixed)
+func (s *Store) Read(id string, key string)(int64, io.Reader, error){
+	return s.ReadStream(id, key)
+}
+
+// ReadStream opens the file of key, the caller closes it
+func (s *Store) ReadStream (id string, key string) (int64, io.ReadCloser, error){
+	pathKey := s.PathTransformFunc(key)
+	fullPathWithRoot := fmt.Sprintf("%s/%s/%s",s.Root,id,pathKey.FullPath())
+
+	file, err := os.Open(fullPathWithRoot)
+	if err != nil{
+		return 0, nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil{
+		return 0, nil, err
+	}
+	
+	return fi.Size(), file, nil
+}
+
+
+// Meta is the sidecar record kept next to every object on disk. Digest is the sha256 of the plaintext, computed by the owner
+// so that the owner's copy and every encrypted replica agree on it
+type Meta struct{
+	Key string
+	Size int64
+	Digest string
+	ModTime int64
+	// Deleted marks a tombstone, the data is gone but the record stays so the object isn't brought back by a peer
+	Deleted bool
+	// Erasure is set on erasure coded objects and their shards
+	Erasure *ErasureInfo `json:",omitempty"`
+	// Hinted is when a node took the object as a hint for an offline replica, the hint expires counting from then
+	Hinted int64 `json:",omitempty"`
+	// Signature is the owner's signature of a tombstone, peers that learn of the delete later check it
+	Signature []byte `json:",omitempty"`
+}
+
+// InventoryEntry describes one object held by this store, as seen by anti-entropy
+type InventoryEntry struct{
+	ID string
+	Meta
+}
+
+const metaSuffix = ".meta"
+
+func (s *Store) metaPath(id string, key string) string{
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s%s",s.Root,id,pathKey.FullPath(),metaSuffix)
+}
+
+// WriteMeta replaces the meta record of an object in one step, the inventory walk reads it without a lock
+func (s *Store) WriteMeta(id string, key string, meta Meta) error{
+	meta.Key = key
+	b, err := json.Marshal(meta)
+	if err != nil{
+		return err
+	}
+	path := s.metaPath(id,key)
+	f, err := os.CreateTemp(filepath.Dir(path), "meta-*")
+	if err != nil{
+		return err
+	}
+	if _, err := f.Write(b); err != nil{
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil{
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Tombstone removes the data of an object and leaves a meta record saying when it was deleted and the signature of the
+// owner that deleted it
+func (s *Store) Tombstone(id string, key string, modTime int64, signature []byte) error{
+	pathKey := s.PathTransformFunc(key)
+	fullPathWithRoot := fmt.Sprintf("%s/%s/%s",s.Root,id,pathKey.FullPath())
+
+	if err := os.Remove(fullPathWithRoot); err != nil && !errors.Is(err, os.ErrNotExist){
+		return err
+	}
+	if err := os.MkdirAll(fmt.Sprintf("%s/%s/%s",s.Root,id,pathKey.Pathname), os.ModePerm); err != nil{
+		return err
+	}
+
+	return s.WriteMeta(id, key, Meta{
+		ModTime: modTime,
+		Deleted: true,
+		Signature: signature,
+	})
+}
+
+// DeleteMeta drops the meta record of an object, used to garbage collect tombstones
+func (s *Store) DeleteMeta(id string, key string) error{
+	err := os.Remove(s.metaPath(id, key))
+	if errors.Is(err, os.ErrNotExist){
+		return nil
+	}
+	return err
+}
+
+func (s *Store) ReadMeta(id string, key string) (Meta, error){
+	var meta Meta
+	b, err := os.ReadFile(s.metaPath(id,key))
+	if err != nil{
+		return meta, err
+	}
+	err = json.Unmarshal(b, &meta)
+	return meta, err
+}
+
+// Inventory walks the whole storage root and returns every object that has a meta sidecar, for all owner IDs
+func (s *Store) Inventory() ([]InventoryEntry, error){
+	entries := []InventoryEntry{}
+
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error{
+		if err != nil{
+			if errors.Is(err, os.ErrNotExist){
+				return nil
+			}
+			return err
+		}
+		// Dot directories at the top (e.g. hints) are bookkeeping, not objects we own or replicate
+		if d.IsDir() && path != s.Root && strings.HasPrefix(d.Name(), "."){
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(path, metaSuffix){
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.Root, path)
+		if err != nil{
+			return err
+		}
+		id := strings.Split(filepath.ToSlash(rel), "/")[0]
+
+		b, err := os.ReadFile(path)
+		if err != nil{
+			return err
+		}
+		var meta Meta
+		if err := json.Unmarshal(b, &meta); err != nil{
+			return fmt.Errorf("corrupt meta %s: %w", path, err)
+		}
+
+		// The object itself may have been removed with Delete, which only knows about the data file path.
+		// Tombstones have no data on purpose and are always part of the inventory.
+		if !meta.Deleted && !s.Has(id, meta.Key){
+			return nil
+		}
+
+		entries = append(entries, InventoryEntry{ID: id, Meta: meta})
+		return nil
+	})
+
+	return entries, err
+}
+
+const versionsDir = ".versions"
+
+func (s *Store) versionsPath(id string, key string) string{
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s/%s.json",s.Root,versionsDir,id,pathKey.FullPath())
+}
+
+// ReadVersions returns the version index of key, oldest first. A key without an index has no versions.
+func (s *Store) ReadVersions(id string, key string) ([]Version, error){
+	b, err := os.ReadFile(s.versionsPath(id, key))
+	if errors.Is(err, os.ErrNotExist){
+		return nil, nil
+	}
+	if err != nil{
+		return nil, err
+	}
+
+	var versions []Version
+	err = json.Unmarshal(b, &versions)
+	return versions, err
+}
+
+// WriteVersions replaces the version index of key. The index is written aside and renamed over the old one, readers
+// don't take the lock of the key and must never see a half written index.
+func (s *Store) WriteVersions(id string, key string, versions []Version) error{
+	path := s.versionsPath(id, key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil{
+		return err
+	}
+
+	b, err := json.Marshal(versions)
+	if err != nil{
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "write-*")
+	if err != nil{
+		return err
+	}
+	if _, err := f.Write(b); err != nil{
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil{
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *Store) DeleteVersions(id string, key string) error{
+	err := os.Remove(s.versionsPath(id, key))
+	if errors.Is(err, os.ErrNotExist){
+		return nil
+	}
+	return err
+}
+
+// VersionIndexes returns the version index of every key owned by id
+func (s *Store) VersionIndexes(id string) ([][]Version, error){
+	indexes := [][]Version{}
+
+	err := filepath.WalkDir(fmt.Sprintf("%s/%s/%s",s.Root,versionsDir,id), func(path string, d fs.DirEntry, err error) error{
+		if err != nil{
+			if errors.Is(err, os.ErrNotExist){
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".json"){
+			return nil
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil{
+			return err
+		}
+		var versions []Version
+		if err := json.Unmarshal(b, &versions); err != nil{
+			return fmt.Errorf("corrupt version index %s: %w", path, err)
+		}
+		if len(versions) != 0{
+			indexes = append(indexes, versions)
+		}
+		return nil
+	})
+
+	return indexes, err
+}
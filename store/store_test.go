@@ -0,0 +1,171 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+)
+
+func TestPathTransformFunc(t *testing.T){
+	key := "momsbestpicture"
+	pathKey := CASPathTransformFunc(key)
+
+	expectedOriginalKey := "6804429f74181a63c50c3d81d733a12f14a353ff"
+	expectedPathName := "68044/29f74/181a6/3c50c/3d81d/733a1/2f14a/353ff"
+	if pathKey.Pathname != expectedPathName{
+		t.Errorf("have %s want %s",pathKey.Pathname,expectedPathName)
+	}
+	if pathKey.Filename != expectedOriginalKey{
+		t.Errorf("have %s want %s",pathKey.Filename,expectedOriginalKey)
+	}
+}
+
+func TestStoreDeleteKey(t *testing.T){
+	opts := StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+	}
+	s := NewStore(opts)
+	id := crypto.GenerateID()
+	key := "momspecials"
+
+	data := []byte("some jpg bytes")
+
+	if _, err := s.Write(id, key,bytes.NewReader(data)); err !=nil{
+		t.Errorf(err.Error())
+	}
+
+	if err := s.Delete(id,key);err != nil{
+		t.Errorf(err.Error())
+	}
+}
+
+func TestStore(t *testing.T){
+	s := newStore()
+	id := crypto.GenerateID()
+	defer tearDown(t,s)
+
+	for i := 0 ; i< 50 ; i++{
+
+		key := fmt.Sprintf("pizz%d",i)
+		data := []byte("some jpg bytes")
+
+		if _, err := s.Write(id, key,bytes.NewReader(data)); err !=nil{
+			t.Errorf(err.Error())
+		}
+
+		if ok := s.Has(id, key); !ok{
+			t.Errorf("Expected to have key %s",key)
+		}
+
+		_, r, err := s.Read(id, key)
+		if err!=nil{
+			t.Errorf(err.Error())
+		}
+
+		b, _ := io.ReadAll(r)
+
+		if string(b) != string(data){
+			t.Errorf("want %s have %s",data,b)
+		}
+
+		if err := s.Delete(id, key); err != nil{
+			t.Errorf(err.Error())
+		}
+
+		if ok := s.Has(id, key); ok{
+			t.Errorf("expected to NOT hav key %s",key)
+		}
+	}
+
+	
+}
+
+func newStore() *Store{
+	opts := StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+	}
+	return NewStore(opts)
+}
+
+func tearDown(t *testing.T,s *Store){
+	if err := s.Clear();err != nil{
+		t.Errorf(err.Error())
+	}
+}
+
+func TestStoreInventory(t *testing.T){
+	s := newStore()
+	id := crypto.GenerateID()
+	defer tearDown(t,s)
+
+	for i := 0; i < 5; i++{
+		key := fmt.Sprintf("inv%d", i)
+		if _, err := s.Write(id, key, bytes.NewReader([]byte("some jpg bytes"))); err != nil{
+			t.Fatal(err)
+		}
+		if err := s.WriteMeta(id, key, Meta{Digest: "abc"}); err != nil{
+			t.Fatal(err)
+		}
+	}
+
+	// Objects without a meta sidecar are not part of the inventory
+	if _, err := s.Write(id, "nometa", bytes.NewReader([]byte("x"))); err != nil{
+		t.Fatal(err)
+	}
+
+	entries, err := s.Inventory()
+	if err != nil{
+		t.Fatal(err)
+	}
+	if len(entries) != 5{
+		t.Errorf("have %d entries want 5", len(entries))
+	}
+	for _, e := range entries{
+		if e.ID != id || e.Digest != "abc"{
+			t.Errorf("unexpected entry %+v", e)
+		}
+	}
+}
+
+func TestWriteContextCancelled(t *testing.T){
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id := crypto.GenerateID()
+	if _, err := s.Write(id, "key", strings.NewReader("old")); err != nil{
+		t.Fatal(err)
+	}
+
+	// The writer goes away after the first read
+	ctx, cancel := context.WithCancel(context.Background())
+	r := io.MultiReader(strings.NewReader("new "), readerFunc(func(b []byte) (int, error){
+		cancel()
+		return copy(b, "contents"), nil
+	}), strings.NewReader("never read"))
+	if _, err := s.WriteContext(ctx, id, "key", r); err != context.Canceled{
+		t.Fatalf("have %v want %v", err, context.Canceled)
+	}
+
+	_, rd, err := s.Read(id, "key")
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer rd.(io.Closer).Close()
+	if b, _ := io.ReadAll(rd); string(b) != "old"{
+		t.Errorf("a cancelled write must leave the stored file alone, have %q", b)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(s.Root, tmpDir)); len(entries) != 0{
+		t.Errorf("expected the partial write to be removed, have %d files", len(entries))
+	}
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error){
+	return f(b)
+}
@@ -0,0 +1,83 @@
+package vault
+
+import "sync"
+
+// ackWaiter lets a sender wait for the MessageStoreAck of an object it pushed with Ack set
+type ackWaiter struct{
+	mu sync.Mutex
+	waiters map[string]chan struct{}
+}
+
+func ackKey(addr string, objectID string) string{
+	return addr + "|" + objectID
+}
+
+// expect registers interest in the ack of objectID from addr, it must be called before the object is pushed
+func (a *ackWaiter) expect(addr string, objectID string) <-chan struct{}{
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.waiters == nil{
+		a.waiters = make(map[string]chan struct{})
+	}
+	ch := make(chan struct{})
+	a.waiters[ackKey(addr, objectID)] = ch
+	return ch
+}
+
+func (a *ackWaiter) cancel(addr string, objectID string){
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.waiters, ackKey(addr, objectID))
+}
+
+func (a *ackWaiter) done(addr string, objectID string){
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := ackKey(addr, objectID)
+	if ch, ok := a.waiters[key]; ok{
+		close(ch)
+		delete(a.waiters, key)
+	}
+}
+
+// replyWaiter matches replies to the request they answer by sequence number. Late replies to a request nobody waits
+// for anymore are dropped.
+type replyWaiter struct{
+	mu sync.Mutex
+	seq uint64
+	waiters map[uint64]chan any
+}
+
+// expect registers a new request and returns its sequence number and the channel its replies arrive on
+func (w *replyWaiter) expect(buffer int) (uint64, chan any){
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.waiters == nil{
+		w.waiters = make(map[uint64]chan any)
+	}
+	w.seq++
+	ch := make(chan any, buffer)
+	w.waiters[w.seq] = ch
+	return w.seq, ch
+}
+
+func (w *replyWaiter) cancel(seq uint64){
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.waiters, seq)
+}
+
+func (w *replyWaiter) deliver(seq uint64, msg any){
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if ch, ok := w.waiters[seq]; ok{
+		select{
+		case ch <- msg:
+		default:
+		}
+	}
+}
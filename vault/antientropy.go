@@ -0,0 +1,391 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+	"github.com/ayushn2/distri_vault.git/p2p"
+	"github.com/ayushn2/distri_vault.git/store"
+)
+
+// Anti-entropy keeps replicas converging without relying on explicit Gets.
+// Every interval a node sends each peer it shares replicas with the merkle root of the objects the two of them keep
+// under the ring, the two sides walk down only the subtrees whose hashes differ, swap the entries of the differing
+// leaves and each pulls whatever it is missing or has an older copy of.
+
+type MessageMerkleNodes struct{
+	Prefixes []string
+	Hashes [][]byte
+}
+
+type MessageMerkleEntries struct{
+	Prefixes []string
+	Entries []SyncEntry
+	// Reply asks the receiver to answer with its own entries for the same leaves, so both sides can repair
+	Reply bool
+}
+
+type MessageSyncWant struct{
+	Entries []SyncEntry
+}
+
+// syncBudget is the number of bytes that may still be requested during the current anti-entropy round
+type syncBudget struct{
+	remaining atomic.Int64
+	unlimited atomic.Bool
+}
+
+func (b *syncBudget) reset(limit int64){
+	b.remaining.Store(limit)
+	b.unlimited.Store(limit <= 0)
+}
+
+func (b *syncBudget) take(n int64) bool{
+	if b.unlimited.Load(){
+		return true
+	}
+	if b.remaining.Add(-n) < 0{
+		b.remaining.Add(n)
+		return false
+	}
+	return true
+}
+
+func (s *FileServer) antiEntropyLoop(){
+	ticker := time.NewTicker(s.AntiEntropyInterval)
+	defer ticker.Stop()
+
+	for{
+		select{
+		case <-ticker.C:
+			if err := s.syncRound(); err != nil{
+				s.logger("antientropy").Warn("anti-entropy round failed", "err", err)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// syncRound starts one anti-entropy exchange with every peer we share replicas with. A peer that keeps objects we
+// should have but hold nothing of starts the exchange from its side.
+func (s *FileServer) syncRound() error{
+	entries, err := s.syncInventory()
+	if err != nil{
+		return err
+	}
+
+	s.syncBudget.reset(s.antiEntropyBandwidth())
+
+	var errs []error
+	for _, peer := range s.allPeers(){
+		addr := peer.RemoteAddr().String()
+		id := s.peerID(addr)
+		if len(id) == 0{
+			continue
+		}
+		tree := NewMerkleTree(s.sharedEntries(entries, id))
+		if tree.Root() == nil{
+			continue
+		}
+		msg := Message{
+			Payload: MessageMerkleNodes{
+				Prefixes: []string{""},
+				Hashes: [][]byte{tree.Root()},
+			},
+		}
+		if err := s.sendMessage(addr, &msg); err != nil{
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// syncInventory is the local inventory in the form that is compared against peers
+func (s *FileServer) syncInventory() ([]SyncEntry, error){
+	inventory, err := s.store.Inventory()
+	if err != nil{
+		return nil, err
+	}
+
+	entries := make([]SyncEntry, 0, len(inventory))
+	for _, e := range inventory{
+		// Erasure coded objects and their shards are looked after by shard repair
+		if e.Erasure != nil{
+			continue
+		}
+		entries = append(entries, SyncEntry{
+			ID: e.ID,
+			Key: s.objectKey(e),
+			Digest: e.Digest,
+			ModTime: e.ModTime,
+			Size: e.Size,
+			Deleted: e.Deleted,
+			Signature: e.Signature,
+		})
+	}
+	return entries, nil
+}
+
+// holds reports whether the node id keeps a copy of the object under the current ring, as its owner or a replica
+func (s *FileServer) holds(id string, e SyncEntry) bool{
+	if e.ID == id || s.replicationFactor() <= 0{
+		return true
+	}
+	return contains(s.placement(s.ring, e.ID, e.Key), id)
+}
+
+// sharedEntries are the entries of the ring ranges we replicate together with the node id
+func (s *FileServer) sharedEntries(entries []SyncEntry, id string) []SyncEntry{
+	shared := []SyncEntry{}
+	for _, e := range entries{
+		if s.holds(s.ID, e) && s.holds(id, e){
+			shared = append(shared, e)
+		}
+	}
+	return shared
+}
+
+// merkleTree is the tree we compare with the peer at addr, over the objects both of us keep
+func (s *FileServer) merkleTree(addr string) (*MerkleTree, error){
+	id := s.peerID(addr)
+	if len(id) == 0{
+		return nil, fmt.Errorf("peer (%s) has not said hello", addr)
+	}
+	entries, err := s.syncInventory()
+	if err != nil{
+		return nil, err
+	}
+	return NewMerkleTree(s.sharedEntries(entries, id)), nil
+}
+
+func (s *FileServer) handleMessageMerkleNodes(from string, msg MessageMerkleNodes) error{
+	if len(msg.Prefixes) != len(msg.Hashes){
+		return fmt.Errorf("malformed merkle nodes from (%s)", from)
+	}
+
+	tree, err := s.merkleTree(from)
+	if err != nil{
+		return err
+	}
+
+	diff := []string{}
+	for i, prefix := range msg.Prefixes{
+		if !bytes.Equal(tree.Hash(prefix), msg.Hashes[i]){
+			diff = append(diff, prefix)
+		}
+	}
+	if len(diff) == 0{
+		return nil
+	}
+
+	if isLeafPrefix(diff[0]){
+		return s.sendMessage(from, &Message{
+			Payload: MessageMerkleEntries{
+				Prefixes: diff,
+				Entries: tree.Entries(diff...),
+				Reply: true,
+			},
+		})
+	}
+
+	next := MessageMerkleNodes{}
+	for _, prefix := range diff{
+		for _, child := range childPrefixes(prefix){
+			next.Prefixes = append(next.Prefixes, child)
+			next.Hashes = append(next.Hashes, tree.Hash(child))
+		}
+	}
+	return s.sendMessage(from, &Message{Payload: next})
+}
+
+func (s *FileServer) handleMessageMerkleEntries(from string, msg MessageMerkleEntries) error{
+	tree, err := s.merkleTree(from)
+	if err != nil{
+		return err
+	}
+
+	local := tree.Entries(msg.Prefixes...)
+	wants, err := s.syncWants(local, msg.Entries)
+	if err != nil{
+		return err
+	}
+	if len(wants) > 0{
+		if err := s.sendMessage(from, &Message{Payload: MessageSyncWant{Entries: wants}}); err != nil{
+			return err
+		}
+	}
+
+	if !msg.Reply{
+		return nil
+	}
+
+	return s.sendMessage(from, &Message{
+		Payload: MessageMerkleEntries{
+			Prefixes: msg.Prefixes,
+			Entries: local,
+		},
+	})
+}
+
+// syncWants returns the remote entries we are missing or hold an older copy of, as far as the bandwidth budget allows.
+// Newer tombstones need no transfer and are applied right away, if the owner signed them.
+func (s *FileServer) syncWants(local []SyncEntry, remote []SyncEntry) ([]SyncEntry, error){
+	have := make(map[string]SyncEntry, len(local))
+	for _, e := range local{
+		have[e.objectID()] = e
+	}
+
+	wants := []SyncEntry{}
+	for _, r := range remote{
+		// Our own objects are never pulled back, replicas don't know their plain keys
+		if r.ID == s.ID{
+			continue
+		}
+		if !s.shouldHold(r.ID, r.Key){
+			continue
+		}
+		l, ok := have[r.objectID()]
+		if ok && ((l.Digest == r.Digest && l.Deleted == r.Deleted) || l.ModTime >= r.ModTime){
+			continue
+		}
+		if r.Deleted{
+			if err := s.verifyDelete(r.ID, r.Key, r.ModTime, r.Signature); err != nil{
+				s.logger("antientropy").Warn("ignoring tombstone", "owner", r.ID, "key", r.Key, "err", err)
+				continue
+			}
+			if err := s.store.Tombstone(r.ID, r.Key, r.ModTime, r.Signature); err != nil{
+				return nil, err
+			}
+			continue
+		}
+		if !s.syncBudget.take(r.Size){
+			continue
+		}
+		wants = append(wants, r)
+	}
+	return wants, nil
+}
+
+func (s *FileServer) handleMessageSyncWant(from string, msg MessageSyncWant) error{
+	peer, ok := s.peer(from)
+	if !ok{
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+
+	inventory, err := s.store.Inventory()
+	if err != nil{
+		return err
+	}
+	byKey := make(map[string]InventoryEntry, len(inventory))
+	for _, e := range inventory{
+		byKey[e.ID+"/"+s.objectKey(e)] = e
+	}
+
+	for _, want := range msg.Entries{
+		e, ok := byKey[want.objectID()]
+		if !ok || e.Deleted{
+			continue
+		}
+		if _, err := s.pushObject(peer, e, false); err != nil{
+			return err
+		}
+	}
+	return nil
+}
+
+// objectKey is the key an object is known by on the network. The owner keeps its own copy under the plain key,
+// replicas only ever see the hashed one.
+func (s *FileServer) objectKey(e InventoryEntry) string{
+	if e.ID == s.ID{
+		return crypto.HashKey(e.Key)
+	}
+	return e.Key
+}
+
+// pushObject streams a single object to peer under its hashed key and returns the bytes sent. Our own objects are
+// encrypted on the way out, replicas we hold for others are already ciphertext and are sent as they are.
+// With ack set the receiver answers with a MessageStoreAck once the object is on its disk.
+func (s *FileServer) pushObject(peer p2p.Peer, e InventoryEntry, ack bool) (int64, error){
+	return s.pushFrom(s.store, peer, e, ack)
+}
+
+// pushFrom is pushObject reading the object from the given store instead of our own, e.g. a hint store
+func (s *FileServer) pushFrom(st *store.Store, peer p2p.Peer, e InventoryEntry, ack bool) (int64, error){
+	return s.pushAt(st, peer, e, ack, 0)
+}
+
+// pushAt is pushFrom starting offset bytes into what goes over the wire, to resume an interrupted push
+func (s *FileServer) pushAt(st *store.Store, peer p2p.Peer, e InventoryEntry, ack bool, offset int64) (int64, error){
+	hashedKey := s.objectKey(e)
+
+	size, r, err := s.wireReader(st, e)
+	if err != nil{
+		return 0, err
+	}
+	defer r.Close()
+
+	if _, err := io.CopyN(io.Discard, r, offset); err != nil{
+		return 0, err
+	}
+
+	storeMsg := MessageStoreFile{
+		ID: e.ID,
+		Key: hashedKey,
+		Size: int(size - offset),
+		Offset: offset,
+		Digest: e.Digest,
+		ModTime: e.ModTime,
+		Ack: ack,
+	}
+	if e.ID != s.ID{
+		storeMsg.Erasure = e.Erasure
+	}
+	msg := Message{Payload: storeMsg}
+
+	unlock, _ := s.lockPeers(context.Background(), peer)
+	defer unlock()
+
+	if err := s.send(context.Background(), peer, &msg); err != nil{
+		return 0, err
+	}
+
+	time.Sleep(time.Millisecond * 5)
+	defer s.metrics.stream("out")()
+
+	peer.Send([]byte{p2p.IncomingStream})
+	n, err := io.Copy(peer, r)
+	if err != nil{
+		return 0, err
+	}
+
+	s.logger("transfer").Debug("pushed object", "peer", peer.RemoteAddr().String(), "key", hashedKey,
+		"transfer", transferID(e.ID, hashedKey), "offset", offset, "bytes", n)
+	return n, nil
+}
+
+// wireReader returns an object the way it goes over the wire and its size. Our own objects are encrypted on the
+// way, replicas we hold for others are already ciphertext.
+func (s *FileServer) wireReader(st *store.Store, e InventoryEntry) (int64, io.ReadCloser, error){
+	size, r, err := st.ReadStream(e.ID, e.Key)
+	if err != nil{
+		return 0, nil, err
+	}
+	if e.ID != s.ID{
+		return size, r, nil
+	}
+
+	pr, pw := io.Pipe()
+	go func(){
+		_, err := crypto.CopyEncryptConvergent(s.EncKey, e.Digest, r, pw)
+		r.Close()
+		pw.CloseWithError(err)
+	}()
+	return size + 16, pr, nil
+}
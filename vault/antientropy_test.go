@@ -0,0 +1,71 @@
+package vault
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+)
+
+func TestAntiEntropyRepairsReplica(t *testing.T){
+	nodes := startTestCluster(t, 2, WithReplicationFactor(1))
+	owner, replica := nodes[0].Server(), nodes[1].Server()
+
+	if _, err := nodes[0].Put(context.Background(), "docs/a.txt", strings.NewReader("hello anti-entropy")); err != nil{
+		t.Fatal(err)
+	}
+	replicas := func() []InventoryEntry{
+		return replicasOf(t, replica, owner.ID)
+	}
+	waitFor(t, "the replica", func() bool{ return len(replicas()) == 1 })
+
+	// The replica loses its copy, the next round of the owner brings it back
+	lost := replicas()[0]
+	replica.store.Delete(lost.ID, lost.Key)
+	replica.store.DeleteMeta(lost.ID, lost.Key)
+	if len(replicas()) != 0{
+		t.Fatalf("expected the replica to be gone")
+	}
+	if err := owner.syncRound(); err != nil{
+		t.Fatal(err)
+	}
+	waitFor(t, "anti-entropy to restore the replica", func() bool{
+		held := replicas()
+		return len(held) == 1 && held[0].Digest == lost.Digest
+	})
+}
+
+func TestSyncBudget(t *testing.T){
+	s := newTestServer(t.TempDir())
+	remote := []SyncEntry{
+		{ID: "owner", Key: "aa01", Digest: "d1", ModTime: 1, Size: 60},
+		{ID: "owner", Key: "aa02", Digest: "d2", ModTime: 1, Size: 60},
+	}
+
+	wants, err := s.syncWants(nil, remote)
+	if err != nil || len(wants) != 2{
+		t.Fatalf("expected no budget to want everything, have %v, %v", wants, err)
+	}
+
+	s.syncBudget.reset(100)
+	if wants, _ := s.syncWants(nil, remote); len(wants) != 1{
+		t.Errorf("expected the budget to allow one entry, have %v", wants)
+	}
+	if wants, _ := s.syncWants(nil, remote); len(wants) != 0{
+		t.Errorf("expected the budget to be spent, have %v", wants)
+	}
+
+	// A node holds entries to its budget before its first round too
+	s = NewFileServer(FileServerOpts{
+		EncKey: crypto.NewEncryptionKey(),
+		StorageRoot: t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Transport: s.Transport,
+		AntiEntropyBandwidth: 10,
+	})
+	small := SyncEntry{ID: "owner", Key: "aa03", Digest: "d3", ModTime: 1, Size: 5}
+	if wants, _ := s.syncWants(nil, append(remote, small)); len(wants) != 1 || wants[0].Key != small.Key{
+		t.Errorf("expected only the entry within the budget, have %v", wants)
+	}
+}
@@ -0,0 +1,155 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to a node elsewhere over its HTTP gateway, see gateway.go. Errors the node answers with are a
+// *ControlError, errors.Is matches them against ErrNotFound, ErrDeleted and ErrDraining.
+type Client struct{
+	baseURL string
+	http *http.Client
+}
+
+// ClientOption configures a client created with NewClient
+type ClientOption func(*Client)
+
+// WithHTTPClient sends the requests with c instead of http.DefaultClient, for TLS settings or a timeout
+func WithHTTPClient(c *http.Client) ClientOption{
+	return func(client *Client){
+		client.http = c
+	}
+}
+
+// NewClient returns a client for the gateway at baseURL, like "http://10.0.0.2:8080"
+func NewClient(baseURL string, opts ...ClientOption) *Client{
+	c := &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		http: http.DefaultClient,
+	}
+	for _, opt := range opts{
+		opt(c)
+	}
+	return c
+}
+
+// objectURL escapes every segment of key but keeps the slashes between them
+func (c *Client) objectURL(key string) string{
+	segments := strings.Split(key, "/")
+	for i, segment := range segments{
+		segments[i] = url.PathEscape(segment)
+	}
+	return c.baseURL + "/objects/" + strings.Join(segments, "/")
+}
+
+// do sends the request and turns an error status into a *ControlError. The body of a successful response has to be
+// closed.
+func (c *Client) do(ctx context.Context, method string, url string, body io.Reader) (*http.Response, error){
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil{
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil{
+		return nil, err
+	}
+	if resp.StatusCode < 300{
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var msg ControlResponse
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil || len(msg.Code) == 0{
+		// A HEAD response has no body to say what went wrong
+		msg.Error = fmt.Sprintf("%s %s: %s", method, url, resp.Status)
+		msg.Code = "internal"
+		if resp.StatusCode == http.StatusNotFound{
+			msg.Code = "not_found"
+		}
+	}
+	return nil, &ControlError{Code: msg.Code, Message: msg.Error}
+}
+
+// Put stores r as a new version of key
+func (c *Client) Put(ctx context.Context, key string, r io.Reader) (ObjectInfo, error){
+	var info ObjectInfo
+	resp, err := c.do(ctx, http.MethodPut, c.objectURL(key), r)
+	if err != nil{
+		return info, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info, err
+}
+
+// Get reads the latest version of key, the reader has to be closed
+func (c *Client) Get(ctx context.Context, key string) (io.ReadCloser, error){
+	resp, err := c.do(ctx, http.MethodGet, c.objectURL(key), nil)
+	if err != nil{
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Stat describes key without reading it. The gateway answers with headers only, so Versions and Conflict are not set.
+func (c *Client) Stat(ctx context.Context, key string) (ObjectInfo, error){
+	resp, err := c.do(ctx, http.MethodHead, c.objectURL(key), nil)
+	if err != nil{
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+
+	info := ObjectInfo{
+		Key: key,
+		Version: resp.Header.Get("X-Version"),
+	}
+	info.Size, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	info.ModTime, _ = time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified"))
+	info.Digest, _ = strconv.Unquote(resp.Header.Get("ETag"))
+	return info, nil
+}
+
+// Delete deletes key with all its versions
+func (c *Client) Delete(ctx context.Context, key string) error{
+	resp, err := c.do(ctx, http.MethodDelete, c.objectURL(key), nil)
+	if err != nil{
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// List describes the keys starting with prefix, sorted. It follows the pages of the listing to the end.
+func (c *Client) List(ctx context.Context, prefix string) ([]ObjectInfo, error){
+	objects := []ObjectInfo{}
+	cursor := ""
+	for{
+		query := url.Values{"prefix": {prefix}}
+		if len(cursor) != 0{
+			query.Set("cursor", cursor)
+		}
+		resp, err := c.do(ctx, http.MethodGet, c.baseURL+"/objects?"+query.Encode(), nil)
+		if err != nil{
+			return nil, err
+		}
+		var page ListPage
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil{
+			return nil, err
+		}
+
+		objects = append(objects, page.Objects...)
+		if !page.Truncated{
+			return objects, nil
+		}
+		cursor = page.NextCursor
+	}
+}
@@ -0,0 +1,62 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClient(t *testing.T){
+	n := startTestNode(t)
+	srv := httptest.NewServer(n.Server().Gateway())
+	defer srv.Close()
+	c := NewClient(srv.URL + "/")
+	ctx := context.Background()
+
+	info, err := c.Put(ctx, "docs/a b.txt", strings.NewReader("hello client"))
+	if err != nil{
+		t.Fatal(err)
+	}
+	if info.Key != "docs/a b.txt" || info.Size != 12{
+		t.Errorf("unexpected put result %+v", info)
+	}
+	c.Put(ctx, "docs/c.txt", strings.NewReader("c"))
+	c.Put(ctx, "pics/d.jpg", strings.NewReader("d"))
+
+	rc, err := c.Get(ctx, "docs/a b.txt")
+	if err != nil{
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(b) != "hello client"{
+		t.Errorf("get returned %q, %v", b, err)
+	}
+
+	stat, err := c.Stat(ctx, "docs/a b.txt")
+	if err != nil || stat.Size != 12 || stat.Digest != info.Digest || stat.Version != info.Version{
+		t.Errorf("stat returned %+v, %v, want %+v", stat, err, info)
+	}
+
+	objects, err := c.List(ctx, "docs/")
+	if err != nil || len(objects) != 2 || objects[0].Key != "docs/a b.txt" || objects[1].Key != "docs/c.txt"{
+		t.Errorf("unexpected listing %+v, %v", objects, err)
+	}
+
+	if err := c.Delete(ctx, "docs/a b.txt"); err != nil{
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "docs/a b.txt"); !errors.Is(err, ErrDeleted){
+		t.Errorf("have %v want %v", err, ErrDeleted)
+	}
+	if _, err := c.Stat(ctx, "missing"); !errors.Is(err, ErrNotFound){
+		t.Errorf("have %v want %v", err, ErrNotFound)
+	}
+	var ctlErr *ControlError
+	if err := c.Delete(ctx, "missing"); !errors.As(err, &ctlErr) || ctlErr.Code != "not_found"{
+		t.Errorf("expected a not_found error, have %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxClockDrift is how far ahead of our wall clock a peer's timestamp may be. A node with a clock set years ahead
+// would otherwise drag every clock in the cluster along with it, and its writes would win every conflict.
+const maxClockDrift = time.Minute
+
+var ErrClockDrift = errors.New("timestamp too far ahead of our clock")
+
+// HybridClock is a hybrid logical clock folded into unix nanoseconds. It follows the wall clock, never goes backwards
+// and is pushed forward by every timestamp seen from a peer, so a write that causally follows another always gets a
+// larger timestamp even if the two nodes' wall clocks disagree.
+type HybridClock struct{
+	mu sync.Mutex
+	last int64
+}
+
+// Now returns a timestamp larger than any returned or observed before
+func (c *HybridClock) Now() int64{
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pt := time.Now().UnixNano()
+	if pt <= c.last{
+		c.last++
+	} else{
+		c.last = pt
+	}
+	return c.last
+}
+
+// Observe moves the clock past a timestamp received from another node. A timestamp more than maxClockDrift ahead of
+// our wall clock is rejected and leaves the clock alone.
+func (c *HybridClock) Observe(ts int64) error{
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if drift := time.Duration(ts - time.Now().UnixNano()); drift > maxClockDrift{
+		return fmt.Errorf("%w: %s ahead", ErrClockDrift, drift)
+	}
+	if ts > c.last{
+		c.last = ts
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package vault
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHybridClockMonotonic(t *testing.T){
+	var c HybridClock
+
+	last := c.Now()
+	for i := 0; i < 1000; i++{
+		now := c.Now()
+		if now <= last{
+			t.Fatalf("clock went backwards: %d after %d", now, last)
+		}
+		last = now
+	}
+
+	// A timestamp from a node whose clock runs ahead pushes ours past it
+	ahead := last + int64(10*time.Second)
+	if err := c.Observe(ahead); err != nil{
+		t.Fatal(err)
+	}
+	if now := c.Now(); now <= ahead{
+		t.Errorf("have %d want more than %d", now, ahead)
+	}
+
+	// One from a node whose clock is set far in the future is refused and doesn't move ours
+	future := time.Now().Add(24 * time.Hour).UnixNano()
+	if err := c.Observe(future); !errors.Is(err, ErrClockDrift){
+		t.Fatalf("have %v want ErrClockDrift", err)
+	}
+	if now := c.Now(); now >= future{
+		t.Errorf("expected the clock to stay put, have %d", now)
+	}
+}
@@ -0,0 +1,415 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ayushn2/distri_vault.git/p2p"
+	"gopkg.in/yaml.v3"
+)
+
+// A node is configured from a TOML, YAML or JSON file, picked by its extension, with environment variables on top:
+// every setting can be overridden by DISTRI_VAULT_ followed by its env tag, lists are comma separated. Flags of the
+// node command override both. Sending the node a SIGHUP loads the configuration again and applies the settings that
+// can change without a restart, see Reload.
+
+const EnvPrefix = "DISTRI_VAULT_"
+
+type Config struct{
+	Listen string `toml:"listen" yaml:"listen" json:"listen" env:"LISTEN"`
+	Advertise string `toml:"advertise" yaml:"advertise" json:"advertise" env:"ADVERTISE"`
+	StorageRoot string `toml:"storage_root" yaml:"storage_root" json:"storage_root" env:"STORAGE_ROOT"`
+	ControlSocket string `toml:"control_socket" yaml:"control_socket" json:"control_socket" env:"SOCKET"`
+	// HTTPAddr is where the HTTP gateway listens, it is off if not set
+	HTTPAddr string `toml:"http_addr" yaml:"http_addr" json:"http_addr" env:"HTTP_ADDR"`
+	// S3Addr is where the S3 front-end listens, S3Keys the "access key:secret" pairs it accepts. They can be
+	// changed with a reload.
+	S3Addr string `toml:"s3_addr" yaml:"s3_addr" json:"s3_addr" env:"S3_ADDR"`
+	S3Keys []string `toml:"s3_keys" yaml:"s3_keys" json:"s3_keys" env:"S3_KEYS"`
+	// AdminAddr is where the Prometheus metrics are served, they are off if not set
+	AdminAddr string `toml:"admin_addr" yaml:"admin_addr" json:"admin_addr" env:"ADMIN_ADDR"`
+	// TraceExporter is where the spans of Store and Get go, "stdout" or "otlp" to post them to TraceEndpoint, like
+	// http://localhost:4318/v1/traces. Tracing is off if not set.
+	TraceExporter string `toml:"trace_exporter" yaml:"trace_exporter" json:"trace_exporter" env:"TRACE_EXPORTER"`
+	TraceEndpoint string `toml:"trace_endpoint" yaml:"trace_endpoint" json:"trace_endpoint" env:"TRACE_ENDPOINT"`
+	Bootstrap []string `toml:"bootstrap" yaml:"bootstrap" json:"bootstrap" env:"BOOTSTRAP"`
+	Cluster string `toml:"cluster" yaml:"cluster" json:"cluster" env:"CLUSTER"`
+
+	// ID and EncryptionKey (hex) are generated and kept in the storage root if not set
+	ID string `toml:"id" yaml:"id" json:"id" env:"ID"`
+	EncryptionKey string `toml:"encryption_key" yaml:"encryption_key" json:"encryption_key" env:"ENCRYPTION_KEY"`
+	// PathTransform is how keys map to paths on disk, "cas" or "plain"
+	PathTransform string `toml:"path_transform" yaml:"path_transform" json:"path_transform" env:"PATH_TRANSFORM"`
+
+	ReplicationFactor int `toml:"replication_factor" yaml:"replication_factor" json:"replication_factor" env:"REPLICATION_FACTOR"`
+	// StorageMode is "replicate" or "erasure:<data>+<parity>"
+	StorageMode string `toml:"storage_mode" yaml:"storage_mode" json:"storage_mode" env:"STORAGE_MODE"`
+	AntiEntropyInterval Duration `toml:"anti_entropy_interval" yaml:"anti_entropy_interval" json:"anti_entropy_interval" env:"ANTI_ENTROPY_INTERVAL"`
+
+	// These can be changed with a reload
+	AntiEntropyBandwidth int64 `toml:"anti_entropy_bandwidth" yaml:"anti_entropy_bandwidth" json:"anti_entropy_bandwidth" env:"ANTI_ENTROPY_BANDWIDTH"`
+	RebalanceRate int64 `toml:"rebalance_rate" yaml:"rebalance_rate" json:"rebalance_rate" env:"REBALANCE_RATE"`
+	LogLevel string `toml:"log_level" yaml:"log_level" json:"log_level" env:"LOG_LEVEL"`
+	// LogLevels are "component=level" pairs for the components logging at another level than LogLevel
+	LogLevels []string `toml:"log_levels" yaml:"log_levels" json:"log_levels" env:"LOG_LEVELS"`
+
+	// LogFormat is "text" or "json"
+	LogFormat string `toml:"log_format" yaml:"log_format" json:"log_format" env:"LOG_FORMAT"`
+}
+
+// Duration is a time.Duration written like "30s" in config files
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(b []byte) error{
+	v, err := time.ParseDuration(string(b))
+	if err != nil{
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error){
+	return []byte(time.Duration(d).String()), nil
+}
+
+func DefaultConfig() Config{
+	return Config{
+		Listen: ":3000",
+		ControlSocket: DefaultControlSocket,
+		PathTransform: "cas",
+		StorageMode: "replicate",
+		LogLevel: "info",
+		LogFormat: "text",
+	}
+}
+
+// LoadConfig reads the config file at path, if any, over the defaults and applies the environment on top
+func LoadConfig(path string) (Config, error){
+	return loadConfig(path, os.LookupEnv)
+}
+
+func loadConfig(path string, lookupEnv func(string) (string, bool)) (Config, error){
+	c := DefaultConfig()
+	if len(path) != 0{
+		if err := c.readFile(path); err != nil{
+			return c, fmt.Errorf("config %s: %w", path, err)
+		}
+	}
+	if err := c.applyEnv(lookupEnv); err != nil{
+		return c, err
+	}
+	return c, c.Validate()
+}
+
+// readFile decodes a config file over c, keys the config doesn't know are an error so typos don't go unnoticed
+func (c *Config) readFile(path string) error{
+	b, err := os.ReadFile(path)
+	if err != nil{
+		return err
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext{
+	case ".toml":
+		md, err := toml.Decode(string(b), c)
+		if err != nil{
+			return err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) != 0{
+			return fmt.Errorf("unknown setting %q", undecoded[0].String())
+		}
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF){
+			return err
+		}
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil{
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown config format %q, expected .toml, .yaml, .yml or .json", ext)
+	}
+	return nil
+}
+
+// applyEnv overrides the settings that have an environment variable set
+func (c *Config) applyEnv(lookupEnv func(string) (string, bool)) error{
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++{
+		name := EnvPrefix + t.Field(i).Tag.Get("env")
+		value, ok := lookupEnv(name)
+		if !ok{
+			continue
+		}
+
+		field := v.Field(i)
+		switch field.Interface().(type){
+		case string:
+			field.SetString(value)
+		case []string:
+			field.Set(reflect.ValueOf(commaList(value)))
+		case Duration:
+			var d Duration
+			if err := d.UnmarshalText([]byte(value)); err != nil{
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			field.Set(reflect.ValueOf(d))
+		case int, int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil{
+				return fmt.Errorf("%s: expected a number, have %q", name, value)
+			}
+			field.SetInt(n)
+		}
+	}
+	return nil
+}
+
+// Validate checks every setting and reports all that are wrong at once
+func (c Config) Validate() error{
+	var errs []error
+	invalid := func(setting string, format string, args ...any){
+		errs = append(errs, fmt.Errorf("%s: %s", setting, fmt.Sprintf(format, args...)))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil{
+		invalid("listen", "expected host:port, have %q", c.Listen)
+	}
+	if _, _, err := net.SplitHostPort(c.Advertise); len(c.Advertise) != 0 && err != nil{
+		invalid("advertise", "expected host:port, have %q", c.Advertise)
+	}
+	if _, _, err := net.SplitHostPort(c.HTTPAddr); len(c.HTTPAddr) != 0 && err != nil{
+		invalid("http_addr", "expected host:port, have %q", c.HTTPAddr)
+	}
+	if _, _, err := net.SplitHostPort(c.S3Addr); len(c.S3Addr) != 0 && err != nil{
+		invalid("s3_addr", "expected host:port, have %q", c.S3Addr)
+	}
+	if _, _, err := net.SplitHostPort(c.AdminAddr); len(c.AdminAddr) != 0 && err != nil{
+		invalid("admin_addr", "expected host:port, have %q", c.AdminAddr)
+	}
+	switch c.TraceExporter{
+	case "", "stdout":
+	case "otlp":
+		if u, err := url.Parse(c.TraceEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0{
+			invalid("trace_endpoint", "expected an http or https URL, have %q", c.TraceEndpoint)
+		}
+	default:
+		invalid("trace_exporter", "expected stdout or otlp, have %q", c.TraceExporter)
+	}
+	if len(c.S3Addr) != 0 && len(c.S3Keys) == 0{
+		invalid("s3_keys", "the s3 front-end needs at least one access key")
+	}
+	for _, pair := range c.S3Keys{
+		if key, secret, ok := strings.Cut(pair, ":"); !ok || len(key) == 0 || len(secret) == 0{
+			invalid("s3_keys", "expected access key:secret, have %q", pair)
+		}
+	}
+	for _, addr := range c.Bootstrap{
+		if _, _, err := net.SplitHostPort(addr); err != nil{
+			invalid("bootstrap", "expected host:port, have %q", addr)
+		}
+	}
+	if key, err := hex.DecodeString(c.EncryptionKey); len(c.EncryptionKey) != 0 && (err != nil || len(key) != 32){
+		invalid("encryption_key", "expected 64 hex characters")
+	}
+	if _, err := c.pathTransform(); err != nil{
+		invalid("path_transform", "%s", err)
+	}
+	if c.ReplicationFactor < 0{
+		invalid("replication_factor", "can't be negative")
+	}
+	if _, err := ParseStorageMode(c.StorageMode); err != nil{
+		invalid("storage_mode", "%s", err)
+	}
+	if c.AntiEntropyInterval < 0{
+		invalid("anti_entropy_interval", "can't be negative")
+	}
+	if c.AntiEntropyBandwidth < 0{
+		invalid("anti_entropy_bandwidth", "can't be negative")
+	}
+	if c.RebalanceRate < 0{
+		invalid("rebalance_rate", "can't be negative")
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil{
+		invalid("log_level", "%s", err)
+	}
+	if _, err := parseLogLevels(c.LogLevels); err != nil{
+		invalid("log_levels", "%s", err)
+	}
+	if _, err := NewLogger(io.Discard, c.LogFormat); err != nil{
+		invalid("log_format", "%s", err)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c Config) pathTransform() (PathTransformFunc, error){
+	switch c.PathTransform{
+	case "cas", "":
+		return CASPathTransformFunc, nil
+	case "plain":
+		return DefaultTransformFunc, nil
+	}
+	return nil, fmt.Errorf("expected cas or plain, have %q", c.PathTransform)
+}
+
+// ParseStorageMode reads "replicate" or "erasure:<data>+<parity>"
+func ParseStorageMode(s string) (StorageMode, error){
+	if s == "replicate" || len(s) == 0{
+		return StorageMode{}, nil
+	}
+
+	var mode StorageMode
+	if _, err := fmt.Sscanf(s, "erasure:%d+%d", &mode.DataShards, &mode.ParityShards); err != nil{
+		return mode, fmt.Errorf("expected replicate or erasure:<data>+<parity>, have %q", s)
+	}
+	if _, err := NewReedSolomon(mode.DataShards, mode.ParityShards); err != nil{
+		return mode, err
+	}
+	return mode, nil
+}
+
+// Options turns the config into the options of a file server and its transport. Decoding errors can't happen on a
+// validated config.
+func (c Config) Options() (FileServerOpts, p2p.TCPTransportOpts){
+	pathTransform, _ := c.pathTransform()
+	mode, _ := ParseStorageMode(c.StorageMode)
+	encKey, _ := hex.DecodeString(c.EncryptionKey)
+
+	opts := FileServerOpts{
+		ID: c.ID,
+		EncKey: encKey,
+		StorageRoot: c.StorageRoot,
+		PathTransformFunc: pathTransform,
+		BootstrapNodes: c.Bootstrap,
+		AntiEntropyInterval: time.Duration(c.AntiEntropyInterval),
+		AntiEntropyBandwidth: c.AntiEntropyBandwidth,
+		ReplicationFactor: c.ReplicationFactor,
+		RebalanceRate: c.RebalanceRate,
+		AdvertiseAddr: c.Advertise,
+		ClusterName: c.Cluster,
+		DefaultStorageMode: mode,
+		ControlSocket: c.ControlSocket,
+		HTTPAddr: c.HTTPAddr,
+		S3Addr: c.S3Addr,
+		S3Keys: c.s3Keys(),
+		AdminAddr: c.AdminAddr,
+	}
+	opts.Logger, _ = NewLogger(os.Stderr, c.LogFormat)
+	opts.LogLevels = new(LogLevels)
+	opts.LogLevels.Set(c.LogLevel)
+	opts.LogLevels.SetComponents(c.LogLevels)
+	switch c.TraceExporter{
+	case "stdout":
+		opts.SpanExporter = NewStdoutExporter(os.Stdout)
+	case "otlp":
+		opts.SpanExporter = NewOTLPExporter(OTLPExporterOpts{Endpoint: c.TraceEndpoint, Logger: opts.Logger})
+	}
+	if len(opts.StorageRoot) == 0{
+		opts.StorageRoot = c.Listen + "_network"
+	}
+
+	tcpOpts := p2p.TCPTransportOpts{
+		ListenAddr: c.Listen,
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder: p2p.DefaultDecoder{},
+	}
+	return opts, tcpOpts
+}
+
+func (c Config) s3Keys() map[string]string{
+	keys := map[string]string{}
+	for _, pair := range c.S3Keys{
+		key, secret, _ := strings.Cut(pair, ":")
+		keys[key] = secret
+	}
+	return keys
+}
+
+// RestartRequired lists the settings that differ between c and next but only take effect after a restart
+func (c Config) RestartRequired(next Config) []string{
+	changed := []string{}
+	v, w := reflect.ValueOf(c), reflect.ValueOf(next)
+	for i := 0; i < v.NumField(); i++{
+		name := v.Type().Field(i).Tag.Get("toml")
+		switch name{
+		case "bootstrap", "anti_entropy_bandwidth", "rebalance_rate", "log_level", "log_levels", "s3_keys":
+			continue
+		}
+		if !reflect.DeepEqual(v.Field(i).Interface(), w.Field(i).Interface()){
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// Reload applies the settings of opts that can change while the node runs: the bandwidth limits, the S3 access keys,
+// the log levels and the bootstrap list. Bootstrap nodes that are new are dialed, the connections to the ones that were dropped from it stay up.
+func (s *FileServer) Reload(opts FileServerOpts){
+	s.settingsLock.Lock()
+	old := s.BootstrapNodes
+	s.AntiEntropyBandwidth = opts.AntiEntropyBandwidth
+	s.RebalanceRate = opts.RebalanceRate
+	s.BootstrapNodes = opts.BootstrapNodes
+	s.S3Keys = opts.S3Keys
+	s.settingsLock.Unlock()
+	if opts.LogLevels != nil{
+		s.LogLevels.update(opts.LogLevels)
+	}
+
+	for _, addr := range opts.BootstrapNodes{
+		if !contains(old, addr){
+			go s.redial(addr)
+		}
+	}
+}
+
+func (s *FileServer) antiEntropyBandwidth() int64{
+	s.settingsLock.Lock()
+	defer s.settingsLock.Unlock()
+	return s.AntiEntropyBandwidth
+}
+
+func (s *FileServer) rebalanceRate() int64{
+	s.settingsLock.Lock()
+	defer s.settingsLock.Unlock()
+	return s.RebalanceRate
+}
+
+// s3Secret returns the secret of an S3 access key, Reload may swap the keys at any time
+func (s *FileServer) s3Secret(accessKey string) (string, bool){
+	s.settingsLock.Lock()
+	defer s.settingsLock.Unlock()
+	secret, ok := s.S3Keys[accessKey]
+	return secret, ok
+}
+
+// commaList splits a comma separated value, ignoring empty items
+func commaList(v string) []string{
+	items := []string{}
+	for _, item := range strings.Split(v, ","){
+		if item = strings.TrimSpace(item); len(item) != 0{
+			items = append(items, item)
+		}
+	}
+	return items
+}
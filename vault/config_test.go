@@ -0,0 +1,166 @@
+package vault
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name string, content string) string{
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil{
+		t.Fatal(err)
+	}
+	return path
+}
+
+func noEnv(string) (string, bool){ return "", false }
+
+func TestLoadConfigFormats(t *testing.T){
+	files := map[string]string{
+		"node.toml": `
+listen = ":4000"
+bootstrap = [":3000", ":5000"]
+storage_mode = "erasure:4+2"
+anti_entropy_interval = "30s"
+rebalance_rate = 1048576
+`,
+		"node.yaml": `
+listen: ":4000"
+bootstrap: [":3000", ":5000"]
+storage_mode: erasure:4+2
+anti_entropy_interval: 30s
+rebalance_rate: 1048576
+`,
+		"node.json": `{
+	"listen": ":4000",
+	"bootstrap": [":3000", ":5000"],
+	"storage_mode": "erasure:4+2",
+	"anti_entropy_interval": "30s",
+	"rebalance_rate": 1048576
+}`,
+	}
+
+	want := DefaultConfig()
+	want.Listen = ":4000"
+	want.Bootstrap = []string{":3000", ":5000"}
+	want.StorageMode = "erasure:4+2"
+	want.AntiEntropyInterval = Duration(30 * time.Second)
+	want.RebalanceRate = 1 << 20
+
+	for name, content := range files{
+		cfg, err := loadConfig(writeConfig(t, name, content), noEnv)
+		if err != nil{
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !reflect.DeepEqual(cfg, want){
+			t.Errorf("%s: have %+v want %+v", name, cfg, want)
+		}
+	}
+
+	opts, tcpOpts := want.Options()
+	if tcpOpts.ListenAddr != ":4000" || opts.DefaultStorageMode != ErasureCoded(4, 2) || opts.AntiEntropyInterval != 30*time.Second{
+		t.Errorf("options don't match the config: %+v", opts)
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T){
+	path := writeConfig(t, "node.toml", "listen = \":4000\"\nlog_level = \"warn\"\n")
+	env := map[string]string{
+		"DISTRI_VAULT_LISTEN": ":6000",
+		"DISTRI_VAULT_BOOTSTRAP": ":3000, :4000",
+		"DISTRI_VAULT_REPLICATION_FACTOR": "3",
+	}
+	cfg, err := loadConfig(path, func(k string) (string, bool){
+		v, ok := env[k]
+		return v, ok
+	})
+	if err != nil{
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":6000" || cfg.ReplicationFactor != 3 || cfg.LogLevel != "warn" || !reflect.DeepEqual(cfg.Bootstrap, []string{":3000", ":4000"}){
+		t.Errorf("environment not applied over the file: %+v", cfg)
+	}
+
+	env["DISTRI_VAULT_REPLICATION_FACTOR"] = "three"
+	if _, err := loadConfig(path, func(k string) (string, bool){ v, ok := env[k]; return v, ok }); err == nil{
+		t.Errorf("expected a malformed number to be rejected")
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T){
+	path := writeConfig(t, "node.yaml", `
+listen: "3000"
+encryption_key: "abcd"
+path_transform: sha1
+storage_mode: erasure:0+2
+rebalance_rate: -1
+log_level: loud
+log_levels: ["raft=loud", "disk=debug"]
+log_format: xml
+trace_exporter: otlp
+trace_endpoint: localhost:4318
+s3_keys: ["nosecret"]
+`)
+	_, err := loadConfig(path, noEnv)
+	if err == nil{
+		t.Fatalf("expected the config to be rejected")
+	}
+	for _, setting := range []string{"listen", "encryption_key", "path_transform", "storage_mode", "rebalance_rate", "log_level", "log_levels", "log_format", "trace_endpoint", "s3_keys"}{
+		if !strings.Contains(err.Error(), setting+":"){
+			t.Errorf("expected an error about %s in %q", setting, err)
+		}
+	}
+
+	if _, err := loadConfig(writeConfig(t, "node.toml", "lisen = \":3000\"\n"), noEnv); err == nil || !strings.Contains(err.Error(), "lisen"){
+		t.Errorf("expected an unknown setting to be rejected, have %v", err)
+	}
+	if _, err := loadConfig(writeConfig(t, "node.ini", ""), noEnv); err == nil{
+		t.Errorf("expected an unknown format to be rejected")
+	}
+}
+
+func TestReload(t *testing.T){
+	cfg := DefaultConfig()
+	next := cfg
+	next.RebalanceRate = 1000
+	next.Bootstrap = []string{":3000"}
+	next.StorageRoot = "elsewhere"
+	next.LogLevels = []string{"raft=debug"}
+	if changed := cfg.RestartRequired(next); !reflect.DeepEqual(changed, []string{"storage_root"}){
+		t.Errorf("expected only storage_root to need a restart, have %v", changed)
+	}
+
+	s := newTestServer(t.TempDir())
+	opts, _ := next.Options()
+	opts.BootstrapNodes = nil
+	s.Reload(opts)
+	if s.rebalanceRate() != 1000{
+		t.Errorf("expected the rebalance rate to be reloaded, have %d", s.rebalanceRate())
+	}
+	if level := s.LogLevels.component("raft"); level != slog.LevelDebug{
+		t.Errorf("expected the log levels to be reloaded, have %s", level)
+	}
+
+	// The S3 keys are swapped under requests that are being authenticated
+	done := make(chan struct{})
+	go func(){
+		defer close(done)
+		for i := 0; i < 100; i++{
+			s.s3Secret("key")
+		}
+	}()
+	for i := 0; i < 100; i++{
+		opts.S3Keys = map[string]string{"key": fmt.Sprint(i)}
+		s.Reload(opts)
+	}
+	<-done
+	if secret, ok := s.s3Secret("key"); !ok || secret != "99"{
+		t.Errorf("expected the last S3 keys to be reloaded, have %q", secret)
+	}
+}
@@ -0,0 +1,254 @@
+package vault
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// The control socket lets the command line client drive a running node. It is a unix socket taking one request per
+// connection: a JSON line naming the operation, followed by the file for a put. The node answers with a JSON line and,
+// for a get, the file after it.
+
+// DefaultControlSocket is where the client looks for a node when neither -socket nor DISTRI_VAULT_SOCKET say otherwise
+var DefaultControlSocket = filepath.Join(os.TempDir(), "distri_vault.sock")
+
+const (
+	ControlPut = "put"
+	ControlGet = "get"
+	ControlDelete = "rm"
+	ControlList = "ls"
+	ControlStat = "stat"
+	ControlPeers = "peers"
+)
+
+type ControlRequest struct{
+	Op string
+	Key string
+	Prefix string
+}
+
+type ControlResponse struct{
+	Error string `json:",omitempty"`
+	// Code classifies Error for scripts, see errorCode
+	Code string `json:",omitempty"`
+	Object *ObjectInfo `json:",omitempty"`
+	Objects []ObjectInfo `json:",omitempty"`
+	Peers []PeerStatus `json:",omitempty"`
+}
+
+// errorCode maps the errors a request can fail with to a stable name
+func errorCode(err error) string{
+	var conflict *ConflictError
+	switch{
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrNoHolders), errors.Is(err, ErrVersionNotFound):
+		return "not_found"
+	case errors.Is(err, ErrDeleted):
+		return "deleted"
+	case errors.Is(err, ErrDraining):
+		return "draining"
+	case errors.As(err, &conflict):
+		return "conflict"
+	}
+	return "internal"
+}
+
+func (s *FileServer) startControl() error{
+	if len(s.ControlSocket) == 0{
+		return nil
+	}
+
+	// A socket left behind by a node that didn't shut down cleanly would make the listen fail
+	if conn, err := net.Dial("unix", s.ControlSocket); err == nil{
+		conn.Close()
+		return fmt.Errorf("control socket %s is in use by another node", s.ControlSocket)
+	}
+	os.Remove(s.ControlSocket)
+
+	ln, err := net.Listen("unix", s.ControlSocket)
+	if err != nil{
+		return err
+	}
+	s.control = ln
+
+	go func(){
+		for{
+			conn, err := ln.Accept()
+			if err != nil{
+				if !errors.Is(err, net.ErrClosed){
+					s.logger("control").Error("control socket accept error", "err", err)
+				}
+				return
+			}
+			go s.serveControl(conn)
+		}
+	}()
+	return nil
+}
+
+func (s *FileServer) stopControl(){
+	if s.control != nil{
+		s.control.Close()
+	}
+}
+
+func (s *FileServer) serveControl(conn net.Conn){
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadBytes('\n')
+	if err != nil{
+		return
+	}
+	var req ControlRequest
+	if err := json.Unmarshal(line, &req); err != nil{
+		writeControl(conn, ControlResponse{Error: err.Error(), Code: "bad_request"})
+		return
+	}
+
+	if req.Op == ControlGet{
+		s.serveControlGet(conn, req)
+		return
+	}
+
+	resp, err := s.handleControl(req, r)
+	if err != nil{
+		resp = ControlResponse{Error: err.Error(), Code: errorCode(err)}
+	}
+	writeControl(conn, resp)
+}
+
+func (s *FileServer) handleControl(req ControlRequest, body io.Reader) (ControlResponse, error){
+	switch req.Op{
+	case ControlPut:
+		if err := s.Store(req.Key, body); err != nil{
+			return ControlResponse{}, err
+		}
+		info, err := s.Stat(req.Key)
+		return ControlResponse{Object: &info}, err
+	case ControlDelete:
+		return ControlResponse{}, s.Delete(req.Key)
+	case ControlList:
+		objects, err := s.List(req.Prefix)
+		return ControlResponse{Objects: objects}, err
+	case ControlStat:
+		info, err := s.Stat(req.Key)
+		return ControlResponse{Object: &info}, err
+	case ControlPeers:
+		return ControlResponse{Peers: s.Peers()}, nil
+	}
+	return ControlResponse{}, fmt.Errorf("unknown operation %q", req.Op)
+}
+
+func (s *FileServer) serveControlGet(conn net.Conn, req ControlRequest){
+	r, err := s.Get(req.Key)
+	if err != nil{
+		writeControl(conn, ControlResponse{Error: err.Error(), Code: errorCode(err)})
+		return
+	}
+	if rc, ok := r.(io.ReadCloser); ok{
+		defer rc.Close()
+	}
+
+	resp := ControlResponse{}
+	if info, err := s.Stat(req.Key); err == nil{
+		resp.Object = &info
+	}
+	if err := writeControl(conn, resp); err != nil{
+		return
+	}
+	io.Copy(conn, r)
+}
+
+func writeControl(w io.Writer, resp ControlResponse) error{
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// ControlError is a request the node turned down
+type ControlError struct{
+	Code string
+	Message string
+}
+
+func (e *ControlError) Error() string{
+	return e.Message
+}
+
+// Is lets errors.Is match a ControlError against the error its code stands for, see errorCode
+func (e *ControlError) Is(target error) bool{
+	switch e.Code{
+	case "not_found":
+		return target == ErrNotFound
+	case "deleted":
+		return target == ErrDeleted
+	case "draining":
+		return target == ErrDraining
+	}
+	return false
+}
+
+// ControlClient talks to a node over its control socket
+type ControlClient struct{
+	Socket string
+}
+
+// Do sends req with body and returns the response. The returned reader holds whatever the node sent after the
+// response and has to be closed.
+func (c *ControlClient) Do(req ControlRequest, body io.Reader) (ControlResponse, io.ReadCloser, error){
+	var resp ControlResponse
+
+	conn, err := net.Dial("unix", c.Socket)
+	if err != nil{
+		return resp, nil, fmt.Errorf("no node listening on %s: %w", c.Socket, err)
+	}
+
+	b, err := json.Marshal(req)
+	if err == nil{
+		_, err = conn.Write(append(b, '\n'))
+	}
+	if err == nil && body != nil{
+		_, err = io.Copy(conn, body)
+	}
+	if err == nil{
+		// The node reads a put until the end of the stream
+		err = conn.(*net.UnixConn).CloseWrite()
+	}
+	if err != nil{
+		conn.Close()
+		return resp, nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadBytes('\n')
+	if err == nil{
+		err = json.Unmarshal(line, &resp)
+	}
+	if err != nil{
+		conn.Close()
+		return resp, nil, fmt.Errorf("bad response from node: %w", err)
+	}
+	if len(resp.Error) != 0{
+		conn.Close()
+		return resp, nil, &ControlError{Code: resp.Code, Message: resp.Error}
+	}
+
+	return resp, struct{
+		io.Reader
+		io.Closer
+	}{r, conn}, nil
+}
+
+// Call is Do for requests that only have a response
+func (c *ControlClient) Call(req ControlRequest, body io.Reader) (ControlResponse, error){
+	resp, rc, err := c.Do(req, body)
+	if err != nil{
+		return resp, err
+	}
+	rc.Close()
+	return resp, nil
+}
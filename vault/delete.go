@@ -0,0 +1,350 @@
+package vault
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+)
+
+const defaultTombstoneGracePeriod = 7 * 24 * time.Hour
+
+// peerKeysFile keeps the signing key pinned for every node ID, so that a restart doesn't let another node claim an ID
+const peerKeysFile = ".peerkeys.json"
+
+var (
+	ErrDeleted = errors.New("file has been deleted")
+	ErrBadSignature = errors.New("delete is not signed by the owner")
+	ErrKeyMismatch = errors.New("node ID is pinned to another signing key")
+	ErrBadHelloProof = errors.New("hello is not signed by the key it claims")
+)
+
+const helloNonceSize = 32
+
+// MessageHelloProof answers the nonce of a hello. Signing it along with our ID and key shows that we hold the key, a
+// replayed or forged hello can't claim an ID.
+type MessageHelloProof struct{
+	Signature []byte
+}
+
+func helloProofPayload(nonce []byte, id string, pub ed25519.PublicKey) []byte{
+	return []byte(fmt.Sprintf("hello|%x|%s|%x", nonce, id, []byte(pub)))
+}
+
+// newChallenge picks the nonce the peer at addr has to sign, the caller holds peerLock
+func (s *FileServer) newChallenge(addr string) []byte{
+	nonce := make([]byte, helloNonceSize)
+	rand.Read(nonce)
+	s.challenges[addr] = nonce
+	return nonce
+}
+
+// handleMessageHello keeps the hello until the peer proves it holds the key, and proves the same to the peer
+func (s *FileServer) handleMessageHello(from string, msg MessageHello) error{
+	if len(msg.Nonce) != helloNonceSize{
+		return fmt.Errorf("hello of %s without a challenge", msg.ID)
+	}
+	s.peerLock.Lock()
+	s.hellos[from] = msg
+	s.peerLock.Unlock()
+
+	pub := s.SigningKey.Public().(ed25519.PublicKey)
+	proof := MessageHelloProof{Signature: ed25519.Sign(s.SigningKey, helloProofPayload(msg.Nonce, s.ID, pub))}
+	return s.sendMessage(from, &Message{Payload: proof})
+}
+
+// handleMessageHelloProof takes the pending hello of the peer once it signed the nonce we sent it
+func (s *FileServer) handleMessageHelloProof(from string, msg MessageHelloProof) error{
+	s.peerLock.Lock()
+	hello, ok := s.hellos[from]
+	nonce := s.challenges[from]
+	delete(s.hellos, from)
+	delete(s.challenges, from)
+	s.peerLock.Unlock()
+	if !ok || nonce == nil{
+		return fmt.Errorf("peer (%s) sent a hello proof without a hello", from)
+	}
+
+	valid := len(hello.PublicKey) == ed25519.PublicKeySize &&
+		ed25519.Verify(hello.PublicKey, helloProofPayload(nonce, hello.ID, hello.PublicKey), msg.Signature)
+	if !valid{
+		s.logger("peers").Warn("rejecting hello", "peer", from, "id", hello.ID, "err", ErrBadHelloProof)
+		if peer, ok := s.peer(from); ok{
+			peer.Close()
+		}
+		s.removePeer(from)
+		return ErrBadHelloProof
+	}
+	return s.acceptHello(from, hello)
+}
+
+// MessageDeleteFile asks every replica to drop an object. It is signed by the owner so only the owner can delete its files.
+type MessageDeleteFile struct{
+	ID string
+	Key string
+	ModTime int64
+	Signature []byte
+	// Shards is the number of shards of an erasure coded object, their holders tombstone them along with it
+	Shards int
+}
+
+func deleteSignaturePayload(id string, key string, modTime int64) []byte{
+	return []byte(fmt.Sprintf("delete|%s|%s|%d", id, key, modTime))
+}
+
+// verifyDelete checks that the owner signed the delete of key. The shards of an erasure coded object go with the
+// signature of the object.
+func (s *FileServer) verifyDelete(id string, key string, modTime int64, signature []byte) error{
+	if base, _, ok := parseShardKey(key); ok{
+		key = base
+	}
+	s.peerLock.Lock()
+	pub, ok := s.peerKeys[id]
+	s.peerLock.Unlock()
+
+	if !ok || !ed25519.Verify(pub, deleteSignaturePayload(id, key, modTime), signature){
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// pinKey takes pub as the signing key of the node id the first time id proves a hello, from then on a hello for id
+// has to come with the same key. Otherwise any node could claim the ID of another and sign deletes of its files.
+func (s *FileServer) pinKey(id string, pub ed25519.PublicKey) error{
+	if len(pub) != ed25519.PublicKeySize{
+		return fmt.Errorf("malformed signing key of %d bytes", len(pub))
+	}
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	if pinned, ok := s.peerKeys[id]; ok{
+		if !pinned.Equal(pub){
+			return ErrKeyMismatch
+		}
+		return nil
+	}
+	s.peerKeys[id] = pub
+
+	keys := make(map[string]string, len(s.peerKeys))
+	for id, key := range s.peerKeys{
+		keys[id] = hex.EncodeToString(key)
+	}
+	b, err := json.Marshal(keys)
+	if err != nil{
+		return err
+	}
+	if err := os.MkdirAll(s.store.Root, os.ModePerm); err != nil{
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.store.Root, peerKeysFile), b, 0644)
+}
+
+// loadPeerKeys reads the keys pinned before a restart, our own ID is pinned to our own key
+func (s *FileServer) loadPeerKeys() error{
+	path := filepath.Join(s.store.Root, peerKeysFile)
+	keys := map[string]string{}
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist){
+		return fmt.Errorf("reading pinned keys: %w", err)
+	}
+	if err == nil{
+		if err := json.Unmarshal(b, &keys); err != nil{
+			return fmt.Errorf("reading pinned keys: %w", err)
+		}
+	}
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	for id, key := range keys{
+		pub, err := hex.DecodeString(key)
+		if err != nil || len(pub) != ed25519.PublicKeySize{
+			return fmt.Errorf("corrupt key of %s in %s", id, path)
+		}
+		s.peerKeys[id] = pub
+	}
+	s.peerKeys[s.ID] = s.SigningKey.Public().(ed25519.PublicKey)
+	return nil
+}
+
+// Delete removes the file with all its versions from the local disk and from every peer in the network. A tombstone is
+// left behind everywhere so anti-entropy and replicas that were offline during the delete don't bring the file back.
+func (s *FileServer) Delete(key string) error{
+	return s.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is Delete giving up on telling the peers once ctx is done. The local delete is done before any peer
+// is told, peers that weren't learn of it from the tombstones through anti-entropy.
+func (s *FileServer) DeleteContext(ctx context.Context, key string) error{
+	if err := ctx.Err(); err != nil{
+		return err
+	}
+	unlock := s.versionLocks.lock(crypto.HashKey(key))
+	versions, legacy, err := s.readVersions(key)
+	if err != nil{
+		unlock()
+		return err
+	}
+
+	// The plain key is tombstoned too, it covers files written before versioning and makes Get fail fast
+	keys := []string{key}
+	for _, v := range versions{
+		keys = append(keys, versionKey(key, v.ID))
+	}
+	msgs := []*Message{}
+	for _, k := range keys{
+		msg, err := s.tombstone(k)
+		if err != nil{
+			unlock()
+			return err
+		}
+		msgs = append(msgs, msg)
+	}
+	err = s.store.DeleteVersions(s.ID, crypto.HashKey(key))
+	if err == nil && legacy{
+		err = s.store.DeleteVersions(s.ID, key)
+	}
+	unlock()
+	if err != nil{
+		return err
+	}
+
+	var errs []error
+	for _, msg := range msgs{
+		if err := s.broadcast(ctx, msg); err != nil{
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deleteObject deletes a single object by its storage key
+func (s *FileServer) deleteObject(ctx context.Context, key string) error{
+	msg, err := s.tombstone(key)
+	if err != nil{
+		return err
+	}
+	return s.broadcast(ctx, msg)
+}
+
+// tombstone deletes an object from the local disk and returns the message that deletes it on the peers
+func (s *FileServer) tombstone(key string) (*Message, error){
+	modTime := s.clock.Now()
+
+	shards := 0
+	if meta, err := s.store.ReadMeta(s.ID, key); err == nil && meta.Erasure != nil{
+		shards = meta.Erasure.TotalShards()
+	}
+
+	hashedKey := crypto.HashKey(key)
+	signature := ed25519.Sign(s.SigningKey, deleteSignaturePayload(s.ID, hashedKey, modTime))
+	if err := s.store.Tombstone(s.ID, key, modTime, signature); err != nil{
+		return nil, err
+	}
+
+	msg := Message{
+		Payload: MessageDeleteFile{
+			ID: s.ID,
+			Key: hashedKey,
+			ModTime: modTime,
+			Signature: signature,
+			Shards: shards,
+		},
+	}
+
+	s.logger("server").Info("deleting from the network", "key", key)
+	return &msg, nil
+}
+
+// deleted reports whether the object has a tombstone at least as recent as modTime
+func (s *FileServer) deleted(id string, key string, modTime int64) bool{
+	meta, err := s.store.ReadMeta(id, key)
+	if err != nil{
+		return false
+	}
+	return meta.Deleted && meta.ModTime >= modTime
+}
+
+func (s *FileServer) handleMessageDeleteFile(from string, msg MessageDeleteFile) error{
+	if err := s.clock.Observe(msg.ModTime); err != nil{
+		return err
+	}
+
+	if err := s.verifyDelete(msg.ID, msg.Key, msg.ModTime, msg.Signature); err != nil{
+		return err
+	}
+
+	unlock := s.objectLocks.lock(msg.ID + "/" + msg.Key)
+	defer unlock()
+
+	// A newer write of the same key wins over the delete
+	if meta, err := s.store.ReadMeta(msg.ID, msg.Key); err == nil && meta.ModTime > msg.ModTime{
+		return nil
+	}
+
+	s.logger("server").Debug("deleting on request of a peer", "peer", from, "owner", msg.ID, "key", msg.Key)
+
+	for i := 0; i < msg.Shards && i < maxShards; i++{
+		key := shardKey(msg.Key, i)
+		if _, err := s.store.ReadMeta(msg.ID, key); err != nil{
+			continue
+		}
+		if err := s.store.Tombstone(msg.ID, key, msg.ModTime, msg.Signature); err != nil{
+			return err
+		}
+	}
+
+	return s.store.Tombstone(msg.ID, msg.Key, msg.ModTime, msg.Signature)
+}
+
+func (s *FileServer) tombstoneGracePeriod() time.Duration{
+	if s.TombstoneGracePeriod <= 0{
+		return defaultTombstoneGracePeriod
+	}
+	return s.TombstoneGracePeriod
+}
+
+func (s *FileServer) tombstoneLoop(){
+	interval := s.tombstoneGracePeriod()
+	if interval > 10*time.Minute{
+		interval = 10 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for{
+		select{
+		case <-ticker.C:
+			if err := s.gcTombstones(); err != nil{
+				s.logger("server").Warn("tombstone gc error", "err", err)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// gcTombstones forgets tombstones older than the grace period, by then every replica should have seen the delete
+func (s *FileServer) gcTombstones() error{
+	inventory, err := s.store.Inventory()
+	if err != nil{
+		return err
+	}
+
+	for _, e := range inventory{
+		if !e.Deleted || time.Since(time.Unix(0, e.ModTime)) < s.tombstoneGracePeriod(){
+			continue
+		}
+		if err := s.store.DeleteMeta(e.ID, e.Key); err != nil{
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+	"github.com/ayushn2/distri_vault.git/p2p"
+)
+
+func TestHandleDeleteFileVerifiesSignature(t *testing.T){
+	s := newTestServer(t.TempDir())
+	owner := crypto.NewSigningKey()
+	s.peerKeys["owner"] = owner.Public().(ed25519.PublicKey)
+
+	key := crypto.HashKey("picture.jpg")
+	if _, err := s.store.Write("owner", key, bytes.NewReader([]byte("ciphertext"))); err != nil{
+		t.Fatal(err)
+	}
+	if err := s.store.WriteMeta("owner", key, Meta{ModTime: time.Now().Add(-time.Minute).UnixNano()}); err != nil{
+		t.Fatal(err)
+	}
+
+	modTime := time.Now().UnixNano()
+	forged := MessageDeleteFile{
+		ID: "owner",
+		Key: key,
+		ModTime: modTime,
+		Signature: ed25519.Sign(crypto.NewSigningKey(), deleteSignaturePayload("owner", key, modTime)),
+	}
+	if err := s.handleMessageDeleteFile("peer", forged); err != ErrBadSignature{
+		t.Fatalf("have %v want %v", err, ErrBadSignature)
+	}
+	if !s.store.Has("owner", key){
+		t.Fatalf("forged delete must not remove the file")
+	}
+
+	signed := forged
+	signed.Signature = ed25519.Sign(owner, deleteSignaturePayload("owner", key, modTime))
+	if err := s.handleMessageDeleteFile("peer", signed); err != nil{
+		t.Fatal(err)
+	}
+	if s.store.Has("owner", key){
+		t.Errorf("expected the file to be deleted")
+	}
+	if !s.deleted("owner", key, modTime - 1){
+		t.Errorf("expected a tombstone that wins over older writes")
+	}
+}
+
+func TestDeleteLeavesTombstone(t *testing.T){
+	s := newTestServer(t.TempDir())
+	s.TombstoneGracePeriod = time.Millisecond
+
+	if err := s.Store("picture.jpg", bytes.NewReader([]byte("data"))); err != nil{
+		t.Fatal(err)
+	}
+	if err := s.Delete("picture.jpg"); err != nil{
+		t.Fatal(err)
+	}
+	if _, err := s.Get("picture.jpg"); err != ErrDeleted{
+		t.Errorf("have %v want %v", err, ErrDeleted)
+	}
+
+	inventory, err := s.store.Inventory()
+	if err != nil{
+		t.Fatal(err)
+	}
+	// One tombstone for the stored version and one for the plain key
+	if len(inventory) != 2{
+		t.Fatalf("expected two tombstones, have %+v", inventory)
+	}
+	for _, e := range inventory{
+		if !e.Deleted{
+			t.Errorf("expected %s to be a tombstone", e.Key)
+		}
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if err := s.gcTombstones(); err != nil{
+		t.Fatal(err)
+	}
+	if inventory, _ := s.store.Inventory(); len(inventory) != 0{
+		t.Errorf("expected the tombstone to be garbage collected")
+	}
+}
+
+func TestHelloPinsKey(t *testing.T){
+	root := t.TempDir()
+	s := newTestServer(root)
+	// sign is what the node holding key answers to nonce when claiming pub
+	hello := func(pub ed25519.PublicKey, sign func(nonce []byte) []byte) error{
+		conn, other := net.Pipe()
+		t.Cleanup(func(){ other.Close() })
+		go io.Copy(io.Discard, other)
+		s.OnPeer(p2p.NewTCPPeer(conn, false))
+
+		s.peerLock.Lock()
+		nonce := s.challenges["pipe"]
+		s.peerLock.Unlock()
+		if err := s.handleMessageHello("pipe", MessageHello{ID: "node", PublicKey: pub, Nonce: make([]byte, helloNonceSize)}); err != nil{
+			return err
+		}
+		return s.handleMessageHelloProof("pipe", MessageHelloProof{Signature: sign(nonce)})
+	}
+	signed := func(key ed25519.PrivateKey) (ed25519.PublicKey, func([]byte) []byte){
+		pub := key.Public().(ed25519.PublicKey)
+		return pub, func(nonce []byte) []byte{
+			return ed25519.Sign(key, helloProofPayload(nonce, "node", pub))
+		}
+	}
+
+	honest := crypto.NewSigningKey()
+	if err := hello(signed(honest)); err != nil{
+		t.Fatal(err)
+	}
+	if err := hello(signed(honest)); err != nil{
+		t.Errorf("expected the same key to be taken again, have %v", err)
+	}
+	if err := hello(signed(crypto.NewSigningKey())); err != ErrKeyMismatch{
+		t.Fatalf("have %v want %v", err, ErrKeyMismatch)
+	}
+	if _, ok := s.peer("pipe"); ok{
+		t.Errorf("expected the node claiming a pinned ID to be dropped")
+	}
+
+	// Claiming the pinned key takes a signature with it, over the nonce of this hello and not an old one
+	pub, _ := signed(honest)
+	_, forged := signed(crypto.NewSigningKey())
+	if err := hello(pub, forged); err != ErrBadHelloProof{
+		t.Errorf("have %v want %v", err, ErrBadHelloProof)
+	}
+	_, sign := signed(honest)
+	replayed := sign(make([]byte, helloNonceSize))
+	if err := hello(pub, func([]byte) []byte{ return replayed }); err != ErrBadHelloProof{
+		t.Errorf("have %v want %v", err, ErrBadHelloProof)
+	}
+	if _, ok := s.peer("pipe"); ok{
+		t.Errorf("expected the node failing the challenge to be dropped")
+	}
+
+	// The pin outlives a restart
+	s = newTestServer(root)
+	if err := s.loadPeerKeys(); err != nil{
+		t.Fatal(err)
+	}
+	if err := s.pinKey("node", crypto.NewSigningKey().Public().(ed25519.PublicKey)); err != ErrKeyMismatch{
+		t.Errorf("have %v want %v", err, ErrKeyMismatch)
+	}
+}
+
+func TestSyncVerifiesTombstones(t *testing.T){
+	s := newTestServer(t.TempDir())
+	owner := crypto.NewSigningKey()
+	s.peerKeys["owner"] = owner.Public().(ed25519.PublicKey)
+
+	key := crypto.HashKey("picture.jpg")
+	if _, err := s.store.Write("owner", key, bytes.NewReader([]byte("ciphertext"))); err != nil{
+		t.Fatal(err)
+	}
+	s.store.WriteMeta("owner", key, Meta{Digest: "digest", ModTime: 1})
+	local := []SyncEntry{{ID: "owner", Key: key, Digest: "digest", ModTime: 1}}
+
+	modTime := time.Now().UnixNano()
+	forged := SyncEntry{
+		ID: "owner",
+		Key: key,
+		ModTime: modTime,
+		Deleted: true,
+		Signature: ed25519.Sign(crypto.NewSigningKey(), deleteSignaturePayload("owner", key, modTime)),
+	}
+	if _, err := s.syncWants(local, []SyncEntry{forged}); err != nil{
+		t.Fatal(err)
+	}
+	if !s.store.Has("owner", key){
+		t.Fatalf("a tombstone the owner didn't sign must not remove the file")
+	}
+
+	signed := forged
+	signed.Signature = ed25519.Sign(owner, deleteSignaturePayload("owner", key, modTime))
+	if _, err := s.syncWants(local, []SyncEntry{signed}); err != nil{
+		t.Fatal(err)
+	}
+	meta, err := s.store.ReadMeta("owner", key)
+	if err != nil || !meta.Deleted || !bytes.Equal(meta.Signature, signed.Signature){
+		t.Errorf("expected a signed tombstone to be applied and kept with its signature, have %+v, %v", meta, err)
+	}
+}
@@ -0,0 +1,56 @@
+package vault
+
+import (
+	"github.com/ayushn2/distri_vault.git/p2p"
+)
+
+// With a ClusterName set the node announces itself on the LAN over UDP multicast and dials the nodes of the same
+// cluster it hears about, so a vault can come up without any BootstrapNodes. Only the node with the smaller ID dials,
+// both sides hear each other and would otherwise race to connect.
+
+func (s *FileServer) startDiscovery() error{
+	if len(s.ClusterName) == 0{
+		return nil
+	}
+
+	s.discovery = p2p.NewDiscovery(p2p.DiscoveryOpts{
+		ClusterName: s.ClusterName,
+		ID: s.ID,
+		ListenAddr: s.advertiseAddr(),
+		GroupAddr: s.DiscoveryGroup,
+		Interval: s.DiscoveryInterval,
+		OnDiscover: s.onDiscover,
+	})
+	return s.discovery.Start()
+}
+
+func (s *FileServer) stopDiscovery(){
+	if s.discovery != nil{
+		s.discovery.Close()
+	}
+}
+
+func (s *FileServer) onDiscover(id string, addr string){
+	if _, ok := s.peerAddr(id); ok{
+		return
+	}
+	if learned := s.learnPeers(PeerInfo{ID: id, Addr: addr}); len(learned) > 0{
+		s.logger("discovery").Info("discovered node", "id", id, "peer", addr)
+	}
+	if s.ID > id || s.connectedTo(addr){
+		return
+	}
+
+	// Announcements keep coming while the node is up, a failed dial is simply retried on the next one. The dial
+	// runs on its own so a node that doesn't answer can't hold up the announcements of the others.
+	done, ok := s.reconnect.startDial(addr)
+	if !ok{
+		return
+	}
+	go func(){
+		defer done()
+		if err := s.dial(addr); err != nil{
+			s.logger("discovery").Warn("dial of discovered node failed", "id", id, "peer", addr, "err", err)
+		}
+	}()
+}
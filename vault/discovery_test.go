@@ -0,0 +1,62 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ayushn2/distri_vault.git/p2p"
+)
+
+// stalledTransport is a transport whose dials hang until released
+type stalledTransport struct{
+	p2p.Transport
+	dials chan string
+	release chan struct{}
+}
+
+func (t *stalledTransport) DialContext(ctx context.Context, addr string) error{
+	t.dials <- addr
+	select{
+	case <-t.release:
+	case <-ctx.Done():
+	}
+	return errors.New("unreachable")
+}
+
+func TestDiscoveredNodesDialedInBackground(t *testing.T){
+	s := newTestServer(t.TempDir())
+	tr := &stalledTransport{Transport: s.Transport, dials: make(chan string, 4), release: make(chan struct{})}
+	s.Transport = tr
+	defer close(tr.release)
+
+	// Node IDs are hex, so we are the one to dial "zz" nodes
+	announced := make(chan struct{})
+	go func(){
+		s.onDiscover("zz1", "10.0.0.2:3000")
+		s.onDiscover("zz1", "10.0.0.2:3000")
+		s.onDiscover("zz2", "10.0.0.3:3000")
+		close(announced)
+	}()
+	select{
+	case <-announced:
+	case <-time.After(time.Second):
+		t.Fatal("expected announcements to be handled while the dials hang")
+	}
+
+	dialed := map[string]bool{}
+	for i := 0; i < 2; i++{
+		select{
+		case addr := <-tr.dials:
+			dialed[addr] = true
+		case <-time.After(time.Second):
+			t.Fatalf("expected both nodes to be dialed, have %v", dialed)
+		}
+	}
+	select{
+	case addr := <-tr.dials:
+		t.Errorf("expected a single dial in flight to %s", addr)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
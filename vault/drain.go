@@ -0,0 +1,251 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// drainAckTimeout is how long Drain waits for the new owners to acknowledge an object before retrying it
+const drainAckTimeout = 5 * time.Second
+
+// drainRetry is the wait before the first retry of the objects that could not be handed over, it doubles up to
+// maxDrainRetry while they keep failing
+const (
+	drainRetry = time.Second
+	maxDrainRetry = 30 * time.Second
+)
+
+// drainStateFile lives in the storage root and records which objects have already been handed over,
+// so an interrupted drain picks up where it stopped
+const drainStateFile = ".drain"
+
+var (
+	ErrDraining = errors.New("node is draining and does not accept new files")
+	ErrNoDrainTargets = errors.New("no peers to drain to")
+)
+
+// MessageLeave announces that a node has handed over all its data and is leaving the network
+type MessageLeave struct{
+	ID string
+}
+
+type drainState struct{
+	Started time.Time
+	// Done holds the object IDs (owner/hashed key) every new owner has acknowledged
+	Done map[string]bool
+}
+
+type drainer struct{
+	mu sync.Mutex
+	active bool
+	state drainState
+}
+
+func (s *FileServer) drainStatePath() string{
+	return filepath.Join(s.store.Root, drainStateFile)
+}
+
+func (s *FileServer) loadDrainState() (drainState, bool, error){
+	state := drainState{Done: make(map[string]bool)}
+
+	b, err := os.ReadFile(s.drainStatePath())
+	if errors.Is(err, os.ErrNotExist){
+		return state, false, nil
+	}
+	if err != nil{
+		return state, false, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil{
+		return state, false, err
+	}
+	if state.Done == nil{
+		state.Done = make(map[string]bool)
+	}
+	return state, true, nil
+}
+
+func (s *FileServer) saveDrainState(state drainState) error{
+	b, err := json.Marshal(state)
+	if err != nil{
+		return err
+	}
+	if err := os.MkdirAll(s.store.Root, os.ModePerm); err != nil{
+		return err
+	}
+	return os.WriteFile(s.drainStatePath(), b, 0644)
+}
+
+func (s *FileServer) removeDrainState() error{
+	if err := os.Remove(s.drainStatePath()); err != nil && !errors.Is(err, os.ErrNotExist){
+		return err
+	}
+	return nil
+}
+
+// Draining reports whether the node is being decommissioned
+func (s *FileServer) Draining() bool{
+	s.drain.mu.Lock()
+	defer s.drain.mu.Unlock()
+	return s.drain.active
+}
+
+// Drain retires the node without losing redundancy. It stops accepting new files, hands every object it holds to the
+// nodes that own it once this node is off the ring, waits until they all acknowledged, announces its departure and
+// shuts the server down. Progress is kept on disk, calling Drain again (or restarting the node) resumes it. A node
+// with no other node on its ring has nobody to hand its data to, Drain fails with ErrNoDrainTargets.
+func (s *FileServer) Drain() error{
+	state, resumed, err := s.loadDrainState()
+	if err != nil{
+		return err
+	}
+	// A resumed drain runs while the node is still finding the cluster again, it waits for the other nodes
+	others := s.ring.Clone()
+	others.Remove(s.ID)
+	if len(others.Members()) == 0 && !resumed{
+		return ErrNoDrainTargets
+	}
+	if state.Started.IsZero(){
+		state.Started = time.Now()
+	}
+
+	s.drain.mu.Lock()
+	s.drain.active = true
+	s.drain.state = state
+	s.drain.mu.Unlock()
+
+	if err := s.saveDrainState(state); err != nil{
+		return err
+	}
+
+	s.logger("drain").Info("draining node")
+
+	retry := drainRetry
+	for{
+		// The placement follows the ring as it is now, nodes may have come or gone since the last pass
+		ring := s.ring.Clone()
+		ring.Remove(s.ID)
+
+		inventory, err := s.store.Inventory()
+		if err != nil{
+			return err
+		}
+
+		remaining := 0
+		for _, e := range inventory{
+			objectID := e.ID + "/" + s.objectKey(e)
+			// Our erasure coded files are already spread as shards, the holders drain those themselves
+			if state.Done[objectID] || e.Deleted || s.erasureCoded(e){
+				continue
+			}
+			remaining++
+
+			select{
+			case <-s.quitch:
+				return nil
+			default:
+			}
+
+			if err := s.drainObject(ring, e); err != nil{
+				s.logger("drain").Warn("drain of object failed, will retry", "owner", e.ID, "key", s.objectKey(e), "err", err)
+				continue
+			}
+
+			state.Done[objectID] = true
+			if err := s.saveDrainState(state); err != nil{
+				return err
+			}
+			remaining--
+		}
+
+		if remaining == 0{
+			break
+		}
+		select{
+		case <-time.After(retry):
+		case <-s.quitch:
+			return nil
+		}
+		retry = min(2*retry, maxDrainRetry)
+	}
+
+	if err := s.broadcast(context.Background(), &Message{Payload: MessageLeave{ID: s.ID}}); err != nil{
+		return err
+	}
+	// The node is gone from the cluster now, a restart joins it again instead of draining once more
+	if err := s.removeDrainState(); err != nil{
+		return err
+	}
+
+	s.logger("drain").Info("drain complete, leaving the network")
+
+	s.Stop()
+	return nil
+}
+
+// drainObject pushes one object to its owners under ring and waits until all of them acknowledged it
+func (s *FileServer) drainObject(ring *HashRing, e InventoryEntry) error{
+	key := s.objectKey(e)
+	objectID := e.ID + "/" + key
+
+	targets := []string{}
+	for _, id := range s.placement(ring, e.ID, key){
+		if addr, ok := s.peerAddr(id); ok{
+			targets = append(targets, addr)
+		}
+	}
+	if len(targets) == 0{
+		return ErrNoDrainTargets
+	}
+
+	acks := make([]<-chan struct{}, 0, len(targets))
+	for _, addr := range targets{
+		acks = append(acks, s.acks.expect(addr, objectID))
+		defer s.acks.cancel(addr, objectID)
+	}
+
+	for _, addr := range targets{
+		peer, ok := s.peer(addr)
+		if !ok{
+			return fmt.Errorf("peer (%s) could not be found in the peer list", addr)
+		}
+		if _, err := s.pushObject(peer, e, true); err != nil{
+			return err
+		}
+	}
+
+	timeout := time.After(drainAckTimeout)
+	for _, ack := range acks{
+		select{
+		case <-ack:
+		case <-timeout:
+			return fmt.Errorf("timed out waiting for acknowledgements")
+		case <-s.quitch:
+			return fmt.Errorf("server stopped")
+		}
+	}
+	return nil
+}
+
+func (s *FileServer) handleMessageLeave(from string, msg MessageLeave) error{
+	// Only a node can announce its own leave, anyone else could evict it from the cluster
+	if id := s.peerID(from); id != msg.ID{
+		return fmt.Errorf("peer (%s) is %q and can't announce the leave of %q", from, id, msg.ID)
+	}
+	s.logger("membership").Info("node left the network", "id", msg.ID, "peer", from)
+
+	s.removePeer(from)
+	s.forget(msg.ID)
+	s.forgetPeer(msg.ID)
+	s.memberLeft(msg.ID)
+
+	if prev, ok := s.ring.Leave(msg.ID); ok{
+		s.rebalancer.Trigger(prev, s.replicationFactor())
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+	"github.com/ayushn2/distri_vault.git/p2p"
+)
+
+func newTestServer(root string) *FileServer{
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr: ":0",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder: p2p.DefaultDecoder{},
+	})
+	return NewFileServer(FileServerOpts{
+		EncKey: crypto.NewEncryptionKey(),
+		StorageRoot: root,
+		PathTransformFunc: CASPathTransformFunc,
+		Transport: tr,
+	})
+}
+
+func TestDrainStateResumes(t *testing.T){
+	s := newTestServer(t.TempDir())
+
+	if _, ok, err := s.loadDrainState(); err != nil || ok{
+		t.Fatalf("expected no drain state, have ok=%v err=%v", ok, err)
+	}
+
+	state := drainState{Done: map[string]bool{"owner/key": true}}
+	if err := s.saveDrainState(state); err != nil{
+		t.Fatal(err)
+	}
+
+	loaded, ok, err := s.loadDrainState()
+	if err != nil || !ok{
+		t.Fatalf("expected drain state, have ok=%v err=%v", ok, err)
+	}
+	if !loaded.Done["owner/key"]{
+		t.Errorf("expected finished object to be remembered")
+	}
+}
+
+func TestDrainingRejectsStore(t *testing.T){
+	s := newTestServer(t.TempDir())
+	s.drain.active = true
+
+	if err := s.Store("key", bytes.NewReader([]byte("data"))); err != ErrDraining{
+		t.Errorf("have %v want %v", err, ErrDraining)
+	}
+}
+
+func TestDrainWithoutPeers(t *testing.T){
+	s := newTestServer(t.TempDir())
+
+	if err := s.Drain(); err != ErrNoDrainTargets{
+		t.Fatalf("have %v want %v", err, ErrNoDrainTargets)
+	}
+	if _, ok, _ := s.loadDrainState(); ok || s.Draining(){
+		t.Errorf("expected a drain that could not start to leave nothing behind")
+	}
+}
+
+func TestDrainHandsOver(t *testing.T){
+	nodes := startTestCluster(t, 3, WithReplicationFactor(1))
+	owner := nodes[0]
+	if _, err := owner.Put(context.Background(), "docs/a.txt", strings.NewReader("hello drain")); err != nil{
+		t.Fatal(err)
+	}
+
+	var holder, other *Node
+	waitFor(t, "the replica", func() bool{
+		for i, n := range nodes[1:]{
+			if len(replicasOf(t, n.Server(), owner.ID())) == 1{
+				holder, other = n, nodes[2-i]
+				return true
+			}
+		}
+		return false
+	})
+
+	s := holder.Server()
+	if err := s.Drain(); err != nil{
+		t.Fatal(err)
+	}
+	if len(replicasOf(t, other.Server(), owner.ID())) != 1{
+		t.Errorf("expected the replica to be handed to the remaining node")
+	}
+	if _, ok, err := s.loadDrainState(); ok || err != nil{
+		t.Errorf("expected the drain state to be removed once the node left, have ok=%v err=%v", ok, err)
+	}
+	waitFor(t, "the owner to take the drained node off its ring", func() bool{
+		return !owner.Server().ring.Has(holder.ID())
+	})
+}
+
+func TestSpoofedLeaveIgnored(t *testing.T){
+	s := newTestServer(t.TempDir())
+	s.peerIDs["127.0.0.1:4000"] = "n2"
+	s.ring.Add("n2")
+	s.ring.Add("n3")
+
+	if err := s.handleMessageLeave("127.0.0.1:4000", MessageLeave{ID: "n3"}); err == nil{
+		t.Errorf("expected a leave announced for another node to be refused")
+	}
+	if !s.ring.Has("n3") || !s.ring.Has("n2"){
+		t.Fatalf("expected the ring to be left alone, have %v", s.ring.Members())
+	}
+
+	if err := s.handleMessageLeave("127.0.0.1:4000", MessageLeave{ID: "n2"}); err != nil{
+		t.Fatal(err)
+	}
+	if s.ring.Has("n2"){
+		t.Errorf("expected n2 to leave the ring")
+	}
+}
@@ -0,0 +1,482 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+	"github.com/ayushn2/distri_vault.git/p2p"
+)
+
+// Erasure coded files are an alternative to whole replicas. The owner keeps its plaintext copy as usual, but instead
+// of sending the ciphertext to every replica it splits it into DataShards data and ParityShards parity shards and
+// hands each shard to a different node on the ring. Any DataShards of them are enough to rebuild the ciphertext.
+// Shards are regular objects stored under "<hashed key>#<index>", so rebalance, hints and drain move them around
+// like replicas. Anti-entropy leaves them alone, the owner checks on them every RepairInterval instead and rebuilds
+// the ones that went missing.
+
+const (
+	defaultRepairInterval = time.Minute
+	shardFetchTimeout = 2 * time.Second
+)
+
+// StorageMode picks how a file is made redundant, the zero value replicates whole copies
+type StorageMode struct{
+	DataShards int
+	ParityShards int
+}
+
+func ErasureCoded(dataShards int, parityShards int) StorageMode{
+	return StorageMode{DataShards: dataShards, ParityShards: parityShards}
+}
+
+func (m StorageMode) erasureCoded() bool{
+	return m.DataShards > 0
+}
+
+type storeOptions struct{
+	mode *StorageMode
+}
+
+// StoreOption tunes a single Store call
+type StoreOption func(*storeOptions)
+
+// WithStorageMode stores the file in mode, whatever its namespace is configured with
+func WithStorageMode(mode StorageMode) StoreOption{
+	return func(o *storeOptions){
+		o.mode = &mode
+	}
+}
+
+// ShardData describes a shard a peer holds. A shard can be far larger than a message, so Data never goes over the
+// wire with it, the owner pulls it chunk by chunk with MessageGetChunk and fills it in.
+type ShardData struct{
+	Info ErasureInfo
+	Digest string
+	Size int64
+	Data []byte
+}
+
+// MessageGetShards asks which shards of an object the receiver holds, the reply carries the same Seq
+type MessageGetShards struct{
+	Seq uint64
+	ID string
+	Key string
+	Shards int
+}
+
+type MessageShards struct{
+	Seq uint64
+	ID string
+	Key string
+	Shards []ShardData
+}
+
+// namespaceOf returns the part of key before the first slash, keys without one live in the empty namespace
+func namespaceOf(key string) string{
+	if i := strings.Index(key, "/"); i >= 0{
+		return key[:i]
+	}
+	return ""
+}
+
+// storageMode decides how key is stored: the mode passed to Store, the one of its namespace or the default one
+func (s *FileServer) storageMode(key string, opts ...StoreOption) StorageMode{
+	o := storeOptions{}
+	for _, opt := range opts{
+		opt(&o)
+	}
+	if o.mode != nil{
+		return *o.mode
+	}
+	if mode, ok := s.StorageModes[namespaceOf(key)]; ok{
+		return mode
+	}
+	return s.DefaultStorageMode
+}
+
+func (s *FileServer) repairInterval() time.Duration{
+	if s.RepairInterval <= 0{
+		return defaultRepairInterval
+	}
+	return s.RepairInterval
+}
+
+func shardKey(hashedKey string, index int) string{
+	return fmt.Sprintf("%s#%d", hashedKey, index)
+}
+
+func parseShardKey(key string) (string, int, bool){
+	i := strings.LastIndex(key, "#")
+	if i < 0{
+		return "", 0, false
+	}
+	index, err := strconv.Atoi(key[i+1:])
+	if err != nil{
+		return "", 0, false
+	}
+	return key[:i], index, true
+}
+
+// shardHolder returns the node that holds shard index of the object owned by ownerID under ring. Shards go round the
+// ring starting at the object's position, they land on distinct nodes as long as there are enough of them.
+func shardHolder(ring *HashRing, ownerID string, hashedKey string, index int) (string, bool){
+	ids := []string{}
+	for _, id := range ring.Owners(hashedKey, 0){
+		if id != ownerID{
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0{
+		return "", false
+	}
+	return ids[index%len(ids)], true
+}
+
+// erasureCoded reports whether e is our own copy of an erasure coded file, which never leaves this node whole
+func (s *FileServer) erasureCoded(e InventoryEntry) bool{
+	return e.ID == s.ID && e.Erasure != nil
+}
+
+// storeShards encrypts the object, cuts the ciphertext into shards and sends every shard to its holder. A holder
+// that is offline gets its shard through a hint, or through repair once it is back.
+func (s *FileServer) storeShards(ctx context.Context, key string, plain io.Reader, digest string, mode StorageMode, modTime int64) (ErasureInfo, error){
+	ciphertext := new(bytes.Buffer)
+	if _, err := crypto.CopyEncryptConvergent(s.EncKey, digest, plain, ciphertext); err != nil{
+		return ErasureInfo{}, err
+	}
+
+	rs, err := NewReedSolomon(mode.DataShards, mode.ParityShards)
+	if err != nil{
+		return ErasureInfo{}, err
+	}
+	shards := rs.Split(ciphertext.Bytes())
+	if err := rs.Encode(shards); err != nil{
+		return ErasureInfo{}, err
+	}
+
+	info := ErasureInfo{
+		DataShards: mode.DataShards,
+		ParityShards: mode.ParityShards,
+		Size: int64(ciphertext.Len()),
+		Shard: -1,
+	}
+
+	hashedKey := crypto.HashKey(key)
+	for i, shard := range shards{
+		if err := s.sendShard(ctx, hashedKey, info, i, shard, modTime); err != nil{
+			s.logger("erasure").Warn("shard not placed, repair will retry", "key", key, "shard", i, "err", err)
+		}
+	}
+	return info, nil
+}
+
+func (s *FileServer) sendShard(ctx context.Context, hashedKey string, info ErasureInfo, index int, data []byte, modTime int64) error{
+	holder, ok := shardHolder(s.ring, s.ID, hashedKey, index)
+	if !ok{
+		return fmt.Errorf("no peers to hold it")
+	}
+
+	var peer p2p.Peer
+	hint := ""
+	if addr, ok := s.peerAddr(holder); ok{
+		peer, ok = s.peer(addr)
+	}
+	if peer == nil{
+		if peer, ok = s.hintHolder(hashedKey, holder, nil); !ok{
+			return fmt.Errorf("holder %s is offline", holder)
+		}
+		hint = holder
+	}
+
+	info.Shard = index
+	digest := sha256.Sum256(data)
+	msg := Message{
+		Payload: MessageStoreFile{
+			ID: s.ID,
+			Key: shardKey(hashedKey, index),
+			Size: len(data),
+			Digest: hex.EncodeToString(digest[:]),
+			ModTime: modTime,
+			Hint: hint,
+			Erasure: &info,
+		},
+	}
+
+	unlock, err := s.lockPeers(ctx, peer)
+	if err != nil{
+		return err
+	}
+	defer unlock()
+
+	if err := s.send(ctx, peer, &msg); err != nil{
+		return err
+	}
+
+	time.Sleep(time.Millisecond * 5)
+
+	if err := peer.SendContext(ctx, []byte{p2p.IncomingStream}); err != nil{
+		return err
+	}
+	if err := peer.SendContext(ctx, data); err != nil{
+		// The holder is left waiting for the shard, it only gives up on a closed connection
+		peer.Close()
+		return err
+	}
+	return nil
+}
+
+// heldShard is a shard and the peer that holds it
+type heldShard struct{
+	from string
+	shard ShardData
+}
+
+// locateShards asks every peer which shards of one of our objects it holds. It stops waiting once want shards are
+// located, every peer answered, or the timeout hits.
+func (s *FileServer) locateShards(ctx context.Context, hashedKey string, info ErasureInfo, want int) map[int]heldShard{
+	peers := s.allPeers()
+	seq, replies := s.replies.expect(len(peers))
+	defer s.replies.cancel(seq)
+
+	s.multicast(ctx, peers, &Message{
+		Payload: MessageGetShards{
+			Seq: seq,
+			ID: s.ID,
+			Key: hashedKey,
+			Shards: info.TotalShards(),
+		},
+	})
+
+	held := make(map[int]heldShard)
+	timeout := time.After(shardFetchTimeout)
+	for answered := 0; answered < len(peers) && len(held) < want; answered++{
+		select{
+		case reply := <-replies:
+			r := reply.(swarmReply)
+			for _, shard := range r.msg.(MessageShards).Shards{
+				if shard.Info.DataShards != info.DataShards || shard.Info.ParityShards != info.ParityShards{
+					continue
+				}
+				held[shard.Info.Shard] = heldShard{from: r.from, shard: shard}
+			}
+		case <-timeout:
+			return held
+		case <-ctx.Done():
+			return held
+		case <-s.quitch:
+			return held
+		}
+	}
+	return held
+}
+
+// fetchShards locates the shards of one of our objects and returns the valid ones by index, at most want of them.
+// With probe set the shards are only located, no data is transferred.
+func (s *FileServer) fetchShards(ctx context.Context, hashedKey string, info ErasureInfo, want int, probe bool) map[int]ShardData{
+	found := make(map[int]ShardData)
+	for i, h := range s.locateShards(ctx, hashedKey, info, want){
+		if probe{
+			found[i] = h.shard
+			continue
+		}
+		if len(found) == want{
+			break
+		}
+
+		shard := h.shard
+		data, err := s.fetchShardData(ctx, h.from, hashedKey, shard)
+		if err != nil{
+			s.logger("erasure").Warn("fetching shard failed", "peer", h.from, "key", hashedKey, "shard", i, "err", err)
+			continue
+		}
+		digest := sha256.Sum256(data)
+		if hex.EncodeToString(digest[:]) != shard.Digest{
+			s.metrics.scrubFindings.add(1, "corrupt_shard")
+			s.logger("erasure").Warn("dropping corrupt shard", "key", hashedKey, "shard", i)
+			continue
+		}
+		shard.Data = data
+		found[i] = shard
+	}
+	return found
+}
+
+// fetchShardData pulls a shard from addr a chunk at a time, each chunk is well inside p2p.MaxMessageSize
+func (s *FileServer) fetchShardData(ctx context.Context, addr string, hashedKey string, shard ShardData) ([]byte, error){
+	chunkSize := s.chunkSize()
+	data := make([]byte, 0, shard.Size)
+	for i := 0; int64(len(data)) < shard.Size; i++{
+		chunk, err := s.requestChunk(ctx, addr, MessageGetChunk{
+			ID: s.ID,
+			Key: shardKey(hashedKey, shard.Info.Shard),
+			Index: i,
+			ChunkSize: chunkSize,
+		})
+		if err != nil{
+			return nil, err
+		}
+		if len(chunk) == 0 || int64(len(data) + len(chunk)) > shard.Size{
+			return nil, fmt.Errorf("shard is not %d bytes long", shard.Size)
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// reconstruct rebuilds the ciphertext of one of our erasure coded objects from the shards held by the peers
+func (s *FileServer) reconstruct(ctx context.Context, hashedKey string, info ErasureInfo) ([][]byte, *ReedSolomon, error){
+	rs, err := NewReedSolomon(info.DataShards, info.ParityShards)
+	if err != nil{
+		return nil, nil, err
+	}
+
+	found := s.fetchShards(ctx, hashedKey, info, info.DataShards, false)
+	shards := make([][]byte, info.TotalShards())
+	for i, shard := range found{
+		if i < len(shards){
+			shards[i] = shard.Data
+		}
+	}
+	if err := rs.Reconstruct(shards); err != nil{
+		return nil, nil, fmt.Errorf("%s: %d of %d shards found: %w", hashedKey, len(found), info.DataShards, err)
+	}
+	return shards, rs, nil
+}
+
+// getShards brings back our local copy of an erasure coded object from its shards, along with its meta. The digest
+// of the rebuilt copy is checked if meta has one.
+func (s *FileServer) getShards(ctx context.Context, key string, meta Meta) (io.Reader, error){
+	s.logger("erasure").Debug("file not on disk, rebuilding it from shards", "key", key)
+
+	shards, rs, err := s.reconstruct(ctx, crypto.HashKey(key), *meta.Erasure)
+	if err != nil{
+		return nil, err
+	}
+	ciphertext, err := rs.Join(shards, meta.Erasure.Size)
+	if err != nil{
+		return nil, err
+	}
+
+	if _, err := s.store.WriteDecryptContext(ctx, s.ID, s.EncKey, key, bytes.NewReader(ciphertext)); err != nil{
+		return nil, err
+	}
+	digest, err := s.store.Digest(s.ID, key)
+	if err != nil{
+		return nil, err
+	}
+	if len(meta.Digest) != 0 && digest != meta.Digest{
+		s.store.Delete(s.ID, key)
+		return nil, fmt.Errorf("rebuilt copy of (%s) does not match its digest", key)
+	}
+	meta.Digest = digest
+	if err := s.store.WriteMeta(s.ID, key, meta); err != nil{
+		return nil, err
+	}
+
+	_, r, err := s.store.Read(s.ID, key)
+	return r, err
+}
+
+func (s *FileServer) handleMessageGetShards(from string, msg MessageGetShards) error{
+	reply := MessageShards{Seq: msg.Seq, ID: msg.ID, Key: msg.Key}
+
+	for i := 0; i < msg.Shards && i < maxShards; i++{
+		key := shardKey(msg.Key, i)
+		meta, err := s.store.ReadMeta(msg.ID, key)
+		if err != nil || meta.Deleted || meta.Erasure == nil || !s.store.Has(msg.ID, key){
+			continue
+		}
+
+		reply.Shards = append(reply.Shards, ShardData{Info: *meta.Erasure, Digest: meta.Digest, Size: meta.Size})
+	}
+
+	return s.sendMessage(from, &Message{Payload: reply})
+}
+
+func (s *FileServer) handleMessageShards(from string, msg MessageShards){
+	s.replies.deliver(msg.Seq, swarmReply{from: from, msg: msg})
+}
+
+func (s *FileServer) repairLoop(){
+	ticker := time.NewTicker(s.repairInterval())
+	defer ticker.Stop()
+
+	for{
+		select{
+		case <-ticker.C:
+			if err := s.repairShards(); err != nil{
+				s.logger("erasure").Warn("shard repair error", "err", err)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// repairShards checks every erasure coded object we own and rebuilds the shards its holders are missing
+func (s *FileServer) repairShards() error{
+	inventory, err := s.store.Inventory()
+	if err != nil{
+		return err
+	}
+
+	for _, e := range inventory{
+		if e.Deleted || !s.erasureCoded(e){
+			continue
+		}
+		if err := s.repairObject(e); err != nil{
+			s.logger("erasure").Warn("repair failed", "key", e.Key, "err", err)
+		}
+	}
+	return nil
+}
+
+func (s *FileServer) repairObject(e InventoryEntry) error{
+	ctx := context.Background()
+	hashedKey := crypto.HashKey(e.Key)
+	info := *e.Erasure
+
+	present := s.fetchShards(ctx, hashedKey, info, info.TotalShards(), true)
+	missing := []int{}
+	for i := 0; i < info.TotalShards(); i++{
+		if _, ok := present[i]; !ok{
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0{
+		return nil
+	}
+
+	s.metrics.scrubFindings.add(int64(len(missing)), "missing_shard")
+	s.logger("erasure").Info("repairing shards", "key", e.Key, "missing", len(missing))
+
+	shards, _, err := s.reconstruct(ctx, hashedKey, info)
+	if err == nil{
+		for _, i := range missing{
+			if err := s.sendShard(ctx, hashedKey, info, i, shards[i], e.ModTime); err != nil{
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Too much is gone to rebuild the ciphertext, encode our plaintext again. The encryption is convergent so this
+	// gives back the very same shards, they carry a newer timestamp all the same so they win over any leftovers.
+	_, r, err := s.store.Read(s.ID, e.Key)
+	if err != nil{
+		return err
+	}
+	if rc, ok := r.(io.ReadCloser); ok{
+		defer rc.Close()
+	}
+	_, err = s.storeShards(ctx, e.Key, r, e.Digest, StorageMode{DataShards: info.DataShards, ParityShards: info.ParityShards}, s.clock.Now())
+	return err
+}
@@ -0,0 +1,99 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+	"github.com/ayushn2/distri_vault.git/p2p"
+)
+
+func TestStorageMode(t *testing.T){
+	s := newTestServer(t.TempDir())
+	s.StorageModes = map[string]StorageMode{"archive": ErasureCoded(4, 2)}
+
+	if mode := s.storageMode("archive/2019.tar"); mode != ErasureCoded(4, 2){
+		t.Errorf("expected the namespace mode, have %+v", mode)
+	}
+	if mode := s.storageMode("notes.txt"); mode.erasureCoded(){
+		t.Errorf("expected replication by default, have %+v", mode)
+	}
+	if mode := s.storageMode("notes.txt", WithStorageMode(ErasureCoded(2, 1))); mode != ErasureCoded(2, 1){
+		t.Errorf("expected the mode passed to Store, have %+v", mode)
+	}
+	if mode := s.storageMode("archive/2019.tar", WithStorageMode(StorageMode{})); mode.erasureCoded(){
+		t.Errorf("expected a file to be able to opt out of its namespace mode")
+	}
+}
+
+func TestShardPlacement(t *testing.T){
+	ring := NewHashRing(defaultVirtualNodes, "owner")
+	for _, id := range []string{"a", "b", "c", "d", "e"}{
+		ring.Add(id)
+	}
+
+	s := newTestServer(t.TempDir())
+	hashedKey := crypto.HashKey("archive/2019.tar")
+
+	holders := map[string]bool{}
+	for i := 0; i < 5; i++{
+		placement := s.placement(ring, "owner", shardKey(hashedKey, i))
+		if len(placement) != 1 || placement[0] == "owner"{
+			t.Fatalf("shard %d placed on %v", i, placement)
+		}
+		holders[placement[0]] = true
+	}
+	if len(holders) != 5{
+		t.Errorf("expected five shards on five distinct nodes, have %v", holders)
+	}
+
+	if base, index, ok := parseShardKey(shardKey(hashedKey, 3)); !ok || base != hashedKey || index != 3{
+		t.Errorf("shard key did not parse back, have %s %d %v", base, index, ok)
+	}
+	if _, _, ok := parseShardKey(hashedKey); ok{
+		t.Errorf("a plain key is not a shard")
+	}
+}
+
+func TestErasureRebuildInChunks(t *testing.T){
+	nodes := startTestCluster(t, 4)
+	s := nodes[0].Server()
+	ctx := context.Background()
+
+	// Every shard is larger than a message can be, it has to come back a chunk at a time
+	data := make([]byte, 2*p2p.MaxMessageSize + 1<<20)
+	rand.Read(data)
+	if _, err := nodes[0].Put(ctx, "archive/big.bin", bytes.NewReader(data), WithStorageMode(ErasureCoded(2, 1))); err != nil{
+		t.Fatal(err)
+	}
+	versions, err := s.Versions("archive/big.bin")
+	if err != nil || len(versions) != 1 || versions[0].Erasure == nil{
+		t.Fatalf("expected an erasure coded version, have %+v %v", versions, err)
+	}
+	vkey := versionKey("archive/big.bin", versions[0].ID)
+	waitFor(t, "the shards to be placed", func() bool{
+		return len(s.fetchShards(ctx, crypto.HashKey(vkey), *versions[0].Erasure, 3, true)) == 3
+	})
+
+	if err := s.store.Delete(s.ID, vkey); err != nil{
+		t.Fatal(err)
+	}
+	if s.store.Has(s.ID, vkey){
+		t.Fatal("expected the local copy to be gone")
+	}
+	rc, err := nodes[0].Get(ctx, "archive/big.bin")
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	have, err := io.ReadAll(rc)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, data){
+		t.Errorf("rebuilt %d bytes that don't match the %d stored", len(have), len(data))
+	}
+}
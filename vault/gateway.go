@@ -0,0 +1,272 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The HTTP gateway exposes the files of a node to applications that can't link against it:
+//
+//	PUT    /objects/{key}    store the request body as a new version of key
+//	GET    /objects/{key}    read the latest version, Range and If-None-Match are honoured
+//	HEAD   /objects/{key}    the headers of a GET without reading the file
+//	DELETE /objects/{key}    delete key with all its versions
+//	GET    /objects?prefix=&limit=&cursor=    list keys, a page at a time
+//	       /dav/             the keys as a WebDAV tree, see webdav.go
+//
+// Files are identified by the sha256 of their contents, which is the ETag. Errors come back as a JSON body with the
+// same Error and Code fields as the control socket.
+
+const (
+	defaultListLimit = 1000
+	maxListLimit = 1000
+)
+
+// ListPage is one page of a listing, NextCursor is passed as cursor to get the next one
+type ListPage struct{
+	Objects []ObjectInfo
+	NextCursor string `json:",omitempty"`
+	Truncated bool
+}
+
+type gateway struct{
+	s *FileServer
+}
+
+// Gateway returns the HTTP handler of the gateway, it is served on HTTPAddr if that is set
+func (s *FileServer) Gateway() http.Handler{
+	g := &gateway{s: s}
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /objects/{key...}", g.put)
+	mux.HandleFunc("GET /objects/{key...}", g.get)
+	mux.HandleFunc("HEAD /objects/{key...}", g.head)
+	mux.HandleFunc("DELETE /objects/{key...}", g.delete)
+	mux.HandleFunc("GET /objects", g.list)
+	mux.Handle(davPrefix+"/", s.WebDAV())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request){
+		writeHTTPError(w, http.StatusNotFound, "not_found", fmt.Errorf("no such endpoint %s %s", r.Method, r.URL.Path))
+	})
+	return withTraceparent(mux)
+}
+
+func (s *FileServer) startGateway() error{
+	if len(s.HTTPAddr) == 0{
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", s.HTTPAddr)
+	if err != nil{
+		return err
+	}
+	s.gateway = &http.Server{
+		Handler: s.Gateway(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func(){
+		if err := s.gateway.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed){
+			s.logger("gateway").Error("http gateway error", "err", err)
+		}
+	}()
+	s.logger("gateway").Info("http gateway listening", "addr", ln.Addr().String())
+	return nil
+}
+
+func (s *FileServer) stopGateway(){
+	if s.gateway != nil{
+		s.gateway.Close()
+	}
+}
+
+func writeJSONResponse(w http.ResponseWriter, status int, v any){
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, code string, err error){
+	writeJSONResponse(w, status, ControlResponse{Error: err.Error(), Code: code})
+}
+
+// writeError answers with the status that goes with err
+func writeError(w http.ResponseWriter, err error){
+	code := errorCode(err)
+	status := http.StatusInternalServerError
+	switch code{
+	case "not_found", "deleted":
+		status = http.StatusNotFound
+	case "conflict":
+		status = http.StatusConflict
+	case "draining":
+		status = http.StatusServiceUnavailable
+	}
+	writeHTTPError(w, status, code, err)
+}
+
+func etag(info ObjectInfo) string{
+	return strconv.Quote(info.Digest)
+}
+
+func setObjectHeaders(w http.ResponseWriter, info ObjectInfo){
+	w.Header().Set("ETag", etag(info))
+	w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if len(info.Version) != 0{
+		w.Header().Set("X-Version", info.Version)
+	}
+}
+
+// requestKey is the key a request is about, a request without one is answered with an error
+func requestKey(w http.ResponseWriter, r *http.Request) (string, bool){
+	key := r.PathValue("key")
+	if len(key) == 0{
+		writeHTTPError(w, http.StatusBadRequest, "bad_request", errors.New("missing key"))
+		return "", false
+	}
+	return key, true
+}
+
+func (g *gateway) put(w http.ResponseWriter, r *http.Request){
+	key, ok := requestKey(w, r)
+	if !ok{
+		return
+	}
+	if err := g.s.StoreContext(r.Context(), key, r.Body); err != nil{
+		writeError(w, err)
+		return
+	}
+	info, err := g.s.Stat(key)
+	if err != nil{
+		writeError(w, err)
+		return
+	}
+	setObjectHeaders(w, info)
+	writeJSONResponse(w, http.StatusCreated, info)
+}
+
+func (g *gateway) get(w http.ResponseWriter, r *http.Request){
+	key, ok := requestKey(w, r)
+	if !ok{
+		return
+	}
+	info, err := g.s.Stat(key)
+	if err != nil{
+		writeError(w, err)
+		return
+	}
+
+	// The ETag alone answers a conditional request, without reading the file
+	if match := r.Header.Get("If-None-Match"); len(match) != 0 && (match == etag(info) || match == "*"){
+		setObjectHeaders(w, info)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	rd, err := g.s.GetContext(r.Context(), key)
+	if err != nil{
+		writeError(w, err)
+		return
+	}
+	if rc, ok := rd.(io.ReadCloser); ok{
+		defer rc.Close()
+	}
+
+	content, err := readSeeker(rd)
+	if err != nil{
+		writeError(w, err)
+		return
+	}
+
+	setObjectHeaders(w, info)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", info.ModTime, content)
+}
+
+// readSeeker returns the file rd as something ServeContent can serve ranges from, a file rebuilt from shards comes back
+// as a plain reader and is read into memory
+func readSeeker(rd io.Reader) (io.ReadSeeker, error){
+	if content, ok := rd.(io.ReadSeeker); ok{
+		return content, nil
+	}
+	b, err := io.ReadAll(rd)
+	if err != nil{
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
+
+func (g *gateway) head(w http.ResponseWriter, r *http.Request){
+	key, ok := requestKey(w, r)
+	if !ok{
+		return
+	}
+	info, err := g.s.Stat(key)
+	if err != nil{
+		// A HEAD response has no body, the status says it all
+		writeError(w, err)
+		return
+	}
+	setObjectHeaders(w, info)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *gateway) delete(w http.ResponseWriter, r *http.Request){
+	key, ok := requestKey(w, r)
+	if !ok{
+		return
+	}
+	if _, err := g.s.Stat(key); err != nil{
+		writeError(w, err)
+		return
+	}
+	if err := g.s.DeleteContext(r.Context(), key); err != nil{
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *gateway) list(w http.ResponseWriter, r *http.Request){
+	query := r.URL.Query()
+
+	limit := defaultListLimit
+	if v := query.Get("limit"); len(v) != 0{
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0{
+			writeHTTPError(w, http.StatusBadRequest, "bad_request", fmt.Errorf("limit must be a positive number, have %q", v))
+			return
+		}
+		limit = min(n, maxListLimit)
+	}
+
+	objects, err := g.s.List(query.Get("prefix"))
+	if err != nil{
+		writeError(w, err)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, paginate(objects, query.Get("cursor"), limit))
+}
+
+// paginate returns the page of limit objects after the key cursor, objects are sorted by key
+func paginate(objects []ObjectInfo, cursor string, limit int) ListPage{
+	start := 0
+	for start < len(objects) && len(cursor) != 0 && objects[start].Key <= cursor{
+		start++
+	}
+
+	page := ListPage{Objects: objects[start:]}
+	if len(page.Objects) > limit{
+		page.Objects = page.Objects[:limit]
+		page.Truncated = true
+		page.NextCursor = page.Objects[limit-1].Key
+	}
+	return page
+}
@@ -0,0 +1,129 @@
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func do(t *testing.T, method string, url string, body string, header ...string) *http.Response{
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil{
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2{
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil{
+		t.Fatal(err)
+	}
+	t.Cleanup(func(){ resp.Body.Close() })
+	return resp
+}
+
+func readBody(t *testing.T, resp *http.Response) string{
+	b, err := io.ReadAll(resp.Body)
+	if err != nil{
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestGatewayObjects(t *testing.T){
+	s := newTestServer(t.TempDir())
+	srv := httptest.NewServer(s.Gateway())
+	defer srv.Close()
+	url := srv.URL + "/objects/docs/readme.txt"
+
+	resp := do(t, "PUT", url, "hello gateway")
+	if resp.StatusCode != http.StatusCreated{
+		t.Fatalf("put returned %d: %s", resp.StatusCode, readBody(t, resp))
+	}
+	var info ObjectInfo
+	json.NewDecoder(resp.Body).Decode(&info)
+	etag := resp.Header.Get("ETag")
+	if info.Key != "docs/readme.txt" || info.Size != 13 || etag != fmt.Sprintf("%q", info.Digest){
+		t.Errorf("unexpected put response %+v with ETag %s", info, etag)
+	}
+
+	resp = do(t, "GET", url, "")
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || body != "hello gateway" || resp.Header.Get("ETag") != etag{
+		t.Errorf("get returned %d %q", resp.StatusCode, body)
+	}
+
+	resp = do(t, "GET", url, "", "Range", "bytes=6-")
+	if body := readBody(t, resp); resp.StatusCode != http.StatusPartialContent || body != "gateway"{
+		t.Errorf("range get returned %d %q", resp.StatusCode, body)
+	}
+
+	if resp = do(t, "GET", url, "", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified{
+		t.Errorf("conditional get returned %d", resp.StatusCode)
+	}
+
+	resp = do(t, "HEAD", url, "")
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 13 || resp.Header.Get("ETag") != etag{
+		t.Errorf("head returned %d with length %d", resp.StatusCode, resp.ContentLength)
+	}
+
+	if resp = do(t, "DELETE", url, ""); resp.StatusCode != http.StatusNoContent{
+		t.Errorf("delete returned %d", resp.StatusCode)
+	}
+	resp = do(t, "GET", url, "")
+	var e ControlResponse
+	json.NewDecoder(resp.Body).Decode(&e)
+	if resp.StatusCode != http.StatusNotFound || e.Code != "deleted" || resp.Header.Get("Content-Type") != "application/json"{
+		t.Errorf("get after delete returned %d %+v", resp.StatusCode, e)
+	}
+
+	if resp = do(t, "GET", srv.URL+"/objects/missing", ""); resp.StatusCode != http.StatusNotFound{
+		t.Errorf("get of a missing key returned %d", resp.StatusCode)
+	}
+	if resp = do(t, "PUT", srv.URL+"/objects/", "x"); resp.StatusCode != http.StatusBadRequest{
+		t.Errorf("put without a key returned %d", resp.StatusCode)
+	}
+}
+
+func TestGatewayList(t *testing.T){
+	s := newTestServer(t.TempDir())
+	srv := httptest.NewServer(s.Gateway())
+	defer srv.Close()
+
+	for _, key := range []string{"a/1", "a/2", "a/3", "b/1"}{
+		if resp := do(t, "PUT", srv.URL+"/objects/"+key, key); resp.StatusCode != http.StatusCreated{
+			t.Fatalf("put %s returned %d", key, resp.StatusCode)
+		}
+	}
+
+	keys := []string{}
+	cursor := ""
+	for pages := 0; ; pages++{
+		if pages > 3{
+			t.Fatalf("listing doesn't end")
+		}
+		resp := do(t, "GET", srv.URL+"/objects?prefix=a/&limit=2&cursor="+cursor, "")
+		var page ListPage
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil{
+			t.Fatal(err)
+		}
+		for _, o := range page.Objects{
+			keys = append(keys, o.Key)
+		}
+		if !page.Truncated{
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if strings.Join(keys, ",") != "a/1,a/2,a/3"{
+		t.Errorf("listing returned %v", keys)
+	}
+
+	if resp := do(t, "GET", srv.URL+"/objects?limit=zero", ""); resp.StatusCode != http.StatusBadRequest{
+		t.Errorf("bad limit returned %d", resp.StatusCode)
+	}
+}
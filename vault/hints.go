@@ -0,0 +1,251 @@
+package vault
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+	"github.com/ayushn2/distri_vault.git/p2p"
+	"github.com/ayushn2/distri_vault.git/store"
+)
+
+// Hinted handoff keeps writes available while a replica owner is offline. The writer hands the replica to another
+// node together with a hint naming the real owner, that node keeps it aside and replays it once the owner says hello again.
+
+const (
+	hintsDir = ".hints"
+	defaultHintTTL = 3 * time.Hour
+	defaultHintMaxBytes = 1 << 30
+	hintAckTimeout = 5 * time.Second
+	maxHintSweepInterval = 10 * time.Minute
+)
+
+type replicaTarget struct{
+	peer p2p.Peer
+	// hint is the ID of the offline node this replica is held for, empty for a regular replica
+	hint string
+}
+
+// replicaTargets returns where a new object must be replicated to, substituting a hint holder for every replica
+// owner that is not connected. With full replication every connected peer already gets a copy, so there is nobody
+// left to hold a hint and offline nodes catch up through anti-entropy instead.
+func (s *FileServer) replicaTargets(hashedKey string) []replicaTarget{
+	targets := []replicaTarget{}
+	used := make(map[string]bool)
+
+	if s.replicationFactor() <= 0{
+		for _, peer := range s.allPeers(){
+			targets = append(targets, replicaTarget{peer: peer})
+		}
+		return targets
+	}
+
+	offline := []string{}
+	for _, id := range s.placement(s.ring, s.ID, hashedKey){
+		addr, ok := s.peerAddr(id)
+		if !ok{
+			offline = append(offline, id)
+			continue
+		}
+		if peer, ok := s.peer(addr); ok{
+			targets = append(targets, replicaTarget{peer: peer})
+			used[addr] = true
+		}
+	}
+
+	for _, id := range offline{
+		peer, ok := s.hintHolder(hashedKey, id, used)
+		if !ok{
+			s.logger("hints").Warn("no node available to hold a hint for offline replica", "id", id, "key", hashedKey)
+			continue
+		}
+		used[peer.RemoteAddr().String()] = true
+		targets = append(targets, replicaTarget{peer: peer, hint: id})
+	}
+
+	return targets
+}
+
+// hintHolder picks the next connected node on the ring that isn't already receiving this object
+func (s *FileServer) hintHolder(hashedKey string, offlineID string, used map[string]bool) (p2p.Peer, bool){
+	for _, id := range s.ring.Owners(hashedKey, 0){
+		if id == s.ID || id == offlineID{
+			continue
+		}
+		addr, ok := s.peerAddr(id)
+		if !ok || used[addr]{
+			continue
+		}
+		if peer, ok := s.peer(addr); ok{
+			return peer, true
+		}
+	}
+	return nil, false
+}
+
+func (s *FileServer) hintTTL() time.Duration{
+	if s.HintTTL <= 0{
+		return defaultHintTTL
+	}
+	return s.HintTTL
+}
+
+func (s *FileServer) hintMaxBytes() int64{
+	if s.HintMaxBytes <= 0{
+		return defaultHintMaxBytes
+	}
+	return s.HintMaxBytes
+}
+
+// hintStore holds the hinted replicas for a single offline node
+func (s *FileServer) hintStore(id string) *store.Store{
+	return store.NewStore(store.StoreOpts{
+		Root: filepath.Join(s.store.Root, hintsDir, id),
+		PathTransformFunc: s.store.PathTransformFunc,
+	})
+}
+
+// sweepHints drops expired hints and returns the number of bytes the remaining ones take on disk
+func (s *FileServer) sweepHints() (int64, error){
+	dirs, err := os.ReadDir(filepath.Join(s.store.Root, hintsDir))
+	if os.IsNotExist(err){
+		return 0, nil
+	}
+	if err != nil{
+		return 0, err
+	}
+
+	var total int64
+	for _, dir := range dirs{
+		if !dir.IsDir(){
+			continue
+		}
+		hints := s.hintStore(dir.Name())
+		inventory, err := hints.Inventory()
+		if err != nil{
+			return 0, err
+		}
+		for _, e := range inventory{
+			if s.hintExpired(e){
+				if err := hints.Delete(e.ID, e.Key); err != nil{
+					return 0, err
+				}
+				continue
+			}
+			total += e.Size
+		}
+	}
+	s.hintBytes.Store(total)
+	return total, nil
+}
+
+// hintExpired reports whether the hint was taken longer than the TTL ago, hints from before that was recorded count
+// from the time of the object
+func (s *FileServer) hintExpired(e InventoryEntry) bool{
+	taken := e.Hinted
+	if taken == 0{
+		taken = e.ModTime
+	}
+	return time.Since(time.Unix(0, taken)) > s.hintTTL()
+}
+
+// hintLoop drops expired hints even when no hint arrives and their node never comes back
+func (s *FileServer) hintLoop(){
+	ticker := time.NewTicker(min(s.hintTTL(), maxHintSweepInterval))
+	defer ticker.Stop()
+
+	for{
+		if _, err := s.sweepHints(); err != nil{
+			s.logger("hints").Warn("hint sweep error", "err", err)
+		}
+		select{
+		case <-ticker.C:
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// storeHint keeps a replica that was sent to us on behalf of an offline node
+func (s *FileServer) storeHint(peer p2p.Peer, msg MessageStoreFile) error{
+	defer peer.CloseStream()
+
+	// The hint names a directory under the hints, so it has to be a node ID and nothing that walks out of it
+	if !crypto.ValidID(msg.Hint){
+		io.Copy(io.Discard, io.LimitReader(peer, int64(msg.Size)))
+		return fmt.Errorf("hint for %q rejected, not a node ID", msg.Hint)
+	}
+
+	usage := s.hintBytes.Load()
+	if usage+int64(msg.Size) > s.hintMaxBytes(){
+		io.Copy(io.Discard, io.LimitReader(peer, int64(msg.Size)))
+		return fmt.Errorf("hint for %s rejected, hints already take %d bytes", msg.Hint, usage)
+	}
+
+	hints := s.hintStore(msg.Hint)
+	n, err := hints.Write(msg.ID, msg.Key, io.LimitReader(peer, int64(msg.Size)))
+	if err != nil{
+		return err
+	}
+	s.hintBytes.Add(n)
+
+	s.logger("hints").Info("holding hint for offline node", "id", msg.Hint, "key", msg.Key, "bytes", n)
+
+	return hints.WriteMeta(msg.ID, msg.Key, Meta{
+		Size: n,
+		Digest: msg.Digest,
+		ModTime: msg.ModTime,
+		Erasure: msg.Erasure,
+		Hinted: time.Now().UnixNano(),
+	})
+}
+
+// replayHints hands every hint held for id over to it now that it is back, dropping each one once acknowledged
+func (s *FileServer) replayHints(addr string, id string){
+	hints := s.hintStore(id)
+	inventory, err := hints.Inventory()
+	if err != nil || len(inventory) == 0{
+		return
+	}
+
+	peer, ok := s.peer(addr)
+	if !ok{
+		return
+	}
+
+	replayed := 0
+	for _, e := range inventory{
+		if s.hintExpired(e){
+			hints.Delete(e.ID, e.Key)
+			continue
+		}
+
+		objectID := e.ID + "/" + e.Key
+		ack := s.acks.expect(addr, objectID)
+		if _, err := s.pushFrom(hints, peer, e, true); err != nil{
+			s.acks.cancel(addr, objectID)
+			s.logger("hints").Warn("replaying hint failed", "id", id, "peer", addr, "key", e.Key, "err", err)
+			return
+		}
+
+		select{
+		case <-ack:
+			if err := hints.Delete(e.ID, e.Key); err != nil{
+				s.logger("hints").Warn("could not drop replayed hint", "key", e.Key, "err", err)
+			} else{
+				s.hintBytes.Add(-e.Size)
+			}
+			replayed++
+		case <-time.After(hintAckTimeout):
+			s.acks.cancel(addr, objectID)
+			s.logger("hints").Warn("hint was not acknowledged, keeping it", "id", id, "peer", addr, "key", e.Key)
+		case <-s.quitch:
+			return
+		}
+	}
+
+	s.logger("hints").Info("replayed hints", "id", id, "peer", addr, "hints", replayed)
+}
@@ -0,0 +1,123 @@
+package vault
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+	"github.com/ayushn2/distri_vault.git/p2p"
+)
+
+func TestSweepHintsExpires(t *testing.T){
+	s := newTestServer(t.TempDir())
+	s.HintTTL = time.Hour
+
+	// An old object taken as a hint just now is fresh, the TTL counts from the hint
+	old := time.Now().Add(-2 * time.Hour).UnixNano()
+	hints := s.hintStore("offline")
+	for key, meta := range map[string]Meta{
+		"fresh": {ModTime: old, Hinted: time.Now().UnixNano()},
+		"stale": {ModTime: old, Hinted: old},
+	}{
+		n, err := hints.Write("owner", key, bytes.NewReader([]byte("some bytes")))
+		if err != nil{
+			t.Fatal(err)
+		}
+		meta.Size = n
+		if err := hints.WriteMeta("owner", key, meta); err != nil{
+			t.Fatal(err)
+		}
+	}
+
+	usage, err := s.sweepHints()
+	if err != nil{
+		t.Fatal(err)
+	}
+	if usage != int64(len("some bytes")){
+		t.Errorf("have usage %d want %d", usage, len("some bytes"))
+	}
+	if hints.Has("owner", "stale") || !hints.Has("owner", "fresh"){
+		t.Errorf("expected only the stale hint to be dropped")
+	}
+
+	// Hints are bookkeeping and must not show up as objects of the node itself
+	inventory, err := s.store.Inventory()
+	if err != nil{
+		t.Fatal(err)
+	}
+	if len(inventory) != 0{
+		t.Errorf("have %d inventory entries want 0", len(inventory))
+	}
+}
+
+func TestReplayHints(t *testing.T){
+	addr := freeAddr(t)
+	holder := startTestNode(t, WithListenAddr(addr))
+	s := holder.Server()
+
+	// A replica was handed to us while the node "back" was offline
+	owner, key := crypto.GenerateID(), crypto.HashKey("file")
+	data := "ciphertext of the replica"
+	hints := s.hintStore("back")
+	n, err := hints.Write(owner, key, strings.NewReader(data))
+	if err != nil{
+		t.Fatal(err)
+	}
+	if err := hints.WriteMeta(owner, key, Meta{Size: n, Digest: "digest", ModTime: 1, Hinted: time.Now().UnixNano()}); err != nil{
+		t.Fatal(err)
+	}
+
+	back := startTestNode(t, WithID("back"), WithBootstrap(addr))
+	waitFor(t, "the hint to be replayed", func() bool{
+		return len(replicasOf(t, back.Server(), owner)) == 1
+	})
+	waitFor(t, "the replayed hint to be dropped", func() bool{
+		return !hints.Has(owner, key)
+	})
+	if !back.Server().store.Has(owner, key){
+		t.Errorf("expected the node to hold the replica under its hashed key")
+	}
+}
+
+// pipePeer is a peer whose stream was not opened by a transport, so there is nothing to close
+type pipePeer struct{
+	*p2p.TCPPeer
+}
+
+func (p pipePeer) CloseStream(){}
+
+func TestStoreHintRejectsPaths(t *testing.T){
+	s := newTestServer(t.TempDir())
+	data := []byte("ciphertext of the replica")
+	hint := func(id string) error{
+		conn, other := net.Pipe()
+		t.Cleanup(func(){ other.Close() })
+		go other.Write(data)
+		return s.storeHint(pipePeer{p2p.NewTCPPeer(conn, false)}, MessageStoreFile{ID: "owner", Key: "hashedkey", Size: len(data), Hint: id})
+	}
+
+	for _, id := range []string{"..", "../..", "a/b", "back", ""}{
+		if err := hint(id); err == nil{
+			t.Errorf("expected the hint for %q to be rejected", id)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Join(s.store.Root, hintsDir)); len(entries) != 0{
+		t.Errorf("expected no hints to be taken, have %d", len(entries))
+	}
+
+	id := crypto.GenerateID()
+	if err := hint(id); err != nil{
+		t.Fatal(err)
+	}
+	if !s.hintStore(id).Has("owner", "hashedkey"){
+		t.Errorf("expected the hint to be held")
+	}
+	if have := s.hintBytes.Load(); have != int64(len(data)){
+		t.Errorf("have hint usage %d want %d", have, len(data))
+	}
+}
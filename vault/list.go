@@ -0,0 +1,176 @@
+package vault
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("file not found")
+
+// ObjectInfo describes the latest version of a key
+type ObjectInfo struct{
+	Key string
+	Size int64
+	ModTime time.Time
+	Digest string
+	// Version is the ID of the latest version, empty for files written before versioning
+	Version string
+	Versions int
+	// Conflict is set when the key has concurrent versions, the info is then about the last writer's one
+	Conflict bool
+}
+
+func objectInfo(key string, versions []Version) ObjectInfo{
+	siblings := heads(versions)
+	latest, _ := LastWriterWins(key, siblings)
+	return ObjectInfo{
+		Key: key,
+		Size: latest.Size,
+		ModTime: latest.ModTime,
+		Digest: latest.Digest,
+		Version: latest.ID,
+		Versions: len(versions),
+		Conflict: len(siblings) > 1,
+	}
+}
+
+// Stat describes the latest version of key without reading it
+func (s *FileServer) Stat(key string) (ObjectInfo, error){
+	versions, err := s.versions(key)
+	if err != nil{
+		return ObjectInfo{}, err
+	}
+	if len(versions) != 0{
+		return objectInfo(key, versions), nil
+	}
+
+	// Files written before versioning live under their plain key
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if err != nil{
+		return ObjectInfo{}, ErrNotFound
+	}
+	if meta.Deleted{
+		return ObjectInfo{}, ErrDeleted
+	}
+	return ObjectInfo{
+		Key: key,
+		Size: meta.Size,
+		ModTime: time.Unix(0, meta.ModTime),
+		Digest: meta.Digest,
+	}, nil
+}
+
+// List describes every key we own that starts with prefix, sorted by key. Keys stored before their version records
+// named the key aren't listed.
+func (s *FileServer) List(prefix string) ([]ObjectInfo, error){
+	indexes, err := s.store.VersionIndexes(s.ID)
+	if err != nil{
+		return nil, err
+	}
+
+	objects := []ObjectInfo{}
+	for _, versions := range indexes{
+		key := ""
+		for _, v := range versions{
+			if len(v.Key) != 0{
+				key = v.Key
+			}
+		}
+		if len(key) == 0 || !strings.HasPrefix(key, prefix){
+			continue
+		}
+		objects = append(objects, objectInfo(key, versions))
+	}
+
+	sort.Slice(objects, func(i, j int) bool{ return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Keys are flat, but read with slashes as separators they form a tree: "docs/2024/a.txt" is the file a.txt in the
+// directory 2024 in docs. A directory exists while a key is under it, an empty one is kept as a marker key ending in
+// a slash, the way S3 tools create folders.
+
+// DirEntry is a file or a directory in the tree view of the keys
+type DirEntry struct{
+	Name string
+	Dir bool
+	// Object is the file, for a directory the ModTime of its newest file
+	Object ObjectInfo
+}
+
+// dirMarker is the key that keeps the directory dir in existence while it is empty
+func dirMarker(dir string) string{
+	return dir + "/"
+}
+
+// ReadDir lists the files and directories directly in dir, sorted by name. The root is "".
+func (s *FileServer) ReadDir(dir string) ([]DirEntry, error){
+	prefix := ""
+	if len(dir) != 0{
+		prefix = dirMarker(dir)
+	}
+	objects, err := s.List(prefix)
+	if err != nil{
+		return nil, err
+	}
+	if len(objects) == 0 && len(dir) != 0{
+		return nil, ErrNotFound
+	}
+
+	entries := []DirEntry{}
+	for _, o := range objects{
+		name, _, isDir := strings.Cut(o.Key[len(prefix):], "/")
+		if len(name) == 0{
+			continue
+		}
+		if !isDir{
+			entries = append(entries, DirEntry{Name: name, Object: o})
+			continue
+		}
+
+		// Keys under the same directory are next to each other
+		if n := len(entries); n != 0 && entries[n-1].Dir && entries[n-1].Name == name{
+			if o.ModTime.After(entries[n-1].Object.ModTime){
+				entries[n-1].Object.ModTime = o.ModTime
+			}
+			continue
+		}
+		entries = append(entries, DirEntry{Name: name, Dir: true, Object: ObjectInfo{Key: prefix + name, ModTime: o.ModTime}})
+	}
+	sort.Slice(entries, func(i, j int) bool{ return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// StatPath describes the file or directory at path in the tree view, a key that is a file wins over a directory of
+// the same name
+func (s *FileServer) StatPath(path string) (DirEntry, error){
+	name := path[strings.LastIndex(path, "/")+1:]
+	if len(path) == 0{
+		return DirEntry{Dir: true}, nil
+	}
+
+	info, err := s.Stat(path)
+	if err == nil{
+		return DirEntry{Name: name, Object: info}, nil
+	}
+	if !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrDeleted){
+		return DirEntry{}, err
+	}
+
+	objects, err := s.List(dirMarker(path))
+	if err != nil{
+		return DirEntry{}, err
+	}
+	if len(objects) == 0{
+		return DirEntry{}, ErrNotFound
+	}
+	entry := DirEntry{Name: name, Dir: true, Object: ObjectInfo{Key: path}}
+	for _, o := range objects{
+		if o.ModTime.After(entry.Object.ModTime){
+			entry.Object.ModTime = o.ModTime
+		}
+	}
+	return entry, nil
+}
@@ -0,0 +1,164 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A node logs through FileServerOpts.Logger at the levels of FileServerOpts.LogLevels. Every record carries the node
+// ID and the component it comes from, and where it makes sense the peer address, key and transfer it is about.
+// log_level is the level of every component, log_levels sets it apart for single ones like "raft=debug", log_format
+// writes text or JSON lines.
+
+// logComponents are the parts of a node that log, each can have a level of its own
+var logComponents = []string{
+	"server", "transport", "discovery", "peers", "membership", "store", "transfer", "swarm", "erasure", "hints",
+	"antientropy", "rebalance", "drain", "raft", "control", "gateway", "s3", "webdav", "admin",
+}
+
+// LogLevels are the levels a node logs at, they can be changed while it runs. The zero value logs every component at
+// info.
+type LogLevels struct{
+	// level is the level of the components without one of their own in components
+	level slog.LevelVar
+
+	mu sync.RWMutex
+	components map[string]slog.Level
+}
+
+// Set sets the level of every component, one of debug, info, warn or error
+func (l *LogLevels) Set(s string) error{
+	level, err := parseLogLevel(s)
+	if err != nil{
+		return err
+	}
+	l.level.Set(level)
+	return nil
+}
+
+// SetComponents sets the level of single components from "component=level" pairs, the components left out go back to
+// the level of Set
+func (l *LogLevels) SetComponents(pairs []string) error{
+	levels, err := parseLogLevels(pairs)
+	if err != nil{
+		return err
+	}
+	l.mu.Lock()
+	l.components = levels
+	l.mu.Unlock()
+	return nil
+}
+
+// update takes over the levels of other
+func (l *LogLevels) update(other *LogLevels){
+	other.mu.RLock()
+	components := other.components
+	other.mu.RUnlock()
+
+	l.level.Set(other.level.Level())
+	l.mu.Lock()
+	l.components = components
+	l.mu.Unlock()
+}
+
+func (l *LogLevels) component(component string) slog.Level{
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if level, ok := l.components[component]; ok{
+		return level
+	}
+	return l.level.Level()
+}
+
+// defaultLogger is used by nodes that were given no logger
+func defaultLogger() *slog.Logger{
+	l, _ := NewLogger(os.Stderr, "text")
+	return l
+}
+
+// NewLogger writes the log to w as "text" or "json" lines. The handler lets every level through, which records are
+// written is up to the LogLevels of the node.
+func NewLogger(w io.Writer, format string) (*slog.Logger, error){
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch format{
+	case "text", "":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("expected text or json, have %q", format)
+}
+
+// parseLogLevel reads debug, info, warn or error
+func parseLogLevel(s string) (slog.Level, error){
+	var level slog.Level
+	err := level.UnmarshalText([]byte(strings.TrimSpace(s)))
+	return level, err
+}
+
+// parseLogLevels reads "component=level" pairs
+func parseLogLevels(pairs []string) (map[string]slog.Level, error){
+	levels := map[string]slog.Level{}
+	for _, pair := range pairs{
+		component, s, ok := strings.Cut(pair, "=")
+		component = strings.TrimSpace(component)
+		if !ok{
+			return nil, fmt.Errorf("expected component=level, have %q", pair)
+		}
+		if !contains(logComponents, component){
+			return nil, fmt.Errorf("unknown component %q, expected one of %s", component, strings.Join(logComponents, ", "))
+		}
+		level, err := parseLogLevel(s)
+		if err != nil{
+			return nil, fmt.Errorf("%s: %w", component, err)
+		}
+		levels[component] = level
+	}
+	return levels, nil
+}
+
+// componentHandler lets the records of a component through at the level set for it
+type componentHandler struct{
+	slog.Handler
+	levels *LogLevels
+	component string
+}
+
+func (h componentHandler) Enabled(ctx context.Context, level slog.Level) bool{
+	return level >= h.levels.component(h.component) && h.Handler.Enabled(ctx, level)
+}
+
+func (h componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler{
+	return componentHandler{h.Handler.WithAttrs(attrs), h.levels, h.component}
+}
+
+func (h componentHandler) WithGroup(name string) slog.Handler{
+	return componentHandler{h.Handler.WithGroup(name), h.levels, h.component}
+}
+
+// componentLogger is l for one component, logging at its level in levels
+func componentLogger(l *slog.Logger, levels *LogLevels, component string) *slog.Logger{
+	return slog.New(componentHandler{l.Handler(), levels, component}).With("component", component)
+}
+
+// componentLoggers builds the logger of every component from the logger of a node
+func componentLoggers(l *slog.Logger, levels *LogLevels) map[string]*slog.Logger{
+	loggers := make(map[string]*slog.Logger, len(logComponents))
+	for _, component := range logComponents{
+		loggers[component] = componentLogger(l, levels, component)
+	}
+	return loggers
+}
+
+// logger is the logger of a component of the node
+func (s *FileServer) logger(component string) *slog.Logger{
+	if l, ok := s.loggers[component]; ok{
+		return l
+	}
+	return s.loggers["server"]
+}
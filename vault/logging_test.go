@@ -0,0 +1,56 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestComponentLevels(t *testing.T){
+	buf := new(bytes.Buffer)
+	l, err := NewLogger(buf, "json")
+	if err != nil{
+		t.Fatal(err)
+	}
+	levels := new(LogLevels)
+	if err := levels.Set("warn"); err != nil{
+		t.Fatal(err)
+	}
+	if err := levels.SetComponents([]string{"raft=debug"}); err != nil{
+		t.Fatal(err)
+	}
+
+	// A second node in the same process keeps its own levels
+	other := componentLoggers(l.With("node", "n2"), new(LogLevels))
+	other["raft"].Debug("hidden")
+
+	loggers := componentLoggers(l.With("node", "n1"), levels)
+	loggers["server"].Info("hidden")
+	loggers["server"].Warn("shown", "key", "a.txt")
+	loggers["raft"].Debug("shown", "term", 3)
+
+	records := []map[string]any{}
+	dec := json.NewDecoder(buf)
+	for dec.More(){
+		var record map[string]any
+		if err := dec.Decode(&record); err != nil{
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2{
+		t.Fatalf("expected 2 records, have %v", records)
+	}
+	for i, component := range []string{"server", "raft"}{
+		if records[i]["msg"] != "shown" || records[i]["node"] != "n1" || records[i]["component"] != component{
+			t.Errorf("expected a record of %s with the node attached, have %v", component, records[i])
+		}
+	}
+	if records[0]["key"] != "a.txt"{
+		t.Errorf("expected the key attribute, have %v", records[0])
+	}
+
+	if err := levels.SetComponents([]string{"disk=debug"}); err == nil{
+		t.Errorf("expected an unknown component to be rejected")
+	}
+}
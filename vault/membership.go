@@ -0,0 +1,453 @@
+package vault
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Membership is a SWIM style failure detector. Every probe interval one member is pinged directly, if it doesn't answer
+// in time a few other members are asked to ping it on our behalf, and if none of them gets an answer either the member
+// becomes suspect. A suspect that doesn't refute the suspicion within the suspicion timeout is declared dead.
+// State changes are gossiped piggybacked on pings and acks.
+
+const (
+	defaultProbeInterval = time.Second
+	defaultProbeTimeout = 500 * time.Millisecond
+	defaultSuspicionTimeout = 5 * time.Second
+	indirectProbes = 3
+	maxPiggyback = 8
+)
+
+type MemberState int
+
+const (
+	MemberAlive MemberState = iota
+	MemberSuspect
+	MemberDead
+)
+
+func (st MemberState) String() string{
+	switch st{
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// MemberUpdate is a gossiped statement about the state of a member
+type MemberUpdate struct{
+	ID string
+	State MemberState
+	Incarnation uint64
+}
+
+type MessagePing struct{
+	Seq uint64
+	Updates []MemberUpdate
+}
+
+type MessagePingAck struct{
+	Seq uint64
+	Updates []MemberUpdate
+}
+
+// MessagePingReq asks the receiver to ping Target for us and relay the ack
+type MessagePingReq struct{
+	Seq uint64
+	Target string
+	Updates []MemberUpdate
+}
+
+type member struct{
+	state MemberState
+	incarnation uint64
+	suspectAt time.Time
+}
+
+type gossipItem struct{
+	update MemberUpdate
+	transmits int
+}
+
+type relay struct{
+	origin string
+	seq uint64
+}
+
+type membership struct{
+	mu sync.Mutex
+	incarnation uint64
+	members map[string]*member
+	gossip []*gossipItem
+	seq uint64
+	acks map[uint64]chan struct{}
+	relays map[uint64]relay
+	probeOrder []string
+}
+
+func (s *FileServer) probeInterval() time.Duration{
+	if s.ProbeInterval <= 0{
+		return defaultProbeInterval
+	}
+	return s.ProbeInterval
+}
+
+func (s *FileServer) probeTimeout() time.Duration{
+	if s.ProbeTimeout <= 0{
+		return defaultProbeTimeout
+	}
+	return s.ProbeTimeout
+}
+
+func (s *FileServer) suspicionTimeout() time.Duration{
+	if s.SuspicionTimeout <= 0{
+		return defaultSuspicionTimeout
+	}
+	return s.SuspicionTimeout
+}
+
+// Members returns the state of every member we know about, ourselves excluded
+func (s *FileServer) Members() map[string]MemberState{
+	m := &s.members
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	states := make(map[string]MemberState, len(m.members))
+	for id, mem := range m.members{
+		states[id] = mem.state
+	}
+	return states
+}
+
+// memberJoined starts tracking a node we just said hello to
+func (s *FileServer) memberJoined(id string){
+	m := &s.members
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.members == nil{
+		m.members = make(map[string]*member)
+	}
+	if mem, ok := m.members[id]; ok && mem.state != MemberDead{
+		return
+	}
+	m.members[id] = &member{state: MemberAlive}
+}
+
+// memberLeft stops tracking a node that left the network on its own
+func (s *FileServer) memberLeft(id string){
+	m := &s.members
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.members, id)
+}
+
+func (s *FileServer) probeLoop(){
+	ticker := time.NewTicker(s.probeInterval())
+	defer ticker.Stop()
+
+	for{
+		select{
+		case <-ticker.C:
+			s.checkSuspects()
+			if id, ok := s.nextProbeTarget(); ok{
+				go s.probe(id)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// nextProbeTarget walks the members in a shuffled round robin so every member is probed within a bounded time
+func (s *FileServer) nextProbeTarget() (string, bool){
+	m := &s.members
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for len(m.probeOrder) == 0{
+		for id, mem := range m.members{
+			if mem.state != MemberDead{
+				m.probeOrder = append(m.probeOrder, id)
+			}
+		}
+		if len(m.probeOrder) == 0{
+			return "", false
+		}
+		rand.Shuffle(len(m.probeOrder), func(i, j int){
+			m.probeOrder[i], m.probeOrder[j] = m.probeOrder[j], m.probeOrder[i]
+		})
+	}
+
+	id := m.probeOrder[0]
+	m.probeOrder = m.probeOrder[1:]
+	if mem, ok := m.members[id]; !ok || mem.state == MemberDead{
+		return "", false
+	}
+	return id, true
+}
+
+func (s *FileServer) probe(id string){
+	seq, ack := s.expectPingAck()
+	defer s.cancelPingAck(seq)
+
+	if addr, ok := s.peerAddr(id); ok{
+		s.sendMessage(addr, &Message{Payload: MessagePing{Seq: seq, Updates: s.piggyback()}})
+	}
+
+	select{
+	case <-ack:
+		return
+	case <-time.After(s.probeTimeout()):
+	case <-s.quitch:
+		return
+	}
+
+	// No direct answer, ask a few others to try before we suspect it
+	for _, helper := range s.randomMembers(indirectProbes, id){
+		if addr, ok := s.peerAddr(helper); ok{
+			s.sendMessage(addr, &Message{Payload: MessagePingReq{Seq: seq, Target: id, Updates: s.piggyback()}})
+		}
+	}
+
+	select{
+	case <-ack:
+		return
+	case <-time.After(s.probeInterval() - s.probeTimeout()):
+	case <-s.quitch:
+		return
+	}
+
+	s.members.mu.Lock()
+	mem, ok := s.members.members[id]
+	var update MemberUpdate
+	if ok{
+		update = MemberUpdate{ID: id, State: MemberSuspect, Incarnation: mem.incarnation}
+	}
+	s.members.mu.Unlock()
+
+	if ok{
+		s.applyUpdate(update)
+	}
+}
+
+func (s *FileServer) randomMembers(n int, exclude string) []string{
+	m := &s.members
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := []string{}
+	for id, mem := range m.members{
+		if id != exclude && mem.state == MemberAlive{
+			ids = append(ids, id)
+		}
+	}
+	rand.Shuffle(len(ids), func(i, j int){ ids[i], ids[j] = ids[j], ids[i] })
+	if len(ids) > n{
+		ids = ids[:n]
+	}
+	return ids
+}
+
+func (s *FileServer) expectPingAck() (uint64, <-chan struct{}){
+	m := &s.members
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.acks == nil{
+		m.acks = make(map[uint64]chan struct{})
+		m.relays = make(map[uint64]relay)
+	}
+	m.seq++
+	ch := make(chan struct{})
+	m.acks[m.seq] = ch
+	return m.seq, ch
+}
+
+func (s *FileServer) cancelPingAck(seq uint64){
+	m := &s.members
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.acks, seq)
+}
+
+// checkSuspects declares dead every suspect that didn't refute the suspicion in time
+func (s *FileServer) checkSuspects(){
+	m := &s.members
+	m.mu.Lock()
+	updates := []MemberUpdate{}
+	for id, mem := range m.members{
+		if mem.state == MemberSuspect && time.Since(mem.suspectAt) > s.suspicionTimeout(){
+			updates = append(updates, MemberUpdate{ID: id, State: MemberDead, Incarnation: mem.incarnation})
+		}
+	}
+	m.mu.Unlock()
+
+	for _, u := range updates{
+		s.applyUpdate(u)
+	}
+}
+
+// applyUpdate merges a statement about a member into our view following the SWIM precedence rules,
+// and queues it for gossip if it changed anything
+func (s *FileServer) applyUpdate(u MemberUpdate){
+	m := &s.members
+	m.mu.Lock()
+
+	// Somebody suspects us, refute it with a higher incarnation
+	if u.ID == s.ID{
+		if u.State != MemberAlive && u.Incarnation >= m.incarnation{
+			m.incarnation = u.Incarnation + 1
+			m.queueGossip(MemberUpdate{ID: s.ID, State: MemberAlive, Incarnation: m.incarnation})
+		}
+		m.mu.Unlock()
+		return
+	}
+
+	mem, ok := m.members[u.ID]
+	if !ok || mem.state == MemberDead{
+		m.mu.Unlock()
+		return
+	}
+
+	apply := false
+	switch u.State{
+	case MemberAlive:
+		apply = u.Incarnation > mem.incarnation
+	case MemberSuspect:
+		apply = u.Incarnation > mem.incarnation || (u.Incarnation == mem.incarnation && mem.state == MemberAlive)
+	case MemberDead:
+		apply = u.Incarnation >= mem.incarnation
+	}
+	if !apply{
+		m.mu.Unlock()
+		return
+	}
+
+	mem.state = u.State
+	mem.incarnation = u.Incarnation
+	if u.State == MemberSuspect{
+		mem.suspectAt = time.Now()
+	}
+	m.queueGossip(u)
+	m.mu.Unlock()
+
+	s.logger("membership").Info("member state changed", "id", u.ID, "state", u.State.String())
+
+	if u.State == MemberDead{
+		s.memberDead(u.ID)
+	}
+}
+
+func (m *membership) queueGossip(u MemberUpdate){
+	// Every update is retransmitted a number of times that grows with the log of the cluster size
+	transmits := 3 * int(math.Ceil(math.Log(float64(len(m.members)+2))))
+
+	for _, item := range m.gossip{
+		if item.update.ID == u.ID{
+			item.update = u
+			item.transmits = transmits
+			return
+		}
+	}
+	m.gossip = append(m.gossip, &gossipItem{update: u, transmits: transmits})
+}
+
+// piggyback returns the updates to attach to the next outgoing ping or ack
+func (s *FileServer) piggyback() []MemberUpdate{
+	m := &s.members
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	updates := []MemberUpdate{}
+	remaining := m.gossip[:0]
+	for _, item := range m.gossip{
+		if len(updates) < maxPiggyback{
+			updates = append(updates, item.update)
+			item.transmits--
+		}
+		if item.transmits > 0{
+			remaining = append(remaining, item)
+		}
+	}
+	m.gossip = remaining
+	return updates
+}
+
+// memberDead drops a dead node from the peers and the ring, and lets the rebalancer re-replicate what it held
+func (s *FileServer) memberDead(id string){
+	if addr, ok := s.peerAddr(id); ok{
+		if peer, ok := s.peer(addr); ok{
+			peer.Close()
+		}
+		s.removePeer(addr)
+	}
+
+	if prev, ok := s.ring.Leave(id); ok{
+		s.rebalancer.Trigger(prev, s.replicationFactor())
+	}
+}
+
+func (s *FileServer) handleMessagePing(from string, msg MessagePing){
+	for _, u := range msg.Updates{
+		s.applyUpdate(u)
+	}
+	if err := s.sendMessage(from, &Message{Payload: MessagePingAck{Seq: msg.Seq, Updates: s.piggyback()}}); err != nil{
+		s.logger("membership").Warn("ping ack error", "peer", from, "err", err)
+	}
+}
+
+func (s *FileServer) handleMessagePingAck(from string, msg MessagePingAck){
+	for _, u := range msg.Updates{
+		s.applyUpdate(u)
+	}
+
+	m := &s.members
+	m.mu.Lock()
+	ch, ok := m.acks[msg.Seq]
+	if ok{
+		close(ch)
+		delete(m.acks, msg.Seq)
+	}
+	r, relayed := m.relays[msg.Seq]
+	delete(m.relays, msg.Seq)
+	m.mu.Unlock()
+
+	// The ack answers a ping we sent for somebody else, pass it on
+	if relayed{
+		s.sendMessage(r.origin, &Message{Payload: MessagePingAck{Seq: r.seq, Updates: s.piggyback()}})
+	}
+}
+
+func (s *FileServer) handleMessagePingReq(from string, msg MessagePingReq){
+	for _, u := range msg.Updates{
+		s.applyUpdate(u)
+	}
+
+	addr, ok := s.peerAddr(msg.Target)
+	if !ok{
+		return
+	}
+
+	seq, _ := s.expectPingAck()
+	s.cancelPingAck(seq)
+
+	m := &s.members
+	m.mu.Lock()
+	m.relays[seq] = relay{origin: from, seq: msg.Seq}
+	m.mu.Unlock()
+
+	time.AfterFunc(s.probeInterval(), func(){
+		m.mu.Lock()
+		delete(m.relays, seq)
+		m.mu.Unlock()
+	})
+
+	s.sendMessage(addr, &Message{Payload: MessagePing{Seq: seq, Updates: s.piggyback()}})
+}
@@ -0,0 +1,184 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+	"github.com/ayushn2/distri_vault.git/p2p"
+)
+
+func TestMembershipPrecedence(t *testing.T){
+	s := newTestServer(t.TempDir())
+	s.SuspicionTimeout = time.Millisecond
+	s.memberJoined("b")
+	s.ring.Add("b")
+
+	s.applyUpdate(MemberUpdate{ID: "b", State: MemberSuspect, Incarnation: 0})
+	if st := s.Members()["b"]; st != MemberSuspect{
+		t.Fatalf("have %s want suspect", st)
+	}
+
+	// An alive with the same incarnation doesn't clear the suspicion, only a refutation with a higher one does
+	s.applyUpdate(MemberUpdate{ID: "b", State: MemberAlive, Incarnation: 0})
+	if st := s.Members()["b"]; st != MemberSuspect{
+		t.Fatalf("have %s want suspect", st)
+	}
+	s.applyUpdate(MemberUpdate{ID: "b", State: MemberAlive, Incarnation: 1})
+	if st := s.Members()["b"]; st != MemberAlive{
+		t.Fatalf("have %s want alive", st)
+	}
+
+	s.applyUpdate(MemberUpdate{ID: "b", State: MemberSuspect, Incarnation: 1})
+	time.Sleep(5 * time.Millisecond)
+	s.checkSuspects()
+	if st := s.Members()["b"]; st != MemberDead{
+		t.Fatalf("have %s want dead", st)
+	}
+	if s.ring.Has("b"){
+		t.Errorf("expected dead member to be taken off the ring")
+	}
+}
+
+func TestMembershipRefutesSuspicion(t *testing.T){
+	s := newTestServer(t.TempDir())
+
+	s.applyUpdate(MemberUpdate{ID: s.ID, State: MemberSuspect, Incarnation: 0})
+
+	updates := s.piggyback()
+	if len(updates) != 1{
+		t.Fatalf("have %d updates want 1", len(updates))
+	}
+	if u := updates[0]; u.ID != s.ID || u.State != MemberAlive || u.Incarnation != 1{
+		t.Errorf("expected an alive refutation with incarnation 1, have %+v", u)
+	}
+}
+
+func TestPingsAnsweredDuringTransfer(t *testing.T){
+	nodes := startTestCluster(t, 3)
+	s1, s2, s3 := nodes[0].Server(), nodes[1].Server(), nodes[2].Server()
+
+	// s1 starts streaming an object to s2 and stalls halfway through it
+	addr, ok := s1.peerAddr(s2.ID)
+	if !ok{
+		t.Fatal("s1 has no address for s2")
+	}
+	peer, _ := s1.peer(addr)
+	msg := Message{Payload: MessageStoreFile{ID: s1.ID, Key: crypto.HashKey("stalled"), Size: 1 << 20}}
+	if err := s1.sendMessage(addr, &msg); err != nil{
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	peer.Send([]byte{p2p.IncomingStream})
+	peer.Send(make([]byte, 1024))
+
+	// s2 still answers a ping from s3 while it waits for the rest of the stream
+	addr, ok = s3.peerAddr(s2.ID)
+	if !ok{
+		t.Fatal("s3 has no address for s2")
+	}
+	seq, ack := s3.expectPingAck()
+	defer s3.cancelPingAck(seq)
+	if err := s3.sendMessage(addr, &Message{Payload: MessagePing{Seq: seq}}); err != nil{
+		t.Fatal(err)
+	}
+	select{
+	case <-ack:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a ping ack while a transfer is stalled")
+	}
+}
+
+func TestPingsDuringPush(t *testing.T){
+	nodes := startTestCluster(t, 2, WithServerOptions(func(opts *FileServerOpts){ opts.AntiEntropyInterval = 0 }))
+	s1, s2 := nodes[0].Server(), nodes[1].Server()
+	addr, ok := s1.peerAddr(s2.ID)
+	if !ok{
+		t.Fatal("s1 has no address for s2")
+	}
+	peer, _ := s1.peer(addr)
+
+	data := make([]byte, 8<<20)
+	rand.Read(data)
+	if _, err := s1.store.Write(s1.ID, "big", bytes.NewReader(data)); err != nil{
+		t.Fatal(err)
+	}
+	digest, err := s1.store.Digest(s1.ID, "big")
+	if err != nil{
+		t.Fatal(err)
+	}
+	if err := s1.store.WriteMeta(s1.ID, "big", Meta{Size: int64(len(data)), Digest: digest, ModTime: s1.clock.Now()}); err != nil{
+		t.Fatal(err)
+	}
+	inventory, err := s1.store.Inventory()
+	if err != nil || len(inventory) != 1{
+		t.Fatalf("expected the object in the inventory, have %v %v", inventory, err)
+	}
+
+	// Pings to s2 go out all through the push, none of them may end up inside the stream
+	done := make(chan struct{})
+	pinged := make(chan struct{})
+	go func(){
+		defer close(pinged)
+		for{
+			select{
+			case <-done:
+				return
+			default:
+			}
+			s1.sendMessage(addr, &Message{Payload: MessagePing{}})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	_, err = s1.pushFrom(s1.store, peer, inventory[0], false)
+	close(done)
+	<-pinged
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the object to arrive", func() bool{
+		return len(replicasOf(t, s2, s1.ID)) == 1
+	})
+	_, r, err := s2.store.Read(s1.ID, replicasOf(t, s2, s1.ID)[0].Key)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if rc, ok := r.(io.ReadCloser); ok{
+		defer rc.Close()
+	}
+	plain := new(bytes.Buffer)
+	if _, err := crypto.CopyDecrypt(s1.EncKey, r, plain); err != nil{
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain.Bytes(), data){
+		t.Fatal("expected the object to arrive intact")
+	}
+	seq, ack := s1.expectPingAck()
+	defer s1.cancelPingAck(seq)
+	if err := s1.sendMessage(addr, &Message{Payload: MessagePing{Seq: seq}}); err != nil{
+		t.Fatal(err)
+	}
+	select{
+	case <-ack:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the connection to stay in sync after the push")
+	}
+}
+
+func TestProbeTimeoutMustBeShorterThanInterval(t *testing.T){
+	n, err := NewNode(WithListenAddr("127.0.0.1:0"), WithStorageRoot(t.TempDir()), WithServerOptions(func(opts *FileServerOpts){
+		opts.ProbeInterval = 100 * time.Millisecond
+		opts.ProbeTimeout = 200 * time.Millisecond
+	}))
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer n.Close()
+	if err := n.Start(); err == nil{
+		t.Errorf("expected a probe timeout longer than the interval to be refused")
+	}
+}
@@ -0,0 +1,124 @@
+package vault
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+)
+
+// merkleDepth is the number of hex characters of the hashed key used to place an entry in the tree.
+// Every level fans out 16 ways, so a depth of 2 gives 256 leaves, each covering a contiguous range of the key space.
+const merkleDepth = 2
+
+const hexDigits = "0123456789abcdef"
+
+// SyncEntry is the unit anti-entropy compares between replicas. Key is always the hashed key, the same for the owner and every replica
+type SyncEntry struct{
+	ID string
+	Key string
+	Digest string
+	ModTime int64
+	Size int64
+	Deleted bool
+	// Signature is the owner's signature of a tombstone, see MessageDeleteFile
+	Signature []byte
+}
+
+func (e SyncEntry) objectID() string{
+	return e.ID + "/" + e.Key
+}
+
+// MerkleTree is an in-memory merkle tree over the (owner ID, hashed key, digest) inventory of a node
+type MerkleTree struct{
+	hashes map[string][]byte
+	leaves map[string][]SyncEntry
+}
+
+func NewMerkleTree(entries []SyncEntry) *MerkleTree{
+	t := &MerkleTree{
+		hashes: make(map[string][]byte),
+		leaves: make(map[string][]SyncEntry),
+	}
+
+	for _, e := range entries{
+		if len(e.Key) < merkleDepth{
+			continue
+		}
+		prefix := e.Key[:merkleDepth]
+		t.leaves[prefix] = append(t.leaves[prefix], e)
+	}
+
+	for prefix, leaf := range t.leaves{
+		sort.Slice(leaf, func(i, j int) bool{
+			return leaf[i].objectID() < leaf[j].objectID()
+		})
+
+		h := sha256.New()
+		for _, e := range leaf{
+			fmt.Fprintf(h, "%s|%s|%s|%t\n", e.ID, e.Key, e.Digest, e.Deleted)
+		}
+		t.hashes[prefix] = h.Sum(nil)
+	}
+
+	for depth := merkleDepth - 1; depth >= 0; depth--{
+		for _, prefix := range prefixesAt(depth){
+			h := sha256.New()
+			empty := true
+			for _, child := range childPrefixes(prefix){
+				if ch, ok := t.hashes[child]; ok{
+					h.Write([]byte(child))
+					h.Write(ch)
+					empty = false
+				}
+			}
+			if !empty{
+				t.hashes[prefix] = h.Sum(nil)
+			}
+		}
+	}
+
+	return t
+}
+
+// Root returns the hash of the whole tree, nil if the tree is empty
+func (t *MerkleTree) Root() []byte{
+	return t.Hash("")
+}
+
+// Hash returns the hash of the subtree under prefix, nil if there are no entries under it
+func (t *MerkleTree) Hash(prefix string) []byte{
+	return t.hashes[prefix]
+}
+
+// Entries returns all the entries held by the given leaves
+func (t *MerkleTree) Entries(prefixes ...string) []SyncEntry{
+	entries := []SyncEntry{}
+	for _, prefix := range prefixes{
+		entries = append(entries, t.leaves[prefix]...)
+	}
+	return entries
+}
+
+func isLeafPrefix(prefix string) bool{
+	return len(prefix) == merkleDepth
+}
+
+func childPrefixes(prefix string) []string{
+	children := make([]string, len(hexDigits))
+	for i, c := range hexDigits{
+		children[i] = prefix + string(c)
+	}
+	return children
+}
+
+func prefixesAt(depth int) []string{
+	prefixes := []string{""}
+	for i := 0; i < depth; i++{
+		next := make([]string, 0, len(prefixes)*len(hexDigits))
+		for _, p := range prefixes{
+			next = append(next, childPrefixes(p)...)
+		}
+		prefixes = next
+	}
+	return prefixes
+}
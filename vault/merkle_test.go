@@ -0,0 +1,67 @@
+package vault
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+)
+
+func makeSyncEntries(n int) []SyncEntry{
+	entries := make([]SyncEntry, n)
+	for i := 0; i < n; i++{
+		entries[i] = SyncEntry{
+			ID: "owner",
+			Key: crypto.HashKey(fmt.Sprintf("file_%d", i)),
+			Digest: fmt.Sprintf("digest_%d", i),
+		}
+	}
+	return entries
+}
+
+func TestMerkleTreeEqual(t *testing.T){
+	a := NewMerkleTree(makeSyncEntries(100))
+	b := NewMerkleTree(makeSyncEntries(100))
+
+	if !bytes.Equal(a.Root(), b.Root()){
+		t.Errorf("expected equal roots for the same inventory")
+	}
+
+	if NewMerkleTree(nil).Root() != nil{
+		t.Errorf("expected empty tree to have a nil root")
+	}
+}
+
+func TestMerkleTreeDiff(t *testing.T){
+	entries := makeSyncEntries(100)
+	a := NewMerkleTree(entries)
+
+	changed := make([]SyncEntry, len(entries))
+	copy(changed, entries)
+	changed[42].Digest = "something else"
+	b := NewMerkleTree(changed)
+
+	if bytes.Equal(a.Root(), b.Root()){
+		t.Fatalf("expected roots to differ")
+	}
+
+	// Walking down only the differing subtrees must end at exactly the leaf holding the changed entry
+	prefixes := []string{""}
+	for !isLeafPrefix(prefixes[0]){
+		next := []string{}
+		for _, p := range prefixes{
+			for _, child := range childPrefixes(p){
+				if !bytes.Equal(a.Hash(child), b.Hash(child)){
+					next = append(next, child)
+				}
+			}
+		}
+		prefixes = next
+	}
+
+	want := changed[42].Key[:merkleDepth]
+	if len(prefixes) != 1 || prefixes[0] != want{
+		t.Errorf("have %v want [%s]", prefixes, want)
+	}
+}
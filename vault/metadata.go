@@ -0,0 +1,430 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Cluster metadata is the small set of facts every node has to agree on: who is a member, how the ring is laid out,
+// which namespaces exist, who may do what in them and which encryption key epoch is current. It is kept in a state
+// machine replicated with raft among the nodes listed in FileServerOpts.RaftVoters, every other node follows the log
+// as a learner so placement is the same everywhere. Changes can be proposed on any node, followers hand them to the
+// leader, every node reads its local copy.
+
+// Permission is a set of rights a principal holds on a namespace
+type Permission uint8
+
+const (
+	PermRead Permission = 1 << iota
+	PermWrite
+	PermDelete
+	PermAdmin
+)
+
+const (
+	MetaAddMember = "add-member"
+	MetaRemoveMember = "remove-member"
+	MetaSetReplication = "set-replication"
+	MetaAddNamespace = "add-namespace"
+	MetaRemoveNamespace = "remove-namespace"
+	MetaGrant = "grant"
+	MetaRevoke = "revoke"
+	MetaRotateKey = "rotate-key"
+)
+
+// MetaCommand is one change to the cluster metadata, which fields matter depends on Op
+type MetaCommand struct{
+	Op string
+	ID string
+	Addr string
+	ReplicationFactor int
+	Namespace string
+	Principal string
+	Perm Permission
+	// Epoch is the key epoch a rotation moves to, it has to follow the current one
+	Epoch uint64
+}
+
+type ClusterMetadata struct{
+	// Members maps node IDs to their advertised address. Once there are any, only members are placed on the ring.
+	Members map[string]string
+	// ReplicationFactor overrides FileServerOpts.ReplicationFactor when set
+	ReplicationFactor int
+	Namespaces []string
+	// ACLs maps a namespace to the permissions of every principal on it
+	ACLs map[string]map[string]Permission
+	// KeyEpoch is the encryption key epoch clients encrypt new files under. Nodes only ever hold ciphertext, they
+	// keep it for the clients and don't read it themselves.
+	KeyEpoch uint64
+}
+
+// MessageProposeMetadata hands a change proposed on a follower to the raft leader
+type MessageProposeMetadata struct{
+	Seq uint64
+	Command MetaCommand
+}
+
+// MessageProposeMetadataReply tells the follower how its proposal went, Err is empty once it is applied
+type MessageProposeMetadataReply struct{
+	Seq uint64
+	Err string
+}
+
+// proposalWaiter matches the replies of the leader to the proposals we handed to it
+type proposalWaiter struct{
+	mu sync.Mutex
+	seq uint64
+	waiters map[uint64]chan error
+}
+
+func (w *proposalWaiter) expect() (uint64, <-chan error){
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.waiters == nil{
+		w.waiters = make(map[uint64]chan error)
+	}
+	w.seq++
+	ch := make(chan error, 1)
+	w.waiters[w.seq] = ch
+	return w.seq, ch
+}
+
+func (w *proposalWaiter) cancel(seq uint64){
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.waiters, seq)
+}
+
+func (w *proposalWaiter) done(seq uint64, err error){
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if ch, ok := w.waiters[seq]; ok{
+		ch <- err
+		delete(w.waiters, seq)
+	}
+}
+
+// Allowed reports whether principal holds perm on namespace, admins hold every permission
+func (m ClusterMetadata) Allowed(namespace string, principal string, perm Permission) bool{
+	held := m.ACLs[namespace][principal]
+	return held&PermAdmin != 0 || held&perm == perm
+}
+
+func (m ClusterMetadata) hasNamespace(namespace string) bool{
+	i := sort.SearchStrings(m.Namespaces, namespace)
+	return i < len(m.Namespaces) && m.Namespaces[i] == namespace
+}
+
+func (m ClusterMetadata) clone() ClusterMetadata{
+	c := ClusterMetadata{
+		Members: make(map[string]string, len(m.Members)),
+		ReplicationFactor: m.ReplicationFactor,
+		Namespaces: append([]string{}, m.Namespaces...),
+		ACLs: make(map[string]map[string]Permission, len(m.ACLs)),
+		KeyEpoch: m.KeyEpoch,
+	}
+	for id, addr := range m.Members{
+		c.Members[id] = addr
+	}
+	for ns, acl := range m.ACLs{
+		c.ACLs[ns] = make(map[string]Permission, len(acl))
+		for principal, perm := range acl{
+			c.ACLs[ns][principal] = perm
+		}
+	}
+	return c
+}
+
+// metadataMachine applies MetaCommands, it is the raft StateMachine of the cluster metadata
+type metadataMachine struct{
+	mu sync.RWMutex
+	meta ClusterMetadata
+	// onApply is told about every applied command and the replication factor from before it
+	onApply func(cmd MetaCommand, prevRF int)
+}
+
+func newMetadataMachine() *metadataMachine{
+	return &metadataMachine{meta: ClusterMetadata{}.clone()}
+}
+
+func (m *metadataMachine) Metadata() ClusterMetadata{
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.meta.clone()
+}
+
+func (m *metadataMachine) replicationFactor() int{
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.meta.ReplicationFactor
+}
+
+// placeable reports whether id may hold data, any node can while the metadata lists no members
+func (m *metadataMachine) placeable(id string) bool{
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.meta.Members[id]
+	return ok || len(m.meta.Members) == 0
+}
+
+func (m *metadataMachine) Apply(b []byte) error{
+	var cmd MetaCommand
+	if err := json.Unmarshal(b, &cmd); err != nil{
+		return err
+	}
+
+	m.mu.Lock()
+	prevRF := m.meta.ReplicationFactor
+	err := m.apply(cmd)
+	m.mu.Unlock()
+
+	if err == nil && m.onApply != nil{
+		m.onApply(cmd, prevRF)
+	}
+	return err
+}
+
+func (m *metadataMachine) apply(cmd MetaCommand) error{
+	meta := &m.meta
+	switch cmd.Op{
+	case MetaAddMember:
+		meta.Members[cmd.ID] = cmd.Addr
+	case MetaRemoveMember:
+		delete(meta.Members, cmd.ID)
+	case MetaSetReplication:
+		if cmd.ReplicationFactor < 0{
+			return fmt.Errorf("invalid replication factor %d", cmd.ReplicationFactor)
+		}
+		meta.ReplicationFactor = cmd.ReplicationFactor
+	case MetaAddNamespace:
+		if meta.hasNamespace(cmd.Namespace){
+			return nil
+		}
+		meta.Namespaces = append(meta.Namespaces, cmd.Namespace)
+		sort.Strings(meta.Namespaces)
+	case MetaRemoveNamespace:
+		i := sort.SearchStrings(meta.Namespaces, cmd.Namespace)
+		if i < len(meta.Namespaces) && meta.Namespaces[i] == cmd.Namespace{
+			meta.Namespaces = append(meta.Namespaces[:i], meta.Namespaces[i+1:]...)
+		}
+		delete(meta.ACLs, cmd.Namespace)
+	case MetaGrant:
+		if !meta.hasNamespace(cmd.Namespace){
+			return fmt.Errorf("namespace (%s) does not exist", cmd.Namespace)
+		}
+		if meta.ACLs[cmd.Namespace] == nil{
+			meta.ACLs[cmd.Namespace] = make(map[string]Permission)
+		}
+		meta.ACLs[cmd.Namespace][cmd.Principal] |= cmd.Perm
+	case MetaRevoke:
+		if acl, ok := meta.ACLs[cmd.Namespace]; ok{
+			acl[cmd.Principal] &^= cmd.Perm
+			if acl[cmd.Principal] == 0{
+				delete(acl, cmd.Principal)
+			}
+		}
+	case MetaRotateKey:
+		if cmd.Epoch != meta.KeyEpoch+1{
+			return fmt.Errorf("key epoch %d does not follow %d", cmd.Epoch, meta.KeyEpoch)
+		}
+		meta.KeyEpoch = cmd.Epoch
+	default:
+		return fmt.Errorf("unknown metadata operation (%s)", cmd.Op)
+	}
+	return nil
+}
+
+func (m *metadataMachine) Snapshot() ([]byte, error){
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return json.Marshal(m.meta)
+}
+
+func (m *metadataMachine) Restore(snapshot []byte) error{
+	var meta ClusterMetadata
+	if err := json.Unmarshal(snapshot, &meta); err != nil{
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.meta = meta.clone()
+	return nil
+}
+
+func (s *FileServer) raftDir() string{
+	return filepath.Join(s.store.Root, ".raft")
+}
+
+// startRaft joins the raft group, as a voter when the node is one of RaftVoters and as a learner otherwise
+func (s *FileServer) startRaft() error{
+	if len(s.RaftVoters) == 0{
+		return nil
+	}
+
+	s.meta.onApply = s.metadataApplied
+	r, err := NewRaft(RaftOpts{
+		ID: s.ID,
+		Voters: s.RaftVoters,
+		Learners: s.raftLearners,
+		Send: s.sendRaft,
+		StateMachine: s.meta,
+		Dir: s.raftDir(),
+		ElectionTimeout: s.RaftElectionTimeout,
+		SnapshotThreshold: s.RaftSnapshotThreshold,
+		Logger: s.logger("raft"),
+	})
+	if err != nil{
+		return err
+	}
+	s.raft = r
+
+	go r.Start()
+	return nil
+}
+
+// raftLearners are the connected nodes that don't vote, the leader keeps their copy of the metadata up to date
+func (s *FileServer) raftLearners() []string{
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	ids := []string{}
+	for _, id := range s.peerIDs{
+		if !contains(s.RaftVoters, id) && !contains(ids, id){
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (s *FileServer) sendRaft(to string, msg any) error{
+	addr, ok := s.peerAddr(to)
+	if !ok{
+		return fmt.Errorf("raft member %s is not connected", to)
+	}
+	return s.sendMessage(addr, &Message{Payload: msg})
+}
+
+func (s *FileServer) stepRaft(msg any){
+	if s.raft != nil{
+		s.raft.Step(msg)
+	}
+}
+
+// metadataApplied reacts to metadata changes that affect the node
+func (s *FileServer) metadataApplied(cmd MetaCommand, prevRF int){
+	switch cmd.Op{
+	case MetaSetReplication:
+		// Objects were placed under the factor from before the change, or our own when the cluster had none
+		if prevRF <= 0{
+			prevRF = s.ReplicationFactor
+		}
+		s.rebalancer.Trigger(s.ring.Clone(), prevRF)
+	case MetaAddMember, MetaRemoveMember:
+		s.placeMembers()
+	}
+}
+
+// placeMembers brings the ring in line with the members in the metadata, connected members are placed on it and
+// other nodes are taken off
+func (s *FileServer) placeMembers(){
+	s.peerLock.Lock()
+	ids := []string{}
+	for _, id := range s.peerIDs{
+		ids = append(ids, id)
+	}
+	s.peerLock.Unlock()
+
+	for _, id := range ids{
+		var prev *HashRing
+		var changed bool
+		if s.meta.placeable(id){
+			prev, changed = s.ring.Join(id)
+		} else{
+			prev, changed = s.ring.Leave(id)
+		}
+		if changed{
+			s.rebalancer.Trigger(prev, s.replicationFactor())
+		}
+	}
+}
+
+// Metadata returns this node's copy of the cluster metadata. It lags behind the leader by at most the entries
+// that are not applied here yet.
+func (s *FileServer) Metadata() ClusterMetadata{
+	return s.meta.Metadata()
+}
+
+// ProposeMetadata applies cmd to the cluster metadata. A node that doesn't lead hands it to the leader and waits
+// for the leader to apply it.
+func (s *FileServer) ProposeMetadata(cmd MetaCommand) error{
+	if s.raft == nil{
+		return fmt.Errorf("[%s] has no raft voters configured", s.Transport.Addr())
+	}
+	b, err := json.Marshal(cmd)
+	if err != nil{
+		return err
+	}
+	if err := s.raft.Propose(b); !errors.Is(err, ErrNotLeader){
+		return err
+	}
+
+	leader := s.raft.Leader()
+	addr, ok := s.peerAddr(leader)
+	if !ok{
+		return fmt.Errorf("%w, the leader (%s) is not connected", ErrNotLeader, leader)
+	}
+	seq, reply := s.proposals.expect()
+	defer s.proposals.cancel(seq)
+	if err := s.sendMessage(addr, &Message{Payload: MessageProposeMetadata{Seq: seq, Command: cmd}}); err != nil{
+		return err
+	}
+
+	select{
+	case err := <-reply:
+		return err
+	case <-time.After(10 * s.raft.ElectionTimeout):
+		return fmt.Errorf("leader (%s) did not answer the proposal in time", leader)
+	case <-s.quitch:
+		return ErrRaftStopped
+	}
+}
+
+// handleMessageProposeMetadata proposes what a follower handed us, only the leader takes it so it is never handed on
+func (s *FileServer) handleMessageProposeMetadata(from string, msg MessageProposeMetadata) error{
+	reply := MessageProposeMetadataReply{Seq: msg.Seq}
+	err := ErrNotLeader
+	if s.raft != nil{
+		var b []byte
+		if b, err = json.Marshal(msg.Command); err == nil{
+			err = s.raft.Propose(b)
+		}
+	}
+	if err != nil{
+		reply.Err = err.Error()
+	}
+	return s.sendMessage(from, &Message{Payload: reply})
+}
+
+func (s *FileServer) handleMessageProposeMetadataReply(msg MessageProposeMetadataReply){
+	var err error
+	if len(msg.Err) != 0{
+		err = errors.New(msg.Err)
+	}
+	s.proposals.done(msg.Seq, err)
+}
+
+// replicationFactor is the cluster wide replication factor if the metadata sets one, the configured one otherwise
+func (s *FileServer) replicationFactor() int{
+	if rf := s.meta.replicationFactor(); rf > 0{
+		return rf
+	}
+	return s.ReplicationFactor
+}
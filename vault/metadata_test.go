@@ -0,0 +1,116 @@
+package vault
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func applyMeta(t *testing.T, m *metadataMachine, cmd MetaCommand) error{
+	t.Helper()
+	b, err := json.Marshal(cmd)
+	if err != nil{
+		t.Fatal(err)
+	}
+	return m.Apply(b)
+}
+
+func TestMetadataMachine(t *testing.T){
+	m := newMetadataMachine()
+
+	for _, cmd := range []MetaCommand{
+		{Op: MetaAddMember, ID: "a", Addr: "10.0.0.1:3000"},
+		{Op: MetaAddNamespace, Namespace: "photos"},
+		{Op: MetaGrant, Namespace: "photos", Principal: "alice", Perm: PermRead | PermWrite},
+		{Op: MetaGrant, Namespace: "photos", Principal: "bob", Perm: PermAdmin},
+		{Op: MetaRevoke, Namespace: "photos", Principal: "alice", Perm: PermWrite},
+		{Op: MetaRotateKey, Epoch: 1},
+	}{
+		if err := applyMeta(t, m, cmd); err != nil{
+			t.Fatalf("%s: %s", cmd.Op, err)
+		}
+	}
+
+	if err := applyMeta(t, m, MetaCommand{Op: MetaRotateKey, Epoch: 3}); err == nil{
+		t.Errorf("expected skipping a key epoch to fail")
+	}
+
+	meta := m.Metadata()
+	if !meta.Allowed("photos", "alice", PermRead) || meta.Allowed("photos", "alice", PermWrite){
+		t.Errorf("alice should only be able to read, have %v", meta.ACLs["photos"]["alice"])
+	}
+	if !meta.Allowed("photos", "bob", PermDelete){
+		t.Errorf("an admin should hold every permission")
+	}
+	if meta.Allowed("videos", "alice", PermRead){
+		t.Errorf("nobody holds permissions on a namespace that doesn't exist")
+	}
+
+	snapshot, err := m.Snapshot()
+	if err != nil{
+		t.Fatal(err)
+	}
+	restored := newMetadataMachine()
+	if err := restored.Restore(snapshot); err != nil{
+		t.Fatal(err)
+	}
+	if got := restored.Metadata(); got.KeyEpoch != 1 || got.Members["a"] != "10.0.0.1:3000" || !got.Allowed("photos", "alice", PermRead){
+		t.Errorf("snapshot did not round trip, have %+v", got)
+	}
+}
+
+func TestMetadataOnEveryNode(t *testing.T){
+	opts := WithServerOptions(func(opts *FileServerOpts){
+		opts.RaftVoters = []string{"node-a", "node-b"}
+		opts.RaftElectionTimeout = 100 * time.Millisecond
+		opts.AntiEntropyInterval = 0
+	})
+	addr := freeAddr(t)
+	nodes := []*Node{startTestNode(t, WithID("node-a"), WithListenAddr(addr), opts)}
+	for _, id := range []string{"node-b", "node-c"}{
+		nodes = append(nodes, startTestNode(t, WithID(id), WithListenAddr(freeAddr(t)), WithBootstrap(addr), opts))
+	}
+	a, b, c := nodes[0].Server(), nodes[1].Server(), nodes[2].Server()
+	for _, n := range nodes{
+		s := n.Server()
+		waitFor(t, "the cluster to connect", func() bool{
+			s.peerLock.Lock()
+			defer s.peerLock.Unlock()
+			return len(s.peerIDs) == 2
+		})
+	}
+	waitFor(t, "every node to know the leader", func() bool{
+		leader := a.raft.Leader()
+		return len(leader) != 0 && b.raft.Leader() == leader && c.raft.Leader() == leader
+	})
+	follower := a
+	if st, _ := a.raft.State(); st == RaftLeader{
+		follower = b
+	}
+
+	// The voter that doesn't lead and the learner both hand their proposals to the leader
+	if err := follower.ProposeMetadata(MetaCommand{Op: MetaSetReplication, ReplicationFactor: 1}); err != nil{
+		t.Fatal(err)
+	}
+	if err := c.ProposeMetadata(MetaCommand{Op: MetaAddNamespace, Namespace: "photos"}); err != nil{
+		t.Fatal(err)
+	}
+	waitFor(t, "the metadata on every node", func() bool{
+		for _, s := range []*FileServer{a, b, c}{
+			if s.replicationFactor() != 1 || !s.Metadata().hasNamespace("photos"){
+				return false
+			}
+		}
+		return true
+	})
+
+	// Once there are members only they are placed, the same way on every node
+	for _, id := range []string{"node-a", "node-b"}{
+		if err := c.ProposeMetadata(MetaCommand{Op: MetaAddMember, ID: id}); err != nil{
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "node-c to be taken off the ring", func() bool{
+		return !a.ring.Has("node-c") && !b.ring.Has("node-c") && c.ring.Has("node-a") && c.ring.Has("node-b")
+	})
+}
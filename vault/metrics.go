@@ -0,0 +1,295 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A node keeps counters of what it does and serves them in the Prometheus text format on the admin port:
+//
+//	GET /metrics    every metric of the node
+//
+// The counters start at zero with the process, per peer ones go away with the connection.
+
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metricVec is a counter or gauge with a series per combination of label values
+type metricVec struct{
+	name string
+	help string
+	kind string
+	labels []string
+
+	mu sync.Mutex
+	series map[string]*series
+}
+
+type series struct{
+	values []string
+	v atomic.Int64
+}
+
+func newCounter(name string, help string, labels ...string) *metricVec{
+	return &metricVec{name: name, help: help, kind: "counter", labels: labels, series: map[string]*series{}}
+}
+
+func newGauge(name string, help string, labels ...string) *metricVec{
+	return &metricVec{name: name, help: help, kind: "gauge", labels: labels, series: map[string]*series{}}
+}
+
+// with is the series of the given label values, created at zero
+func (m *metricVec) with(values ...string) *atomic.Int64{
+	id := strings.Join(values, "\x00")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.series[id]; ok{
+		return &s.v
+	}
+	s := &series{values: values}
+	m.series[id] = s
+	return &s.v
+}
+
+func (m *metricVec) add(n int64, values ...string){
+	m.with(values...).Add(n)
+}
+
+// delete drops the series of the given label values
+func (m *metricVec) delete(values ...string){
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.series, strings.Join(values, "\x00"))
+}
+
+func (m *metricVec) writeTo(w io.Writer){
+	writeHeader(w, m.name, m.help, m.kind)
+	m.mu.Lock()
+	ids := make([]string, 0, len(m.series))
+	for id := range m.series{
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids{
+		s := m.series[id]
+		fmt.Fprintf(w, "%s%s %d\n", m.name, labelSet(m.labels, s.values), s.v.Load())
+	}
+	m.mu.Unlock()
+}
+
+// histogram counts observations in cumulative buckets
+type histogram struct{
+	name string
+	help string
+	buckets []float64
+
+	mu sync.Mutex
+	counts []uint64
+	sum float64
+	count uint64
+}
+
+func newHistogram(name string, help string, buckets []float64) *histogram{
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64){
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range h.buckets{
+		if v <= le{
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// since observes the seconds since start
+func (h *histogram) since(start time.Time){
+	h.observe(time.Since(start).Seconds())
+}
+
+func (h *histogram) writeTo(w io.Writer){
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range h.buckets{
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(le), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string){
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelSet(names []string, values []string) string{
+	if len(names) == 0{
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names{
+		pairs[i] = name + "=\"" + labelEscaper.Replace(values[i]) + "\""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string{
+	if math.IsInf(v, 1){
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metrics are the counters of a node
+type metrics struct{
+	peerSent *metricVec
+	peerReceived *metricVec
+	storeDuration *histogram
+	getDuration *histogram
+	replications *metricVec
+	streams *metricVec
+	decodeErrors *metricVec
+	scrubFindings *metricVec
+}
+
+func newMetrics() *metrics{
+	return &metrics{
+		peerSent: newCounter("distri_vault_peer_sent_bytes_total", "Bytes sent to a peer connection.", "peer"),
+		peerReceived: newCounter("distri_vault_peer_received_bytes_total", "Bytes received from a peer connection.", "peer"),
+		storeDuration: newHistogram("distri_vault_store_duration_seconds", "Time a Store took, replication included.", latencyBuckets),
+		getDuration: newHistogram("distri_vault_get_duration_seconds", "Time a Get took to find its file, locally or on the network.", latencyBuckets),
+		replications: newCounter("distri_vault_replications_total", "Replicas streamed to peers on Store, by result.", "result"),
+		streams: newGauge("distri_vault_active_streams", "Object streams in progress, by direction.", "direction"),
+		decodeErrors: newCounter("distri_vault_decode_errors_total", "Messages from peers that could not be decoded."),
+		scrubFindings: newCounter("distri_vault_scrub_findings_total", "Problems the shard repair checks found, by kind.", "kind"),
+	}
+}
+
+// writeTo writes every metric of s in the Prometheus text format
+func (m *metrics) writeTo(w io.Writer, s *FileServer){
+	m.peerSent.writeTo(w)
+	m.peerReceived.writeTo(w)
+	m.storeDuration.writeTo(w)
+	m.getDuration.writeTo(w)
+	m.replications.writeTo(w)
+	m.streams.writeTo(w)
+	m.decodeErrors.writeTo(w)
+	m.scrubFindings.writeTo(w)
+
+	writeHeader(w, "distri_vault_disk_usage_bytes", "Bytes of the files under the storage root.", "gauge")
+	fmt.Fprintf(w, "distri_vault_disk_usage_bytes %d\n", diskUsage(s.store.Root))
+}
+
+// diskUsage adds up the size of the files under root
+func diskUsage(root string) int64{
+	var total int64
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error{
+		if err != nil || d.IsDir(){
+			return nil
+		}
+		if info, err := d.Info(); err == nil{
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// stream counts a stream in progress in direction, "in" or "out", until the returned func is called
+func (m *metrics) stream(direction string) (done func()){
+	n := m.streams.with(direction)
+	n.Add(1)
+	return func(){
+		n.Add(-1)
+	}
+}
+
+// countingConn counts the bytes of a peer connection
+type countingConn struct{
+	net.Conn
+	sent *atomic.Int64
+	received *atomic.Int64
+}
+
+func (c countingConn) Read(b []byte) (int, error){
+	n, err := c.Conn.Read(b)
+	c.received.Add(int64(n))
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (int, error){
+	n, err := c.Conn.Write(b)
+	c.sent.Add(int64(n))
+	return n, err
+}
+
+// countConn is the WrapConn of the transport
+func (s *FileServer) countConn(conn net.Conn) net.Conn{
+	addr := conn.RemoteAddr().String()
+	return countingConn{
+		Conn: conn,
+		sent: s.metrics.peerSent.with(addr),
+		received: s.metrics.peerReceived.with(addr),
+	}
+}
+
+// dropPeerMetrics forgets the counters of a connection that is gone
+func (s *FileServer) dropPeerMetrics(addr string){
+	s.metrics.peerSent.delete(addr)
+	s.metrics.peerReceived.delete(addr)
+}
+
+// Metrics returns the HTTP handler of the admin port, it is served on AdminAddr if that is set
+func (s *FileServer) Metrics() http.Handler{
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request){
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.metrics.writeTo(w, s)
+	})
+	return mux
+}
+
+func (s *FileServer) startAdmin() error{
+	if len(s.AdminAddr) == 0{
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", s.AdminAddr)
+	if err != nil{
+		return err
+	}
+	s.admin = &http.Server{
+		Handler: s.Metrics(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func(){
+		if err := s.admin.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed){
+			s.logger("admin").Error("admin server error", "err", err)
+		}
+	}()
+	s.logger("admin").Info("admin server listening", "addr", ln.Addr().String())
+	return nil
+}
+
+func (s *FileServer) stopAdmin(){
+	if s.admin != nil{
+		s.admin.Close()
+	}
+}
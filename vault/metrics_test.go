@@ -0,0 +1,75 @@
+package vault
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T){
+	n := startTestNode(t)
+	s := n.Server()
+	ctx := context.Background()
+
+	if _, err := n.Put(ctx, "docs/a.txt", strings.NewReader("hello metrics")); err != nil{
+		t.Fatal(err)
+	}
+	rc, err := n.Get(ctx, "docs/a.txt")
+	if err != nil{
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, rc)
+	rc.Close()
+
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := s.countConn(a)
+	go io.Copy(io.Discard, b)
+	conn.Write([]byte("12345"))
+
+	scrape := func() string{
+		w := httptest.NewRecorder()
+		s.Metrics().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain"){
+			t.Errorf("unexpected content type %q", w.Header().Get("Content-Type"))
+		}
+		return w.Body.String()
+	}
+	body := scrape()
+	for _, line := range []string{
+		"# TYPE distri_vault_store_duration_seconds histogram",
+		"distri_vault_store_duration_seconds_count 1",
+		"distri_vault_get_duration_seconds_count 1",
+		`distri_vault_get_duration_seconds_bucket{le="+Inf"} 1`,
+		`distri_vault_peer_sent_bytes_total{peer="pipe"} 5`,
+		`distri_vault_peer_received_bytes_total{peer="pipe"} 0`,
+		"distri_vault_decode_errors_total",
+	}{
+		if !strings.Contains(body, line+"\n") && !strings.Contains(body, line+" "){
+			t.Errorf("expected %q in\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, "distri_vault_disk_usage_bytes 0\n"){
+		t.Errorf("expected the stored file to count towards the disk usage")
+	}
+
+	s.dropPeerMetrics("pipe")
+	if strings.Contains(scrape(), `peer="pipe"`){
+		t.Errorf("expected the series of a closed connection to be dropped")
+	}
+}
+
+func TestMetricLabels(t *testing.T){
+	m := newCounter("test_total", "Test.", "kind")
+	m.add(2, `a "quoted"\name`)
+
+	w := new(strings.Builder)
+	m.writeTo(w)
+	want := "# HELP test_total Test.\n# TYPE test_total counter\n" + `test_total{kind="a \"quoted\"\\name"} 2` + "\n"
+	if w.String() != want{
+		t.Errorf("expected\n%s\nhave\n%s", want, w.String())
+	}
+}
@@ -0,0 +1,100 @@
+package vault
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+	"github.com/ayushn2/distri_vault.git/p2p"
+	"github.com/ayushn2/distri_vault.git/store"
+)
+
+// A node has to come back with the same ID and keys after a restart, otherwise it can't find or decrypt the files it
+// stored before. They are generated on first start and kept in the storage root.
+
+const identityFile = ".identity.json"
+
+type nodeIdentity struct{
+	ID string
+	EncKey string
+	SigningKey string
+}
+
+// loadIdentity fills in the ID and keys opts doesn't set from the identity kept in root, creating it if there is none
+func loadIdentity(root string, opts *FileServerOpts) error{
+	path := filepath.Join(root, identityFile)
+
+	var id nodeIdentity
+	if err := readJSON(path, &id); err != nil{
+		return fmt.Errorf("reading node identity: %w", err)
+	}
+
+	if len(id.ID) == 0{
+		id.ID = crypto.GenerateID()
+	}
+	if len(id.EncKey) == 0{
+		id.EncKey = hex.EncodeToString(crypto.NewEncryptionKey())
+	}
+	if len(id.SigningKey) == 0{
+		id.SigningKey = hex.EncodeToString(crypto.NewSigningKey())
+	}
+	if err := writeJSON(path, id); err != nil{
+		return err
+	}
+
+	if len(opts.ID) == 0{
+		opts.ID = id.ID
+	}
+	if len(opts.EncKey) == 0{
+		key, err := hex.DecodeString(id.EncKey)
+		if err != nil{
+			return fmt.Errorf("corrupt encryption key in %s", path)
+		}
+		opts.EncKey = key
+	}
+	if opts.SigningKey == nil{
+		key, err := hex.DecodeString(id.SigningKey)
+		if err != nil || len(key) != ed25519.PrivateKeySize{
+			return fmt.Errorf("corrupt signing key in %s", path)
+		}
+		opts.SigningKey = ed25519.PrivateKey(key)
+	}
+	return nil
+}
+
+// newNode sets up a file server listening over TCP
+func newNode(opts FileServerOpts, tcpOpts p2p.TCPTransportOpts) (*FileServer, error){
+	if len(opts.StorageRoot) == 0{
+		opts.StorageRoot = store.DefaultRootFolderName
+	}
+	if err := os.MkdirAll(opts.StorageRoot, os.ModePerm); err != nil{
+		return nil, err
+	}
+	if err := loadIdentity(opts.StorageRoot, &opts); err != nil{
+		return nil, err
+	}
+	if opts.PathTransformFunc == nil{
+		opts.PathTransformFunc = CASPathTransformFunc
+	}
+
+	if tcpOpts.Logger == nil{
+		if opts.Logger == nil{
+			opts.Logger = defaultLogger()
+		}
+		if opts.LogLevels == nil{
+			opts.LogLevels = new(LogLevels)
+		}
+		tcpOpts.Logger = componentLogger(opts.Logger.With("node", opts.ID), opts.LogLevels, "transport")
+	}
+	tcpTransport := p2p.NewTCPTransport(tcpOpts)
+	opts.Transport = tcpTransport
+
+	s := NewFileServer(opts)
+	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
+	tcpTransport.WrapConn = s.countConn
+	return s, nil
+}
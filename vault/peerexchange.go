@@ -0,0 +1,196 @@
+package vault
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Peer exchange lets a node that only knows its bootstrap nodes find the rest of the cluster. Every hello carries the
+// listen address the node advertises, on connect both sides hand each other their address book, and the books are
+// gossiped again periodically. A node keeps dialing addresses from its book until it has TargetPeers connections.
+
+const (
+	defaultTargetPeers = 8
+	defaultPeerExchangeInterval = 30 * time.Second
+)
+
+// PeerInfo is what we know about a node from the address book
+type PeerInfo struct{
+	ID string
+	Addr string
+	Capabilities []string
+}
+
+type MessagePeerExchange struct{
+	Peers []PeerInfo
+}
+
+type peerBook struct{
+	mu sync.Mutex
+	peers map[string]PeerInfo
+}
+
+func (s *FileServer) targetPeers() int{
+	if s.TargetPeers <= 0{
+		return defaultTargetPeers
+	}
+	return s.TargetPeers
+}
+
+func (s *FileServer) peerExchangeInterval() time.Duration{
+	if s.PeerExchangeInterval <= 0{
+		return defaultPeerExchangeInterval
+	}
+	return s.PeerExchangeInterval
+}
+
+// advertiseAddr is the address other nodes can reach our listener on
+func (s *FileServer) advertiseAddr() string{
+	if len(s.AdvertiseAddr) != 0{
+		return s.AdvertiseAddr
+	}
+	return s.Transport.Addr()
+}
+
+// capabilities lists the optional features this node speaks, so peers can tell what to expect from it
+func (s *FileServer) capabilities() []string{
+	caps := []string{"replication", "erasure-coding", "versioning", "tombstones", "hints", "swim"}
+	if s.AntiEntropyInterval > 0{
+		caps = append(caps, "anti-entropy")
+	}
+	return caps
+}
+
+// KnownPeers returns the address book, sorted by node ID
+func (s *FileServer) KnownPeers() []PeerInfo{
+	b := &s.book
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	peers := make([]PeerInfo, 0, len(b.peers))
+	for _, p := range b.peers{
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool{ return peers[i].ID < peers[j].ID })
+	return peers
+}
+
+// PeerStatus is what we know about another node, for display
+type PeerStatus struct{
+	ID string
+	Addr string
+	// State is the failure detector's view of the node, empty if it never joined
+	State string
+	Connected bool
+}
+
+// Peers returns every node we know of from the address book or the failure detector, sorted by node ID
+func (s *FileServer) Peers() []PeerStatus{
+	byID := make(map[string]*PeerStatus)
+	for _, p := range s.KnownPeers(){
+		byID[p.ID] = &PeerStatus{ID: p.ID, Addr: p.Addr}
+	}
+	for id, state := range s.Members(){
+		if _, ok := byID[id]; !ok{
+			byID[id] = &PeerStatus{ID: id}
+		}
+		byID[id].State = state.String()
+	}
+
+	peers := make([]PeerStatus, 0, len(byID))
+	for id, p := range byID{
+		if addr, ok := s.peerAddr(id); ok{
+			p.Connected = true
+			if len(p.Addr) == 0{
+				p.Addr = addr
+			}
+		}
+		peers = append(peers, *p)
+	}
+	sort.Slice(peers, func(i, j int) bool{ return peers[i].ID < peers[j].ID })
+	return peers
+}
+
+// learnPeers adds peers to the address book and returns the ones we didn't know yet
+func (s *FileServer) learnPeers(peers ...PeerInfo) []PeerInfo{
+	b := &s.book
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.peers == nil{
+		b.peers = make(map[string]PeerInfo)
+	}
+
+	learned := []PeerInfo{}
+	for _, p := range peers{
+		if p.ID == s.ID || len(p.Addr) == 0{
+			continue
+		}
+		if cur, ok := b.peers[p.ID]; ok && cur.Addr == p.Addr{
+			continue
+		}
+		b.peers[p.ID] = p
+		learned = append(learned, p)
+	}
+	return learned
+}
+
+func (s *FileServer) forgetPeer(id string){
+	b := &s.book
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.peers, id)
+}
+
+func (s *FileServer) sendPeerExchange(to string) error{
+	return s.sendMessage(to, &Message{Payload: MessagePeerExchange{Peers: s.KnownPeers()}})
+}
+
+func (s *FileServer) handleMessagePeerExchange(from string, msg MessagePeerExchange) error{
+	if learned := s.learnPeers(msg.Peers...); len(learned) > 0{
+		s.logger("peers").Info("learned new peers", "peer", from, "learned", len(learned))
+	}
+	s.fillConnections()
+	return nil
+}
+
+// fillConnections dials nodes from the address book we are not connected to, until we have TargetPeers connections
+func (s *FileServer) fillConnections(){
+	missing := s.targetPeers() - len(s.allPeers())
+	if missing <= 0{
+		return
+	}
+
+	for _, p := range s.KnownPeers(){
+		if missing == 0{
+			return
+		}
+		if _, ok := s.peerAddr(p.ID); ok{
+			continue
+		}
+		missing--
+
+		go func(addr string){
+			if err := s.dial(addr); err != nil{
+				s.logger("peers").Warn("dial from peer exchange failed", "peer", addr, "err", err)
+			}
+		}(p.Addr)
+	}
+}
+
+func (s *FileServer) peerExchangeLoop(){
+	ticker := time.NewTicker(s.peerExchangeInterval())
+	defer ticker.Stop()
+
+	for{
+		select{
+		case <-ticker.C:
+			s.broadcast(context.Background(), &Message{Payload: MessagePeerExchange{Peers: s.KnownPeers()}})
+			s.fillConnections()
+		case <-s.quitch:
+			return
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package vault
+
+import "testing"
+
+func TestLearnPeers(t *testing.T){
+	s := newTestServer(t.TempDir())
+
+	learned := s.learnPeers(
+		PeerInfo{ID: "b", Addr: "10.0.0.2:3000"},
+		PeerInfo{ID: s.ID, Addr: "10.0.0.1:3000"},
+		PeerInfo{ID: "c"},
+	)
+	if len(learned) != 1 || learned[0].ID != "b"{
+		t.Fatalf("expected to only learn about b, have %v", learned)
+	}
+
+	if learned := s.learnPeers(PeerInfo{ID: "b", Addr: "10.0.0.2:3000"}); len(learned) != 0{
+		t.Errorf("expected nothing new, have %v", learned)
+	}
+	if learned := s.learnPeers(PeerInfo{ID: "b", Addr: "10.0.0.9:3000"}); len(learned) != 1{
+		t.Errorf("expected a changed address to be learned")
+	}
+}
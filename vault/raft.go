@@ -0,0 +1,795 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Raft replicates a log of commands to a fixed set of voters and applies the committed ones to a state machine in the
+// same order on every node. It is transport agnostic: outgoing messages go through RaftOpts.Send and incoming ones are
+// handed to Step, the file server carries them as regular messages over p2p.Transport.
+// Once enough entries were applied the state machine is snapshotted and the log before it is dropped, followers that
+// fell behind the snapshot are sent the snapshot instead of the entries.
+
+const (
+	defaultElectionTimeout = time.Second
+	defaultSnapshotThreshold = 1024
+	maxAppendEntries = 64
+)
+
+var (
+	ErrNotLeader = errors.New("not the raft leader")
+	ErrProposalDropped = errors.New("proposal was overwritten by another leader")
+	ErrRaftStopped = errors.New("raft stopped")
+)
+
+type RaftState int
+
+const (
+	RaftFollower RaftState = iota
+	RaftCandidate
+	RaftLeader
+)
+
+func (st RaftState) String() string{
+	switch st{
+	case RaftFollower:
+		return "follower"
+	case RaftCandidate:
+		return "candidate"
+	case RaftLeader:
+		return "leader"
+	}
+	return "unknown"
+}
+
+// StateMachine is what the replicated log is applied to
+type StateMachine interface{
+	Apply(cmd []byte) error
+	Snapshot() ([]byte, error)
+	Restore(snapshot []byte) error
+}
+
+// RaftEntry is one slot of the replicated log, a nil command is the no-op a new leader starts its term with
+type RaftEntry struct{
+	Index uint64
+	Term uint64
+	Command []byte
+}
+
+type MessageRequestVote struct{
+	From string
+	Term uint64
+	LastLogIndex uint64
+	LastLogTerm uint64
+}
+
+type MessageVote struct{
+	From string
+	Term uint64
+	Granted bool
+}
+
+type MessageAppendEntries struct{
+	From string
+	Term uint64
+	PrevLogIndex uint64
+	PrevLogTerm uint64
+	Entries []RaftEntry
+	LeaderCommit uint64
+}
+
+// MessageAppendEntriesReply answers both appends and snapshots. MatchIndex is the last index known to match the
+// leader on success and a hint where to retry from on failure.
+type MessageAppendEntriesReply struct{
+	From string
+	Term uint64
+	Success bool
+	MatchIndex uint64
+}
+
+type MessageInstallSnapshot struct{
+	From string
+	Term uint64
+	LastIndex uint64
+	LastTerm uint64
+	Data []byte
+}
+
+type RaftOpts struct{
+	ID string
+	// Voters are the IDs of every node of the raft group, this one included unless the node is a learner
+	Voters []string
+	// Learners returns the nodes the leader replicates the log to on top of the voters. They never vote or stand for
+	// election and don't count towards a quorum, they just keep a copy of the state machine.
+	Learners func() []string
+	Send func(to string, msg any) error
+	StateMachine StateMachine
+	// Dir holds the term, vote, log and snapshot, nothing is persisted if empty
+	Dir string
+	// ElectionTimeout is the minimum time without a leader before an election, heartbeats go out five times as often
+	ElectionTimeout time.Duration
+	// SnapshotThreshold is the number of applied entries kept in the log before it is compacted
+	SnapshotThreshold int
+	// Logger is where the node logs to, the default logger of the package if not set
+	Logger *slog.Logger
+}
+
+type raftMessage struct{
+	to string
+	msg any
+}
+
+type proposal struct{
+	term uint64
+	done chan error
+}
+
+type Raft struct{
+	RaftOpts
+
+	mu sync.Mutex
+	state RaftState
+	term uint64
+	votedFor string
+	leader string
+
+	// log holds the entries after the snapshot, the snapshot covers everything up to snapIndex
+	log []RaftEntry
+	snapIndex uint64
+	snapTerm uint64
+	snapshot []byte
+
+	commitIndex uint64
+	lastApplied uint64
+
+	votes map[string]bool
+	nextIndex map[string]uint64
+	matchIndex map[string]uint64
+	proposals map[uint64]proposal
+
+	electionDeadline time.Time
+	lastHeartbeat time.Time
+	outbox []raftMessage
+	quitch chan struct{}
+	stopOnce sync.Once
+}
+
+func NewRaft(opts RaftOpts) (*Raft, error){
+	if opts.ElectionTimeout <= 0{
+		opts.ElectionTimeout = defaultElectionTimeout
+	}
+	if opts.SnapshotThreshold <= 0{
+		opts.SnapshotThreshold = defaultSnapshotThreshold
+	}
+	if opts.Logger == nil{
+		opts.Logger = componentLogger(defaultLogger().With("node", opts.ID), new(LogLevels), "raft")
+	}
+	r := &Raft{
+		RaftOpts: opts,
+		proposals: make(map[uint64]proposal),
+		quitch: make(chan struct{}),
+	}
+	if err := r.load(); err != nil{
+		return nil, err
+	}
+	r.resetElectionDeadline()
+	return r, nil
+}
+
+// Start runs the election and heartbeat timers until Stop
+func (r *Raft) Start(){
+	ticker := time.NewTicker(r.heartbeatInterval() / 2)
+	defer ticker.Stop()
+
+	for{
+		select{
+		case <-ticker.C:
+			r.mu.Lock()
+			r.tick()
+			out := r.takeOutbox()
+			r.mu.Unlock()
+			r.flush(out)
+		case <-r.quitch:
+			return
+		}
+	}
+}
+
+func (r *Raft) Stop(){
+	r.stopOnce.Do(func(){
+		close(r.quitch)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for index, p := range r.proposals{
+			p.done <- ErrRaftStopped
+			delete(r.proposals, index)
+		}
+	})
+}
+
+// State returns the role of the node and the current term
+func (r *Raft) State() (RaftState, uint64){
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state, r.term
+}
+
+// Leader returns the ID of the leader of the current term, empty if there is none we know of
+func (r *Raft) Leader() string{
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leader
+}
+
+// Propose appends cmd to the log and waits until it was committed and applied on this node. It fails with
+// ErrNotLeader on any node but the leader.
+func (r *Raft) Propose(cmd []byte) error{
+	r.mu.Lock()
+	if r.state != RaftLeader{
+		r.mu.Unlock()
+		return ErrNotLeader
+	}
+
+	index := r.appendEntry(cmd)
+	done := make(chan error, 1)
+	r.proposals[index] = proposal{term: r.term, done: done}
+	r.broadcastAppend()
+	r.advanceCommit()
+	out := r.takeOutbox()
+	r.mu.Unlock()
+	r.flush(out)
+
+	select{
+	case err := <-done:
+		return err
+	case <-time.After(10 * r.ElectionTimeout):
+		return fmt.Errorf("proposal %d was not committed in time", index)
+	case <-r.quitch:
+		return ErrRaftStopped
+	}
+}
+
+// Step handles a message from another member of the group
+func (r *Raft) Step(msg any){
+	r.mu.Lock()
+	switch m := msg.(type){
+	case MessageRequestVote:
+		r.handleRequestVote(m)
+	case MessageVote:
+		r.handleVote(m)
+	case MessageAppendEntries:
+		r.handleAppendEntries(m)
+	case MessageAppendEntriesReply:
+		r.handleAppendEntriesReply(m)
+	case MessageInstallSnapshot:
+		r.handleInstallSnapshot(m)
+	}
+	out := r.takeOutbox()
+	r.mu.Unlock()
+	r.flush(out)
+}
+
+func (r *Raft) heartbeatInterval() time.Duration{
+	return r.ElectionTimeout / 5
+}
+
+func (r *Raft) resetElectionDeadline(){
+	jitter := time.Duration(rand.Int63n(int64(r.ElectionTimeout)))
+	r.electionDeadline = time.Now().Add(r.ElectionTimeout + jitter)
+}
+
+func (r *Raft) quorum() int{
+	return len(r.Voters)/2 + 1
+}
+
+func (r *Raft) others() []string{
+	ids := []string{}
+	for _, id := range r.Voters{
+		if id != r.ID{
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// voter reports whether the node votes, a learner only follows
+func (r *Raft) voter() bool{
+	return contains(r.Voters, r.ID)
+}
+
+// replicas are the nodes the leader sends the log to, the other voters and the learners
+func (r *Raft) replicas() []string{
+	ids := r.others()
+	if r.Learners == nil{
+		return ids
+	}
+	for _, id := range r.Learners(){
+		if id != r.ID && !contains(ids, id){
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (r *Raft) send(to string, msg any){
+	r.outbox = append(r.outbox, raftMessage{to: to, msg: msg})
+}
+
+func (r *Raft) takeOutbox() []raftMessage{
+	out := r.outbox
+	r.outbox = nil
+	return out
+}
+
+// flush sends the messages queued while the lock was held, a message that can't be delivered is simply lost and
+// covered by the next heartbeat or election
+func (r *Raft) flush(out []raftMessage){
+	for _, m := range out{
+		if err := r.Send(m.to, m.msg); err != nil{
+			r.Logger.Debug("raft send failed", "to", m.to, "err", err)
+		}
+	}
+}
+
+func (r *Raft) tick(){
+	now := time.Now()
+	if r.state == RaftLeader{
+		if now.Sub(r.lastHeartbeat) >= r.heartbeatInterval(){
+			r.broadcastAppend()
+		}
+		return
+	}
+	if now.After(r.electionDeadline) && r.voter(){
+		r.startElection()
+	}
+}
+
+func (r *Raft) lastIndex() uint64{
+	return r.snapIndex + uint64(len(r.log))
+}
+
+func (r *Raft) lastTerm() uint64{
+	if len(r.log) == 0{
+		return r.snapTerm
+	}
+	return r.log[len(r.log)-1].Term
+}
+
+// termAt returns the term of the entry at index, false if the entry is compacted away or not there yet
+func (r *Raft) termAt(index uint64) (uint64, bool){
+	if index == r.snapIndex{
+		return r.snapTerm, true
+	}
+	if index < r.snapIndex || index > r.lastIndex(){
+		return 0, false
+	}
+	return r.log[index-r.snapIndex-1].Term, true
+}
+
+func (r *Raft) entry(index uint64) RaftEntry{
+	return r.log[index-r.snapIndex-1]
+}
+
+func (r *Raft) appendEntry(cmd []byte) uint64{
+	index := r.lastIndex() + 1
+	r.log = append(r.log, RaftEntry{Index: index, Term: r.term, Command: cmd})
+	r.persistLog()
+	return index
+}
+
+func (r *Raft) becomeFollower(term uint64, leader string){
+	if term > r.term{
+		r.term = term
+		r.votedFor = ""
+		r.persistState()
+	}
+	if r.state == RaftLeader{
+		r.Logger.Info("stepping down as raft leader", "term", r.term)
+	}
+	r.state = RaftFollower
+	r.leader = leader
+	r.resetElectionDeadline()
+}
+
+func (r *Raft) startElection(){
+	r.state = RaftCandidate
+	r.term++
+	r.votedFor = r.ID
+	r.leader = ""
+	r.votes = map[string]bool{r.ID: true}
+	r.persistState()
+	r.resetElectionDeadline()
+
+	if len(r.votes) >= r.quorum(){
+		r.becomeLeader()
+		return
+	}
+
+	for _, id := range r.others(){
+		r.send(id, MessageRequestVote{
+			From: r.ID,
+			Term: r.term,
+			LastLogIndex: r.lastIndex(),
+			LastLogTerm: r.lastTerm(),
+		})
+	}
+}
+
+func (r *Raft) becomeLeader(){
+	r.Logger.Info("became raft leader", "term", r.term)
+
+	r.state = RaftLeader
+	r.leader = r.ID
+	r.nextIndex = make(map[string]uint64)
+	r.matchIndex = make(map[string]uint64)
+	for _, id := range r.others(){
+		r.nextIndex[id] = r.lastIndex() + 1
+	}
+
+	// Entries of earlier terms can only be committed through an entry of the current one
+	r.appendEntry(nil)
+	r.broadcastAppend()
+	r.advanceCommit()
+}
+
+func (r *Raft) handleRequestVote(m MessageRequestVote){
+	if m.Term > r.term{
+		r.becomeFollower(m.Term, "")
+	}
+
+	upToDate := m.LastLogTerm > r.lastTerm() || (m.LastLogTerm == r.lastTerm() && m.LastLogIndex >= r.lastIndex())
+	granted := m.Term == r.term && (r.votedFor == "" || r.votedFor == m.From) && upToDate
+	if granted{
+		r.votedFor = m.From
+		r.persistState()
+		r.resetElectionDeadline()
+	}
+	r.send(m.From, MessageVote{From: r.ID, Term: r.term, Granted: granted})
+}
+
+func (r *Raft) handleVote(m MessageVote){
+	if m.Term > r.term{
+		r.becomeFollower(m.Term, "")
+		return
+	}
+	if r.state != RaftCandidate || m.Term != r.term || !m.Granted{
+		return
+	}
+
+	r.votes[m.From] = true
+	if len(r.votes) >= r.quorum(){
+		r.becomeLeader()
+	}
+}
+
+func (r *Raft) broadcastAppend(){
+	r.lastHeartbeat = time.Now()
+	for _, id := range r.replicas(){
+		r.sendAppend(id)
+	}
+}
+
+func (r *Raft) sendAppend(to string){
+	// A learner that showed up during the term is probed from the end of the log like everyone else
+	next, ok := r.nextIndex[to]
+	if !ok{
+		next = r.lastIndex() + 1
+		r.nextIndex[to] = next
+	}
+	if next <= r.snapIndex{
+		r.send(to, MessageInstallSnapshot{
+			From: r.ID,
+			Term: r.term,
+			LastIndex: r.snapIndex,
+			LastTerm: r.snapTerm,
+			Data: r.snapshot,
+		})
+		return
+	}
+
+	prev := next - 1
+	prevTerm, _ := r.termAt(prev)
+	entries := []RaftEntry{}
+	for i := next; i <= r.lastIndex() && len(entries) < maxAppendEntries; i++{
+		entries = append(entries, r.entry(i))
+	}
+
+	r.send(to, MessageAppendEntries{
+		From: r.ID,
+		Term: r.term,
+		PrevLogIndex: prev,
+		PrevLogTerm: prevTerm,
+		Entries: entries,
+		LeaderCommit: r.commitIndex,
+	})
+}
+
+func (r *Raft) handleAppendEntries(m MessageAppendEntries){
+	if m.Term < r.term{
+		r.send(m.From, MessageAppendEntriesReply{From: r.ID, Term: r.term})
+		return
+	}
+	r.becomeFollower(m.Term, m.From)
+
+	reject := func(hint uint64){
+		r.send(m.From, MessageAppendEntriesReply{From: r.ID, Term: r.term, MatchIndex: hint})
+	}
+
+	// Entries up to the snapshot are committed and therefore identical to the leader's, skip over them
+	prev, prevTerm, entries := m.PrevLogIndex, m.PrevLogTerm, m.Entries
+	for prev < r.snapIndex && len(entries) > 0{
+		prev, prevTerm, entries = entries[0].Index, entries[0].Term, entries[1:]
+	}
+	if prev < r.snapIndex{
+		reject(r.snapIndex)
+		return
+	}
+	if prev > r.lastIndex(){
+		reject(r.lastIndex())
+		return
+	}
+	if term, _ := r.termAt(prev); term != prevTerm{
+		reject(r.commitIndex)
+		return
+	}
+
+	changed := false
+	for _, e := range entries{
+		if e.Index <= r.lastIndex(){
+			if term, _ := r.termAt(e.Index); term == e.Term{
+				continue
+			}
+			r.truncate(e.Index)
+		}
+		r.log = append(r.log, e)
+		changed = true
+	}
+	if changed{
+		r.persistLog()
+	}
+
+	lastNew := prev + uint64(len(entries))
+	if m.LeaderCommit > r.commitIndex{
+		r.commitIndex = min(m.LeaderCommit, lastNew)
+		r.apply()
+	}
+	r.send(m.From, MessageAppendEntriesReply{From: r.ID, Term: r.term, Success: true, MatchIndex: lastNew})
+}
+
+// truncate drops the entries from index on, proposals waiting for them lost to another leader
+func (r *Raft) truncate(index uint64){
+	for i := index; i <= r.lastIndex(); i++{
+		if p, ok := r.proposals[i]; ok{
+			p.done <- ErrProposalDropped
+			delete(r.proposals, i)
+		}
+	}
+	r.log = r.log[:index-r.snapIndex-1]
+}
+
+func (r *Raft) handleAppendEntriesReply(m MessageAppendEntriesReply){
+	if m.Term > r.term{
+		r.becomeFollower(m.Term, "")
+		return
+	}
+	if r.state != RaftLeader || m.Term != r.term{
+		return
+	}
+
+	if m.Success{
+		if m.MatchIndex > r.matchIndex[m.From]{
+			r.matchIndex[m.From] = m.MatchIndex
+		}
+		r.nextIndex[m.From] = r.matchIndex[m.From] + 1
+		r.advanceCommit()
+		if r.nextIndex[m.From] <= r.lastIndex(){
+			r.sendAppend(m.From)
+		}
+		return
+	}
+
+	next := m.MatchIndex + 1
+	if next >= r.nextIndex[m.From] && r.nextIndex[m.From] > 1{
+		next = r.nextIndex[m.From] - 1
+	}
+	r.nextIndex[m.From] = max(next, 1)
+	r.sendAppend(m.From)
+}
+
+// advanceCommit commits the highest entry of the current term a majority of the voters has
+func (r *Raft) advanceCommit(){
+	for index := r.lastIndex(); index > r.commitIndex; index--{
+		if term, _ := r.termAt(index); term != r.term{
+			return
+		}
+
+		replicas := 1
+		for _, id := range r.others(){
+			if r.matchIndex[id] >= index{
+				replicas++
+			}
+		}
+		if replicas >= r.quorum(){
+			r.commitIndex = index
+			r.apply()
+			return
+		}
+	}
+}
+
+func (r *Raft) apply(){
+	for r.lastApplied < r.commitIndex{
+		r.lastApplied++
+		e := r.entry(r.lastApplied)
+
+		var err error
+		if e.Command != nil{
+			err = r.StateMachine.Apply(e.Command)
+		}
+		if p, ok := r.proposals[e.Index]; ok{
+			if p.term != e.Term{
+				err = ErrProposalDropped
+			}
+			p.done <- err
+			delete(r.proposals, e.Index)
+		}
+	}
+	r.compact()
+}
+
+// compact snapshots the state machine once SnapshotThreshold applied entries piled up in the log
+func (r *Raft) compact(){
+	if r.lastApplied-r.snapIndex < uint64(r.SnapshotThreshold){
+		return
+	}
+
+	data, err := r.StateMachine.Snapshot()
+	if err != nil{
+		r.Logger.Error("raft snapshot error", "err", err)
+		return
+	}
+
+	term, _ := r.termAt(r.lastApplied)
+	r.log = append([]RaftEntry{}, r.log[r.lastApplied-r.snapIndex:]...)
+	r.snapIndex, r.snapTerm, r.snapshot = r.lastApplied, term, data
+	r.persistSnapshot()
+	r.persistLog()
+}
+
+func (r *Raft) handleInstallSnapshot(m MessageInstallSnapshot){
+	if m.Term < r.term{
+		r.send(m.From, MessageAppendEntriesReply{From: r.ID, Term: r.term})
+		return
+	}
+	r.becomeFollower(m.Term, m.From)
+
+	if m.LastIndex <= r.commitIndex{
+		r.send(m.From, MessageAppendEntriesReply{From: r.ID, Term: r.term, Success: true, MatchIndex: m.LastIndex})
+		return
+	}
+
+	if err := r.StateMachine.Restore(m.Data); err != nil{
+		r.Logger.Error("raft restore error", "err", err)
+		return
+	}
+
+	// Keep whatever follows the snapshot if our log agrees with it, drop the log otherwise
+	if term, ok := r.termAt(m.LastIndex); ok && term == m.LastTerm{
+		r.log = append([]RaftEntry{}, r.log[m.LastIndex-r.snapIndex:]...)
+	}else{
+		r.truncate(r.snapIndex + 1)
+	}
+	r.snapIndex, r.snapTerm, r.snapshot = m.LastIndex, m.LastTerm, m.Data
+	r.commitIndex, r.lastApplied = m.LastIndex, m.LastIndex
+	r.persistSnapshot()
+	r.persistLog()
+
+	r.send(m.From, MessageAppendEntriesReply{From: r.ID, Term: r.term, Success: true, MatchIndex: m.LastIndex})
+}
+
+type raftHardState struct{
+	Term uint64
+	VotedFor string
+}
+
+type raftLog struct{
+	SnapIndex uint64
+	SnapTerm uint64
+	Entries []RaftEntry
+}
+
+func (r *Raft) persistState(){
+	r.persist("state.json", raftHardState{Term: r.term, VotedFor: r.votedFor})
+}
+
+func (r *Raft) persistLog(){
+	r.persist("log.json", raftLog{SnapIndex: r.snapIndex, SnapTerm: r.snapTerm, Entries: r.log})
+}
+
+func (r *Raft) persistSnapshot(){
+	if len(r.Dir) == 0{
+		return
+	}
+	if err := writeFileAtomic(filepath.Join(r.Dir, "snapshot"), r.snapshot); err != nil{
+		r.Logger.Error("raft persist error", "err", err)
+	}
+}
+
+func (r *Raft) persist(name string, v any){
+	if len(r.Dir) == 0{
+		return
+	}
+	b, err := json.Marshal(v)
+	if err == nil{
+		err = writeFileAtomic(filepath.Join(r.Dir, name), b)
+	}
+	if err != nil{
+		r.Logger.Error("raft persist error", "err", err)
+	}
+}
+
+// load restores the persisted state, the state machine is rebuilt from the snapshot and the log is replayed as
+// the leader tells us what is committed
+func (r *Raft) load() error{
+	if len(r.Dir) == 0{
+		return nil
+	}
+
+	var hard raftHardState
+	if err := readJSON(filepath.Join(r.Dir, "state.json"), &hard); err != nil{
+		return err
+	}
+	r.term, r.votedFor = hard.Term, hard.VotedFor
+
+	var l raftLog
+	if err := readJSON(filepath.Join(r.Dir, "log.json"), &l); err != nil{
+		return err
+	}
+	r.snapIndex, r.snapTerm, r.log = l.SnapIndex, l.SnapTerm, l.Entries
+
+	snapshot, err := os.ReadFile(filepath.Join(r.Dir, "snapshot"))
+	if errors.Is(err, os.ErrNotExist){
+		return nil
+	}
+	if err != nil{
+		return err
+	}
+	if err := r.StateMachine.Restore(snapshot); err != nil{
+		return err
+	}
+	r.snapshot = snapshot
+	r.commitIndex, r.lastApplied = r.snapIndex, r.snapIndex
+	return nil
+}
+
+func readJSON(path string, v any) error{
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist){
+		return nil
+	}
+	if err != nil{
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeFileAtomic replaces path with data so that a crash leaves either the old or the new content behind
+func writeFileAtomic(path string, data []byte) error{
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil{
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil{
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,332 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// raftNet delivers raft messages between in-process nodes, nodes can be cut off to simulate crashes and partitions
+type raftNet struct{
+	mu sync.Mutex
+	nodes map[string]*Raft
+	down map[string]bool
+}
+
+func (n *raftNet) sender(from string) func(string, any) error{
+	return func(to string, msg any) error{
+		n.mu.Lock()
+		r, ok := n.nodes[to]
+		cut := n.down[from] || n.down[to]
+		n.mu.Unlock()
+
+		if !ok || cut{
+			return errors.New("unreachable")
+		}
+		go r.Step(msg)
+		return nil
+	}
+}
+
+// learners returns the nodes on the net that aren't voters
+func (n *raftNet) learners(voters []string) func() []string{
+	return func() []string{
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		ids := []string{}
+		for id := range n.nodes{
+			if !contains(voters, id){
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+}
+
+func (n *raftNet) setDown(id string, down bool){
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[id] = down
+}
+
+type raftNode struct{
+	raft *Raft
+	meta *metadataMachine
+}
+
+func newRaftCluster(t *testing.T, size int, snapshotThreshold int) (*raftNet, []raftNode){
+	net := &raftNet{nodes: make(map[string]*Raft), down: make(map[string]bool)}
+
+	voters := []string{}
+	for i := 0; i < size; i++{
+		voters = append(voters, fmt.Sprintf("node-%d", i))
+	}
+
+	nodes := []raftNode{}
+	for _, id := range voters{
+		meta := newMetadataMachine()
+		r, err := NewRaft(RaftOpts{
+			ID: id,
+			Voters: voters,
+			Learners: net.learners(voters),
+			Send: net.sender(id),
+			StateMachine: meta,
+			ElectionTimeout: 50 * time.Millisecond,
+			SnapshotThreshold: snapshotThreshold,
+		})
+		if err != nil{
+			t.Fatal(err)
+		}
+		net.nodes[id] = r
+		nodes = append(nodes, raftNode{raft: r, meta: meta})
+	}
+	for _, n := range nodes{
+		go n.raft.Start()
+		t.Cleanup(n.raft.Stop)
+	}
+	return net, nodes
+}
+
+func waitFor(t *testing.T, what string, cond func() bool){
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond(){
+		if time.Now().After(deadline){
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitLeader waits until exactly one of the reachable nodes leads and returns it
+func waitLeader(t *testing.T, net *raftNet, nodes []raftNode) raftNode{
+	t.Helper()
+	var leader raftNode
+	waitFor(t, "a leader", func() bool{
+		leaders := 0
+		for _, n := range nodes{
+			net.mu.Lock()
+			down := net.down[n.raft.ID]
+			net.mu.Unlock()
+			if st, _ := n.raft.State(); st == RaftLeader && !down{
+				leader = n
+				leaders++
+			}
+		}
+		return leaders == 1
+	})
+	return leader
+}
+
+func proposeMeta(r *Raft, cmd MetaCommand) error{
+	b, err := json.Marshal(cmd)
+	if err != nil{
+		return err
+	}
+	return r.Propose(b)
+}
+
+func hasNamespace(n raftNode, ns string) bool{
+	return n.meta.Metadata().hasNamespace(ns)
+}
+
+func TestRaftElection(t *testing.T){
+	net, nodes := newRaftCluster(t, 3, 0)
+	leader := waitLeader(t, net, nodes)
+
+	for _, n := range nodes{
+		if n.raft == leader.raft{
+			continue
+		}
+		if err := proposeMeta(n.raft, MetaCommand{Op: MetaAddNamespace, Namespace: "photos"}); err != ErrNotLeader{
+			t.Errorf("expected ErrNotLeader from a follower, have %v", err)
+		}
+	}
+
+	if err := proposeMeta(leader.raft, MetaCommand{Op: MetaAddNamespace, Namespace: "photos"}); err != nil{
+		t.Fatal(err)
+	}
+	if err := proposeMeta(leader.raft, MetaCommand{Op: MetaGrant, Namespace: "videos", Principal: "alice", Perm: PermRead}); err == nil{
+		t.Errorf("expected granting on a missing namespace to fail")
+	}
+
+	waitFor(t, "the namespace on every node", func() bool{
+		for _, n := range nodes{
+			if !hasNamespace(n, "photos"){
+				return false
+			}
+			if n.raft.Leader() != leader.raft.ID{
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestRaftFailover(t *testing.T){
+	net, nodes := newRaftCluster(t, 5, 0)
+	old := waitLeader(t, net, nodes)
+	_, oldTerm := old.raft.State()
+
+	if err := proposeMeta(old.raft, MetaCommand{Op: MetaAddNamespace, Namespace: "photos"}); err != nil{
+		t.Fatal(err)
+	}
+
+	net.setDown(old.raft.ID, true)
+	leader := waitLeader(t, net, nodes)
+	if leader.raft == old.raft{
+		t.Fatalf("the isolated leader is still the only leader")
+	}
+	if _, term := leader.raft.State(); term <= oldTerm{
+		t.Errorf("expected the new leader's term to be after %d, have %d", oldTerm, term)
+	}
+	if !hasNamespace(leader, "photos"){
+		t.Errorf("new leader lost a committed entry")
+	}
+
+	if err := proposeMeta(leader.raft, MetaCommand{Op: MetaAddNamespace, Namespace: "videos"}); err != nil{
+		t.Fatal(err)
+	}
+	// The old leader can't reach a majority anymore
+	if err := proposeMeta(old.raft, MetaCommand{Op: MetaAddNamespace, Namespace: "lost"}); err == nil{
+		t.Fatalf("expected a proposal on the isolated leader to fail")
+	}
+
+	net.setDown(old.raft.ID, false)
+	waitFor(t, "the old leader to catch up", func() bool{
+		st, _ := old.raft.State()
+		return st == RaftFollower && hasNamespace(old, "videos") && !hasNamespace(old, "lost")
+	})
+}
+
+func TestRaftSnapshotCatchUp(t *testing.T){
+	net, nodes := newRaftCluster(t, 3, 5)
+	leader := waitLeader(t, net, nodes)
+
+	var lagging raftNode
+	for _, n := range nodes{
+		if n.raft != leader.raft{
+			lagging = n
+			break
+		}
+	}
+	net.setDown(lagging.raft.ID, true)
+
+	for i := 0; i < 20; i++{
+		if err := proposeMeta(leader.raft, MetaCommand{Op: MetaAddMember, ID: fmt.Sprintf("m%d", i), Addr: ":3000"}); err != nil{
+			t.Fatal(err)
+		}
+	}
+
+	leader.raft.mu.Lock()
+	snapIndex, kept := leader.raft.snapIndex, len(leader.raft.log)
+	leader.raft.mu.Unlock()
+	if snapIndex == 0 || kept >= 20{
+		t.Fatalf("expected the log to be compacted, snapshot at %d with %d entries kept", snapIndex, kept)
+	}
+
+	net.setDown(lagging.raft.ID, false)
+	waitFor(t, "the lagging node to install the snapshot", func() bool{
+		return len(lagging.meta.Metadata().Members) == 20
+	})
+}
+
+func TestRaftLearner(t *testing.T){
+	net, nodes := newRaftCluster(t, 3, 5)
+	leader := waitLeader(t, net, nodes)
+
+	// Enough entries that the learner joining late gets a snapshot first
+	for i := 0; i < 10; i++{
+		if err := proposeMeta(leader.raft, MetaCommand{Op: MetaAddMember, ID: fmt.Sprintf("m%d", i), Addr: ":3000"}); err != nil{
+			t.Fatal(err)
+		}
+	}
+
+	meta := newMetadataMachine()
+	learner, err := NewRaft(RaftOpts{
+		ID: "learner",
+		Voters: leader.raft.Voters,
+		Send: net.sender("learner"),
+		StateMachine: meta,
+		ElectionTimeout: 50 * time.Millisecond,
+	})
+	if err != nil{
+		t.Fatal(err)
+	}
+	net.mu.Lock()
+	net.nodes["learner"] = learner
+	net.mu.Unlock()
+	go learner.Start()
+	t.Cleanup(learner.Stop)
+
+	if err := proposeMeta(leader.raft, MetaCommand{Op: MetaAddNamespace, Namespace: "photos"}); err != nil{
+		t.Fatal(err)
+	}
+	waitFor(t, "the learner to catch up", func() bool{
+		m := meta.Metadata()
+		return len(m.Members) == 10 && m.hasNamespace("photos")
+	})
+
+	// A learner never stands for election, not even with every voter gone
+	for _, n := range nodes{
+		net.setDown(n.raft.ID, true)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if st, _ := learner.State(); st != RaftFollower{
+		t.Errorf("expected the learner to stay a follower, it is %s", st)
+	}
+}
+
+func TestRaftRestart(t *testing.T){
+	dir := t.TempDir()
+	start := func(meta *metadataMachine) *Raft{
+		r, err := NewRaft(RaftOpts{
+			ID: "a",
+			Voters: []string{"a"},
+			Send: func(string, any) error{ return nil },
+			StateMachine: meta,
+			Dir: dir,
+			ElectionTimeout: 20 * time.Millisecond,
+			SnapshotThreshold: 3,
+		})
+		if err != nil{
+			t.Fatal(err)
+		}
+		go r.Start()
+		return r
+	}
+
+	r := start(newMetadataMachine())
+	waitFor(t, "the single voter to lead", func() bool{
+		st, _ := r.State()
+		return st == RaftLeader
+	})
+	for _, ns := range []string{"a", "b", "c", "d", "e"}{
+		if err := proposeMeta(r, MetaCommand{Op: MetaAddNamespace, Namespace: ns}); err != nil{
+			t.Fatal(err)
+		}
+	}
+	_, term := r.State()
+	r.Stop()
+
+	meta := newMetadataMachine()
+	r = start(meta)
+	defer r.Stop()
+
+	if len(meta.Metadata().Namespaces) != 5{
+		t.Errorf("expected the snapshot to be restored, have %v", meta.Metadata().Namespaces)
+	}
+	waitFor(t, "the restarted voter to lead again", func() bool{
+		st, _ := r.State()
+		return st == RaftLeader
+	})
+	if _, restarted := r.State(); restarted <= term{
+		t.Errorf("expected the term to survive the restart, have %d after %d", restarted, term)
+	}
+	if err := proposeMeta(r, MetaCommand{Op: MetaAddNamespace, Namespace: "f"}); err != nil{
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,356 @@
+package vault
+
+import (
+	"crypto/ed25519"
+	"sync"
+	"time"
+)
+
+// rebalanceSettle is how long the rebalancer waits after a membership change before moving data,
+// so a burst of joins (e.g. a node dialing all its bootstrap nodes) is handled in a single pass
+const rebalanceSettle = 500 * time.Millisecond
+
+// rebalanceAckTimeout is how long a push waits for its acknowledgement. A surplus copy whose targets never confirmed
+// is kept, the next pass or anti-entropy gets it to them.
+const rebalanceAckTimeout = 5 * time.Minute
+
+type MessageHello struct{
+	ID string
+	PublicKey ed25519.PublicKey
+	// ListenAddr is the address the node accepts connections on, the remote address of an inbound connection is just an ephemeral port
+	ListenAddr string
+	Capabilities []string
+	// Nonce is the challenge the receiver has to sign before we take the ID and key it claims, see MessageHelloProof
+	Nonce []byte
+}
+
+// MessageStoreAck confirms that an object pushed with Ack set has been written to disk
+type MessageStoreAck struct{
+	ID string
+	Key string
+}
+
+// RebalanceProgress is a snapshot of what the rebalancer is doing
+type RebalanceProgress struct{
+	Running bool
+	Paused bool
+	// Total is the number of transfers planned by the current (or last) pass, Moved how many of them are done
+	Total int
+	Moved int
+	Bytes int64
+	// Deleted counts surplus copies removed after the new owners acknowledged them
+	Deleted int
+	LastRun time.Time
+}
+
+type pendingMove struct{
+	entry InventoryEntry
+	surplus bool
+	waiting map[string]struct{}
+	sent time.Time
+}
+
+// Rebalancer moves data to its new owners whenever the ring changes
+type Rebalancer struct{
+	s *FileServer
+
+	mu sync.Mutex
+	cond *sync.Cond
+	paused bool
+	prev *HashRing
+	prevRF int
+	progress RebalanceProgress
+	pending map[string]*pendingMove
+
+	triggerch chan struct{}
+}
+
+func NewRebalancer(s *FileServer) *Rebalancer{
+	r := &Rebalancer{
+		s: s,
+		pending: make(map[string]*pendingMove),
+		triggerch: make(chan struct{}, 1),
+	}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// Trigger schedules a rebalancing pass. prev and prevRF are the ring and replication factor as they were before the
+// change; if a pass is already scheduled the older ring is kept, since that is the placement the data on disk still
+// follows. Concurrent changes can trigger out of order, the rings tell which is older.
+func (r *Rebalancer) Trigger(prev *HashRing, prevRF int){
+	r.mu.Lock()
+	if r.prev == nil || prev.older(r.prev){
+		r.prev, r.prevRF = prev, prevRF
+	}
+	r.mu.Unlock()
+
+	select{
+	case r.triggerch <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Rebalancer) Pause(){
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paused = true
+}
+
+func (r *Rebalancer) Resume(){
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paused = false
+	r.cond.Broadcast()
+}
+
+func (r *Rebalancer) Progress() RebalanceProgress{
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := r.progress
+	p.Paused = r.paused
+	return p
+}
+
+func (r *Rebalancer) waitIfPaused(){
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.paused{
+		r.cond.Wait()
+	}
+}
+
+func (r *Rebalancer) loop(){
+	ticker := time.NewTicker(rebalanceAckTimeout)
+	defer ticker.Stop()
+
+	for{
+		select{
+		case <-r.triggerch:
+		case <-ticker.C:
+			r.expire(time.Now())
+			continue
+		case <-r.s.quitch:
+			return
+		}
+
+		select{
+		case <-time.After(rebalanceSettle):
+		case <-r.s.quitch:
+			return
+		}
+
+		r.mu.Lock()
+		prev, prevRF := r.prev, r.prevRF
+		r.prev = nil
+		r.mu.Unlock()
+
+		if prev == nil{
+			continue
+		}
+		if err := r.run(prev, prevRF); err != nil{
+			r.s.logger("rebalance").Warn("rebalance error", "err", err)
+		}
+	}
+}
+
+// run moves every object we are responsible for from its placement under prev and prevRF to its placement under the
+// current ring and replication factor
+func (r *Rebalancer) run(prev *HashRing, prevRF int) error{
+	s := r.s
+
+	inventory, err := s.store.Inventory()
+	if err != nil{
+		return err
+	}
+
+	type move struct{
+		entry InventoryEntry
+		targets []string
+		surplus bool
+	}
+	moves := []move{}
+
+	for _, e := range inventory{
+		// Tombstones carry no data, anti-entropy spreads them. Erasure coded files only ever leave as shards.
+		if e.Deleted || s.erasureCoded(e){
+			continue
+		}
+		key := s.objectKey(e)
+		oldPlacement := s.placementRF(prev, prevRF, e.ID, key)
+		newPlacement := s.placement(s.ring, e.ID, key)
+
+		targets := []string{}
+		for _, id := range newPlacement{
+			if id != s.ID && !contains(oldPlacement, id){
+				targets = append(targets, id)
+			}
+		}
+		surplus := e.ID != s.ID && !contains(newPlacement, s.ID)
+
+		if len(targets) == 0 || !r.responsible(e, oldPlacement, surplus){
+			continue
+		}
+		moves = append(moves, move{entry: e, targets: targets, surplus: surplus})
+	}
+
+	r.mu.Lock()
+	r.progress = RebalanceProgress{
+		Running: true,
+		Total: len(moves),
+		Deleted: r.progress.Deleted,
+		LastRun: time.Now(),
+	}
+	r.mu.Unlock()
+
+	defer func(){
+		r.mu.Lock()
+		r.progress.Running = false
+		r.mu.Unlock()
+		p := r.Progress()
+		s.logger("rebalance").Info("rebalance finished", "moved", p.Moved, "total", p.Total, "bytes", p.Bytes)
+	}()
+
+	for _, m := range moves{
+		r.waitIfPaused()
+
+		select{
+		case <-s.quitch:
+			return nil
+		default:
+		}
+
+		objectID := m.entry.ID + "/" + s.objectKey(m.entry)
+		pm := &pendingMove{
+			entry: m.entry,
+			surplus: m.surplus,
+			waiting: make(map[string]struct{}),
+			sent: time.Now(),
+		}
+
+		var sent int64
+		for _, id := range m.targets{
+			addr, ok := s.peerAddr(id)
+			if !ok{
+				continue
+			}
+			peer, ok := s.peer(addr)
+			if !ok{
+				continue
+			}
+
+			r.mu.Lock()
+			pm.waiting[addr] = struct{}{}
+			r.pending[objectID] = pm
+			r.mu.Unlock()
+
+			n, err := s.pushObject(peer, m.entry, true)
+			if err != nil{
+				s.logger("rebalance").Warn("rebalance push failed", "peer", addr, "key", s.objectKey(m.entry), "err", err)
+				// No ack is coming for a push that failed, the copy is kept
+				r.mu.Lock()
+				delete(pm.waiting, addr)
+				pm.surplus = false
+				if len(pm.waiting) == 0{
+					delete(r.pending, objectID)
+				}
+				r.mu.Unlock()
+				continue
+			}
+			sent += n
+		}
+
+		r.mu.Lock()
+		r.progress.Moved++
+		r.progress.Bytes += sent
+		r.mu.Unlock()
+
+		r.throttle(sent)
+	}
+
+	return nil
+}
+
+// responsible decides whether this node sends the object, so that a new owner gets it from one node instead of all of them.
+// The owner always sends its own objects, a surplus holder sends so it knows when it may delete, otherwise the first
+// surviving node of the old placement covers for an owner that is gone.
+func (r *Rebalancer) responsible(e InventoryEntry, oldPlacement []string, surplus bool) bool{
+	s := r.s
+	if e.ID == s.ID || surplus{
+		return true
+	}
+	if s.ring.Has(e.ID){
+		return false
+	}
+	for _, id := range oldPlacement{
+		if s.ring.Has(id){
+			return id == s.ID
+		}
+	}
+	return false
+}
+
+// throttle sleeps long enough to keep the rebalancer under RebalanceRate bytes per second
+func (r *Rebalancer) throttle(n int64){
+	rate := r.s.rebalanceRate()
+	if rate <= 0 || n <= 0{
+		return
+	}
+	select{
+	case <-time.After(time.Duration(n) * time.Second / time.Duration(rate)):
+	case <-r.s.quitch:
+	}
+}
+
+// acked is called when from has confirmed it stored the object, surplus copies are deleted once every target confirmed
+func (r *Rebalancer) acked(from string, msg MessageStoreAck) error{
+	objectID := msg.ID + "/" + msg.Key
+
+	r.mu.Lock()
+	pm, ok := r.pending[objectID]
+	if !ok{
+		r.mu.Unlock()
+		return nil
+	}
+	delete(pm.waiting, from)
+	done := len(pm.waiting) == 0
+	if done{
+		delete(r.pending, objectID)
+	}
+	r.mu.Unlock()
+
+	if !done || !pm.surplus{
+		return nil
+	}
+
+	if err := r.s.store.Delete(pm.entry.ID, pm.entry.Key); err != nil{
+		return err
+	}
+
+	r.mu.Lock()
+	r.progress.Deleted++
+	r.mu.Unlock()
+
+	return nil
+}
+
+// expire forgets the pushes that were not acknowledged within rebalanceAckTimeout, their surplus copies are kept
+func (r *Rebalancer) expire(now time.Time){
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for objectID, pm := range r.pending{
+		if now.Sub(pm.sent) > rebalanceAckTimeout{
+			r.s.logger("rebalance").Debug("rebalance ack timed out", "object", objectID, "waiting", len(pm.waiting))
+			delete(r.pending, objectID)
+		}
+	}
+}
+
+func contains(ids []string, id string) bool{
+	for _, v := range ids{
+		if v == id{
+			return true
+		}
+	}
+	return false
+}
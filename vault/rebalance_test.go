@@ -0,0 +1,193 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRebalanceOnJoin(t *testing.T){
+	addr := freeAddr(t)
+	n1 := startTestNode(t, WithListenAddr(addr), WithReplicationFactor(1))
+	if _, err := n1.Put(context.Background(), "docs/a.txt", strings.NewReader("hello rebalance")); err != nil{
+		t.Fatal(err)
+	}
+	s1 := n1.Server()
+
+	// The pass waits while paused, then moves the file to the node that joined
+	s1.PauseRebalance()
+	n2 := startTestNode(t, WithBootstrap(addr), WithReplicationFactor(1))
+	waitFor(t, "the rebalance pass to start", func() bool{
+		p := s1.RebalanceProgress()
+		return p.Running && p.Paused && p.Total == 1
+	})
+	time.Sleep(50 * time.Millisecond)
+	if p := s1.RebalanceProgress(); p.Moved != 0 || len(replicasOf(t, n2.Server(), n1.ID())) != 0{
+		t.Fatalf("expected a paused rebalancer to move nothing, have %+v", p)
+	}
+
+	s1.ResumeRebalance()
+	waitFor(t, "the file to move to the new node", func() bool{
+		return len(replicasOf(t, n2.Server(), n1.ID())) == 1
+	})
+	waitFor(t, "the pass to finish", func() bool{
+		p := s1.RebalanceProgress()
+		return !p.Running && p.Moved == 1 && p.Bytes > 0
+	})
+}
+
+func TestRebalanceOnLeave(t *testing.T){
+	nodes := startTestCluster(t, 3, WithReplicationFactor(1))
+	owner := nodes[0]
+	if _, err := owner.Put(context.Background(), "docs/a.txt", strings.NewReader("hello rebalance")); err != nil{
+		t.Fatal(err)
+	}
+
+	var holder, other *Node
+	waitFor(t, "the replica", func() bool{
+		for i, n := range nodes[1:]{
+			if len(replicasOf(t, n.Server(), owner.ID())) == 1{
+				holder, other = n, nodes[2-i]
+				return true
+			}
+		}
+		return false
+	})
+
+	// The holder leaves, the owner hands its replica to the node that takes over its range
+	s := owner.Server()
+	addr, ok := s.peerAddr(holder.ID())
+	if !ok{
+		t.Fatalf("expected the owner to know the holder")
+	}
+	holder.Close()
+	if err := s.handleMessageLeave(addr, MessageLeave{ID: holder.ID()}); err != nil{
+		t.Fatal(err)
+	}
+	waitFor(t, "the replica to move to the remaining node", func() bool{
+		return len(replicasOf(t, other.Server(), owner.ID())) == 1
+	})
+}
+
+func TestRebalanceOnReplicationChange(t *testing.T){
+	// Without anti-entropy only the rebalancer can add the replica
+	noSync := WithServerOptions(func(opts *FileServerOpts){ opts.AntiEntropyInterval = 0 })
+	nodes := startTestCluster(t, 3, WithReplicationFactor(1), noSync)
+	owner := nodes[0]
+	if _, err := owner.Put(context.Background(), "docs/a.txt", strings.NewReader("hello rebalance")); err != nil{
+		t.Fatal(err)
+	}
+	held := func() int{
+		n := 0
+		for _, node := range nodes[1:]{
+			n += len(replicasOf(t, node.Server(), owner.ID()))
+		}
+		return n
+	}
+	waitFor(t, "the replica", func() bool{ return held() == 1 })
+
+	// The passes scheduled by the nodes joining must be done, they would pick up the new factor on their own
+	for _, node := range nodes{
+		r := node.Server().rebalancer
+		waitFor(t, "the join passes", func() bool{
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			return r.prev == nil && !r.progress.Running
+		})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// Raising the replication factor through the cluster metadata adds the missing replica
+	b, err := json.Marshal(MetaCommand{Op: MetaSetReplication, ReplicationFactor: 2})
+	if err != nil{
+		t.Fatal(err)
+	}
+	for _, node := range nodes{
+		// As raft applies it on a voter
+		s := node.Server()
+		s.meta.onApply = s.metadataApplied
+		if err := s.meta.Apply(b); err != nil{
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "a second replica", func() bool{ return held() == 2 })
+}
+
+func TestRebalanceTriggerKeepsOlderRing(t *testing.T){
+	s := newTestServer(t.TempDir())
+	ring := NewHashRing(0, "a")
+
+	// Two joins race, the second one triggers first
+	first, _ := ring.Join("b")
+	second, _ := ring.Join("c")
+	s.rebalancer.Trigger(second, 1)
+	s.rebalancer.Trigger(first, 1)
+
+	s.rebalancer.mu.Lock()
+	defer s.rebalancer.mu.Unlock()
+	if s.rebalancer.prev != first{
+		t.Errorf("expected the ring from before both joins, have %v", s.rebalancer.prev.Members())
+	}
+}
+
+func TestRebalanceThrottle(t *testing.T){
+	s := newTestServer(t.TempDir())
+	s.RebalanceRate = 5000
+
+	start := time.Now()
+	s.rebalancer.throttle(500)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond{
+		t.Errorf("expected 500 bytes at 5000 bytes/s to take 100ms, took %s", elapsed)
+	}
+
+	s.RebalanceRate = 0
+	start = time.Now()
+	s.rebalancer.throttle(500)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond{
+		t.Errorf("expected no rate to not wait, took %s", elapsed)
+	}
+}
+
+func TestRebalanceDeletesAfterAcks(t *testing.T){
+	s := newTestServer(t.TempDir())
+	if _, err := s.store.Write("owner", "key", strings.NewReader("surplus copy")); err != nil{
+		t.Fatal(err)
+	}
+	r := s.rebalancer
+	r.pending["owner/key"] = &pendingMove{
+		entry: InventoryEntry{ID: "owner", Meta: Meta{Key: "key"}},
+		surplus: true,
+		waiting: map[string]struct{}{"a": {}, "b": {}},
+		sent: time.Now(),
+	}
+
+	r.acked("a", MessageStoreAck{ID: "owner", Key: "key"})
+	if !s.store.Has("owner", "key"){
+		t.Fatalf("expected the copy to stay until every target acknowledged")
+	}
+	r.acked("b", MessageStoreAck{ID: "owner", Key: "key"})
+	if s.store.Has("owner", "key") || r.Progress().Deleted != 1{
+		t.Errorf("expected the surplus copy to be deleted once acknowledged")
+	}
+	if len(r.pending) != 0{
+		t.Errorf("expected the move to be done, have %v", r.pending)
+	}
+}
+
+func TestRebalancePendingExpires(t *testing.T){
+	s := newTestServer(t.TempDir())
+	r := s.rebalancer
+	now := time.Now()
+	r.pending["owner/old"] = &pendingMove{waiting: map[string]struct{}{"a": {}}, surplus: true, sent: now.Add(-2 * rebalanceAckTimeout)}
+	r.pending["owner/new"] = &pendingMove{waiting: map[string]struct{}{"a": {}}, surplus: true, sent: now}
+
+	r.expire(now)
+	if _, ok := r.pending["owner/old"]; ok{
+		t.Errorf("expected the unacknowledged move to expire")
+	}
+	if _, ok := r.pending["owner/new"]; !ok{
+		t.Errorf("expected the recent move to be kept")
+	}
+}
@@ -0,0 +1,214 @@
+package vault
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ayushn2/distri_vault.git/p2p"
+)
+
+const (
+	reconnectBaseDelay = 500 * time.Millisecond
+	reconnectMaxDelay = 30 * time.Second
+	// dialTimeout bounds a single connect, a dial to a node that went dark otherwise lasts as long as the OS keeps trying
+	dialTimeout = 5 * time.Second
+)
+
+// reconnector redials bootstrap nodes and peers we dialed whenever their connection is lost
+type reconnector struct{
+	mu sync.Mutex
+	// ids maps an address we dialed to the node ID that answered on it
+	ids map[string]string
+	// dropped holds the addresses of duplicate connections we closed on purpose
+	dropped map[string]bool
+	// forgotten holds the IDs of nodes that left the network for good
+	forgotten map[string]bool
+	// dialing holds the addresses a dial is in flight to, redials and dials of discovered nodes alike
+	dialing map[string]bool
+}
+
+// reconnectDelay is an exponential backoff with equal jitter, so nodes that lost each other don't redial in lockstep
+func reconnectDelay(attempt int) time.Duration{
+	d := reconnectBaseDelay
+	for i := 0; i < attempt && d < reconnectMaxDelay; i++{
+		d *= 2
+	}
+	if d > reconnectMaxDelay{
+		d = reconnectMaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (r *reconnector) init(){
+	if r.ids == nil{
+		r.ids = make(map[string]string)
+		r.dropped = make(map[string]bool)
+		r.forgotten = make(map[string]bool)
+		r.dialing = make(map[string]bool)
+	}
+}
+
+// startDial claims addr for a dial, ok is false when another one to it is still in flight. done releases it.
+func (r *reconnector) startDial(addr string) (done func(), ok bool){
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+	if r.dialing[addr]{
+		return nil, false
+	}
+	r.dialing[addr] = true
+	return func(){
+		r.mu.Lock()
+		delete(r.dialing, addr)
+		r.mu.Unlock()
+	}, true
+}
+
+func (s *FileServer) dial(addr string) error{
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	return s.Transport.DialContext(ctx, addr)
+}
+
+// redial keeps dialing addr with backoff until a connection is up again, we are connected to the same node some other
+// way, or the node left the network
+func (s *FileServer) redial(addr string){
+	done, ok := s.reconnect.startDial(addr)
+	if !ok{
+		return
+	}
+	defer done()
+
+	for attempt := 0; ; attempt++{
+		if s.connectedTo(addr){
+			return
+		}
+
+		s.logger("peers").Debug("connecting", "peer", addr, "attempt", attempt)
+		err := s.dial(addr)
+		if err == nil{
+			return
+		}
+
+		delay := reconnectDelay(attempt)
+		s.logger("peers").Info("dial failed, retrying", "peer", addr, "err", err, "delay", delay)
+
+		select{
+		case <-time.After(delay):
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// connectedTo reports whether there is no point dialing addr: we are already connected to it or to the node behind it,
+// or the node left the network
+func (s *FileServer) connectedTo(addr string) bool{
+	if _, ok := s.peer(addr); ok{
+		return true
+	}
+
+	r := &s.reconnect
+	r.mu.Lock()
+	r.init()
+	id, known := r.ids[addr]
+	forgotten := known && r.forgotten[id]
+	r.mu.Unlock()
+
+	if forgotten{
+		return true
+	}
+	if known{
+		_, ok := s.peerAddr(id)
+		return ok
+	}
+	return false
+}
+
+// forget stops redialing a node that left the network
+func (s *FileServer) forget(id string){
+	r := &s.reconnect
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+	r.forgotten[id] = true
+}
+
+// OnPeerDisconnect forgets a peer whose connection is gone and redials it if we were the ones who dialed it.
+// Inbound peers are the other side's job to redial, their remote address is just an ephemeral port.
+func (s *FileServer) OnPeerDisconnect(p p2p.Peer){
+	addr := p.RemoteAddr().String()
+
+	s.peerLock.Lock()
+	if cur, ok := s.peers[addr]; ok && cur == p{
+		delete(s.peers, addr)
+		delete(s.peerIDs, addr)
+	}
+	s.peerLock.Unlock()
+	s.dropPeerMetrics(addr)
+
+	r := &s.reconnect
+	r.mu.Lock()
+	r.init()
+	dropped := r.dropped[addr]
+	delete(r.dropped, addr)
+	r.mu.Unlock()
+
+	s.logger("peers").Info("disconnected", "peer", addr)
+
+	if dropped || !p.Outbound(){
+		return
+	}
+
+	select{
+	case <-s.quitch:
+		return
+	default:
+	}
+
+	go s.redial(addr)
+}
+
+// dedupPeer makes sure we keep a single connection to a node when both sides dialed each other at the same time.
+// Both ends keep the connection dialed by the node with the smaller ID, so they agree without talking about it.
+// It returns false if the connection from is the one that has to go.
+func (s *FileServer) dedupPeer(from string, id string) bool{
+	s.peerLock.Lock()
+	newPeer, ok := s.peers[from]
+	var other string
+	for addr, peerID := range s.peerIDs{
+		if peerID == id && addr != from{
+			other = addr
+		}
+	}
+	oldPeer, hasOld := s.peers[other]
+	s.peerLock.Unlock()
+
+	if !ok || !hasOld{
+		return true
+	}
+
+	preferred := func(p p2p.Peer) bool{
+		return p.Outbound() == (s.ID < id)
+	}
+
+	drop, dropAddr, keepNew := oldPeer, other, true
+	if !preferred(newPeer) && preferred(oldPeer){
+		drop, dropAddr, keepNew = newPeer, from, false
+	}
+
+	r := &s.reconnect
+	r.mu.Lock()
+	r.init()
+	r.dropped[dropAddr] = true
+	r.mu.Unlock()
+
+	s.logger("peers").Debug("dropping duplicate connection", "peer", dropAddr, "id", id)
+
+	s.removePeer(dropAddr)
+	drop.Close()
+
+	return keepNew
+}
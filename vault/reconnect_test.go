@@ -0,0 +1,16 @@
+package vault
+
+import "testing"
+
+func TestReconnectDelay(t *testing.T){
+	for attempt := 0; attempt < 20; attempt++{
+		d := reconnectDelay(attempt)
+		if d < reconnectBaseDelay/2 || d > reconnectMaxDelay{
+			t.Errorf("attempt %d: delay %s out of bounds", attempt, d)
+		}
+	}
+
+	if reconnectDelay(10) < reconnectMaxDelay/2{
+		t.Errorf("expected late attempts to back off to the max delay")
+	}
+}
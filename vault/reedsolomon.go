@@ -0,0 +1,274 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ReedSolomon is a systematic Reed-Solomon code over GF(2^8). Data is cut into DataShards equally sized shards and
+// ParityShards more are computed from them, any DataShards of the shards are enough to rebuild all of them.
+// The encoding matrix is a Vandermonde matrix turned systematic by multiplying it with the inverse of its top square,
+// which keeps every square submatrix of it invertible.
+
+var ErrTooFewShards = errors.New("too few shards to reconstruct")
+
+const maxShards = 256
+
+var gfExp, gfLog = gfTables()
+
+// gfTables builds the exponent and logarithm tables of GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1
+func gfTables() ([512]byte, [256]byte){
+	var exp [512]byte
+	var log [256]byte
+
+	x := 1
+	for i := 0; i < 255; i++{
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0{
+			x ^= 0x11d
+		}
+	}
+	// Doubling the table saves reducing the sum of two logarithms
+	for i := 255; i < 512; i++{
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}
+
+func gfMul(a byte, b byte) byte{
+	if a == 0 || b == 0{
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte{
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte{
+	if n == 0{
+		return 1
+	}
+	if a == 0{
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+type gfMatrix [][]byte
+
+func newGFMatrix(rows int, cols int) gfMatrix{
+	m := make(gfMatrix, rows)
+	for r := range m{
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m gfMatrix) mul(o gfMatrix) gfMatrix{
+	res := newGFMatrix(len(m), len(o[0]))
+	for r := range m{
+		for c := range o[0]{
+			var v byte
+			for i := range o{
+				v ^= gfMul(m[r][i], o[i][c])
+			}
+			res[r][c] = v
+		}
+	}
+	return res
+}
+
+// invert returns the inverse of the square matrix m by Gauss-Jordan elimination
+func (m gfMatrix) invert() (gfMatrix, error){
+	n := len(m)
+	work := newGFMatrix(n, 2*n)
+	for r := range m{
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+
+	for c := 0; c < n; c++{
+		pivot := c
+		for pivot < n && work[pivot][c] == 0{
+			pivot++
+		}
+		if pivot == n{
+			return nil, errors.New("matrix is singular")
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		scale := gfInv(work[c][c])
+		for i := range work[c]{
+			work[c][i] = gfMul(work[c][i], scale)
+		}
+		for r := 0; r < n; r++{
+			if r == c || work[r][c] == 0{
+				continue
+			}
+			f := work[r][c]
+			for i := range work[r]{
+				work[r][i] ^= gfMul(f, work[c][i])
+			}
+		}
+	}
+
+	inv := newGFMatrix(n, n)
+	for r := range inv{
+		copy(inv[r], work[r][n:])
+	}
+	return inv, nil
+}
+
+type ReedSolomon struct{
+	DataShards int
+	ParityShards int
+	matrix gfMatrix
+}
+
+func NewReedSolomon(dataShards int, parityShards int) (*ReedSolomon, error){
+	if dataShards <= 0 || parityShards < 0 || dataShards+parityShards > maxShards{
+		return nil, fmt.Errorf("invalid erasure coding %d+%d", dataShards, parityShards)
+	}
+
+	total := dataShards + parityShards
+	vandermonde := newGFMatrix(total, dataShards)
+	for r := range vandermonde{
+		for c := range vandermonde[r]{
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := vandermonde[:dataShards].invert()
+	if err != nil{
+		return nil, err
+	}
+
+	return &ReedSolomon{
+		DataShards: dataShards,
+		ParityShards: parityShards,
+		matrix: vandermonde.mul(top),
+	}, nil
+}
+
+func (rs *ReedSolomon) totalShards() int{
+	return rs.DataShards + rs.ParityShards
+}
+
+// Split cuts data into the data shards, padding the last one with zeros, and allocates the parity shards
+func (rs *ReedSolomon) Split(data []byte) [][]byte{
+	size := (len(data) + rs.DataShards - 1) / rs.DataShards
+	if size == 0{
+		size = 1
+	}
+
+	padded := make([]byte, size*rs.totalShards())
+	copy(padded, data)
+
+	shards := make([][]byte, rs.totalShards())
+	for i := range shards{
+		shards[i] = padded[i*size : (i+1)*size]
+	}
+	return shards
+}
+
+// Encode computes the parity shards from the data shards
+func (rs *ReedSolomon) Encode(shards [][]byte) error{
+	if len(shards) != rs.totalShards(){
+		return fmt.Errorf("expected %d shards, have %d", rs.totalShards(), len(shards))
+	}
+	for i := rs.DataShards; i < rs.totalShards(); i++{
+		rs.encodeRow(shards, i)
+	}
+	return nil
+}
+
+// encodeRow recomputes shard i from the data shards
+func (rs *ReedSolomon) encodeRow(shards [][]byte, i int){
+	out := make([]byte, len(shards[0]))
+	for j := 0; j < rs.DataShards; j++{
+		mulAdd(out, shards[j], rs.matrix[i][j])
+	}
+	shards[i] = out
+}
+
+// Reconstruct fills in the missing (nil) shards, it needs at least DataShards of them
+func (rs *ReedSolomon) Reconstruct(shards [][]byte) error{
+	if len(shards) != rs.totalShards(){
+		return fmt.Errorf("expected %d shards, have %d", rs.totalShards(), len(shards))
+	}
+
+	present := []int{}
+	for i, shard := range shards{
+		if shard != nil{
+			present = append(present, i)
+		}
+	}
+	if len(present) < rs.DataShards{
+		return ErrTooFewShards
+	}
+	if len(present) == rs.totalShards(){
+		return nil
+	}
+	present = present[:rs.DataShards]
+
+	size := len(shards[present[0]])
+	for _, i := range present{
+		if len(shards[i]) != size{
+			return errors.New("shards differ in size")
+		}
+	}
+
+	sub := newGFMatrix(rs.DataShards, rs.DataShards)
+	for r, i := range present{
+		copy(sub[r], rs.matrix[i])
+	}
+	decode, err := sub.invert()
+	if err != nil{
+		return err
+	}
+
+	for j := 0; j < rs.DataShards; j++{
+		if shards[j] != nil{
+			continue
+		}
+		out := make([]byte, size)
+		for r, i := range present{
+			mulAdd(out, shards[i], decode[j][r])
+		}
+		shards[j] = out
+	}
+	for i := rs.DataShards; i < rs.totalShards(); i++{
+		if shards[i] == nil{
+			rs.encodeRow(shards, i)
+		}
+	}
+	return nil
+}
+
+// Join concatenates the data shards and cuts off the padding
+func (rs *ReedSolomon) Join(shards [][]byte, size int64) ([]byte, error){
+	data := make([]byte, 0, size)
+	for _, shard := range shards[:rs.DataShards]{
+		if shard == nil{
+			return nil, ErrTooFewShards
+		}
+		data = append(data, shard...)
+	}
+	if int64(len(data)) < size{
+		return nil, fmt.Errorf("shards hold %d bytes, expected %d", len(data), size)
+	}
+	return data[:size], nil
+}
+
+// mulAdd adds c times in to out
+func mulAdd(out []byte, in []byte, c byte){
+	if c == 0{
+		return
+	}
+	for i, b := range in{
+		out[i] ^= gfMul(c, b)
+	}
+}
@@ -0,0 +1,62 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestReedSolomonReconstruct(t *testing.T){
+	rs, err := NewReedSolomon(4, 2)
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 1000)
+	rand.Read(data)
+
+	shards := rs.Split(data)
+	if err := rs.Encode(shards); err != nil{
+		t.Fatal(err)
+	}
+
+	// Every way of losing two of the six shards has to be recoverable
+	for a := 0; a < 6; a++{
+		for b := a + 1; b < 6; b++{
+			damaged := make([][]byte, len(shards))
+			copy(damaged, shards)
+			damaged[a], damaged[b] = nil, nil
+
+			if err := rs.Reconstruct(damaged); err != nil{
+				t.Fatalf("lost %d and %d: %s", a, b, err)
+			}
+			for i := range shards{
+				if !bytes.Equal(shards[i], damaged[i]){
+					t.Fatalf("lost %d and %d: shard %d rebuilt wrong", a, b, i)
+				}
+			}
+			joined, err := rs.Join(damaged, int64(len(data)))
+			if err != nil{
+				t.Fatal(err)
+			}
+			if !bytes.Equal(joined, data){
+				t.Fatalf("lost %d and %d: data rebuilt wrong", a, b)
+			}
+		}
+	}
+
+	damaged := make([][]byte, len(shards))
+	copy(damaged, shards)
+	damaged[0], damaged[3], damaged[5] = nil, nil, nil
+	if err := rs.Reconstruct(damaged); err != ErrTooFewShards{
+		t.Errorf("expected ErrTooFewShards with three shards lost, have %v", err)
+	}
+}
+
+func TestReedSolomonInvalid(t *testing.T){
+	for _, c := range [][2]int{{0, 2}, {4, -1}, {200, 100}}{
+		if _, err := NewReedSolomon(c[0], c[1]); err == nil{
+			t.Errorf("expected %d+%d to be rejected", c[0], c[1])
+		}
+	}
+}
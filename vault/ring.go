@@ -0,0 +1,187 @@
+package vault
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+)
+
+const defaultVirtualNodes = 64
+
+// HashRing is a consistent hash ring over node IDs. Every node is placed on the ring several times (virtual nodes)
+// so keys spread evenly and only a small share of them move when a node joins or leaves.
+type HashRing struct{
+	mu sync.RWMutex
+	virtualNodes int
+	points []uint32
+	owners map[uint32]string
+	members map[string]struct{}
+	// version counts the changes to the ring, a clone keeps the version it was taken at
+	version uint64
+}
+
+func NewHashRing(virtualNodes int, members ...string) *HashRing{
+	if virtualNodes <= 0{
+		virtualNodes = defaultVirtualNodes
+	}
+	r := &HashRing{
+		virtualNodes: virtualNodes,
+		owners: make(map[uint32]string),
+		members: make(map[string]struct{}),
+	}
+	for _, m := range members{
+		r.Add(m)
+	}
+	return r
+}
+
+func ringHash(s string) uint32{
+	h := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint32(h[:4])
+}
+
+// Add places the node on the ring, it returns false if it was already a member
+func (r *HashRing) Add(id string) bool{
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.add(id)
+}
+
+// Join is Add returning the ring as it was before, taken in the same step so that concurrent changes each get the ring
+// the one before them left
+func (r *HashRing) Join(id string) (*HashRing, bool){
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prev := r.clone()
+	return prev, r.add(id)
+}
+
+func (r *HashRing) add(id string) bool{
+	if _, ok := r.members[id]; ok{
+		return false
+	}
+	r.members[id] = struct{}{}
+	r.version++
+
+	for i := 0; i < r.virtualNodes; i++{
+		point := ringHash(fmt.Sprintf("%s#%d", id, i))
+		r.owners[point] = id
+		r.points = append(r.points, point)
+	}
+	sort.Slice(r.points, func(i, j int) bool{ return r.points[i] < r.points[j] })
+
+	return true
+}
+
+// Remove takes the node off the ring, it returns false if it was not a member
+func (r *HashRing) Remove(id string) bool{
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.remove(id)
+}
+
+// Leave is Remove returning the ring as it was before, see Join
+func (r *HashRing) Leave(id string) (*HashRing, bool){
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prev := r.clone()
+	return prev, r.remove(id)
+}
+
+func (r *HashRing) remove(id string) bool{
+	if _, ok := r.members[id]; !ok{
+		return false
+	}
+	delete(r.members, id)
+	r.version++
+
+	points := r.points[:0]
+	for _, point := range r.points{
+		if r.owners[point] == id{
+			delete(r.owners, point)
+			continue
+		}
+		points = append(points, point)
+	}
+	r.points = points
+
+	return true
+}
+
+func (r *HashRing) Has(id string) bool{
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.members[id]
+	return ok
+}
+
+func (r *HashRing) Members() []string{
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	members := make([]string, 0, len(r.members))
+	for m := range r.members{
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Owners returns the first n distinct nodes found walking clockwise from the key, n <= 0 means every member
+func (r *HashRing) Owners(key string, n int) []string{
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if n <= 0 || n > len(r.members){
+		n = len(r.members)
+	}
+	if n == 0{
+		return nil
+	}
+
+	h := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool{ return r.points[i] >= h })
+
+	owners := make([]string, 0, n)
+	seen := make(map[string]struct{}, n)
+	for i := 0; len(owners) < n && i < len(r.points); i++{
+		id := r.owners[r.points[(start+i)%len(r.points)]]
+		if _, ok := seen[id]; ok{
+			continue
+		}
+		seen[id] = struct{}{}
+		owners = append(owners, id)
+	}
+	return owners
+}
+
+// Clone returns an independent copy of the ring, used to remember the placement before a membership change
+func (r *HashRing) Clone() *HashRing{
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.clone()
+}
+
+func (r *HashRing) clone() *HashRing{
+	return &HashRing{
+		virtualNodes: r.virtualNodes,
+		points: slices.Clone(r.points),
+		owners: maps.Clone(r.owners),
+		members: maps.Clone(r.members),
+		version: r.version,
+	}
+}
+
+// older reports whether r is a copy of the ring taken before other
+func (r *HashRing) older(other *HashRing) bool{
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+	return r.version < other.version
+}
@@ -0,0 +1,74 @@
+package vault
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+)
+
+func TestHashRingOwners(t *testing.T){
+	r := NewHashRing(0, "a", "b", "c")
+
+	owners := r.Owners("somekey", 2)
+	if len(owners) != 2 || owners[0] == owners[1]{
+		t.Errorf("expected 2 distinct owners, have %v", owners)
+	}
+
+	if len(r.Owners("somekey", 0)) != 3{
+		t.Errorf("expected n <= 0 to return every member")
+	}
+
+	if NewHashRing(0).Owners("somekey", 1) != nil{
+		t.Errorf("expected empty ring to have no owners")
+	}
+}
+
+func TestHashRingMinimalMovement(t *testing.T){
+	r := NewHashRing(0, "a", "b", "c")
+	prev := r.Clone()
+	r.Add("d")
+
+	moved := 0
+	for i := 0; i < 1000; i++{
+		key := crypto.HashKey(fmt.Sprintf("key_%d", i))
+		before, after := prev.Owners(key, 1)[0], r.Owners(key, 1)[0]
+		if before != after{
+			if after != "d"{
+				t.Fatalf("key %s moved from %s to %s instead of the new node", key, before, after)
+			}
+			moved++
+		}
+	}
+
+	// Roughly a quarter of the keys should move to the new node
+	if moved < 100 || moved > 450{
+		t.Errorf("unexpected number of moved keys %d", moved)
+	}
+
+	if !r.Remove("d") || r.Remove("d"){
+		t.Errorf("expected remove to succeed exactly once")
+	}
+	if len(r.Members()) != 3{
+		t.Errorf("have %v members", r.Members())
+	}
+}
+
+func TestHashRingJoinLeave(t *testing.T){
+	r := NewHashRing(0, "a", "b")
+
+	prev, ok := r.Join("c")
+	if !ok || prev.Has("c") || !r.Has("c"){
+		t.Fatalf("expected the ring before c joined, have %v", prev.Members())
+	}
+	if _, ok := r.Join("c"); ok{
+		t.Errorf("expected c to join only once")
+	}
+	next, ok := r.Leave("c")
+	if !ok || !next.Has("c") || r.Has("c"){
+		t.Fatalf("expected the ring before c left, have %v", next.Members())
+	}
+	if !prev.older(next) || next.older(prev){
+		t.Errorf("expected the ring before the join to be older than the one before the leave")
+	}
+}
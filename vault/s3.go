@@ -0,0 +1,751 @@
+package vault
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The S3 front-end serves the files of a node to tools that speak S3, with path style URLs (http://host/bucket/key).
+// A bucket is a namespace: object k in bucket b is the key "b/k". Buckets exist once they hold an object or are in
+// the cluster metadata, creating one registers it there when this node leads the metadata group.
+//
+// Requests are signed with SigV4 by one of the access keys in FileServerOpts.S3Keys. When the cluster metadata has an
+// ACL for a bucket the access key is the principal it is checked against.
+//
+// Supported are ListBuckets, CreateBucket, HeadBucket, DeleteBucket, GetBucketLocation, ListObjectsV2, PutObject,
+// GetObject (with Range), HeadObject, DeleteObject and multipart uploads. The parts of an upload are kept under
+// .s3/uploads in the storage root until it is completed or aborted.
+
+const (
+	s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat = "2006-01-02T15:04:05.000Z"
+	maxS3Keys = 1000
+	maxPartNumber = 10000
+	// uploadTTL is how long the parts of an upload that was neither completed nor aborted are kept
+	uploadTTL = 7 * 24 * time.Hour
+)
+
+var bucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// s3Error is an error answered with an S3 error code
+type s3Error struct{
+	Status int
+	Code string
+	Message string
+}
+
+func (e *s3Error) Error() string{
+	return e.Message
+}
+
+func s3Errorf(status int, code string, format string, args ...any) error{
+	return &s3Error{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+type s3ErrorResponse struct{
+	XMLName xml.Name `xml:"Error"`
+	Code string
+	Message string
+	Resource string
+}
+
+type s3Bucket struct{
+	Name string
+	CreationDate string
+}
+
+type listAllMyBucketsResult struct{
+	XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+	Xmlns string `xml:"xmlns,attr"`
+	Owner struct{
+		ID string
+		DisplayName string
+	}
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct{
+	Key string
+	LastModified string
+	ETag string
+	Size int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct{
+	Prefix string
+}
+
+type listBucketResult struct{
+	XMLName xml.Name `xml:"ListBucketResult"`
+	Xmlns string `xml:"xmlns,attr"`
+	Name string
+	Prefix string
+	Delimiter string `xml:",omitempty"`
+	StartAfter string `xml:",omitempty"`
+	ContinuationToken string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	EncodingType string `xml:",omitempty"`
+	MaxKeys int
+	KeyCount int
+	IsTruncated bool
+	Contents []s3Object
+	CommonPrefixes []s3CommonPrefix
+}
+
+type locationConstraint struct{
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns string `xml:"xmlns,attr"`
+}
+
+type initiateMultipartUploadResult struct{
+	XMLName xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns string `xml:"xmlns,attr"`
+	Bucket string
+	Key string
+	UploadId string
+}
+
+type completeMultipartUpload struct{
+	Parts []struct{
+		PartNumber int
+		ETag string
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct{
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns string `xml:"xmlns,attr"`
+	Location string
+	Bucket string
+	Key string
+	ETag string
+}
+
+// multipartUpload is the record of an upload kept next to its parts
+type multipartUpload struct{
+	Bucket string
+	Key string
+	Started time.Time
+}
+
+type s3Gateway struct{
+	s *FileServer
+}
+
+// s3Request is an authenticated request
+type s3Request struct{
+	// ctx ends when the client goes away
+	ctx context.Context
+	accessKey string
+	bucket string
+	key string
+	// body is the payload, verified against the signature as it is read
+	body io.Reader
+}
+
+// storageKey is the key the object of the request is stored under
+func (req s3Request) storageKey() string{
+	return req.bucket + "/" + req.key
+}
+
+// S3 returns the HTTP handler of the S3 front-end, it is served on S3Addr if that is set
+func (s *FileServer) S3() http.Handler{
+	return withTraceparent(&s3Gateway{s: s})
+}
+
+func (s *FileServer) startS3() error{
+	if len(s.S3Addr) == 0{
+		return nil
+	}
+
+	s.expireUploads()
+
+	ln, err := net.Listen("tcp", s.S3Addr)
+	if err != nil{
+		return err
+	}
+	s.s3 = &http.Server{
+		Handler: s.S3(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func(){
+		if err := s.s3.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed){
+			s.logger("s3").Error("s3 front-end error", "err", err)
+		}
+	}()
+	s.logger("s3").Info("s3 front-end listening", "addr", ln.Addr().String())
+	return nil
+}
+
+func (s *FileServer) stopS3(){
+	if s.s3 != nil{
+		s.s3.Close()
+	}
+}
+
+func (g *s3Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request){
+	req, err := g.authenticate(r)
+	if err != nil{
+		writeS3Error(w, r, err)
+		return
+	}
+
+	req.bucket, req.key, _ = strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(req.bucket) != 0 && !bucketName.MatchString(req.bucket){
+		writeS3Error(w, r, s3Errorf(http.StatusBadRequest, "InvalidBucketName", "invalid bucket name %q", req.bucket))
+		return
+	}
+
+	query := r.URL.Query()
+	switch{
+	case len(req.bucket) == 0 && r.Method == http.MethodGet:
+		err = g.listBuckets(w, req)
+	case len(req.bucket) == 0:
+		err = s3Errorf(http.StatusMethodNotAllowed, "MethodNotAllowed", "%s is not allowed on the service", r.Method)
+	case len(req.key) == 0:
+		err = g.serveBucket(w, r, req)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		err = g.createUpload(w, req)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		err = g.completeUpload(w, req, query.Get("uploadId"))
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		err = g.uploadPart(w, req, query.Get("uploadId"), query.Get("partNumber"))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		err = g.abortUpload(w, req, query.Get("uploadId"))
+	case r.Method == http.MethodPut && len(r.Header.Get("X-Amz-Copy-Source")) != 0:
+		err = s3Errorf(http.StatusNotImplemented, "NotImplemented", "CopyObject is not supported")
+	case r.Method == http.MethodPut:
+		err = g.putObject(w, req)
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		err = g.getObject(w, r, req)
+	case r.Method == http.MethodDelete:
+		err = g.deleteObject(w, req)
+	default:
+		err = s3Errorf(http.StatusMethodNotAllowed, "MethodNotAllowed", "%s is not allowed on an object", r.Method)
+	}
+	if err != nil{
+		writeS3Error(w, r, err)
+	}
+}
+
+func (g *s3Gateway) serveBucket(w http.ResponseWriter, r *http.Request, req s3Request) error{
+	query := r.URL.Query()
+	switch r.Method{
+	case http.MethodGet:
+		if query.Has("location"){
+			return writeXML(w, http.StatusOK, locationConstraint{Xmlns: s3Namespace})
+		}
+		if query.Get("list-type") != "2"{
+			return s3Errorf(http.StatusNotImplemented, "NotImplemented", "only ListObjectsV2 is supported")
+		}
+		return g.listObjects(w, r, req)
+	case http.MethodPut:
+		return g.createBucket(w, req)
+	case http.MethodHead:
+		if err := g.allowed(req, PermRead); err != nil{
+			return err
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case http.MethodDelete:
+		return g.deleteBucket(w, req)
+	}
+	return s3Errorf(http.StatusMethodNotAllowed, "MethodNotAllowed", "%s is not allowed on a bucket", r.Method)
+}
+
+// authenticate checks the signature of r and returns the request with its verified payload
+func (g *s3Gateway) authenticate(r *http.Request) (s3Request, error){
+	sig, err := parseSigV4(r)
+	if err != nil{
+		return s3Request{}, err
+	}
+
+	secret, ok := g.s.s3Secret(sig.accessKey)
+	if !ok{
+		return s3Request{}, s3Errorf(http.StatusForbidden, "InvalidAccessKeyId", "unknown access key %q", sig.accessKey)
+	}
+
+	if err := sig.verify(r, secret); err != nil{
+		return s3Request{}, err
+	}
+	body, err := sig.payload(r, secret)
+	if err != nil{
+		return s3Request{}, err
+	}
+	return s3Request{ctx: r.Context(), accessKey: sig.accessKey, body: body}, nil
+}
+
+// allowed checks the ACL of the bucket, if the cluster metadata has one
+func (g *s3Gateway) allowed(req s3Request, perm Permission) error{
+	meta := g.s.Metadata()
+	if _, ok := meta.ACLs[req.bucket]; !ok || meta.Allowed(req.bucket, req.accessKey, perm){
+		return nil
+	}
+	return s3Errorf(http.StatusForbidden, "AccessDenied", "%s may not do that in %s", req.accessKey, req.bucket)
+}
+
+func (g *s3Gateway) listBuckets(w http.ResponseWriter, req s3Request) error{
+	objects, err := g.s.List("")
+	if err != nil{
+		return err
+	}
+
+	created := map[string]time.Time{}
+	for _, ns := range g.s.Metadata().Namespaces{
+		created[ns] = time.Time{}
+	}
+	for _, o := range objects{
+		ns := namespaceOf(o.Key)
+		if t, ok := created[ns]; !ok || t.IsZero() || o.ModTime.Before(t){
+			created[ns] = o.ModTime
+		}
+	}
+
+	result := listAllMyBucketsResult{Xmlns: s3Namespace, Buckets: []s3Bucket{}}
+	result.Owner.ID = req.accessKey
+	result.Owner.DisplayName = req.accessKey
+	for ns, t := range created{
+		req.bucket = ns
+		if !bucketName.MatchString(ns) || g.allowed(req, PermRead) != nil{
+			continue
+		}
+		if t.IsZero(){
+			t = time.Now()
+		}
+		result.Buckets = append(result.Buckets, s3Bucket{Name: ns, CreationDate: t.UTC().Format(s3TimeFormat)})
+	}
+	sort.Slice(result.Buckets, func(i, j int) bool{ return result.Buckets[i].Name < result.Buckets[j].Name })
+	return writeXML(w, http.StatusOK, result)
+}
+
+func (g *s3Gateway) createBucket(w http.ResponseWriter, req s3Request) error{
+	if err := g.allowed(req, PermAdmin); err != nil{
+		return err
+	}
+	// Followers leave it to the first object, the bucket exists either way
+	if g.s.raft != nil && g.s.raft.Leader() == g.s.ID && !g.s.Metadata().hasNamespace(req.bucket){
+		if err := g.s.ProposeMetadata(MetaCommand{Op: MetaAddNamespace, Namespace: req.bucket}); err != nil{
+			return err
+		}
+	}
+	w.Header().Set("Location", "/"+req.bucket)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *s3Gateway) deleteBucket(w http.ResponseWriter, req s3Request) error{
+	if err := g.allowed(req, PermAdmin); err != nil{
+		return err
+	}
+	objects, err := g.s.List(req.bucket + "/")
+	if err != nil{
+		return err
+	}
+	if len(objects) != 0{
+		return s3Errorf(http.StatusConflict, "BucketNotEmpty", "bucket %s is not empty", req.bucket)
+	}
+	if g.s.raft != nil && g.s.raft.Leader() == g.s.ID && g.s.Metadata().hasNamespace(req.bucket){
+		if err := g.s.ProposeMetadata(MetaCommand{Op: MetaRemoveNamespace, Namespace: req.bucket}); err != nil{
+			return err
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (g *s3Gateway) listObjects(w http.ResponseWriter, r *http.Request, req s3Request) error{
+	if err := g.allowed(req, PermRead); err != nil{
+		return err
+	}
+	query := r.URL.Query()
+
+	result := listBucketResult{
+		Xmlns: s3Namespace,
+		Name: req.bucket,
+		Prefix: query.Get("prefix"),
+		Delimiter: query.Get("delimiter"),
+		StartAfter: query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+		EncodingType: query.Get("encoding-type"),
+		MaxKeys: maxS3Keys,
+		Contents: []s3Object{},
+		CommonPrefixes: []s3CommonPrefix{},
+	}
+	if v := query.Get("max-keys"); len(v) != 0{
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0{
+			return s3Errorf(http.StatusBadRequest, "InvalidArgument", "max-keys must be a number, have %q", v)
+		}
+		result.MaxKeys = min(n, maxS3Keys)
+	}
+	if len(result.EncodingType) != 0 && result.EncodingType != "url"{
+		return s3Errorf(http.StatusBadRequest, "InvalidArgument", "invalid encoding type %q", result.EncodingType)
+	}
+
+	// The token is the last key or common prefix of the previous page
+	marker := result.StartAfter
+	if len(result.ContinuationToken) != 0{
+		b, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil{
+			return s3Errorf(http.StatusBadRequest, "InvalidArgument", "invalid continuation token")
+		}
+		marker = string(b)
+	}
+
+	objects, err := g.s.List(req.bucket + "/" + result.Prefix)
+	if err != nil{
+		return err
+	}
+
+	encode := func(s string) string{
+		if result.EncodingType == "url"{
+			return uriEncode(s, false)
+		}
+		return s
+	}
+
+	last := ""
+	for _, o := range objects{
+		key := strings.TrimPrefix(o.Key, req.bucket+"/")
+		if key <= marker || (len(result.Delimiter) != 0 && strings.HasSuffix(marker, result.Delimiter) && strings.HasPrefix(key, marker)){
+			continue
+		}
+
+		entry := key
+		if i := strings.Index(key[len(result.Prefix):], result.Delimiter); len(result.Delimiter) != 0 && i >= 0{
+			entry = key[:len(result.Prefix)+i+len(result.Delimiter)]
+			if entry == last{
+				continue
+			}
+		}
+
+		if result.KeyCount == result.MaxKeys{
+			result.IsTruncated = true
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+			break
+		}
+		result.KeyCount++
+		last = entry
+
+		if entry != key{
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(entry)})
+			continue
+		}
+		result.Contents = append(result.Contents, s3Object{
+			Key: encode(key),
+			LastModified: o.ModTime.UTC().Format(s3TimeFormat),
+			ETag: etag(o),
+			Size: o.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+
+	if result.EncodingType == "url"{
+		result.Prefix = encode(result.Prefix)
+		result.Delimiter = encode(result.Delimiter)
+		result.StartAfter = encode(result.StartAfter)
+	}
+	return writeXML(w, http.StatusOK, result)
+}
+
+func (g *s3Gateway) putObject(w http.ResponseWriter, req s3Request) error{
+	if err := g.allowed(req, PermWrite); err != nil{
+		return err
+	}
+	if err := g.s.StoreContext(req.ctx, req.storageKey(), req.body); err != nil{
+		return err
+	}
+	info, err := g.s.Stat(req.storageKey())
+	if err != nil{
+		return err
+	}
+	setS3Headers(w, info)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *s3Gateway) getObject(w http.ResponseWriter, r *http.Request, req s3Request) error{
+	if err := g.allowed(req, PermRead); err != nil{
+		return err
+	}
+	info, err := g.s.Stat(req.storageKey())
+	if err != nil{
+		return err
+	}
+
+	if r.Method == http.MethodHead{
+		setS3Headers(w, info)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	rd, err := g.s.GetContext(req.ctx, req.storageKey())
+	if err != nil{
+		return err
+	}
+	if rc, ok := rd.(io.ReadCloser); ok{
+		defer rc.Close()
+	}
+	content, err := readSeeker(rd)
+	if err != nil{
+		return err
+	}
+
+	setS3Headers(w, info)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", info.ModTime, content)
+	return nil
+}
+
+func (g *s3Gateway) deleteObject(w http.ResponseWriter, req s3Request) error{
+	if err := g.allowed(req, PermDelete); err != nil{
+		return err
+	}
+	// Deleting a key that isn't there succeeds in S3
+	if _, err := g.s.Stat(req.storageKey()); err == nil{
+		if err := g.s.DeleteContext(req.ctx, req.storageKey()); err != nil{
+			return err
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func setS3Headers(w http.ResponseWriter, info ObjectInfo){
+	w.Header().Set("ETag", etag(info))
+	w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if len(info.Version) != 0{
+		w.Header().Set("X-Amz-Version-Id", info.Version)
+	}
+}
+
+func (s *FileServer) uploadsDir() string{
+	return filepath.Join(s.store.Root, ".s3", "uploads")
+}
+
+// expireUploads removes the parts of uploads started more than uploadTTL ago
+func (s *FileServer) expireUploads(){
+	entries, err := os.ReadDir(s.uploadsDir())
+	if err != nil{
+		return
+	}
+	for _, e := range entries{
+		dir := filepath.Join(s.uploadsDir(), e.Name())
+		var upload multipartUpload
+		if err := readJSON(filepath.Join(dir, "upload.json"), &upload); err != nil || time.Since(upload.Started) > uploadTTL{
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+// upload returns the directory of the upload with the given ID, which has to be for the object of req
+func (g *s3Gateway) upload(req s3Request, id string) (string, error){
+	if _, err := hex.DecodeString(id); err != nil || len(id) == 0{
+		return "", s3Errorf(http.StatusNotFound, "NoSuchUpload", "no upload %q", id)
+	}
+	dir := filepath.Join(g.s.uploadsDir(), id)
+
+	var upload multipartUpload
+	if err := readJSON(filepath.Join(dir, "upload.json"), &upload); err != nil || upload.Bucket != req.bucket || upload.Key != req.key{
+		return "", s3Errorf(http.StatusNotFound, "NoSuchUpload", "no upload %q for %s", id, req.storageKey())
+	}
+	return dir, nil
+}
+
+func (g *s3Gateway) createUpload(w http.ResponseWriter, req s3Request) error{
+	if err := g.allowed(req, PermWrite); err != nil{
+		return err
+	}
+
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	id := hex.EncodeToString(buf)
+
+	dir := filepath.Join(g.s.uploadsDir(), id)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil{
+		return err
+	}
+	if err := writeJSON(filepath.Join(dir, "upload.json"), multipartUpload{Bucket: req.bucket, Key: req.key, Started: time.Now()}); err != nil{
+		return err
+	}
+
+	return writeXML(w, http.StatusOK, initiateMultipartUploadResult{
+		Xmlns: s3Namespace,
+		Bucket: req.bucket,
+		Key: req.key,
+		UploadId: id,
+	})
+}
+
+func partPath(dir string, n int) string{
+	return filepath.Join(dir, fmt.Sprintf("part%05d", n))
+}
+
+func (g *s3Gateway) uploadPart(w http.ResponseWriter, req s3Request, id string, partNumber string) error{
+	if err := g.allowed(req, PermWrite); err != nil{
+		return err
+	}
+	dir, err := g.upload(req, id)
+	if err != nil{
+		return err
+	}
+	n, err := strconv.Atoi(partNumber)
+	if err != nil || n < 1 || n > maxPartNumber{
+		return s3Errorf(http.StatusBadRequest, "InvalidArgument", "part number must be between 1 and %d", maxPartNumber)
+	}
+
+	// The part only takes the place of one uploaded before under the same number once it is complete
+	f, err := os.CreateTemp(dir, "incoming")
+	if err != nil{
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), req.body)
+	if cerr := f.Close(); err == nil{
+		err = cerr
+	}
+	if err != nil{
+		return err
+	}
+	if err := os.Rename(f.Name(), partPath(dir, n)); err != nil{
+		return err
+	}
+
+	w.Header().Set("ETag", strconv.Quote(hex.EncodeToString(hash.Sum(nil))))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *s3Gateway) completeUpload(w http.ResponseWriter, req s3Request, id string) error{
+	if err := g.allowed(req, PermWrite); err != nil{
+		return err
+	}
+	dir, err := g.upload(req, id)
+	if err != nil{
+		return err
+	}
+
+	var complete completeMultipartUpload
+	if err := xml.NewDecoder(req.body).Decode(&complete); err != nil{
+		return s3Errorf(http.StatusBadRequest, "MalformedXML", "%s", err)
+	}
+	if len(complete.Parts) == 0{
+		return s3Errorf(http.StatusBadRequest, "MalformedXML", "an upload needs at least one part")
+	}
+
+	readers := []io.Reader{}
+	for i, part := range complete.Parts{
+		if i > 0 && part.PartNumber <= complete.Parts[i-1].PartNumber{
+			return s3Errorf(http.StatusBadRequest, "InvalidPartOrder", "parts have to be listed in ascending order")
+		}
+		f, err := os.Open(partPath(dir, part.PartNumber))
+		if err != nil{
+			return s3Errorf(http.StatusBadRequest, "InvalidPart", "part %d was not uploaded", part.PartNumber)
+		}
+		defer f.Close()
+
+		hash := sha256.New()
+		if _, err := io.Copy(hash, f); err != nil{
+			return err
+		}
+		if strings.Trim(part.ETag, `"`) != hex.EncodeToString(hash.Sum(nil)){
+			return s3Errorf(http.StatusBadRequest, "InvalidPart", "part %d doesn't match its ETag", part.PartNumber)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil{
+			return err
+		}
+		readers = append(readers, f)
+	}
+
+	if err := g.s.StoreContext(req.ctx, req.storageKey(), io.MultiReader(readers...)); err != nil{
+		return err
+	}
+	os.RemoveAll(dir)
+
+	info, err := g.s.Stat(req.storageKey())
+	if err != nil{
+		return err
+	}
+	if len(info.Version) != 0{
+		w.Header().Set("X-Amz-Version-Id", info.Version)
+	}
+	return writeXML(w, http.StatusOK, completeMultipartUploadResult{
+		Xmlns: s3Namespace,
+		Location: "/" + req.storageKey(),
+		Bucket: req.bucket,
+		Key: req.key,
+		ETag: etag(info),
+	})
+}
+
+func (g *s3Gateway) abortUpload(w http.ResponseWriter, req s3Request, id string) error{
+	if err := g.allowed(req, PermWrite); err != nil{
+		return err
+	}
+	dir, err := g.upload(req, id)
+	if err != nil{
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil{
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) error{
+	b, err := xml.Marshal(v)
+	if err != nil{
+		return err
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+	return nil
+}
+
+// writeS3Error answers with the S3 error that goes with err
+func writeS3Error(w http.ResponseWriter, r *http.Request, err error){
+	var e *s3Error
+	if !errors.As(err, &e){
+		e = &s3Error{Status: http.StatusInternalServerError, Code: "InternalError", Message: err.Error()}
+		switch errorCode(err){
+		case "not_found", "deleted":
+			e.Status, e.Code = http.StatusNotFound, "NoSuchKey"
+		case "conflict":
+			e.Status, e.Code = http.StatusConflict, "OperationAborted"
+		case "draining":
+			e.Status, e.Code = http.StatusServiceUnavailable, "ServiceUnavailable"
+		}
+	}
+
+	// A HEAD response has no body, the status says it all
+	if r.Method == http.MethodHead{
+		w.WriteHeader(e.Status)
+		return
+	}
+	writeXML(w, e.Status, s3ErrorResponse{Code: e.Code, Message: e.Message, Resource: r.URL.Path})
+}
@@ -0,0 +1,345 @@
+package vault
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// newS3Client returns a client of an S3 front-end over TLS, where the SDK sends bodies it adds a checksum to aws-chunked
+func newS3Client(t *testing.T, secret string) (*s3.Client, *FileServer){
+	s := newTestServer(t.TempDir())
+	s.S3Keys = map[string]string{"tester": "secret"}
+	srv := httptest.NewTLSServer(s.S3())
+	t.Cleanup(srv.Close)
+
+	client := s3.New(s3.Options{
+		BaseEndpoint: aws.String(srv.URL),
+		Region: "us-east-1",
+		UsePathStyle: true,
+		HTTPClient: srv.Client(),
+		Credentials: credentials.NewStaticCredentialsProvider("tester", secret, ""),
+	})
+	return client, s
+}
+
+func errorCodeOf(err error) string{
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr){
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+func TestS3Objects(t *testing.T){
+	client, _ := newS3Client(t, "secret")
+	ctx := context.Background()
+
+	_, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("photos"),
+		Key: aws.String("2024/cat (1).jpg"),
+		Body: strings.NewReader("meow meow"),
+		ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
+	})
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("2024/cat (1).jpg")})
+	if err != nil{
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(out.Body)
+	out.Body.Close()
+	if string(b) != "meow meow" || aws.ToString(out.ETag) == ""{
+		t.Errorf("get returned %q with ETag %q", b, aws.ToString(out.ETag))
+	}
+
+	out, err = client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("2024/cat (1).jpg"), Range: aws.String("bytes=5-")})
+	if err != nil{
+		t.Fatal(err)
+	}
+	b, _ = io.ReadAll(out.Body)
+	out.Body.Close()
+	if string(b) != "meow"{
+		t.Errorf("range get returned %q", b)
+	}
+
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("photos"), Key: aws.String("2024/cat (1).jpg")})
+	if err != nil || aws.ToInt64(head.ContentLength) != 9{
+		t.Errorf("head returned %v, %v", head, err)
+	}
+
+	buckets, err := client.ListBuckets(ctx, &s3.ListBucketsInput{})
+	if err != nil || len(buckets.Buckets) != 1 || aws.ToString(buckets.Buckets[0].Name) != "photos"{
+		t.Errorf("list buckets returned %v, %v", buckets, err)
+	}
+
+	if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String("photos"), Key: aws.String("2024/cat (1).jpg")}); err != nil{
+		t.Fatal(err)
+	}
+	_, err = client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("2024/cat (1).jpg")})
+	var noSuchKey *types.NoSuchKey
+	if !errors.As(err, &noSuchKey){
+		t.Errorf("get after delete returned %v", err)
+	}
+	if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String("photos"), Key: aws.String("missing")}); err != nil{
+		t.Errorf("deleting a missing key returned %v", err)
+	}
+}
+
+func TestS3ListObjectsV2(t *testing.T){
+	client, _ := newS3Client(t, "secret")
+	ctx := context.Background()
+
+	keys := []string{"docs/a.txt", "docs/b.txt", "docs/old/c.txt", "docs/old/d.txt", "docs/z.txt", "readme"}
+	for _, key := range keys{
+		if _, err := client.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("files"), Key: aws.String(key), Body: strings.NewReader(key)}); err != nil{
+			t.Fatal(err)
+		}
+	}
+
+	// Pages of two, with docs/old/ rolled up into a common prefix that counts as one entry
+	entries := []string{}
+	pages := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String("files"),
+		Prefix: aws.String("docs/"),
+		Delimiter: aws.String("/"),
+		MaxKeys: aws.Int32(2),
+	})
+	for n := 0; pages.HasMorePages(); n++{
+		if n > 5{
+			t.Fatal("listing doesn't end")
+		}
+		page, err := pages.NextPage(ctx)
+		if err != nil{
+			t.Fatal(err)
+		}
+		for _, p := range page.CommonPrefixes{
+			entries = append(entries, aws.ToString(p.Prefix))
+		}
+		for _, o := range page.Contents{
+			entries = append(entries, aws.ToString(o.Key))
+		}
+	}
+	if got := strings.Join(entries, ","); got != "docs/a.txt,docs/b.txt,docs/old/,docs/z.txt"{
+		t.Errorf("listing returned %s", got)
+	}
+
+	all, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("files")})
+	if err != nil || aws.ToInt32(all.KeyCount) != int32(len(keys)) || aws.ToBool(all.IsTruncated){
+		t.Errorf("full listing returned %v, %v", all, err)
+	}
+
+	if _, err := client.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: aws.String("files")}); errorCodeOf(err) != "BucketNotEmpty"{
+		t.Errorf("deleting a bucket with objects returned %v", err)
+	}
+}
+
+func TestS3Multipart(t *testing.T){
+	client, s := newS3Client(t, "secret")
+	ctx := context.Background()
+	bucket, key := aws.String("backups"), aws.String("db.dump")
+
+	upload, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: bucket, Key: key})
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	parts := [][]byte{bytes.Repeat([]byte("a"), 70000), bytes.Repeat([]byte("b"), 100)}
+	completed := []types.CompletedPart{}
+	for i, part := range parts{
+		out, err := client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket: bucket,
+			Key: key,
+			UploadId: upload.UploadId,
+			PartNumber: aws.Int32(int32(i + 1)),
+			Body: bytes.NewReader(part),
+		})
+		if err != nil{
+			t.Fatal(err)
+		}
+		completed = append(completed, types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(int32(i + 1))})
+	}
+
+	// Parts out of order are refused and leave the upload as it was
+	_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket: bucket,
+		Key: key,
+		UploadId: upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: []types.CompletedPart{completed[1], completed[0]}},
+	})
+	if errorCodeOf(err) != "InvalidPartOrder"{
+		t.Errorf("completing with parts out of order returned %v", err)
+	}
+
+	_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket: bucket,
+		Key: key,
+		UploadId: upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: key})
+	if err != nil{
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(out.Body)
+	out.Body.Close()
+	if !bytes.Equal(b, bytes.Join(parts, nil)){
+		t.Errorf("completed upload has %d bytes, want %d", len(b), len(parts[0])+len(parts[1]))
+	}
+
+	if _, err := client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{Bucket: bucket, Key: key, UploadId: upload.UploadId}); errorCodeOf(err) != "NoSuchUpload"{
+		t.Errorf("aborting a completed upload returned %v", err)
+	}
+	if entries, _ := os.ReadDir(s.uploadsDir()); len(entries) != 0{
+		t.Errorf("uploads left behind: %v", entries)
+	}
+}
+
+func TestS3Auth(t *testing.T){
+	ctx := context.Background()
+
+	client, _ := newS3Client(t, "wrong")
+	if _, err := client.ListBuckets(ctx, &s3.ListBucketsInput{}); errorCodeOf(err) != "SignatureDoesNotMatch"{
+		t.Errorf("wrong secret returned %v", err)
+	}
+
+	s := newTestServer(t.TempDir())
+	s.S3Keys = map[string]string{"tester": "secret"}
+	srv := httptest.NewServer(s.S3())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/photos/cat.jpg")
+	if err != nil{
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden{
+		t.Errorf("unsigned request returned %d", resp.StatusCode)
+	}
+
+	other := s3.New(s3.Options{
+		BaseEndpoint: aws.String(srv.URL),
+		Region: "us-east-1",
+		UsePathStyle: true,
+		Credentials: credentials.NewStaticCredentialsProvider("stranger", "secret", ""),
+	})
+	if _, err := other.ListBuckets(ctx, &s3.ListBucketsInput{}); errorCodeOf(err) != "InvalidAccessKeyId"{
+		t.Errorf("unknown access key returned %v", err)
+	}
+
+	// A presigned URL works without any headers
+	signer := s3.NewPresignClient(s3.New(s3.Options{
+		BaseEndpoint: aws.String(srv.URL),
+		Region: "us-east-1",
+		UsePathStyle: true,
+		Credentials: credentials.NewStaticCredentialsProvider("tester", "secret", ""),
+	}))
+	put, err := signer.PresignPutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("photos"), Key: aws.String("cat.jpg")}, s3.WithPresignExpires(time.Minute))
+	if err != nil{
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(put.Method, put.URL, strings.NewReader("meow"))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil{
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK{
+		t.Errorf("presigned put returned %d", resp.StatusCode)
+	}
+}
+
+// The example of a chunked upload in the S3 documentation on signing payloads in multiple chunks
+func TestChunkedReader(t *testing.T){
+	seed := &sigV4{
+		date: time.Date(2013, 5, 24, 0, 0, 0, 0, time.UTC),
+		scope: "20130524/us-east-1/s3/aws4_request",
+		signature: "4f232c4386841ef735655705268965c44a0e4690baa4adea153f7db9fa80a0a9",
+	}
+	body := "10000;chunk-signature=ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648\r\n" +
+		strings.Repeat("a", 65536) + "\r\n" +
+		"400;chunk-signature=0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497\r\n" +
+		strings.Repeat("a", 1024) + "\r\n" +
+		"0;chunk-signature=b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9\r\n\r\n"
+	key := seed.signingKey("wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY")
+
+	read := func(body string) ([]byte, error){
+		r := &chunkedReader{r: bufio.NewReader(strings.NewReader(body)), sig: seed, key: key, prev: seed.signature}
+		return io.ReadAll(r)
+	}
+
+	b, err := read(body)
+	if err != nil || len(b) != 66560{
+		t.Fatalf("read %d bytes, %v", len(b), err)
+	}
+
+	tampered := strings.Replace(body, "aaaa\r\n400", "aaab\r\n400", 1)
+	var e *s3Error
+	if _, err := read(tampered); !errors.As(err, &e) || e.Code != "SignatureDoesNotMatch"{
+		t.Errorf("tampered chunk returned %v", err)
+	}
+}
+
+func TestChunkedReaderManyChunks(t *testing.T){
+	seed := &sigV4{
+		date: time.Date(2013, 5, 24, 0, 0, 0, 0, time.UTC),
+		scope: "20130524/us-east-1/s3/aws4_request",
+		signature: "4f232c4386841ef735655705268965c44a0e4690baa4adea153f7db9fa80a0a9",
+	}
+	key := seed.signingKey("secret")
+	sign := func(prev string, data []byte) string{
+		toSign := strings.Join([]string{sigV4Algorithm + "-PAYLOAD", seed.date.Format(amzDateFormat), seed.scope, prev, emptySHA256, sha256Hex(data)}, "\n")
+		return hex.EncodeToString(hmacSHA256(key, toSign))
+	}
+	read := func(body string) ([]byte, error){
+		r := &chunkedReader{r: bufio.NewReader(strings.NewReader(body)), sig: seed, key: key, prev: seed.signature}
+		return io.ReadAll(r)
+	}
+
+	body, want := new(strings.Builder), new(bytes.Buffer)
+	prev := seed.signature
+	for i := 0; i < 10000; i++{
+		data := bytes.Repeat([]byte{byte('a' + i%26)}, 100)
+		prev = sign(prev, data)
+		fmt.Fprintf(body, "%x;chunk-signature=%s\r\n%s\r\n", len(data), prev, data)
+		want.Write(data)
+	}
+	fmt.Fprintf(body, "0;chunk-signature=%s\r\n\r\n", sign(prev, nil))
+
+	b, err := read(body.String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, want.Bytes()){
+		t.Errorf("read %d bytes that don't match the %d sent", len(b), want.Len())
+	}
+
+	// A chunk over the cap is refused before anything is read into memory
+	var e *s3Error
+	huge := fmt.Sprintf("%x;chunk-signature=%s\r\n", maxPayloadChunkSize+1, sign(seed.signature, nil))
+	if _, err := read(huge); !errors.As(err, &e) || e.Code != "EntityTooLarge"{
+		t.Errorf("oversized chunk returned %v", err)
+	}
+}
@@ -0,0 +1,1068 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+	"github.com/ayushn2/distri_vault.git/p2p"
+	"github.com/ayushn2/distri_vault.git/store"
+)
+
+type FileServerOpts struct{
+	ID string
+	EncKey []byte
+	StorageRoot string
+	PathTransformFunc PathTransformFunc
+	Transport p2p.Transport
+	BootstrapNodes []string
+
+	// AntiEntropyInterval is how often merkle roots are exchanged with peers, zero disables anti-entropy
+	AntiEntropyInterval time.Duration
+	// AntiEntropyBandwidth caps the bytes requested from peers per anti-entropy round, zero means unlimited
+	AntiEntropyBandwidth int64
+
+	// ReplicationFactor is the number of peers that receive a replica of every file, zero replicates to every peer
+	ReplicationFactor int
+	// RebalanceRate caps the bytes per second moved by the rebalancer, zero means unlimited
+	RebalanceRate int64
+
+	// HintTTL is how long a hint for an offline replica owner is kept before it is dropped
+	HintTTL time.Duration
+	// HintMaxBytes caps the disk space hints held for other nodes may take
+	HintMaxBytes int64
+
+	// SigningKey signs the deletes of this node, a fresh one is generated if it is not set
+	SigningKey ed25519.PrivateKey
+	// TombstoneGracePeriod is how long the record of a delete is kept around before it is garbage collected
+	TombstoneGracePeriod time.Duration
+
+	// KeepVersions keeps at least the last N versions of every file, zero disables the rule
+	KeepVersions int
+	// KeepVersionsFor keeps every version younger than this, zero disables the rule. Without either rule all versions are kept.
+	KeepVersionsFor time.Duration
+
+	// ConflictResolver picks what Get returns for a key with concurrent versions, LastWriterWins if not set
+	ConflictResolver ConflictResolver
+
+	// ProbeInterval, ProbeTimeout and SuspicionTimeout tune the failure detector, see membership.go for the defaults
+	ProbeInterval time.Duration
+	ProbeTimeout time.Duration
+	SuspicionTimeout time.Duration
+
+	// AdvertiseAddr is the address peers are told to reach us on, the transport listen address if not set
+	AdvertiseAddr string
+	// TargetPeers is the number of connections peer exchange tries to keep up
+	TargetPeers int
+	PeerExchangeInterval time.Duration
+
+	// ClusterName turns on LAN discovery, only nodes announcing the same name join each other
+	ClusterName string
+	// DiscoveryGroup is the multicast group discovery announces on, p2p.DefaultDiscoveryGroup if not set
+	DiscoveryGroup string
+	DiscoveryInterval time.Duration
+
+	// RaftVoters are the IDs of the nodes replicating the cluster metadata, see metadata.go
+	RaftVoters []string
+	RaftElectionTimeout time.Duration
+	RaftSnapshotThreshold int
+
+	// DefaultStorageMode is how files are made redundant, StorageModes overrides it per namespace. See erasure.go.
+	DefaultStorageMode StorageMode
+	StorageModes map[string]StorageMode
+	// RepairInterval is how often the shards of erasure coded files are checked
+	RepairInterval time.Duration
+
+	// ChunkSize is the size of the pieces objects are fetched from the network in, PipelineDepth the number of
+	// chunk requests kept in flight per peer. See swarm.go.
+	ChunkSize int64
+	PipelineDepth int
+
+	// ControlSocket is the path of the unix socket the command line client talks to, empty disables it. See control.go.
+	ControlSocket string
+	// HTTPAddr is the address the HTTP gateway listens on, empty disables it. See gateway.go.
+	HTTPAddr string
+	// S3Addr is the address the S3 front-end listens on, empty disables it. S3Keys maps the access keys it accepts to
+	// their secret. See s3.go.
+	S3Addr string
+	S3Keys map[string]string
+	// AdminAddr is the address the admin port with the Prometheus metrics listens on, empty disables it. See metrics.go.
+	AdminAddr string
+
+	// Logger is where the node logs to, with the node ID and the component attached to every record, at the levels
+	// of LogLevels. See logging.go.
+	Logger *slog.Logger
+	LogLevels *LogLevels
+	// SpanExporter receives the spans of the Store and Get calls the node takes part in, nil turns tracing off. The
+	// node shuts it down when it stops. See tracing.go.
+	SpanExporter SpanExporter
+}
+
+type FileServer struct{
+	FileServerOpts
+	
+	peerLock sync.Mutex
+	peers map[string]p2p.Peer
+	// peerIDs maps the remote address of a peer to the node ID it announced in its hello
+	peerIDs map[string]string
+	// peerKeys holds the signing key pinned for every node ID we have seen, see pinKey
+	peerKeys map[string]ed25519.PublicKey
+	// challenges holds the nonce sent to every peer in our hello, hellos the hellos waiting for the peer to sign it
+	challenges map[string][]byte
+	hellos map[string]MessageHello
+	store *store.Store
+	quitch chan struct{}
+	stopOnce sync.Once
+
+	// settingsLock guards the options Reload changes while the node runs
+	settingsLock sync.Mutex
+
+	// sendLocks hold every write to a peer, keyed by its address, so a message can't land in the middle of another
+	// one or of a stream. A stream holds the lock from its message to its last byte, see lockPeers.
+	sendLocks keyLocks
+
+	syncBudget syncBudget
+	versionLocks keyLocks
+	objectLocks keyLocks
+	// hintBytes is what hints take on disk as of the last sweep plus the ones taken since
+	hintBytes atomic.Int64
+	ring *HashRing
+	rebalancer *Rebalancer
+	drain drainer
+	acks ackWaiter
+	clock HybridClock
+	members membership
+	reconnect reconnector
+	book peerBook
+	discovery *p2p.Discovery
+	raft *Raft
+	meta *metadataMachine
+	proposals proposalWaiter
+	replies replyWaiter
+	control net.Listener
+	gateway *http.Server
+	s3 *http.Server
+	admin *http.Server
+	metrics *metrics
+	loggers map[string]*slog.Logger
+}
+
+
+
+func NewFileServer(opts FileServerOpts) *FileServer{
+	if len(opts.ID) == 0{
+		opts.ID = crypto.GenerateID()
+	}
+	if opts.SigningKey == nil{
+		opts.SigningKey = crypto.NewSigningKey()
+	}
+	if opts.Logger == nil{
+		opts.Logger = defaultLogger()
+	}
+	if opts.LogLevels == nil{
+		opts.LogLevels = new(LogLevels)
+	}
+	loggers := componentLoggers(opts.Logger.With("node", opts.ID), opts.LogLevels)
+
+	storeOpts := store.StoreOpts{
+		Root: opts.StorageRoot,
+		PathTransformFunc: opts.PathTransformFunc,
+		Logger: loggers["store"],
+	}
+	s := &FileServer{
+		FileServerOpts: opts,
+		store: store.NewStore(storeOpts),
+		quitch: make(chan struct{}),
+		peers: make(map[string]p2p.Peer),
+		peerIDs: make(map[string]string),
+		peerKeys: make(map[string]ed25519.PublicKey),
+		challenges: make(map[string][]byte),
+		hellos: make(map[string]MessageHello),
+		ring: NewHashRing(defaultVirtualNodes, opts.ID),
+		meta: newMetadataMachine(),
+		metrics: newMetrics(),
+		loggers: loggers,
+	}
+	s.rebalancer = NewRebalancer(s)
+	// Entries peers send before our first round are held to the same budget
+	s.syncBudget.reset(opts.AntiEntropyBandwidth)
+	return s
+}
+
+func (s *FileServer) broadcast(ctx context.Context, msg *Message) error{
+	return s.multicast(ctx, s.allPeers(), msg)
+}
+
+// multicast sends msg to the given peers only, a peer that doesn't take it before ctx is done is skipped
+func (s *FileServer) multicast(ctx context.Context, peers []p2p.Peer, msg *Message) error{
+	return s.sendEach(ctx, peers, msg, false)
+}
+
+// sendEach is multicast, held tells that the caller already holds the send locks of the peers
+func (s *FileServer) sendEach(ctx context.Context, peers []p2p.Peer, msg *Message, held bool) (err error){
+	ctx, span := s.childSpan(ctx, "broadcast", "message", fmt.Sprintf("%T", msg.Payload), "peers", len(peers))
+	defer endSpan(span, &err)
+	msg.Trace = traceparent(ctx)
+
+	buf := new(bytes.Buffer)
+
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil{
+		return err
+	}
+
+	frame := p2p.EncodeFrame(buf.Bytes())
+
+	// A dead peer must not keep the message from the others, the failure detector takes care of removing it
+	var errs []error
+	for _, peer := range peers{
+		var err error
+		if held{
+			err = peer.SendContext(ctx, frame)
+		} else{
+			err = s.sendLocked(ctx, peer, frame)
+		}
+		if err != nil{
+			errs = append(errs, fmt.Errorf("send to %s: %w", peer.RemoteAddr(), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// sendLocked writes b to peer once no other message or stream is being written to it
+func (s *FileServer) sendLocked(ctx context.Context, peer p2p.Peer, b []byte) error{
+	unlock, err := s.lockPeers(ctx, peer)
+	if err != nil{
+		return err
+	}
+	defer unlock()
+	return peer.SendContext(ctx, b)
+}
+
+// lockPeers takes the send locks of peers for a message and the stream that follows it. They are taken in the order
+// of the addresses, so two writes to overlapping sets of peers can't wait on each other.
+func (s *FileServer) lockPeers(ctx context.Context, peers ...p2p.Peer) (unlock func(), err error){
+	addrs := make([]string, 0, len(peers))
+	for _, peer := range peers{
+		addrs = append(addrs, peer.RemoteAddr().String())
+	}
+	slices.Sort(addrs)
+	addrs = slices.Compact(addrs)
+
+	unlocks := make([]func(), 0, len(addrs))
+	unlock = func(){
+		for _, u := range unlocks{
+			u()
+		}
+	}
+	for _, addr := range addrs{
+		u, err := s.sendLocks.lockContext(ctx, addr)
+		if err != nil{
+			unlock()
+			return nil, err
+		}
+		unlocks = append(unlocks, u)
+	}
+	return unlock, nil
+}
+
+func (s *FileServer) allPeers() []p2p.Peer{
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers{
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// sendMessage sends msg to a single peer only
+func (s *FileServer) sendMessage(to string, msg *Message) error{
+	return s.sendMessageContext(context.Background(), to, msg)
+}
+
+func (s *FileServer) sendMessageContext(ctx context.Context, to string, msg *Message) error{
+	peer, ok := s.peer(to)
+	if !ok{
+		return fmt.Errorf("peer (%s) could not be found in the peer list", to)
+	}
+	unlock, err := s.lockPeers(ctx, peer)
+	if err != nil{
+		return err
+	}
+	defer unlock()
+	return s.send(ctx, peer, msg)
+}
+
+// send writes msg to peer, the caller holds the send lock of peer
+func (s *FileServer) send(ctx context.Context, peer p2p.Peer, msg *Message) error{
+	msg.Trace = traceparent(ctx)
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil{
+		return err
+	}
+
+	return peer.SendContext(ctx, p2p.EncodeFrame(buf.Bytes()))
+}
+
+// peerAddr returns the remote address of the connected node with the given ID
+func (s *FileServer) peerAddr(id string) (string, bool){
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	for addr, peerID := range s.peerIDs{
+		if peerID == id{
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+func (s *FileServer) peerID(addr string) string{
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	return s.peerIDs[addr]
+}
+
+// placement returns the IDs of the nodes that should hold a replica of the object owned by ownerID under ring.
+// The owner keeps its own plaintext copy and is never one of its replicas.
+func (s *FileServer) placement(ring *HashRing, ownerID string, hashedKey string) []string{
+	return s.placementRF(ring, s.replicationFactor(), ownerID, hashedKey)
+}
+
+// placementRF is placement under replication factor rf rather than the current one
+func (s *FileServer) placementRF(ring *HashRing, rf int, ownerID string, hashedKey string) []string{
+	if base, index, ok := parseShardKey(hashedKey); ok{
+		if holder, ok := shardHolder(ring, ownerID, base, index); ok{
+			return []string{holder}
+		}
+		return []string{}
+	}
+
+	ids := []string{}
+	for _, id := range ring.Owners(hashedKey, 0){
+		if id == ownerID{
+			continue
+		}
+		ids = append(ids, id)
+		if rf > 0 && len(ids) == rf{
+			break
+		}
+	}
+	return ids
+}
+
+// shouldHold reports whether this node is one of the replicas of the object under the current ring
+func (s *FileServer) shouldHold(ownerID string, hashedKey string) bool{
+	if _, _, ok := parseShardKey(hashedKey); ok{
+		return contains(s.placement(s.ring, ownerID, hashedKey), s.ID)
+	}
+	if s.replicationFactor() <= 0{
+		return true
+	}
+	return contains(s.placement(s.ring, ownerID, hashedKey), s.ID)
+}
+
+// removePeer forgets a peer that is gone from the network
+func (s *FileServer) removePeer(addr string){
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	delete(s.peers, addr)
+	delete(s.peerIDs, addr)
+	delete(s.challenges, addr)
+	delete(s.hellos, addr)
+}
+
+func (s *FileServer) peer(addr string) (p2p.Peer, bool){
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peer, ok := s.peers[addr]
+	return peer, ok
+}
+
+type Message struct{
+	Payload any
+	// Trace is the traceparent of the span the message was sent under, empty if it wasn't. See tracing.go.
+	Trace string
+}
+
+type MessageStoreFile struct{
+	ID string
+	Key string
+	Size int
+	// Offset is where the stream starts in the object, non zero when an interrupted transfer is resumed
+	Offset int64
+	Digest string
+	ModTime int64
+	// Ack asks the receiver to confirm the write with a MessageStoreAck
+	Ack bool
+	// Hint names the offline node this replica is handed to us for
+	Hint string
+	// Erasure describes the shard when the object is one
+	Erasure *ErasureInfo
+}
+
+type MessageGetFile struct{
+	ID string
+	Key string
+}
+
+// getObject reads a single object by its storage key, from local disk if we have it and from the network otherwise
+func (s *FileServer) getObject(ctx context.Context, key string) (io.Reader,error){
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if err == nil && meta.Deleted{
+		return nil, ErrDeleted
+	}
+	if s.store.Has(s.ID,key){
+		s.logger("server").Debug("serving file from local disk", "key", key)
+		_, r, err := s.store.Read(s.ID,key)
+		return r, err
+	}
+	if err == nil && meta.Erasure != nil{
+		return s.getShards(ctx, key, meta)
+	}
+	s.logger("server").Debug("file not on disk, fetching it from the network", "key", key)
+
+	n, err := s.fetchSwarm(ctx, key)
+	if err != nil{
+		return nil, err
+	}
+	if err := s.writeLocalMeta(key, n); err != nil{
+		return nil, err
+	}
+	s.logger("server").Debug("fetched file from the network", "key", key, "bytes", n)
+
+	_, r, err := s.store.Read(s.ID,key)
+	return r, err
+}
+
+
+// storeObjectAt writes a single object under its storage key with the given hybrid timestamp and replicates it, or
+// spreads its shards if mode is erasure coded. Once the object is on our disk a cancelled ctx only cuts the
+// replication short, anti-entropy brings the replicas up to date later.
+func ( s *FileServer) storeObjectAt(ctx context.Context, key string,r io.Reader, modTime int64, mode StorageMode) error{
+	// 1. Store this file to disk
+	// 2. Broadcast this file to all known peers in the network
+
+	var(
+		fileBuffer =new(bytes.Buffer)
+		hash = sha256.New()
+		tee =  io.TeeReader(r, io.MultiWriter(fileBuffer, hash))
+	)
+
+	_, write := s.childSpan(ctx, "disk.write", "key", key)
+	size, err := s.store.WriteContext(ctx, s.ID,key, tee)
+	write.SetAttrs("bytes", size)
+	write.RecordError(err)
+	write.End()
+	if err != nil{
+		return err
+	}
+
+	meta := Meta{
+		Size: size,
+		Digest: hex.EncodeToString(hash.Sum(nil)),
+		ModTime: modTime,
+	}
+
+	if mode.erasureCoded(){
+		info, err := s.storeShards(ctx, key, fileBuffer, meta.Digest, mode, modTime)
+		if err != nil{
+			return err
+		}
+		meta.Erasure = &info
+		return s.store.WriteMeta(s.ID, key, meta)
+	}
+
+	if err := s.store.WriteMeta(s.ID, key, meta); err != nil{
+		return err
+	}
+
+	storeMsg := MessageStoreFile{
+		ID : s.ID,
+		Key: crypto.HashKey(key),
+		Size: int(size) + 16,
+		Digest: meta.Digest,
+		ModTime: meta.ModTime,
+	}
+
+	targets := s.replicaTargets(crypto.HashKey(key))
+	if len(targets) == 0{
+		s.logger("server").Debug("stored file", "key", key, "bytes", size, "replicas", 0)
+		return nil
+	}
+
+	// The replicas get the ciphertext, it is encrypted before the connections to them are held up by the stream
+	_, enc := s.childSpan(ctx, "encrypt", "key", key, "bytes", size)
+	ciphertext := new(bytes.Buffer)
+	_, err = crypto.CopyEncryptConvergent(s.EncKey, meta.Digest, fileBuffer, ciphertext)
+	enc.RecordError(err)
+	enc.End()
+	if err != nil{
+		return err
+	}
+
+	targetPeers := make([]p2p.Peer, 0, len(targets))
+	for _, t := range targets{
+		targetPeers = append(targetPeers, t.peer)
+	}
+	unlock, err := s.lockPeers(ctx, targetPeers...)
+	if err != nil{
+		return s.cutShort(ctx, key, err)
+	}
+	defer unlock()
+
+	peers := []p2p.Peer{}
+	for _, t := range targets{
+		storeMsg.Hint = t.hint
+		if err := s.sendEach(ctx, []p2p.Peer{t.peer}, &Message{Payload: storeMsg}, true); err != nil{
+			if ctx.Err() != nil{
+				return s.cutShort(ctx, key, err)
+			}
+			// The peer is gone, forget it so the next write hands its replica off instead
+			s.metrics.replications.add(1, "failed")
+			s.logger("server").Warn("replica unreachable", "peer", t.peer.RemoteAddr().String(), "key", key, "err", err)
+			s.removePeer(t.peer.RemoteAddr().String())
+			continue
+		}
+		peers = append(peers, t.peer)
+	}
+	
+	time.Sleep(time.Millisecond * 5)
+	defer s.metrics.stream("out")()
+	_, send := s.childSpan(ctx, "stream.send", "key", key, "replicas", len(peers), "bytes", ciphertext.Len())
+	mw := &replicaWriter{ctx: ctx, peers: peers, log: s.logger("transfer").With("key", key)}
+	mw.Write([]byte{p2p.IncomingStream})
+	n, err := io.Copy(mw, ciphertext)
+	s.metrics.replications.add(int64(len(mw.peers)), "ok")
+	s.metrics.replications.add(int64(len(peers)-len(mw.peers)), "failed")
+	send.SetAttrs("delivered", len(mw.peers))
+	send.RecordError(err)
+	send.End()
+	if err != nil{
+		return s.cutShort(ctx, key, err)
+	}
+	s.logger("server").Debug("stored file", "key", key, "bytes", size, "replicas", len(peers), "sent", n)
+
+	return nil	
+}
+
+// cutShort is the error of telling the peers about a write that is already on our disk. When it is only ctx running
+// out the write stands, the peers catch up through anti-entropy.
+func (s *FileServer) cutShort(ctx context.Context, key string, err error) error{
+	if err != nil && ctx.Err() != nil{
+		s.logger("server").Warn("replication cut short", "key", key, "err", ctx.Err())
+		return nil
+	}
+	return err
+}
+
+// writeLocalMeta records the meta of an object we just fetched back from the network into our own namespace
+func (s *FileServer) writeLocalMeta(key string, size int64) error{
+	digest, err := s.store.Digest(s.ID, key)
+	if err != nil{
+		return err
+	}
+	return s.store.WriteMeta(s.ID, key, Meta{
+		Size: size,
+		Digest: digest,
+		ModTime: s.clock.Now(),
+	})
+}
+
+// Stop shuts the server down, a drained server has already stopped itself so only the first call counts
+func (s *FileServer) Stop(){
+	s.stopOnce.Do(s.stop)
+}
+
+func (s *FileServer) stop(){
+	close(s.quitch)
+	s.stopControl()
+	s.stopGateway()
+	s.stopS3()
+	s.stopAdmin()
+	s.stopDiscovery()
+	if s.raft != nil{
+		s.raft.Stop()
+	}
+	if s.SpanExporter != nil{
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.SpanExporter.Shutdown(ctx)
+	}
+}
+
+func (s *FileServer) OnPeer(p p2p.Peer) error{
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	s.peers[p.RemoteAddr().String()] = p
+
+	s.logger("peers").Info("connected", "peer", p.RemoteAddr().String())
+
+	// Tell the peer who we are so it can place us on its ring
+	buf := new(bytes.Buffer)
+	hello := MessageHello{
+		ID: s.ID,
+		PublicKey: s.SigningKey.Public().(ed25519.PublicKey),
+		ListenAddr: s.advertiseAddr(),
+		Capabilities: s.capabilities(),
+		Nonce: s.newChallenge(p.RemoteAddr().String()),
+	}
+	if err := gob.NewEncoder(buf).Encode(&Message{Payload: hello}); err != nil{
+		return err
+	}
+	return p.Send(p2p.EncodeFrame(buf.Bytes()))
+}
+
+// acceptHello places a peer that proved its hello on the ring
+func (s *FileServer) acceptHello(from string, msg MessageHello) error{
+	peer, ok := s.peer(from)
+	if !ok{
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+
+	if err := s.pinKey(msg.ID, msg.PublicKey); err != nil{
+		s.logger("peers").Warn("rejecting hello", "peer", from, "id", msg.ID, "err", err)
+		peer.Close()
+		s.removePeer(from)
+		return err
+	}
+
+	s.peerLock.Lock()
+	s.peerIDs[from] = msg.ID
+	s.peerLock.Unlock()
+
+	if peer.Outbound(){
+		s.reconnect.mu.Lock()
+		s.reconnect.init()
+		s.reconnect.ids[from] = msg.ID
+		s.reconnect.mu.Unlock()
+	}
+
+	if !s.dedupPeer(from, msg.ID){
+		return nil
+	}
+
+	s.memberJoined(msg.ID)
+
+	s.learnPeers(PeerInfo{
+		ID: msg.ID,
+		Addr: p2p.ResolveAdvertisedAddr(msg.ListenAddr, from),
+		Capabilities: msg.Capabilities,
+	})
+	if err := s.sendPeerExchange(from); err != nil{
+		return err
+	}
+
+	if !s.meta.placeable(msg.ID){
+		s.logger("peers").Info("node is not a member, keeping it off the ring", "id", msg.ID)
+	} else if prev, ok := s.ring.Join(msg.ID); ok{
+		s.rebalancer.Trigger(prev, s.replicationFactor())
+	}
+
+	go s.replayHints(from, msg.ID)
+	go s.resumeTransfers(from, msg.ID)
+
+	return nil
+}
+
+// RebalanceProgress reports what the rebalancer is doing
+func (s *FileServer) RebalanceProgress() RebalanceProgress{
+	return s.rebalancer.Progress()
+}
+
+// PauseRebalance stops the rebalancer before its next transfer until ResumeRebalance is called
+func (s *FileServer) PauseRebalance(){
+	s.rebalancer.Pause()
+}
+
+func (s *FileServer) ResumeRebalance(){
+	s.rebalancer.Resume()
+}
+
+func (s *FileServer) loop(){
+
+	defer func(){
+		s.logger("server").Info("file server stopped")
+		s.Transport.Close()
+	}()
+
+	for {
+		select{
+			case rpc := <-s.Transport.Consume():
+				var msg Message
+				if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil{
+					s.metrics.decodeErrors.add(1)
+					s.logger("transport").Warn("message decoding error", "peer", rpc.From, "err", err)
+					continue
+				}
+
+				if err := s.handleMessage(rpc.From, &msg); err != nil{
+					s.logger("server").Warn("handle message error", "peer", rpc.From, "message", fmt.Sprintf("%T", msg.Payload), "err", err)
+				}
+				
+			case <-s.quitch:
+				return		
+			}
+	}
+}
+
+func (s *FileServer) handleMessage(from string, msg *Message) error{
+	switch v := msg.Payload.(type){
+	// Transfers read or send whole objects and must not hold up the messages behind them, the failure detector's pings
+	// in particular. The peer's connection waits for a stream to be closed, so what it sends next still comes after.
+	case MessageStoreFile:
+		go func(){
+			if err := s.handleMessageStoreFile(remoteContext(msg.Trace), from, v); err != nil{
+				s.logger("server").Warn("receiving file error", "peer", from, "key", v.Key, "err", err)
+			}
+		}()
+	case MessageGetFile:
+		go func(){
+			if err := s.handleMessageGetFile(from, v); err != nil{
+				s.logger("server").Warn("serving file error", "peer", from, "key", v.Key, "err", err)
+			}
+		}()
+	case MessageMerkleNodes:
+		return s.handleMessageMerkleNodes(from, v)
+	case MessageMerkleEntries:
+		return s.handleMessageMerkleEntries(from, v)
+	case MessageSyncWant:
+		return s.handleMessageSyncWant(from, v)
+	case MessageHello:
+		return s.handleMessageHello(from, v)
+	case MessageHelloProof:
+		return s.handleMessageHelloProof(from, v)
+	case MessageStoreAck:
+		s.acks.done(from, v.ID+"/"+v.Key)
+		return s.rebalancer.acked(from, v)
+	case MessageLeave:
+		return s.handleMessageLeave(from, v)
+	case MessageDeleteFile:
+		return s.handleMessageDeleteFile(from, v)
+	case MessageVersion:
+		return s.handleMessageVersion(from, v)
+	case MessagePing:
+		s.handleMessagePing(from, v)
+	case MessagePingAck:
+		s.handleMessagePingAck(from, v)
+	case MessagePingReq:
+		s.handleMessagePingReq(from, v)
+	case MessagePeerExchange:
+		return s.handleMessagePeerExchange(from, v)
+	case MessageGetShards:
+		go func(){
+			if err := s.handleMessageGetShards(from, v); err != nil{
+				s.logger("erasure").Warn("serving shards error", "peer", from, "key", v.Key, "err", err)
+			}
+		}()
+	case MessageShards:
+		s.handleMessageShards(from, v)
+	case MessageGetManifest:
+		go func(){
+			if err := s.handleMessageGetManifest(from, v); err != nil{
+				s.logger("swarm").Warn("serving manifest error", "peer", from, "key", v.Key, "err", err)
+			}
+		}()
+	case MessageManifest:
+		s.replies.deliver(v.Seq, swarmReply{from: from, msg: v})
+	case MessageGetChunk:
+		// Reading and sending a chunk must not hold up the messages behind it
+		go func(){
+			if err := s.handleMessageGetChunk(remoteContext(msg.Trace), from, v); err != nil{
+				s.logger("swarm").Warn("serving chunk error", "peer", from, "key", v.Key, "err", err)
+			}
+		}()
+	case MessageChunk:
+		s.replies.deliver(v.Seq, swarmReply{from: from, msg: v})
+	case MessageResumeTransfer:
+		// The rest of the object is streamed back, which must not hold up the messages behind it
+		go func(){
+			if err := s.handleMessageResumeTransfer(from, v); err != nil{
+				s.logger("transfer").Warn("resuming transfer error", "peer", from, "key", v.Key, "err", err)
+			}
+		}()
+	case MessageRequestVote:
+		s.stepRaft(v)
+	case MessageVote:
+		s.stepRaft(v)
+	case MessageAppendEntries:
+		s.stepRaft(v)
+	case MessageAppendEntriesReply:
+		s.stepRaft(v)
+	case MessageInstallSnapshot:
+		s.stepRaft(v)
+	case MessageProposeMetadata:
+		// Proposing waits for the entry to commit, which takes messages this loop has to read
+		go func(){
+			if err := s.handleMessageProposeMetadata(from, v); err != nil{
+				s.logger("raft").Warn("answering proposal error", "peer", from, "err", err)
+			}
+		}()
+	case MessageProposeMetadataReply:
+		s.handleMessageProposeMetadataReply(v)
+	}
+	return nil
+}
+
+func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error{
+	if !s.store.Has(msg.ID,msg.Key){
+		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk",s.Transport.Addr(), msg.Key)
+	}
+
+	s.logger("server").Debug("serving file over the network", "peer", from, "key", msg.Key)
+
+	fileSize, r, err := s.store.Read(msg.ID,msg.Key)
+	if err != nil{
+		return err
+	}
+
+	if rc, ok := r.(io.ReadCloser); ok{
+		defer rc.Close()
+	}
+
+	peer, ok := s.peer(from)
+	if !ok{
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	unlock, _ := s.lockPeers(context.Background(), peer)
+	defer unlock()
+	defer s.metrics.stream("out")()
+
+	// First send the "incomingStream" byte to the peer and then we can send the file size as an int64. 
+	peer.Send([]byte{p2p.IncomingStream})
+	binary.Write(peer, binary.LittleEndian, fileSize)
+	n, err := io.Copy(peer,r)
+	if err != nil{
+		return err
+	}
+
+	s.logger("server").Debug("served file", "peer", from, "key", msg.Key, "bytes", n)
+
+	return nil
+}
+
+func (s *FileServer) handleMessageStoreFile(ctx context.Context, from string, msg  MessageStoreFile) (err error){
+	p, ok := s.peer(from)
+	if !ok{
+		return fmt.Errorf("peer (%s) could not be found in the peer list",from)
+	}
+	peer := idlePeer{p, s.logger("transfer").With("transfer", transferID(msg.ID, msg.Key))}
+	defer s.metrics.stream("in")()
+	ctx, span := s.childSpan(ctx, "stream.receive", "peer", from, "key", msg.Key, "bytes", msg.Size, "offset", msg.Offset)
+	defer endSpan(span, &err)
+
+	// A draining node still has to consume the stream to keep the connection in sync, it just doesn't keep it
+	if s.Draining(){
+		io.Copy(io.Discard, io.LimitReader(peer, int64(msg.Size)))
+		peer.CloseStream()
+		return ErrDraining
+	}
+
+	if len(msg.Hint) != 0{
+		return s.storeHint(peer, msg)
+	}
+
+	if err := s.clock.Observe(msg.ModTime); err != nil{
+		io.Copy(io.Discard, io.LimitReader(peer, int64(msg.Size)))
+		peer.CloseStream()
+		return err
+	}
+
+	// Replicas and deletes of the same object from different peers are handled side by side
+	unlock := s.objectLocks.lock(msg.ID + "/" + msg.Key)
+	defer unlock()
+
+	// A replica arriving late for an object that has since been deleted must not bring it back, and when two writes of
+	// the same object race every replica keeps the one with the latest hybrid timestamp, whatever order they arrive in
+	if s.deleted(msg.ID, msg.Key, msg.ModTime) || s.supersedes(msg){
+		io.Copy(io.Discard, io.LimitReader(peer, int64(msg.Size)))
+		peer.CloseStream()
+	} else{
+		n, err := s.receiveObject(ctx, peer, from, msg)
+		peer.CloseStream()
+		if err != nil{
+			return err
+		}
+
+		meta := Meta{
+			Size: n,
+			Digest: msg.Digest,
+			ModTime: msg.ModTime,
+			Erasure: msg.Erasure,
+		}
+		if err := s.store.WriteMeta(msg.ID, msg.Key, meta); err != nil{
+			return err
+		}
+
+		s.logger("server").Debug("stored replica", "peer", from, "owner", msg.ID, "key", msg.Key, "bytes", n)
+	}
+
+	if msg.Ack{
+		return s.sendMessage(from, &Message{Payload: MessageStoreAck{ID: msg.ID, Key: msg.Key}})
+	}
+
+	return nil
+}
+
+// supersedes reports whether the copy we already hold of the object wins over the incoming one
+func (s *FileServer) supersedes(msg MessageStoreFile) bool{
+	meta, err := s.store.ReadMeta(msg.ID, msg.Key)
+	if err != nil || meta.Deleted{
+		return false
+	}
+	if meta.ModTime != msg.ModTime{
+		return meta.ModTime > msg.ModTime
+	}
+	return meta.Digest > msg.Digest
+}
+
+func (s *FileServer) bootstrapNetwork() error{
+	s.settingsLock.Lock()
+	bootstrapNodes := s.BootstrapNodes
+	s.settingsLock.Unlock()
+
+	for _,addr := range bootstrapNodes{
+		// s.Transport.Dial()
+		if len(addr) == 0{
+			continue 
+		}
+		go s.redial(addr)
+		 
+	}
+	return nil
+}
+
+// Start runs the node until Stop is called
+func (s *FileServer) Start() error{
+	if err := s.start(); err != nil{
+		return err
+	}
+	s.loop()
+	return nil
+}
+
+// start listens for peers and starts everything that runs next to the message loop
+func (s *FileServer) start() error{
+	s.logger("server").Info("starting file server", "addr", s.Transport.Addr())
+	if s.probeTimeout() >= s.probeInterval(){
+		return fmt.Errorf("probe timeout %s must be shorter than the probe interval %s", s.probeTimeout(), s.probeInterval())
+	}
+	if err := s.loadPeerKeys(); err != nil{
+		return err
+	}
+	if err := s.Transport.ListenAndAccept(); err!= nil{
+		return err
+	}
+	if len(s.BootstrapNodes) != 0{
+		s.bootstrapNetwork()
+		
+	}
+	if s.AntiEntropyInterval > 0{
+		go s.antiEntropyLoop()
+	}
+	go s.rebalancer.loop()
+	go s.tombstoneLoop()
+	go s.hintLoop()
+	go s.probeLoop()
+	go s.peerExchangeLoop()
+	go s.repairLoop()
+	if err := s.startDiscovery(); err != nil{
+		return err
+	}
+	if err := s.startRaft(); err != nil{
+		return err
+	}
+	if err := s.startControl(); err != nil{
+		return err
+	}
+	if err := s.startGateway(); err != nil{
+		return err
+	}
+	if err := s.startS3(); err != nil{
+		return err
+	}
+	if err := s.startAdmin(); err != nil{
+		return err
+	}
+
+	// A drain that was interrupted is resumed as soon as the node is back
+	if _, ok, err := s.loadDrainState(); err != nil{
+		return err
+	} else if ok{
+		go func(){
+			if err := s.Drain(); err != nil{
+				s.logger("drain").Error("drain error", "err", err)
+			}
+		}()
+	}
+	return nil
+}
+
+func init(){
+	gob.Register(MessageStoreFile{})
+	gob.Register(MessageGetFile{})
+	gob.Register(MessageMerkleNodes{})
+	gob.Register(MessageMerkleEntries{})
+	gob.Register(MessageSyncWant{})
+	gob.Register(MessageHello{})
+	gob.Register(MessageHelloProof{})
+	gob.Register(MessageStoreAck{})
+	gob.Register(MessageLeave{})
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageVersion{})
+	gob.Register(MessagePing{})
+	gob.Register(MessagePingAck{})
+	gob.Register(MessagePingReq{})
+	gob.Register(MessagePeerExchange{})
+	gob.Register(MessageGetShards{})
+	gob.Register(MessageShards{})
+	gob.Register(MessageGetManifest{})
+	gob.Register(MessageManifest{})
+	gob.Register(MessageGetChunk{})
+	gob.Register(MessageChunk{})
+	gob.Register(MessageResumeTransfer{})
+	gob.Register(MessageRequestVote{})
+	gob.Register(MessageVote{})
+	gob.Register(MessageAppendEntries{})
+	gob.Register(MessageProposeMetadata{})
+	gob.Register(MessageProposeMetadataReply{})
+	gob.Register(MessageAppendEntriesReply{})
+	gob.Register(MessageInstallSnapshot{})
+}
+
+
+
+
+
+
+
+
+
+
+
+
+
+
+
+
@@ -0,0 +1,460 @@
+package vault
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4 as S3 checks it. A request is signed in the Authorization header or, for a presigned URL,
+// in the query. The payload is covered by X-Amz-Content-Sha256: the hash of the body, UNSIGNED-PAYLOAD, or one of the
+// aws-chunked encodings where every chunk carries its own signature chained to the one of the request.
+
+const (
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	// maxClockSkew is how far the date of a signed request may be from ours
+	maxClockSkew = 15 * time.Minute
+	amzDateFormat = "20060102T150405Z"
+)
+
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+// sigV4 is the signature of a request and what it was computed over
+type sigV4 struct{
+	accessKey string
+	date time.Time
+	// scope is date/region/service/aws4_request
+	scope string
+	signedHeaders []string
+	signature string
+	payloadHash string
+	presigned bool
+	expires time.Duration
+}
+
+// parseSigV4 reads the signature of r from its Authorization header or its query
+func parseSigV4(r *http.Request) (*sigV4, error){
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != ""{
+		return parsePresigned(query)
+	}
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) == 0{
+		return nil, s3Errorf(http.StatusForbidden, "AccessDenied", "request is not signed")
+	}
+	algorithm, fields, _ := strings.Cut(auth, " ")
+	if algorithm != sigV4Algorithm{
+		return nil, s3Errorf(http.StatusBadRequest, "InvalidArgument", "unsupported signature algorithm %q", algorithm)
+	}
+
+	sig := &sigV4{payloadHash: r.Header.Get("X-Amz-Content-Sha256")}
+	for _, field := range strings.Split(fields, ","){
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch name{
+		case "Credential":
+			if err := sig.parseCredential(value); err != nil{
+				return nil, err
+			}
+		case "SignedHeaders":
+			sig.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			sig.signature = value
+		}
+	}
+	if len(sig.accessKey) == 0 || len(sig.signedHeaders) == 0 || len(sig.signature) == 0{
+		return nil, s3Errorf(http.StatusBadRequest, "AuthorizationHeaderMalformed", "incomplete authorization header")
+	}
+	if len(sig.payloadHash) == 0{
+		return nil, s3Errorf(http.StatusBadRequest, "InvalidRequest", "missing X-Amz-Content-Sha256")
+	}
+
+	var err error
+	if sig.date, err = time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date")); err != nil{
+		return nil, s3Errorf(http.StatusForbidden, "AccessDenied", "missing or malformed X-Amz-Date")
+	}
+	if skew := time.Since(sig.date); skew > maxClockSkew || skew < -maxClockSkew{
+		return nil, s3Errorf(http.StatusForbidden, "RequestTimeTooSkewed", "request time %s is too far from ours", sig.date)
+	}
+	return sig, nil
+}
+
+func parsePresigned(query map[string][]string) (*sigV4, error){
+	get := func(name string) string{
+		if v := query[name]; len(v) != 0{
+			return v[0]
+		}
+		return ""
+	}
+
+	if algorithm := get("X-Amz-Algorithm"); algorithm != sigV4Algorithm{
+		return nil, s3Errorf(http.StatusBadRequest, "InvalidArgument", "unsupported signature algorithm %q", algorithm)
+	}
+	sig := &sigV4{
+		signedHeaders: strings.Split(get("X-Amz-SignedHeaders"), ";"),
+		signature: get("X-Amz-Signature"),
+		payloadHash: unsignedPayload,
+		presigned: true,
+	}
+	if err := sig.parseCredential(get("X-Amz-Credential")); err != nil{
+		return nil, err
+	}
+
+	var err error
+	if sig.date, err = time.Parse(amzDateFormat, get("X-Amz-Date")); err != nil{
+		return nil, s3Errorf(http.StatusForbidden, "AccessDenied", "missing or malformed X-Amz-Date")
+	}
+	seconds, err := strconv.Atoi(get("X-Amz-Expires"))
+	if err != nil || seconds < 0 || seconds > 7*24*3600{
+		return nil, s3Errorf(http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires must be between 0 and 604800 seconds")
+	}
+	sig.expires = time.Duration(seconds) * time.Second
+	if time.Now().After(sig.date.Add(sig.expires)){
+		return nil, s3Errorf(http.StatusForbidden, "AccessDenied", "request has expired")
+	}
+	return sig, nil
+}
+
+// parseCredential reads accesskey/date/region/service/aws4_request
+func (sig *sigV4) parseCredential(credential string) error{
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request"{
+		return s3Errorf(http.StatusBadRequest, "AuthorizationHeaderMalformed", "malformed credential %q", credential)
+	}
+	sig.accessKey = parts[0]
+	sig.scope = strings.Join(parts[1:], "/")
+	return nil
+}
+
+// signingKey derives the key of the scope from the secret
+func (sig *sigV4) signingKey(secret string) []byte{
+	parts := strings.Split(sig.scope, "/")
+	key := []byte("AWS4" + secret)
+	for _, part := range parts{
+		key = hmacSHA256(key, part)
+	}
+	return key
+}
+
+// verify checks the signature of r against the secret of its access key
+func (sig *sigV4) verify(r *http.Request, secret string) error{
+	// The scope has to be signed on the day the request says it was made
+	if !strings.HasPrefix(sig.scope, sig.date.Format("20060102")+"/"){
+		return s3Errorf(http.StatusForbidden, "SignatureDoesNotMatch", "credential scope %s doesn't match the request date", sig.scope)
+	}
+
+	canonical := sig.canonicalRequest(r)
+	toSign := strings.Join([]string{
+		sigV4Algorithm,
+		sig.date.Format(amzDateFormat),
+		sig.scope,
+		sha256Hex([]byte(canonical)),
+	}, "\n")
+
+	expected := hex.EncodeToString(hmacSHA256(sig.signingKey(secret), toSign))
+	if !hmac.Equal([]byte(expected), []byte(sig.signature)){
+		return s3Errorf(http.StatusForbidden, "SignatureDoesNotMatch", "the request signature we calculated does not match the signature you provided")
+	}
+	return nil
+}
+
+func (sig *sigV4) canonicalRequest(r *http.Request) string{
+	headers := []string{}
+	for _, name := range sig.signedHeaders{
+		headers = append(headers, name+":"+headerValue(r, name)+"\n")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		uriEncode(r.URL.Path, false),
+		canonicalQuery(r, sig.presigned),
+		strings.Join(headers, ""),
+		strings.Join(sig.signedHeaders, ";"),
+		sig.payloadHash,
+	}, "\n")
+}
+
+// headerValue is the canonical value of a signed header: its values trimmed and joined by commas
+func headerValue(r *http.Request, name string) string{
+	switch name{
+	case "host":
+		return r.Host
+	case "content-length":
+		// The server takes Content-Length out of the headers when it reads the request
+		if len(r.Header.Values(name)) == 0{
+			return strconv.FormatInt(r.ContentLength, 10)
+		}
+	}
+
+	values := []string{}
+	for _, v := range r.Header.Values(name){
+		values = append(values, strings.Join(strings.Fields(v), " "))
+	}
+	return strings.Join(values, ",")
+}
+
+func canonicalQuery(r *http.Request, presigned bool) string{
+	params := []string{}
+	for name, values := range r.URL.Query(){
+		if presigned && name == "X-Amz-Signature"{
+			continue
+		}
+		for _, v := range values{
+			params = append(params, uriEncode(name, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent encodes everything but the unreserved characters, slashes are kept in paths
+func uriEncode(s string, encodeSlash bool) string{
+	var b strings.Builder
+	for i := 0; i < len(s); i++{
+		c := s[i]
+		switch{
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte{
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(b []byte) string{
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// payload returns the body of r as the client sent it, verified against what it signed. Errors about the payload
+// come from the returned reader once it is read, at the latest at its end.
+func (sig *sigV4) payload(r *http.Request, secret string) (io.Reader, error){
+	body := io.Reader(r.Body)
+
+	switch sig.payloadHash{
+	case unsignedPayload:
+	case streamingPayload:
+		body = &chunkedReader{r: bufio.NewReader(r.Body), sig: sig, key: sig.signingKey(secret), prev: sig.signature}
+	case streamingUnsignedTrailer:
+		body = &chunkedReader{r: bufio.NewReader(r.Body), trailer: true}
+	default:
+		want, err := hex.DecodeString(sig.payloadHash)
+		if err != nil || len(want) != sha256.Size{
+			return nil, s3Errorf(http.StatusBadRequest, "InvalidArgument", "unsupported X-Amz-Content-Sha256 %q", sig.payloadHash)
+		}
+		body = &verifyingReader{r: body, hash: sha256.New(), want: want, code: "XAmzContentSHA256Mismatch"}
+	}
+
+	// A checksum the client added, in a header or in the trailer of an aws-chunked body
+	algorithm := strings.ToLower(r.Header.Get("X-Amz-Sdk-Checksum-Algorithm"))
+	if trailer := r.Header.Get("X-Amz-Trailer"); len(trailer) != 0{
+		algorithm = strings.TrimPrefix(strings.ToLower(trailer), "x-amz-checksum-")
+	}
+	newHash, ok := checksumHashes[algorithm]
+	if !ok{
+		return body, nil
+	}
+	v := &verifyingReader{r: body, hash: newHash(), code: "BadDigest"}
+	if cr, ok := body.(*chunkedReader); ok && cr.trailer{
+		v.wantFrom = func() string{ return cr.trailers.Get("X-Amz-Checksum-" + algorithm) }
+	} else{
+		header := r.Header.Get("X-Amz-Checksum-" + algorithm)
+		if len(header) == 0{
+			return body, nil
+		}
+		v.wantFrom = func() string{ return header }
+	}
+	return v, nil
+}
+
+// checksumHashes are the additional checksums we can verify, the others are accepted as they are
+var checksumHashes = map[string]func() hash.Hash{
+	"crc32": func() hash.Hash{ return crc32.NewIEEE() },
+	"crc32c": func() hash.Hash{ return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	"sha1": sha1.New,
+	"sha256": sha256.New,
+}
+
+// verifyingReader fails at the end of r if the hash of what it read isn't want, or the base64 wantFrom returns
+type verifyingReader struct{
+	r io.Reader
+	hash hash.Hash
+	want []byte
+	wantFrom func() string
+	code string
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error){
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF{
+		want := v.want
+		if v.wantFrom != nil{
+			want, _ = base64.StdEncoding.DecodeString(v.wantFrom())
+		}
+		if !bytes.Equal(v.hash.Sum(nil), want){
+			return n, s3Errorf(http.StatusBadRequest, v.code, "the payload doesn't match the checksum the client sent")
+		}
+	}
+	return n, err
+}
+
+// maxPayloadChunkSize caps a chunk of an aws-chunked body, a signed chunk is held in memory until its signature is
+// checked. Clients send chunks of 64KB to a few MB.
+const maxPayloadChunkSize = 16 << 20
+
+// chunkedReader decodes an aws-chunked body. Each chunk is "<hex size>[;chunk-signature=<sig>]\r\n<data>\r\n" and an
+// empty chunk ends the body, followed by trailing headers if there are any. With a signing key every chunk signature
+// is checked, it signs the data of the chunk and the signature before it.
+type chunkedReader struct{
+	r *bufio.Reader
+	sig *sigV4
+	key []byte
+	prev string
+	trailer bool
+	trailers http.Header
+	// pending holds what is left of a signed chunk, it is read and checked before any of it is handed out
+	pending *bytes.Reader
+	left int64
+	done bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error){
+	for c.left == 0{
+		if c.done{
+			return 0, io.EOF
+		}
+		if err := c.nextChunk(); err != nil{
+			return 0, err
+		}
+	}
+
+	var src io.Reader = c.r
+	if c.pending != nil{
+		src = c.pending
+	}
+	n, err := src.Read(p[:min(int64(len(p)), c.left)])
+	c.left -= int64(n)
+	if err == io.EOF{
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && c.left == 0{
+		err = c.expectCRLF()
+	}
+	return n, err
+}
+
+func (c *chunkedReader) nextChunk() error{
+	line, err := c.readLine()
+	if err != nil{
+		return err
+	}
+	sizeHex, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0{
+		return s3Errorf(http.StatusBadRequest, "IncompleteBody", "malformed chunk header %q", line)
+	}
+	if size > maxPayloadChunkSize{
+		return s3Errorf(http.StatusBadRequest, "EntityTooLarge", "chunk of %d bytes is larger than %d", size, maxPayloadChunkSize)
+	}
+
+	if c.key != nil{
+		signature, ok := strings.CutPrefix(ext, "chunk-signature=")
+		if !ok{
+			return s3Errorf(http.StatusForbidden, "SignatureDoesNotMatch", "chunk is not signed")
+		}
+		// The signature covers the data, so it can only be checked once the whole chunk is read
+		data := make([]byte, size)
+		if _, err := io.ReadFull(c.r, data); err != nil{
+			return s3Errorf(http.StatusBadRequest, "IncompleteBody", "chunk ends early")
+		}
+		if err := c.verifyChunk(signature, data); err != nil{
+			return err
+		}
+		c.pending = bytes.NewReader(data)
+	}
+
+	if size == 0{
+		c.done = true
+		return c.readTrailers()
+	}
+	c.left = size
+	return nil
+}
+
+func (c *chunkedReader) verifyChunk(signature string, data []byte) error{
+	toSign := strings.Join([]string{
+		sigV4Algorithm + "-PAYLOAD",
+		c.sig.date.Format(amzDateFormat),
+		c.sig.scope,
+		c.prev,
+		emptySHA256,
+		sha256Hex(data),
+	}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(c.key, toSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)){
+		return s3Errorf(http.StatusForbidden, "SignatureDoesNotMatch", "chunk signature doesn't match")
+	}
+	c.prev = signature
+	return nil
+}
+
+// readTrailers reads the trailing headers after the last chunk up to the empty line that ends the body
+func (c *chunkedReader) readTrailers() error{
+	c.trailers = http.Header{}
+	for{
+		line, err := c.readLine()
+		if err != nil{
+			return err
+		}
+		if len(line) == 0{
+			return nil
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok{
+			return s3Errorf(http.StatusBadRequest, "IncompleteBody", "malformed trailer %q", line)
+		}
+		c.trailers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+}
+
+func (c *chunkedReader) readLine() (string, error){
+	line, err := c.r.ReadString('\n')
+	if err != nil{
+		return "", s3Errorf(http.StatusBadRequest, "IncompleteBody", "body ends early")
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+func (c *chunkedReader) expectCRLF() error{
+	line, err := c.readLine()
+	if err != nil || len(line) != 0{
+		return s3Errorf(http.StatusBadRequest, "IncompleteBody", "chunk is longer than its size")
+	}
+	return nil
+}
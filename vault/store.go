@@ -0,0 +1,21 @@
+package vault
+
+import "github.com/ayushn2/distri_vault.git/store"
+
+// The files of a node are kept on disk by package store. The records it keeps are part of what the node reports, so
+// they are available under the same names here.
+
+type (
+	Meta = store.Meta
+	InventoryEntry = store.InventoryEntry
+	Version = store.Version
+	VectorClock = store.VectorClock
+	ErasureInfo = store.ErasureInfo
+	PathKey = store.PathKey
+	PathTransformFunc = store.PathTransformFunc
+)
+
+var (
+	CASPathTransformFunc = store.CASPathTransformFunc
+	DefaultTransformFunc = store.DefaultTransformFunc
+)
@@ -0,0 +1,582 @@
+package vault
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+)
+
+// Fetching an object back from the network is done swarm style. Every peer is asked for a manifest of its copy: the
+// ciphertext size, the hash of every chunk and which chunks it has. Replicas are encrypted convergently so peers
+// normally hold the same ciphertext, the ones that do form a swarm and the chunks are pulled from all of them at once,
+// a few requests in flight per peer so fast peers end up serving more. Chunks are picked rarest first, every chunk is
+// checked against its hash before it is written at its offset, and once nothing is left to request the outstanding
+// chunks are asked from idle peers too so a slow peer can't hold up the end of the download.
+
+const (
+	defaultChunkSize = 1 << 20
+	// maxChunkSize keeps a chunk well inside p2p.MaxMessageSize
+	maxChunkSize = 8 << 20
+	defaultPipelineDepth = 4
+	manifestTimeout = 2 * time.Second
+	chunkTimeout = 10 * time.Second
+	maxPeerFailures = 3
+)
+
+var ErrNoHolders = errors.New("no peer holds the object")
+
+type MessageGetManifest struct{
+	Seq uint64
+	ID string
+	Key string
+	ChunkSize int64
+}
+
+type MessageManifest struct{
+	Seq uint64
+	ID string
+	Key string
+	// Held is false when the peer has nothing of the object
+	Held bool
+	Size int64
+	ChunkSize int64
+	Chunks []string
+	// Have marks the chunks the peer can serve, nil means all of them
+	Have []bool
+}
+
+type MessageGetChunk struct{
+	Seq uint64
+	ID string
+	Key string
+	Index int
+	ChunkSize int64
+}
+
+type MessageChunk struct{
+	Seq uint64
+	Data []byte
+	Err string
+}
+
+func (s *FileServer) chunkSize() int64{
+	if s.ChunkSize <= 0{
+		return defaultChunkSize
+	}
+	return min(s.ChunkSize, maxChunkSize)
+}
+
+func (s *FileServer) pipelineDepth() int{
+	if s.PipelineDepth <= 0{
+		return defaultPipelineDepth
+	}
+	return s.PipelineDepth
+}
+
+// has reports whether the manifest's peer can serve chunk i
+func (m MessageManifest) has(i int) bool{
+	return m.Have == nil || m.Have[i]
+}
+
+// fingerprint identifies the ciphertext a manifest describes, peers with the same one can be mixed in a swarm
+func (m MessageManifest) fingerprint() string{
+	return fmt.Sprintf("%d/%d/%s", m.Size, m.ChunkSize, strings.Join(m.Chunks, ","))
+}
+
+// fetchManifests asks every peer for its manifest of an object we own and returns the ones that hold some of it by
+// peer address
+func (s *FileServer) fetchManifests(ctx context.Context, hashedKey string) map[string]MessageManifest{
+	peers := s.allPeers()
+	seq, replies := s.replies.expect(len(peers))
+	defer s.replies.cancel(seq)
+
+	for _, peer := range peers{
+		s.sendMessageContext(ctx, peer.RemoteAddr().String(), &Message{
+			Payload: MessageGetManifest{
+				Seq: seq,
+				ID: s.ID,
+				Key: hashedKey,
+				ChunkSize: s.chunkSize(),
+			},
+		})
+	}
+
+	manifests := make(map[string]MessageManifest)
+	timeout := time.After(manifestTimeout)
+	for answered := 0; answered < len(peers); answered++{
+		select{
+		case reply := <-replies:
+			r := reply.(swarmReply)
+			if m := r.msg.(MessageManifest); m.Held{
+				manifests[r.from] = m
+			}
+		case <-timeout:
+			return manifests
+		case <-ctx.Done():
+			return manifests
+		case <-s.quitch:
+			return manifests
+		}
+	}
+	return manifests
+}
+
+// swarmReply carries a reply along with the peer it came from
+type swarmReply struct{
+	from string
+	msg any
+}
+
+// fetchSwarm pulls the ciphertext of one of our objects from the peers and writes it decrypted into our store. The
+// chunks written before ctx was cancelled are kept for the next fetch.
+func (s *FileServer) fetchSwarm(ctx context.Context, key string) (_ int64, err error){
+	ctx, span := s.childSpan(ctx, "fetch", "key", key)
+	defer endSpan(span, &err)
+	hashedKey := crypto.HashKey(key)
+
+	manifests := s.fetchManifests(ctx, hashedKey)
+	if err := ctx.Err(); err != nil{
+		return 0, err
+	}
+	if len(manifests) == 0{
+		return 0, ErrNoHolders
+	}
+
+	// Copies that were encrypted separately don't mix, start with the ciphertext most peers agree on
+	swarms := make(map[string][]string)
+	for addr, m := range manifests{
+		fp := m.fingerprint()
+		swarms[fp] = append(swarms[fp], addr)
+	}
+	fingerprints := make([]string, 0, len(swarms))
+	for fp := range swarms{
+		fingerprints = append(fingerprints, fp)
+	}
+	sort.Slice(fingerprints, func(i, j int) bool{
+		return len(swarms[fingerprints[i]]) > len(swarms[fingerprints[j]])
+	})
+
+	span.SetAttrs("holders", len(manifests))
+	for _, fp := range fingerprints{
+		peers := make(map[string]MessageManifest)
+		for _, addr := range swarms[fp]{
+			peers[addr] = manifests[addr]
+		}
+
+		var n int64
+		if n, err = s.downloadSwarm(ctx, key, hashedKey, peers); err == nil{
+			return n, nil
+		}
+		if ctx.Err() != nil{
+			return 0, err
+		}
+		s.logger("swarm").Warn("swarm download failed", "key", key, "err", err)
+	}
+	return 0, err
+}
+
+type chunkState int
+
+const (
+	chunkPending chunkState = iota
+	chunkRequested
+	chunkDone
+)
+
+// swarm schedules the chunks of one download over its peers
+type swarm struct{
+	mu sync.Mutex
+	manifest MessageManifest
+	peers map[string]MessageManifest
+	state []chunkState
+	// requested holds the peers every chunk is currently requested from
+	requested []map[string]bool
+	failures map[string]int
+	remaining int
+	changed chan struct{}
+}
+
+func newSwarm(peers map[string]MessageManifest) *swarm{
+	var manifest MessageManifest
+	for _, m := range peers{
+		manifest = m
+		break
+	}
+
+	n := len(manifest.Chunks)
+	sw := &swarm{
+		manifest: manifest,
+		peers: peers,
+		state: make([]chunkState, n),
+		requested: make([]map[string]bool, n),
+		failures: make(map[string]int),
+		remaining: n,
+		changed: make(chan struct{}),
+	}
+	for i := range sw.requested{
+		sw.requested[i] = make(map[string]bool)
+	}
+	return sw
+}
+
+// rarity is the number of live peers that can serve chunk i
+func (sw *swarm) rarity(i int) int{
+	n := 0
+	for addr, m := range sw.peers{
+		if sw.failures[addr] < maxPeerFailures && m.has(i){
+			n++
+		}
+	}
+	return n
+}
+
+// next picks the chunk addr should fetch: the rarest pending chunk it has, or in endgame an outstanding one it isn't
+// fetching already. It returns false when there is nothing left for addr.
+func (sw *swarm) next(addr string) (int, bool, <-chan struct{}){
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if sw.remaining == 0 || sw.failures[addr] >= maxPeerFailures{
+		return 0, false, nil
+	}
+
+	m := sw.peers[addr]
+	best, bestRarity := -1, 0
+	for i, st := range sw.state{
+		if st != chunkPending || !m.has(i){
+			continue
+		}
+		if r := sw.rarity(i); best < 0 || r < bestRarity{
+			best, bestRarity = i, r
+		}
+	}
+	if best < 0{
+		for i, st := range sw.state{
+			if st == chunkRequested && m.has(i) && !sw.requested[i][addr]{
+				best = i
+				break
+			}
+		}
+	}
+	if best < 0{
+		// Nothing to do right now, wait until a chunk is handed back or finishes
+		return 0, true, sw.changed
+	}
+
+	sw.state[best] = chunkRequested
+	sw.requested[best][addr] = true
+	return best, true, nil
+}
+
+func (sw *swarm) notify(){
+	close(sw.changed)
+	sw.changed = make(chan struct{})
+}
+
+// finish records the outcome of fetching chunk i from addr and reports whether the chunk still had to be written
+func (sw *swarm) finish(addr string, i int, ok bool) bool{
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	defer sw.notify()
+
+	delete(sw.requested[i], addr)
+	if sw.state[i] == chunkDone{
+		return false
+	}
+	if !ok{
+		sw.failures[addr]++
+		if len(sw.requested[i]) == 0{
+			sw.state[i] = chunkPending
+		}
+		return false
+	}
+
+	sw.state[i] = chunkDone
+	sw.remaining--
+	return true
+}
+
+// complete marks chunk i as already there, e.g. left by an interrupted fetch
+func (sw *swarm) complete(i int){
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if sw.state[i] != chunkDone{
+		sw.state[i] = chunkDone
+		sw.remaining--
+	}
+}
+
+// doneChunks returns which chunks are written
+func (sw *swarm) doneChunks() []bool{
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	done := make([]bool, len(sw.state))
+	for i, st := range sw.state{
+		done[i] = st == chunkDone
+	}
+	return done
+}
+
+func (sw *swarm) done() bool{
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.remaining == 0
+}
+
+// stalled reports whether no live peer can serve a chunk that is still missing
+func (sw *swarm) stalled() bool{
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	for i, st := range sw.state{
+		if st != chunkDone && sw.rarity(i) == 0{
+			return true
+		}
+	}
+	return false
+}
+
+// downloadSwarm fetches the ciphertext from peers that all hold the same copy and decrypts it into our store
+func (s *FileServer) downloadSwarm(ctx context.Context, key string, hashedKey string, peers map[string]MessageManifest) (int64, error){
+	sw := newSwarm(peers)
+
+	// Whatever an interrupted fetch left behind stays until the fetch completes
+	path := s.fetchPath(hashedKey)
+	f, err := s.openFetch(path, sw)
+	if err != nil{
+		return 0, err
+	}
+	defer f.Close()
+
+	s.logger("swarm").Debug("fetching chunks", "key", key, "transfer", sw.manifest.fingerprint(), "chunks", len(sw.manifest.Chunks),
+		"peers", len(peers))
+
+	var (
+		wg sync.WaitGroup
+		saveLock sync.Mutex
+	)
+	save := func(){
+		saveLock.Lock()
+		defer saveLock.Unlock()
+		if err := saveFetchState(path, sw); err != nil{
+			s.logger("swarm").Warn("could not save the fetch progress", "key", key, "err", err)
+		}
+	}
+	for addr := range peers{
+		for i := 0; i < s.pipelineDepth(); i++{
+			wg.Add(1)
+			go func(){
+				defer wg.Done()
+				s.swarmWorker(ctx, sw, addr, hashedKey, f, save)
+			}()
+		}
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil{
+		return 0, err
+	}
+	if !sw.done(){
+		return 0, fmt.Errorf("%s: peers failed to serve every chunk", key)
+	}
+	defer removeTransfer(path)
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil{
+		return 0, err
+	}
+	_, write := s.childSpan(ctx, "disk.write", "key", key, "decrypt", true)
+	n, err := s.store.WriteDecryptContext(ctx, s.ID, s.EncKey, key, io.LimitReader(f, sw.manifest.Size))
+	write.SetAttrs("bytes", n)
+	write.RecordError(err)
+	write.End()
+	return n, err
+}
+
+// swarmWorker keeps one request to addr in flight until the download is complete or addr failed too often
+// and records the progress with save after every chunk it writes
+func (s *FileServer) swarmWorker(ctx context.Context, sw *swarm, addr string, hashedKey string, f *os.File, save func()){
+	for{
+		i, ok, wait := sw.next(addr)
+		if !ok{
+			return
+		}
+		if wait != nil{
+			if sw.stalled(){
+				return
+			}
+			select{
+			case <-wait:
+			case <-ctx.Done():
+				return
+			case <-s.quitch:
+				return
+			}
+			continue
+		}
+
+		data, err := s.fetchChunk(ctx, addr, hashedKey, i, sw.manifest)
+		if ctx.Err() != nil{
+			return
+		}
+		if err == nil{
+			_, err = f.WriteAt(data, int64(i)*sw.manifest.ChunkSize)
+		}
+		if err != nil{
+			s.logger("swarm").Warn("chunk fetch failed", "peer", addr, "key", hashedKey, "chunk", i, "err", err)
+		}
+		if sw.finish(addr, i, err == nil){
+			save()
+		}
+	}
+}
+
+// fetchChunk requests chunk i from addr and checks it against the manifest
+func (s *FileServer) fetchChunk(ctx context.Context, addr string, hashedKey string, i int, manifest MessageManifest) (_ []byte, err error){
+	ctx, span := s.childSpan(ctx, "chunk.receive", "peer", addr, "key", hashedKey, "chunk", i)
+	defer endSpan(span, &err)
+	data, err := s.requestChunk(ctx, addr, MessageGetChunk{
+		ID: s.ID,
+		Key: hashedKey,
+		Index: i,
+		ChunkSize: manifest.ChunkSize,
+	})
+	if err != nil{
+		return nil, err
+	}
+	if chunkHash(data) != manifest.Chunks[i]{
+		return nil, fmt.Errorf("chunk does not match its hash")
+	}
+	return data, nil
+}
+
+// requestChunk sends msg to addr under a fresh Seq and waits for the chunk
+func (s *FileServer) requestChunk(ctx context.Context, addr string, msg MessageGetChunk) ([]byte, error){
+	seq, replies := s.replies.expect(1)
+	defer s.replies.cancel(seq)
+
+	msg.Seq = seq
+	if err := s.sendMessageContext(ctx, addr, &Message{Payload: msg}); err != nil{
+		return nil, err
+	}
+
+	select{
+	case reply := <-replies:
+		msg := reply.(swarmReply).msg.(MessageChunk)
+		if len(msg.Err) != 0{
+			return nil, errors.New(msg.Err)
+		}
+		return msg.Data, nil
+	case <-time.After(chunkTimeout):
+		return nil, fmt.Errorf("timed out")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.quitch:
+		return nil, fmt.Errorf("server stopped")
+	}
+}
+
+// chunkHashes reads an object and hashes it chunk by chunk
+func chunkHashes(r io.Reader, chunkSize int64) ([]string, error){
+	hashes := []string{}
+	buf := make([]byte, chunkSize)
+	for{
+		n, err := io.ReadFull(r, buf)
+		if n > 0{
+			hashes = append(hashes, chunkHash(buf[:n]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF{
+			return hashes, nil
+		}
+		if err != nil{
+			return nil, err
+		}
+	}
+}
+
+func chunkHash(data []byte) string{
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+func validChunkSize(size int64) bool{
+	return size > 0 && size <= maxChunkSize
+}
+
+func (s *FileServer) handleMessageGetManifest(from string, msg MessageGetManifest) error{
+	reply := MessageManifest{Seq: msg.Seq, ID: msg.ID, Key: msg.Key, ChunkSize: msg.ChunkSize}
+
+	if validChunkSize(msg.ChunkSize) && s.store.Has(msg.ID, msg.Key){
+		if meta, err := s.store.ReadMeta(msg.ID, msg.Key); err == nil && !meta.Deleted && meta.Erasure == nil{
+			size, r, err := s.store.Read(msg.ID, msg.Key)
+			if err != nil{
+				return err
+			}
+			reply.Chunks, err = chunkHashes(r, msg.ChunkSize)
+			if rc, ok := r.(io.ReadCloser); ok{
+				rc.Close()
+			}
+			if err != nil{
+				return err
+			}
+			reply.Held, reply.Size = true, size
+		}
+	}
+
+	return s.sendMessage(from, &Message{Payload: reply})
+}
+
+func (s *FileServer) handleMessageGetChunk(ctx context.Context, from string, msg MessageGetChunk) (err error){
+	_, span := s.childSpan(ctx, "chunk.send", "peer", from, "key", msg.Key, "chunk", msg.Index)
+	defer endSpan(span, &err)
+	reply := MessageChunk{Seq: msg.Seq}
+
+	data, err := s.readChunk(msg)
+	if err != nil{
+		reply.Err = err.Error()
+		span.RecordError(err)
+	}
+	reply.Data = data
+	span.SetAttrs("bytes", len(data))
+
+	return s.sendMessage(from, &Message{Payload: reply})
+}
+
+func (s *FileServer) readChunk(msg MessageGetChunk) ([]byte, error){
+	if !validChunkSize(msg.ChunkSize) || msg.Index < 0{
+		return nil, fmt.Errorf("invalid chunk %d of size %d", msg.Index, msg.ChunkSize)
+	}
+	if !s.store.Has(msg.ID, msg.Key){
+		return nil, fmt.Errorf("object (%s) not found", msg.Key)
+	}
+
+	_, r, err := s.store.Read(msg.ID, msg.Key)
+	if err != nil{
+		return nil, err
+	}
+	if rc, ok := r.(io.ReadCloser); ok{
+		defer rc.Close()
+	}
+
+	ra, ok := r.(io.ReaderAt)
+	if !ok{
+		return nil, fmt.Errorf("object (%s) can't be read at an offset", msg.Key)
+	}
+	data := make([]byte, msg.ChunkSize)
+	n, err := ra.ReadAt(data, int64(msg.Index)*msg.ChunkSize)
+	if err != nil && err != io.EOF{
+		return nil, err
+	}
+	return data[:n], nil
+}
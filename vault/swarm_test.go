@@ -0,0 +1,102 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ayushn2/distri_vault.git/p2p"
+)
+
+func testManifest(have ...bool) MessageManifest{
+	m := MessageManifest{Held: true, Size: 4, ChunkSize: 1, Chunks: []string{"a", "b", "c", "d"}}
+	if len(have) > 0{
+		m.Have = have
+	}
+	return m
+}
+
+func TestSwarmRarestFirst(t *testing.T){
+	sw := newSwarm(map[string]MessageManifest{
+		"full": testManifest(),
+		"partial": testManifest(true, true, false, true),
+		"other": testManifest(false, true, false, true),
+	})
+
+	// Chunk 2 is only on the full peer, then chunk 0 is on two peers, the rest on all three
+	for _, want := range []int{2, 0, 1, 3}{
+		i, ok, wait := sw.next("full")
+		if !ok || wait != nil || i != want{
+			t.Fatalf("expected chunk %d, have %d ok=%v", want, i, ok)
+		}
+	}
+
+	// Everything is requested, the other peers help out with the outstanding chunks they have
+	if i, ok, wait := sw.next("other"); !ok || wait != nil || (i != 1 && i != 3){
+		t.Fatalf("expected an endgame request for chunk 1 or 3, have %d", i)
+	}
+}
+
+func TestSwarmFailures(t *testing.T){
+	sw := newSwarm(map[string]MessageManifest{
+		"bad": testManifest(),
+		"good": testManifest(true, true, false, true),
+	})
+
+	for n := 0; n < maxPeerFailures; n++{
+		i, ok, _ := sw.next("bad")
+		if !ok{
+			t.Fatalf("bad peer gave up after %d failures", n)
+		}
+		sw.finish("bad", i, false)
+	}
+	if _, ok, _ := sw.next("bad"); ok{
+		t.Fatalf("expected the failing peer to be dropped")
+	}
+
+	for{
+		i, ok, wait := sw.next("good")
+		if !ok || wait != nil{
+			break
+		}
+		sw.finish("good", i, true)
+	}
+	if sw.done(){
+		t.Fatalf("expected chunk 2 to be missing")
+	}
+	if !sw.stalled(){
+		t.Errorf("expected the swarm to be stalled once nobody left can serve chunk 2")
+	}
+}
+
+func TestChunkHashes(t *testing.T){
+	hashes, err := chunkHashes(bytes.NewReader(bytes.Repeat([]byte("x"), 10)), 4)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if len(hashes) != 3 || hashes[0] != hashes[1] || hashes[1] == hashes[2]{
+		t.Errorf("expected two full chunks and a short one, have %v", hashes)
+	}
+}
+
+func TestGetContextGivesUp(t *testing.T){
+	s := newTestServer(t.TempDir())
+
+	// A peer that never reads, asking it for the file blocks until the deadline
+	conn, other := net.Pipe()
+	defer other.Close()
+	s.peers[conn.RemoteAddr().String()] = p2p.NewTCPPeer(conn, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := s.GetContext(ctx, "picture.jpg"); !errors.Is(err, context.DeadlineExceeded){
+		t.Errorf("have %v want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed >= manifestTimeout{
+		t.Errorf("expected the fetch to end with the context, it took %s", elapsed)
+	}
+}
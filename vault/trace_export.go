@@ -0,0 +1,376 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOTLPBatchSize = 512
+	defaultOTLPFlushInterval = 5 * time.Second
+)
+
+// InMemoryExporter keeps the spans it is given, to look at them in tests. Its zero value is ready to use.
+type InMemoryExporter struct{
+	mu sync.Mutex
+	spans []SpanData
+}
+
+func (e *InMemoryExporter) ExportSpans(ctx context.Context, spans []SpanData) error{
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *InMemoryExporter) Shutdown(ctx context.Context) error{
+	return nil
+}
+
+// Spans returns the spans exported so far, in the order they ended
+func (e *InMemoryExporter) Spans() []SpanData{
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]SpanData{}, e.spans...)
+}
+
+func (e *InMemoryExporter) Reset(){
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
+
+// StdoutExporter writes every span as a line of JSON
+type StdoutExporter struct{
+	mu sync.Mutex
+	w io.Writer
+}
+
+// NewStdoutExporter writes to w, os.Stdout if it is nil
+func NewStdoutExporter(w io.Writer) *StdoutExporter{
+	if w == nil{
+		w = os.Stdout
+	}
+	return &StdoutExporter{w: w}
+}
+
+type stdoutSpan struct{
+	Name string `json:"name"`
+	TraceID string `json:"trace_id"`
+	SpanID string `json:"span_id"`
+	ParentID string `json:"parent_id,omitempty"`
+	Node string `json:"node"`
+	Start time.Time `json:"start"`
+	Duration string `json:"duration"`
+	Attrs map[string]any `json:"attrs,omitempty"`
+	Err string `json:"error,omitempty"`
+}
+
+func (e *StdoutExporter) ExportSpans(ctx context.Context, spans []SpanData) error{
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	enc := json.NewEncoder(e.w)
+	for _, sp := range spans{
+		line := stdoutSpan{
+			Name: sp.Name,
+			TraceID: sp.TraceID.String(),
+			SpanID: sp.SpanID.String(),
+			Node: sp.Node,
+			Start: sp.Start,
+			Duration: sp.End.Sub(sp.Start).String(),
+			Err: sp.Err,
+		}
+		if sp.ParentID.IsValid(){
+			line.ParentID = sp.ParentID.String()
+		}
+		if len(sp.Attrs) != 0{
+			line.Attrs = make(map[string]any, len(sp.Attrs))
+			for _, attr := range sp.Attrs{
+				line.Attrs[attr.Key] = attr.Value.Resolve().Any()
+			}
+		}
+		if err := enc.Encode(line); err != nil{
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *StdoutExporter) Shutdown(ctx context.Context) error{
+	return nil
+}
+
+// OTLPExporterOpts configures an OTLPExporter
+type OTLPExporterOpts struct{
+	// Endpoint is the URL the spans are posted to, like http://localhost:4318/v1/traces
+	Endpoint string
+	// Headers are added to every request, for the credentials of a hosted collector
+	Headers map[string]string
+	// Client sends the requests, one with a ten second timeout if not set
+	Client *http.Client
+	// BatchSize is the number of spans sent together, FlushInterval how long a span waits for its batch to fill up
+	BatchSize int
+	FlushInterval time.Duration
+	// Logger reports the spans that could not be delivered, slog.Default() if not set
+	Logger *slog.Logger
+}
+
+// OTLPExporter sends spans in batches to an OpenTelemetry collector, as OTLP over HTTP with JSON encoding. A batch
+// the collector doesn't take is dropped.
+type OTLPExporter struct{
+	OTLPExporterOpts
+
+	mu sync.Mutex
+	pending []SpanData
+	flushch chan struct{}
+	quitch chan struct{}
+	done chan struct{}
+	stop sync.Once
+}
+
+func NewOTLPExporter(opts OTLPExporterOpts) *OTLPExporter{
+	if opts.Client == nil{
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.BatchSize <= 0{
+		opts.BatchSize = defaultOTLPBatchSize
+	}
+	if opts.FlushInterval <= 0{
+		opts.FlushInterval = defaultOTLPFlushInterval
+	}
+	if opts.Logger == nil{
+		opts.Logger = slog.Default()
+	}
+	e := &OTLPExporter{
+		OTLPExporterOpts: opts,
+		flushch: make(chan struct{}, 1),
+		quitch: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go e.loop()
+	return e
+}
+
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []SpanData) error{
+	e.mu.Lock()
+	e.pending = append(e.pending, spans...)
+	full := len(e.pending) >= e.BatchSize
+	e.mu.Unlock()
+
+	if full{
+		select{
+		case e.flushch <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Shutdown sends the spans still waiting for their batch
+func (e *OTLPExporter) Shutdown(ctx context.Context) error{
+	e.stop.Do(func(){
+		close(e.quitch)
+	})
+	select{
+	case <-e.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return e.flush(ctx)
+}
+
+func (e *OTLPExporter) loop(){
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.FlushInterval)
+	defer ticker.Stop()
+
+	for{
+		select{
+		case <-ticker.C:
+		case <-e.flushch:
+		case <-e.quitch:
+			return
+		}
+		if err := e.flush(context.Background()); err != nil{
+			e.Logger.Warn("dropping spans the collector didn't take", "endpoint", e.Endpoint, "err", err)
+		}
+	}
+}
+
+// flush posts the pending spans a batch at a time
+func (e *OTLPExporter) flush(ctx context.Context) error{
+	for{
+		e.mu.Lock()
+		n := min(len(e.pending), e.BatchSize)
+		batch := e.pending[:n]
+		e.pending = e.pending[n:]
+		e.mu.Unlock()
+
+		if len(batch) == 0{
+			return nil
+		}
+		if err := e.post(ctx, batch); err != nil{
+			return fmt.Errorf("%d spans: %w", len(batch), err)
+		}
+	}
+}
+
+func (e *OTLPExporter) post(ctx context.Context, spans []SpanData) error{
+	b, err := json.Marshal(otlpTraces(spans))
+	if err != nil{
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Endpoint, bytes.NewReader(b))
+	if err != nil{
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.Headers{
+		req.Header.Set(key, value)
+	}
+	resp, err := e.Client.Do(req)
+	if err != nil{
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300{
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/JSON encoding of ExportTraceServiceRequest, ids are hex and 64 bit integers are strings
+
+type otlpRequest struct{
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct{
+	Resource otlpResource `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct{
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct{
+	Scope otlpScope `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct{
+	Name string `json:"name"`
+}
+
+type otlpSpan struct{
+	TraceID string `json:"traceId"`
+	SpanID string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId,omitempty"`
+	Name string `json:"name"`
+	Kind int `json:"kind"`
+	StartTimeUnixNano string `json:"startTimeUnixNano"`
+	EndTimeUnixNano string `json:"endTimeUnixNano"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	Status otlpStatus `json:"status"`
+}
+
+type otlpKeyValue struct{
+	Key string `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct{
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue *string `json:"intValue,omitempty"`
+	BoolValue *bool `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpStatus struct{
+	Code int `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusError = 2
+)
+
+func otlpString(s string) otlpValue{
+	return otlpValue{StringValue: &s}
+}
+
+func otlpAttr(attr slog.Attr) otlpKeyValue{
+	v := attr.Value.Resolve()
+	var value otlpValue
+	switch v.Kind(){
+	case slog.KindInt64:
+		s := strconv.FormatInt(v.Int64(), 10)
+		value.IntValue = &s
+	case slog.KindUint64:
+		s := strconv.FormatUint(v.Uint64(), 10)
+		value.IntValue = &s
+	case slog.KindBool:
+		b := v.Bool()
+		value.BoolValue = &b
+	case slog.KindFloat64:
+		f := v.Float64()
+		value.DoubleValue = &f
+	default:
+		value = otlpString(v.String())
+	}
+	return otlpKeyValue{Key: attr.Key, Value: value}
+}
+
+// otlpTraces groups spans by the node they ran on, each node is a resource of the distri_vault service
+func otlpTraces(spans []SpanData) otlpRequest{
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{}}
+	index := map[string]int{}
+	for _, sp := range spans{
+		i, ok := index[sp.Node]
+		if !ok{
+			i = len(req.ResourceSpans)
+			index[sp.Node] = i
+			req.ResourceSpans = append(req.ResourceSpans, otlpResourceSpans{
+				Resource: otlpResource{Attributes: []otlpKeyValue{
+					{Key: "service.name", Value: otlpString("distri_vault")},
+					{Key: "service.instance.id", Value: otlpString(sp.Node)},
+				}},
+				ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "distri_vault"}}},
+			})
+		}
+
+		span := otlpSpan{
+			TraceID: sp.TraceID.String(),
+			SpanID: sp.SpanID.String(),
+			Name: sp.Name,
+			Kind: otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(sp.Start.UnixNano(), 10),
+			EndTimeUnixNano: strconv.FormatInt(sp.End.UnixNano(), 10),
+		}
+		if sp.ParentID.IsValid(){
+			span.ParentSpanID = sp.ParentID.String()
+		}
+		for _, attr := range sp.Attrs{
+			span.Attributes = append(span.Attributes, otlpAttr(attr))
+		}
+		if len(sp.Err) != 0{
+			span.Status = otlpStatus{Code: otlpStatusError, Message: sp.Err}
+		}
+		scope := &req.ResourceSpans[i].ScopeSpans[0]
+		scope.Spans = append(scope.Spans, span)
+	}
+	return req
+}
@@ -0,0 +1,260 @@
+package vault
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store and Get are traced across nodes when the node has a SpanExporter. A Store is a "store" span with "disk.write",
+// "encrypt", "broadcast" and "stream.send" below it, a Get a "get" span with "fetch", "chunk.receive" and
+// "disk.write". Every Message sent under a span carries its context as a W3C traceparent, so the "stream.receive"
+// and "chunk.send" spans of the peers join the same trace. Work that doesn't happen on behalf of a Store or Get, like
+// anti-entropy or probes, is not traced.
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (id TraceID) String() string{
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceID) IsValid() bool{
+	return id != TraceID{}
+}
+
+func (id SpanID) String() string{
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) IsValid() bool{
+	return id != SpanID{}
+}
+
+// SpanContext identifies a span across nodes
+type SpanContext struct{
+	TraceID TraceID
+	SpanID SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool{
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats sc as a W3C traceparent, "00-<trace id>-<span id>-<flags>"
+func (sc SpanContext) Traceparent() string{
+	flags := 0
+	if sc.Sampled{
+		flags = 1
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags)
+}
+
+var errTraceparent = errors.New("malformed traceparent")
+
+// ParseTraceparent reads a W3C traceparent. Versions after 00 are read as far as 00 goes, like the spec asks.
+func ParseTraceparent(s string) (SpanContext, error){
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2{
+		return sc, errTraceparent
+	}
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4){
+		return sc, errTraceparent
+	}
+	version, err1 := hex.DecodeString(parts[0])
+	_, err2 := hex.Decode(sc.TraceID[:], []byte(parts[1]))
+	_, err3 := hex.Decode(sc.SpanID[:], []byte(parts[2]))
+	flags, err4 := hex.DecodeString(parts[3])
+	if err := errors.Join(err1, err2, err3, err4); err != nil || len(version) != 1 || !sc.IsValid(){
+		return SpanContext{}, errTraceparent
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns ctx with sc as the parent of the spans started under it, to make the Store and Get
+// of an embedding program part of its own traces
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context{
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span ctx was started under, if any
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool){
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// traceparent is the traceparent of the span ctx is in, empty if it is in none
+func traceparent(ctx context.Context) string{
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok || !sc.Sampled{
+		return ""
+	}
+	return sc.Traceparent()
+}
+
+// SpanData is a finished span the way it is handed to a SpanExporter
+type SpanData struct{
+	Name string
+	TraceID TraceID
+	SpanID SpanID
+	// ParentID is the span this one was started under, zero for the root of a trace
+	ParentID SpanID
+	// Node is the ID of the node the span ran on
+	Node string
+	Start time.Time
+	End time.Time
+	Attrs []slog.Attr
+	// Err is the error the span ended with, empty if it succeeded
+	Err string
+}
+
+// SpanExporter sends finished spans somewhere. ExportSpans is called when a span ends and must not block for long,
+// Shutdown sends what is still buffered and is called once the node stops.
+type SpanExporter interface{
+	ExportSpans(ctx context.Context, spans []SpanData) error
+	Shutdown(ctx context.Context) error
+}
+
+// Span is a span in progress. A nil Span is a span that isn't recorded, all its methods do nothing.
+type Span struct{
+	exporter SpanExporter
+
+	mu sync.Mutex
+	data SpanData
+	ended bool
+}
+
+// SetAttrs adds attributes to the span, given like the arguments of slog.Info
+func (sp *Span) SetAttrs(args ...any){
+	if sp == nil{
+		return
+	}
+	attrs := slog.Group("", args...).Value.Group()
+	sp.mu.Lock()
+	sp.data.Attrs = append(sp.data.Attrs, attrs...)
+	sp.mu.Unlock()
+}
+
+// RecordError marks the span failed with err, a nil err does nothing
+func (sp *Span) RecordError(err error){
+	if sp == nil || err == nil{
+		return
+	}
+	sp.mu.Lock()
+	sp.data.Err = err.Error()
+	sp.mu.Unlock()
+}
+
+// End finishes the span and hands it to the exporter, only the first call counts
+func (sp *Span) End(){
+	if sp == nil{
+		return
+	}
+	sp.mu.Lock()
+	if sp.ended{
+		sp.mu.Unlock()
+		return
+	}
+	sp.ended = true
+	sp.data.End = time.Now()
+	data := sp.data
+	sp.mu.Unlock()
+
+	sp.exporter.ExportSpans(context.Background(), []SpanData{data})
+}
+
+// Context is the SpanContext of the span, the zero value for a span that isn't recorded
+func (sp *Span) Context() SpanContext{
+	if sp == nil{
+		return SpanContext{}
+	}
+	return SpanContext{TraceID: sp.data.TraceID, SpanID: sp.data.SpanID, Sampled: true}
+}
+
+func newSpanID() SpanID{
+	var id SpanID
+	rand.Read(id[:])
+	return id
+}
+
+func newTraceID() TraceID{
+	var id TraceID
+	rand.Read(id[:])
+	return id
+}
+
+// startSpan starts a span under the one ctx is in, or the root of a new trace if it is in none. It returns ctx with
+// the new span in it, or ctx and a nil span if the node doesn't trace.
+func (s *FileServer) startSpan(ctx context.Context, name string, args ...any) (context.Context, *Span){
+	if s.SpanExporter == nil{
+		return ctx, nil
+	}
+	sp := &Span{
+		exporter: s.SpanExporter,
+		data: SpanData{
+			Name: name,
+			SpanID: newSpanID(),
+			Node: s.ID,
+			Start: time.Now(),
+		},
+	}
+	if parent, ok := SpanContextFromContext(ctx); ok{
+		if !parent.Sampled{
+			return ctx, nil
+		}
+		sp.data.TraceID, sp.data.ParentID = parent.TraceID, parent.SpanID
+	} else{
+		sp.data.TraceID = newTraceID()
+	}
+	sp.SetAttrs(args...)
+	return ContextWithSpanContext(ctx, sp.Context()), sp
+}
+
+// childSpan is startSpan for the parts of a trace, it doesn't start a new trace when ctx is in none
+func (s *FileServer) childSpan(ctx context.Context, name string, args ...any) (context.Context, *Span){
+	if _, ok := SpanContextFromContext(ctx); !ok{
+		return ctx, nil
+	}
+	return s.startSpan(ctx, name, args...)
+}
+
+// remoteContext is the context of a message a peer sent under one of its spans, see Message.Trace
+func remoteContext(trace string) context.Context{
+	ctx := context.Background()
+	if len(trace) == 0{
+		return ctx
+	}
+	if sc, err := ParseTraceparent(trace); err == nil{
+		ctx = ContextWithSpanContext(ctx, sc)
+	}
+	return ctx
+}
+
+// withTraceparent makes a request that carries a traceparent header part of the trace of its caller
+func withTraceparent(h http.Handler) http.Handler{
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+		if sc, err := ParseTraceparent(r.Header.Get("traceparent")); err == nil{
+			r = r.WithContext(ContextWithSpanContext(r.Context(), sc))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// endSpan records err on sp and ends it, for deferring with a named error result
+func endSpan(sp *Span, err *error){
+	sp.RecordError(*err)
+	sp.End()
+}
@@ -0,0 +1,179 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T){
+	s := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(s)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7"{
+		t.Errorf("unexpected span context %+v", sc)
+	}
+	if sc.Traceparent() != s{
+		t.Errorf("expected %q, have %q", s, sc.Traceparent())
+	}
+	if _, err := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-later"); err != nil{
+		t.Errorf("expected a later version to be read as 00, have %v", err)
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	}{
+		if _, err := ParseTraceparent(bad); err == nil{
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestTraceAcrossNodes(t *testing.T){
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil{
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	spans := new(InMemoryExporter)
+	n1 := startTestNode(t, WithListenAddr(addr), WithSpanExporter(spans))
+	n2 := startTestNode(t, WithBootstrap(addr), WithSpanExporter(spans))
+	connected := func(s *FileServer) func() bool{
+		return func() bool{
+			s.peerLock.Lock()
+			defer s.peerLock.Unlock()
+			return len(s.peers) != 0
+		}
+	}
+	waitFor(t, "n1 to see n2", connected(n1.Server()))
+	waitFor(t, "n2 to see n1", connected(n2.Server()))
+	ctx := context.Background()
+
+	if _, err := n1.Put(ctx, "docs/a.txt", strings.NewReader("hello tracing")); err != nil{
+		t.Fatal(err)
+	}
+	find := func(node string, name string) (SpanData, bool){
+		for _, sp := range spans.Spans(){
+			if sp.Node == node && sp.Name == name{
+				return sp, true
+			}
+		}
+		return SpanData{}, false
+	}
+	waitFor(t, "the replica to be written", func() bool{
+		_, ok := find(n2.ID(), "stream.receive")
+		return ok
+	})
+
+	root, ok := find(n1.ID(), "store")
+	if !ok || root.ParentID.IsValid(){
+		t.Fatalf("expected a root store span, have %+v", spans.Spans())
+	}
+	for _, want := range []struct{ node, name, parent string }{
+		{n1.ID(), "disk.write", "store"},
+		{n1.ID(), "encrypt", "store"},
+		{n1.ID(), "broadcast", "store"},
+		{n1.ID(), "stream.send", "store"},
+		{n2.ID(), "stream.receive", ""},
+		{n2.ID(), "disk.write", "stream.receive"},
+	}{
+		sp, ok := find(want.node, want.name)
+		if !ok{
+			t.Errorf("expected a %s span on %s", want.name, want.node)
+			continue
+		}
+		if sp.TraceID != root.TraceID{
+			t.Errorf("expected %s on %s in the trace of the store", want.name, want.node)
+		}
+		if parent, ok := find(want.node, want.parent); ok && sp.ParentID != parent.SpanID{
+			t.Errorf("expected %s on %s to be a child of %s", want.name, want.node, want.parent)
+		}
+	}
+	if sp, _ := find(n2.ID(), "stream.receive"); sp.ParentID == (SpanID{}){
+		t.Errorf("expected the stream.receive span to have a parent on n1")
+	}
+
+	spans.Reset()
+	rc, err := n1.Get(ctx, "docs/a.txt")
+	if err != nil{
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, rc)
+	rc.Close()
+	if sp, ok := find(n1.ID(), "get"); !ok || sp.ParentID.IsValid() || len(sp.Err) != 0{
+		t.Errorf("expected a root get span, have %+v", spans.Spans())
+	}
+}
+
+func TestStdoutExporter(t *testing.T){
+	var buf bytes.Buffer
+	e := NewStdoutExporter(&buf)
+	sp := SpanData{Name: "store", TraceID: newTraceID(), SpanID: newSpanID(), Node: "n1", Err: "boom"}
+	sp.Attrs = append(sp.Attrs, slog.String("key", "docs/a.txt"))
+	if err := e.ExportSpans(context.Background(), []SpanData{sp}); err != nil{
+		t.Fatal(err)
+	}
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil{
+		t.Fatalf("expected a JSON line, have %q: %v", buf.String(), err)
+	}
+	if line["name"] != "store" || line["trace_id"] != sp.TraceID.String() || line["error"] != "boom"{
+		t.Errorf("unexpected line %v", line)
+	}
+	if _, ok := line["parent_id"]; ok{
+		t.Errorf("expected no parent_id on a root span")
+	}
+}
+
+func TestOTLPExporter(t *testing.T){
+	bodies := make(chan otlpRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+		if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Authorization") != "token"{
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil{
+			t.Error(err)
+		}
+		bodies <- req
+	}))
+	defer srv.Close()
+
+	e := NewOTLPExporter(OTLPExporterOpts{Endpoint: srv.URL, Headers: map[string]string{"Authorization": "token"}})
+	root := SpanData{Name: "store", TraceID: newTraceID(), SpanID: newSpanID(), Node: "n1"}
+	child := SpanData{Name: "stream.receive", TraceID: root.TraceID, SpanID: newSpanID(), ParentID: root.SpanID, Node: "n2"}
+	e.ExportSpans(context.Background(), []SpanData{root, child})
+	if err := e.Shutdown(context.Background()); err != nil{
+		t.Fatal(err)
+	}
+
+	req := <-bodies
+	if len(req.ResourceSpans) != 2{
+		t.Fatalf("expected a resource per node, have %+v", req)
+	}
+	got := req.ResourceSpans[1].ScopeSpans[0].Spans[0]
+	if got.Name != "stream.receive" || got.TraceID != root.TraceID.String() || got.ParentSpanID != root.SpanID.String(){
+		t.Errorf("unexpected span %+v", got)
+	}
+	if id := req.ResourceSpans[1].Resource.Attributes[1]; id.Value.StringValue == nil || *id.Value.StringValue != "n2"{
+		t.Errorf("unexpected resource %+v", req.ResourceSpans[1].Resource)
+	}
+}
@@ -0,0 +1,420 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+	"github.com/ayushn2/distri_vault.git/p2p"
+)
+
+// Transfers survive a dropped connection. A replica pushed to us is written to a part file under .transfers/incoming
+// next to a record of what it is, and only moved into the store once every byte is in. When the sender connects again
+// we hash the chunks we have and ask it to resume, it checks them against its own copy and streams the rest from the
+// end of the last chunk that matches. Fetches keep their part file and a bitmap of the verified chunks under
+// .transfers/fetch, the next fetch of the object from the same copy only asks for the chunks that are missing.
+
+const (
+	transfersDir = ".transfers"
+	// transferTTL is how long an interrupted transfer is kept around waiting for its sender to come back
+	transferTTL = 24 * time.Hour
+	// streamIdleTimeout is how long a stream may stall before we give up on its sender
+	streamIdleTimeout = 30 * time.Second
+)
+
+// MessageResumeTransfer asks the sender of an interrupted push to send the object again from the first chunk that
+// does not match Chunks, the hashes of what the receiver already has
+type MessageResumeTransfer struct{
+	ID string
+	Key string
+	Digest string
+	ModTime int64
+	ChunkSize int64
+	Chunks []string
+}
+
+// transferRecord describes an incoming push that hasn't completed yet
+type transferRecord struct{
+	// From is the ID of the node sending the object
+	From string
+	ID string
+	Key string
+	// Size is the number of bytes of the whole object on the wire
+	Size int64
+	Digest string
+	ModTime int64
+	Erasure *ErasureInfo
+	Started int64
+}
+
+func (r transferRecord) matches(msg MessageStoreFile) bool{
+	return r.ID == msg.ID && r.Key == msg.Key && r.Digest == msg.Digest && r.ModTime == msg.ModTime &&
+		r.Size == msg.Offset+int64(msg.Size)
+}
+
+// incomingPath is the part file of a push. The owner and key come from the sender and name the file, so they have to
+// be a node ID and the hashed key of an object or of one of its shards.
+func (s *FileServer) incomingPath(id string, key string) (string, error){
+	hashedKey := key
+	if base, _, ok := parseShardKey(key); ok{
+		hashedKey = base
+	}
+	if !crypto.ValidID(id) || !crypto.ValidHashedKey(hashedKey){
+		return "", fmt.Errorf("invalid transfer of (%s) owned by %q", key, id)
+	}
+	return filepath.Join(s.store.Root, transfersDir, "incoming", id, key), nil
+}
+
+func (s *FileServer) fetchPath(hashedKey string) string{
+	return filepath.Join(s.store.Root, transfersDir, "fetch", hashedKey)
+}
+
+func writeJSON(path string, v any) error{
+	b, err := json.Marshal(v)
+	if err != nil{
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// transferID names an incoming push in the log, by the owner and key of the object like its part file
+func transferID(id string, key string) string{
+	return id + "/" + key
+}
+
+func removeTransfer(path string){
+	os.Remove(path)
+	os.Remove(path + ".json")
+}
+
+// idlePeer reads a stream from a peer with a deadline on every read. Nothing else is read from the connection while
+// a stream is, so a sender that stalls mid stream would hold up every message behind it. Its connection is closed
+// instead and the part we have is kept for a resume.
+type idlePeer struct{
+	p2p.Peer
+	log *slog.Logger
+}
+
+func (p idlePeer) Read(b []byte) (int, error){
+	p.Peer.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+	n, err := p.Peer.Read(b)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout(){
+		p.log.Warn("stream stalled, dropping the connection", "peer", p.RemoteAddr().String())
+		p.Peer.Close()
+	}
+	return n, err
+}
+
+// CloseStream clears the deadline before the connection goes back to reading messages
+func (p idlePeer) CloseStream(){
+	p.Peer.SetReadDeadline(time.Time{})
+	p.Peer.CloseStream()
+}
+
+// replicaWriter streams to several replicas at once. A replica whose connection fails is dropped and the others carry
+// on, it asks for the rest of the object with a MessageResumeTransfer once it is back.
+type replicaWriter struct{
+	ctx context.Context
+	peers []p2p.Peer
+	log *slog.Logger
+}
+
+func (w *replicaWriter) Write(b []byte) (int, error){
+	var err error
+	alive := w.peers[:0]
+	for _, peer := range w.peers{
+		stop := p2p.BindContext(w.ctx, peer.SetWriteDeadline)
+		_, err = peer.Write(b)
+		stop()
+		if err != nil{
+			// The replica is left waiting for the rest of the stream, dropping the connection makes it keep the part
+			// it has for a resume instead
+			w.log.Warn("replica dropped mid stream", "peer", peer.RemoteAddr().String(), "err", err)
+			peer.Close()
+			continue
+		}
+		alive = append(alive, peer)
+	}
+	w.peers = alive
+
+	if len(w.peers) == 0 && err != nil{
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// receiveObject writes a pushed object into a part file and moves it into the store once it is complete. A stream
+// that ends early leaves the part file behind for resumeTransfers.
+func (s *FileServer) receiveObject(ctx context.Context, peer p2p.Peer, from string, msg MessageStoreFile) (int64, error){
+	stream := io.LimitReader(peer, int64(msg.Size))
+	path, err := s.incomingPath(msg.ID, msg.Key)
+	if err != nil{
+		io.Copy(io.Discard, stream)
+		return 0, err
+	}
+
+	f, err := s.openIncoming(path, from, msg)
+	if err != nil{
+		io.Copy(io.Discard, stream)
+		return 0, err
+	}
+
+	n, err := io.Copy(f, stream)
+	if err == nil && n < int64(msg.Size){
+		err = io.ErrUnexpectedEOF
+	}
+	if cerr := f.Close(); err == nil{
+		err = cerr
+	}
+	if err != nil{
+		return 0, fmt.Errorf("transfer of (%s) interrupted at %d bytes: %w", msg.Key, msg.Offset+n, err)
+	}
+
+	_, span := s.childSpan(ctx, "disk.write", "key", msg.Key)
+	size, err := s.store.Move(msg.ID, msg.Key, path)
+	span.RecordError(err)
+	span.End()
+	if err != nil{
+		return 0, err
+	}
+	os.Remove(path + ".json")
+	return size, nil
+}
+
+// openIncoming opens the part file of a push, positioned at msg.Offset. Resuming needs a record of the same object
+// and a part file that long.
+func (s *FileServer) openIncoming(path string, from string, msg MessageStoreFile) (*os.File, error){
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil{
+		return nil, err
+	}
+
+	if msg.Offset == 0{
+		record := transferRecord{
+			From: s.peerID(from),
+			ID: msg.ID,
+			Key: msg.Key,
+			Size: int64(msg.Size),
+			Digest: msg.Digest,
+			ModTime: msg.ModTime,
+			Erasure: msg.Erasure,
+			Started: time.Now().UnixNano(),
+		}
+		if err := writeJSON(path+".json", record); err != nil{
+			return nil, err
+		}
+		return os.Create(path)
+	}
+
+	var record transferRecord
+	if err := readJSON(path+".json", &record); err != nil || !record.matches(msg){
+		return nil, fmt.Errorf("no transfer of (%s) to resume", msg.Key)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil{
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.Size() < msg.Offset{
+		err = fmt.Errorf("transfer of (%s) has %d bytes, can't resume at %d", msg.Key, fi.Size(), msg.Offset)
+	}
+	if err == nil{
+		err = f.Truncate(msg.Offset)
+	}
+	if err == nil{
+		_, err = f.Seek(msg.Offset, io.SeekStart)
+	}
+	if err != nil{
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// incomingTransfers returns the records of every interrupted push, dropping the ones that waited too long
+func (s *FileServer) incomingTransfers() []transferRecord{
+	records := []transferRecord{}
+	paths, _ := filepath.Glob(filepath.Join(s.store.Root, transfersDir, "incoming", "*", "*.json"))
+	for _, path := range paths{
+		var record transferRecord
+		if err := readJSON(path, &record); err != nil{
+			continue
+		}
+		if time.Since(time.Unix(0, record.Started)) > transferTTL{
+			removeTransfer(strings.TrimSuffix(path, ".json"))
+			continue
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// resumeTransfers asks the node that just connected to finish the pushes it didn't complete
+func (s *FileServer) resumeTransfers(addr string, id string){
+	for _, record := range s.incomingTransfers(){
+		if record.From != id{
+			continue
+		}
+
+		path, err := s.incomingPath(record.ID, record.Key)
+		if err != nil{
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil{
+			removeTransfer(path)
+			continue
+		}
+		chunks, err := chunkHashes(f, s.chunkSize())
+		f.Close()
+		if err != nil{
+			continue
+		}
+
+		log := s.logger("transfer").With("peer", addr, "key", record.Key, "transfer", transferID(record.ID, record.Key))
+		log.Info("resuming transfer")
+		err = s.sendMessage(addr, &Message{
+			Payload: MessageResumeTransfer{
+				ID: record.ID,
+				Key: record.Key,
+				Digest: record.Digest,
+				ModTime: record.ModTime,
+				ChunkSize: s.chunkSize(),
+				Chunks: chunks,
+			},
+		})
+		if err != nil{
+			log.Warn("asking to resume the transfer failed", "err", err)
+			return
+		}
+	}
+}
+
+// lookupObject finds the object a peer knows under hashedKey, our own objects are stored under their plain key
+func (s *FileServer) lookupObject(id string, hashedKey string) (InventoryEntry, bool){
+	if id != s.ID{
+		meta, err := s.store.ReadMeta(id, hashedKey)
+		if err != nil || !s.store.Has(id, hashedKey){
+			return InventoryEntry{}, false
+		}
+		return InventoryEntry{ID: id, Meta: meta}, true
+	}
+
+	inventory, err := s.store.Inventory()
+	if err != nil{
+		return InventoryEntry{}, false
+	}
+	for _, e := range inventory{
+		if e.ID == s.ID && crypto.HashKey(e.Key) == hashedKey{
+			return e, true
+		}
+	}
+	return InventoryEntry{}, false
+}
+
+func (s *FileServer) handleMessageResumeTransfer(from string, msg MessageResumeTransfer) error{
+	peer, ok := s.peer(from)
+	if !ok{
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+
+	e, ok := s.lookupObject(msg.ID, msg.Key)
+	if !ok || e.Deleted || e.Digest != msg.Digest || e.ModTime != msg.ModTime{
+		return fmt.Errorf("can't resume (%s) for %s, the object is gone or changed", msg.Key, from)
+	}
+	if !validChunkSize(msg.ChunkSize){
+		return fmt.Errorf("invalid chunk size %d", msg.ChunkSize)
+	}
+
+	offset, err := s.verifiedOffset(e, msg)
+	if err != nil{
+		return err
+	}
+	_, err = s.pushAt(s.store, peer, e, false, offset)
+	return err
+}
+
+// verifiedOffset returns how much of the object the receiver has right: the end of the last chunk before the first
+// one that differs from ours
+func (s *FileServer) verifiedOffset(e InventoryEntry, msg MessageResumeTransfer) (int64, error){
+	size, r, err := s.wireReader(s.store, e)
+	if err != nil{
+		return 0, err
+	}
+	defer r.Close()
+
+	ours, err := chunkHashes(io.LimitReader(r, int64(len(msg.Chunks))*msg.ChunkSize), msg.ChunkSize)
+	if err != nil{
+		return 0, err
+	}
+
+	matched := 0
+	for matched < len(ours) && matched < len(msg.Chunks) && ours[matched] == msg.Chunks[matched]{
+		matched++
+	}
+	// The last chunk may be the short tail of the object
+	return min(int64(matched)*msg.ChunkSize, size), nil
+}
+
+// fetchState is the progress of an interrupted fetch, the copy it was fetching and the chunks it verified
+type fetchState struct{
+	Fingerprint string
+	Done []bool
+}
+
+// openFetch opens the part file of a fetch. Chunks left by an earlier fetch of the same copy are checked against the
+// manifest again and marked done in sw.
+func (s *FileServer) openFetch(path string, sw *swarm) (*os.File, error){
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil{
+		return nil, err
+	}
+
+	var state fetchState
+	if err := readJSON(path+".json", &state); err != nil || state.Fingerprint != sw.manifest.fingerprint() ||
+		len(state.Done) != len(sw.manifest.Chunks){
+		removeTransfer(path)
+		return os.Create(path)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil{
+		return nil, err
+	}
+
+	verified := 0
+	buf := make([]byte, sw.manifest.ChunkSize)
+	for i, done := range state.Done{
+		if !done{
+			continue
+		}
+		n, err := f.ReadAt(buf, int64(i)*sw.manifest.ChunkSize)
+		if err != nil && !errors.Is(err, io.EOF){
+			continue
+		}
+		if chunkHash(buf[:n]) == sw.manifest.Chunks[i]{
+			sw.complete(i)
+			verified++
+		}
+	}
+	if verified > 0{
+		s.logger("transfer").Info("resuming fetch", "key", filepath.Base(path), "transfer", sw.manifest.fingerprint(),
+			"chunks", verified, "of", len(sw.manifest.Chunks))
+	}
+	return f, nil
+}
+
+func saveFetchState(path string, sw *swarm) error{
+	return writeJSON(path+".json", fetchState{
+		Fingerprint: sw.manifest.fingerprint(),
+		Done: sw.doneChunks(),
+	})
+}
@@ -0,0 +1,176 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+)
+
+// streamPeer is a peer whose stream is whatever r holds
+type streamPeer struct{
+	net.Conn
+	r io.Reader
+}
+
+func (p *streamPeer) Read(b []byte) (int, error){ return p.r.Read(b) }
+func (p *streamPeer) Send(b []byte) error{ return nil }
+func (p *streamPeer) SendContext(ctx context.Context, b []byte) error{ return nil }
+func (p *streamPeer) CloseStream(){}
+func (p *streamPeer) Outbound() bool{ return false }
+
+func TestReceiveObjectResumes(t *testing.T){
+	s := newTestServer(t.TempDir())
+	data := []byte("0123456789")
+	owner, key := crypto.GenerateID(), crypto.HashKey("file")
+	msg := MessageStoreFile{ID: owner, Key: key, Size: len(data), Digest: "digest", ModTime: 1}
+
+	// The connection drops after 6 bytes
+	if _, err := s.receiveObject(context.Background(), &streamPeer{r: bytes.NewReader(data[:6])}, "peer", msg); err == nil{
+		t.Fatalf("expected a short stream to fail")
+	}
+	if s.store.Has(owner, key){
+		t.Fatalf("expected the partial object to stay out of the store")
+	}
+	if records := s.incomingTransfers(); len(records) != 1 || records[0].Size != int64(len(data)){
+		t.Fatalf("expected the interrupted transfer to be recorded, have %+v", records)
+	}
+
+	stale := msg
+	stale.Digest, stale.Offset, stale.Size = "other", 4, 6
+	if _, err := s.receiveObject(context.Background(), &streamPeer{r: bytes.NewReader(data[4:])}, "peer", stale); err == nil{
+		t.Fatalf("expected resuming a different object to fail")
+	}
+
+	msg.Offset, msg.Size = 4, 6
+	n, err := s.receiveObject(context.Background(), &streamPeer{r: bytes.NewReader(data[4:])}, "peer", msg)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if n != int64(len(data)){
+		t.Errorf("expected %d bytes, have %d", len(data), n)
+	}
+
+	_, r, err := s.store.Read(owner, key)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); !bytes.Equal(b, data){
+		t.Errorf("have %q want %q", b, data)
+	}
+	if records := s.incomingTransfers(); len(records) != 0{
+		t.Errorf("expected the transfer record to be dropped, have %+v", records)
+	}
+}
+
+func TestReceiveObjectRejectsPaths(t *testing.T){
+	s := newTestServer(t.TempDir())
+	data := []byte("0123456789")
+	owner, key := crypto.GenerateID(), crypto.HashKey("file")
+
+	for _, msg := range []MessageStoreFile{
+		{ID: "..", Key: key},
+		{ID: owner, Key: "../../.identity.json"},
+		{ID: owner, Key: key + "#../../x"},
+		{ID: owner, Key: "../" + key + "#1"},
+	}{
+		msg.Size, msg.Digest, msg.ModTime = len(data), "digest", 1
+		if _, err := s.receiveObject(context.Background(), &streamPeer{r: bytes.NewReader(data)}, "peer", msg); err == nil{
+			t.Errorf("expected the push of (%s) owned by %q to be rejected", msg.Key, msg.ID)
+		}
+	}
+	if entries, _ := os.ReadDir(s.store.Root); len(entries) != 0{
+		t.Errorf("expected nothing to be written, have %d entries", len(entries))
+	}
+
+	msg := MessageStoreFile{ID: owner, Key: shardKey(key, 2), Size: len(data), Digest: "digest", ModTime: 1}
+	if _, err := s.receiveObject(context.Background(), &streamPeer{r: bytes.NewReader(data)}, "peer", msg); err != nil{
+		t.Errorf("expected a shard to be taken, have %v", err)
+	}
+}
+
+func TestVerifiedOffset(t *testing.T){
+	s := newTestServer(t.TempDir())
+	if err := s.storeObjectAt(context.Background(), "key", bytes.NewReader(bytes.Repeat([]byte("data"), 10)), 1, StorageMode{}); err != nil{
+		t.Fatal(err)
+	}
+
+	e, ok := s.lookupObject(s.ID, crypto.HashKey("key"))
+	if !ok{
+		t.Fatalf("expected our own object to be found by its hashed key")
+	}
+	size, r, err := s.wireReader(s.store, e)
+	if err != nil{
+		t.Fatal(err)
+	}
+	wire, _ := io.ReadAll(r)
+	r.Close()
+
+	for _, tc := range []struct{
+		have []byte
+		want int64
+	}{
+		{wire[:20], 16},
+		{append(append([]byte{}, wire[:10]...), 'x'), 8},
+		{wire, size},
+	}{
+		chunks, _ := chunkHashes(bytes.NewReader(tc.have), 8)
+		offset, err := s.verifiedOffset(e, MessageResumeTransfer{ChunkSize: 8, Chunks: chunks})
+		if err != nil{
+			t.Fatal(err)
+		}
+		if offset != tc.want{
+			t.Errorf("receiver has %d bytes, expected to resume at %d, have %d", len(tc.have), tc.want, offset)
+		}
+	}
+}
+
+func TestFetchResumes(t *testing.T){
+	s := newTestServer(t.TempDir())
+	data := bytes.Repeat([]byte("abcd"), 10)
+	chunks, _ := chunkHashes(bytes.NewReader(data), 8)
+	peers := map[string]MessageManifest{"peer": {Held: true, Size: int64(len(data)), ChunkSize: 8, Chunks: chunks}}
+
+	path := s.fetchPath("key")
+	f, err := s.openFetch(path, newSwarm(peers))
+	if err != nil{
+		t.Fatal(err)
+	}
+	f.WriteAt(data[:8], 0)
+	f.WriteAt([]byte("corrupt!"), 16)
+	f.Close()
+
+	sw := newSwarm(peers)
+	sw.complete(0)
+	sw.complete(2)
+	if err := saveFetchState(path, sw); err != nil{
+		t.Fatal(err)
+	}
+
+	sw = newSwarm(peers)
+	f, err = s.openFetch(path, sw)
+	if err != nil{
+		t.Fatal(err)
+	}
+	f.Close()
+
+	done := sw.doneChunks()
+	if !done[0] || done[2] || sw.remaining != len(chunks)-1{
+		t.Errorf("expected only the intact chunk to be kept, have %v", done)
+	}
+
+	// A different copy of the object starts over
+	other := map[string]MessageManifest{"peer": {Held: true, Size: 8, ChunkSize: 8, Chunks: chunks[:1]}}
+	sw = newSwarm(other)
+	if f, err = s.openFetch(path, sw); err != nil{
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if fi, _ := os.Stat(path); fi.Size() != 0 || sw.remaining != 1{
+		t.Errorf("expected a fresh part file")
+	}
+}
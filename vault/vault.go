@@ -0,0 +1,299 @@
+// Package vault is a distri_vault node: a FileServer that stores files encrypted on disk and replicates them to its
+// peers over TCP, with the control socket, HTTP gateway, S3 front-end and WebDAV tree on top. Programs that embed a
+// node use NewNode, programs that talk to a node elsewhere use NewClient.
+//
+//	n, err := vault.NewNode(vault.WithListenAddr(":3000"), vault.WithBootstrap("10.0.0.2:3000"))
+//	if err != nil{
+//		return err
+//	}
+//	if err := n.Start(); err != nil{
+//		return err
+//	}
+//	defer n.Close()
+//	info, err := n.Put(ctx, "docs/a.txt", strings.NewReader("hello"))
+package vault
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+var ErrNodeClosed = errors.New("node is closed")
+
+// Node is a FileServer embedded in another program. Its zero value is not usable, create it with NewNode.
+type Node struct{
+	s *FileServer
+
+	lock sync.Mutex
+	started bool
+	closed bool
+	done chan struct{}
+}
+
+type nodeOptions struct{
+	cfg Config
+	server []func(*FileServerOpts)
+}
+
+// Option configures a node created with NewNode
+type Option func(*nodeOptions)
+
+// WithConfig starts from cfg instead of the defaults, options after it change cfg
+func WithConfig(cfg Config) Option{
+	return func(o *nodeOptions){
+		o.cfg = cfg
+	}
+}
+
+// WithListenAddr is the address the node accepts peers on, ":0" picks a free port
+func WithListenAddr(addr string) Option{
+	return func(o *nodeOptions){
+		o.cfg.Listen = addr
+	}
+}
+
+// WithAdvertiseAddr is the address peers reach the node on when it isn't the listen address
+func WithAdvertiseAddr(addr string) Option{
+	return func(o *nodeOptions){
+		o.cfg.Advertise = addr
+	}
+}
+
+// WithStorageRoot is the directory the node keeps its files in, <listen>_network if not set
+func WithStorageRoot(root string) Option{
+	return func(o *nodeOptions){
+		o.cfg.StorageRoot = root
+	}
+}
+
+// WithBootstrap are the nodes to join on start
+func WithBootstrap(addrs ...string) Option{
+	return func(o *nodeOptions){
+		o.cfg.Bootstrap = append(o.cfg.Bootstrap, addrs...)
+	}
+}
+
+// WithCluster finds the nodes of cluster on the LAN
+func WithCluster(cluster string) Option{
+	return func(o *nodeOptions){
+		o.cfg.Cluster = cluster
+	}
+}
+
+// WithID is the owner ID of the node, generated on first start and kept in the storage root if not set
+func WithID(id string) Option{
+	return func(o *nodeOptions){
+		o.cfg.ID = id
+	}
+}
+
+// WithEncryptionKey is the 32 byte key files are encrypted with, generated like the ID if not set
+func WithEncryptionKey(key []byte) Option{
+	return func(o *nodeOptions){
+		o.cfg.EncryptionKey = hex.EncodeToString(key)
+	}
+}
+
+// WithReplicationFactor is the number of replicas of every file, zero replicates to every peer
+func WithReplicationFactor(n int) Option{
+	return func(o *nodeOptions){
+		o.cfg.ReplicationFactor = n
+	}
+}
+
+// WithDefaultStorageMode is how files are made redundant unless their namespace says otherwise
+func WithDefaultStorageMode(mode StorageMode) Option{
+	return WithServerOptions(func(opts *FileServerOpts){
+		opts.DefaultStorageMode = mode
+	})
+}
+
+// WithControlSocket serves the control socket for the command line client at path, a node created with NewNode has
+// none unless this is given
+func WithControlSocket(path string) Option{
+	return func(o *nodeOptions){
+		o.cfg.ControlSocket = path
+	}
+}
+
+// WithHTTPAddr serves the HTTP gateway on addr
+func WithHTTPAddr(addr string) Option{
+	return func(o *nodeOptions){
+		o.cfg.HTTPAddr = addr
+	}
+}
+
+// WithS3 serves the S3 front-end on addr, accepting the access keys in keys which maps them to their secret
+func WithS3(addr string, keys map[string]string) Option{
+	return func(o *nodeOptions){
+		o.cfg.S3Addr = addr
+		for key, secret := range keys{
+			o.cfg.S3Keys = append(o.cfg.S3Keys, key+":"+secret)
+		}
+	}
+}
+
+// WithLogger logs to l instead of stderr, the node ID and the component are attached to every record. The levels come
+// from the log_level and log_levels settings and can be changed through Server().LogLevels.
+func WithLogger(l *slog.Logger) Option{
+	return WithServerOptions(func(opts *FileServerOpts){
+		opts.Logger = l
+	})
+}
+
+// WithAdminAddr serves the Prometheus metrics of the node on addr under /metrics
+func WithAdminAddr(addr string) Option{
+	return func(o *nodeOptions){
+		o.cfg.AdminAddr = addr
+	}
+}
+
+// WithSpanExporter traces the Store and Get calls of the node to e, see tracing.go
+func WithSpanExporter(e SpanExporter) Option{
+	return WithServerOptions(func(opts *FileServerOpts){
+		opts.SpanExporter = e
+	})
+}
+
+// WithServerOptions changes the options of the FileServer directly, for the settings that have no option of their own
+func WithServerOptions(fn func(*FileServerOpts)) Option{
+	return func(o *nodeOptions){
+		o.server = append(o.server, fn)
+	}
+}
+
+// NewNode sets up a node, it doesn't listen before Start
+func NewNode(opts ...Option) (*Node, error){
+	o := nodeOptions{cfg: DefaultConfig()}
+	o.cfg.ControlSocket = ""
+	for _, opt := range opts{
+		opt(&o)
+	}
+	if err := o.cfg.Validate(); err != nil{
+		return nil, err
+	}
+
+	serverOpts, tcpOpts := o.cfg.Options()
+	for _, fn := range o.server{
+		fn(&serverOpts)
+	}
+	s, err := newNode(serverOpts, tcpOpts)
+	if err != nil{
+		return nil, err
+	}
+	return &Node{s: s, done: make(chan struct{})}, nil
+}
+
+// Start listens for peers and joins the bootstrap nodes, it returns once the node is up
+func (n *Node) Start() error{
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed{
+		return ErrNodeClosed
+	}
+	if n.started{
+		return nil
+	}
+
+	if err := n.s.start(); err != nil{
+		// Whatever did start is torn down again, a node that failed to start can't be started again
+		n.closed = true
+		n.s.Stop()
+		n.s.Transport.Close()
+		return err
+	}
+	n.started = true
+	go func(){
+		defer close(n.done)
+		n.s.loop()
+	}()
+	return nil
+}
+
+// Close stops the node and waits for it to let go of its connections
+func (n *Node) Close() error{
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed{
+		return nil
+	}
+	n.closed = true
+	if !n.started{
+		return nil
+	}
+	n.s.Stop()
+	<-n.done
+	return nil
+}
+
+// Server is the FileServer behind the node, for what the Node methods don't cover
+func (n *Node) Server() *FileServer{
+	return n.s
+}
+
+// ID is the owner ID of the node
+func (n *Node) ID() string{
+	return n.s.ID
+}
+
+// Put stores r as a new version of key and replicates it
+func (n *Node) Put(ctx context.Context, key string, r io.Reader, opts ...StoreOption) (ObjectInfo, error){
+	if err := n.s.StoreContext(ctx, key, r, opts...); err != nil{
+		return ObjectInfo{}, err
+	}
+	return n.s.Stat(key)
+}
+
+// Get reads the latest version of key, from a peer if the node doesn't hold it. The reader has to be closed.
+func (n *Node) Get(ctx context.Context, key string) (io.ReadCloser, error){
+	r, err := n.s.GetContext(ctx, key)
+	if err != nil{
+		return nil, err
+	}
+	rc, ok := r.(io.ReadCloser)
+	if !ok{
+		rc = io.NopCloser(r)
+	}
+	return struct{
+		io.Reader
+		io.Closer
+	}{ctxReader{ctx, rc}, rc}, nil
+}
+
+// Stat describes key without reading it
+func (n *Node) Stat(ctx context.Context, key string) (ObjectInfo, error){
+	if err := ctx.Err(); err != nil{
+		return ObjectInfo{}, err
+	}
+	return n.s.Stat(key)
+}
+
+// Delete deletes key with all its versions
+func (n *Node) Delete(ctx context.Context, key string) error{
+	return n.s.DeleteContext(ctx, key)
+}
+
+// List describes the keys starting with prefix, sorted
+func (n *Node) List(ctx context.Context, prefix string) ([]ObjectInfo, error){
+	if err := ctx.Err(); err != nil{
+		return nil, err
+	}
+	return n.s.List(prefix)
+}
+
+// ctxReader stops reading once ctx is done
+type ctxReader struct{
+	ctx context.Context
+	r io.Reader
+}
+
+func (r ctxReader) Read(b []byte) (int, error){
+	if err := r.ctx.Err(); err != nil{
+		return 0, err
+	}
+	return r.r.Read(b)
+}
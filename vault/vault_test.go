@@ -0,0 +1,132 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func startTestNode(t *testing.T, opts ...Option) *Node{
+	dir := t.TempDir()
+	opts = append([]Option{WithListenAddr("127.0.0.1:0"), WithStorageRoot(filepath.Join(dir, "root"))}, opts...)
+	n, err := NewNode(opts...)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if err := n.Start(); err != nil{
+		t.Fatal(err)
+	}
+	t.Cleanup(func(){ n.Close() })
+	return n
+}
+
+// freeAddr is a local address nothing listens on
+func freeAddr(t *testing.T) string{
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// startTestCluster starts n nodes that all joined the first one and waits until every node said hello to every other
+func startTestCluster(t *testing.T, n int, opts ...Option) []*Node{
+	addr := freeAddr(t)
+	nodes := []*Node{startTestNode(t, append([]Option{WithListenAddr(addr)}, opts...)...)}
+	for i := 1; i < n; i++{
+		// Every node needs a real address to advertise, peer exchange dials it
+		nodes = append(nodes, startTestNode(t, append([]Option{WithListenAddr(freeAddr(t)), WithBootstrap(addr)}, opts...)...))
+	}
+	for _, node := range nodes{
+		s := node.Server()
+		waitFor(t, "the cluster to connect", func() bool{
+			s.peerLock.Lock()
+			defer s.peerLock.Unlock()
+			return len(s.peerIDs) == n-1
+		})
+	}
+	return nodes
+}
+
+// replicasOf are the live objects of owner that s holds
+func replicasOf(t *testing.T, s *FileServer, owner string) []InventoryEntry{
+	t.Helper()
+	inventory, err := s.store.Inventory()
+	if err != nil{
+		t.Fatal(err)
+	}
+	held := []InventoryEntry{}
+	for _, e := range inventory{
+		if e.ID == owner && !e.Deleted{
+			held = append(held, e)
+		}
+	}
+	return held
+}
+
+func TestNode(t *testing.T){
+	n := startTestNode(t)
+	ctx := context.Background()
+
+	info, err := n.Put(ctx, "docs/a.txt", strings.NewReader("hello node"))
+	if err != nil{
+		t.Fatal(err)
+	}
+	if info.Key != "docs/a.txt" || info.Size != 10 || len(info.Version) == 0{
+		t.Errorf("unexpected put result %+v", info)
+	}
+	n.Put(ctx, "pics/b.jpg", strings.NewReader("other"))
+
+	rc, err := n.Get(ctx, "docs/a.txt")
+	if err != nil{
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(b) != "hello node"{
+		t.Errorf("get returned %q, %v", b, err)
+	}
+
+	objects, err := n.List(ctx, "docs/")
+	if err != nil || len(objects) != 1 || objects[0].Key != "docs/a.txt"{
+		t.Errorf("unexpected listing %+v, %v", objects, err)
+	}
+
+	if err := n.Delete(ctx, "docs/a.txt"); err != nil{
+		t.Fatal(err)
+	}
+	if _, err := n.Stat(ctx, "docs/a.txt"); !errors.Is(err, ErrDeleted){
+		t.Errorf("have %v want %v", err, ErrDeleted)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := n.Put(cancelled, "c.txt", strings.NewReader("never")); !errors.Is(err, context.Canceled){
+		t.Errorf("have %v want %v", err, context.Canceled)
+	}
+	if _, err := n.Stat(ctx, "c.txt"); !errors.Is(err, ErrNotFound){
+		t.Errorf("a cancelled put must not store the file, stat returned %v", err)
+	}
+}
+
+func TestNodeLifecycle(t *testing.T){
+	if _, err := NewNode(WithListenAddr("nowhere")); err == nil{
+		t.Errorf("expected an invalid listen address to be rejected")
+	}
+
+	n, err := NewNode(WithListenAddr("127.0.0.1:0"), WithStorageRoot(filepath.Join(t.TempDir(), "root")))
+	if err != nil{
+		t.Fatal(err)
+	}
+	if err := n.Close(); err != nil{
+		t.Errorf("closing a node that never started returned %v", err)
+	}
+	if err := n.Start(); err != ErrNodeClosed{
+		t.Errorf("have %v want %v", err, ErrNodeClosed)
+	}
+}
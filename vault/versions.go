@@ -0,0 +1,464 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+)
+
+// Every Store of a key creates a new immutable version. Each version is an object of its own on the network, stored
+// under versionKey(key, id), so replication, anti-entropy and tombstones all work per version. The version index is
+// kept by the owner under the hashed key; nodes sharing an owner ID merge each other's version records so they can
+// see concurrent writes.
+
+var ErrVersionNotFound = errors.New("version not found")
+
+// MessageVersion announces a new version of a key to nodes sharing the owner ID
+type MessageVersion struct{
+	ID string
+	Key string
+	Version Version
+}
+
+// ConflictError is returned by Get when a key has concurrent versions and the resolver keeps them all
+type ConflictError struct{
+	Key string
+	Siblings []Version
+}
+
+func (e *ConflictError) Error() string{
+	return fmt.Sprintf("key (%s) has %d concurrent versions", e.Key, len(e.Siblings))
+}
+
+// ConflictResolver picks the version Get returns when a key has concurrent versions
+type ConflictResolver func(key string, siblings []Version) (Version, error)
+
+// LastWriterWins resolves a conflict in favour of the version with the latest hybrid timestamp
+func LastWriterWins(key string, siblings []Version) (Version, error){
+	winner := siblings[0]
+	for _, v := range siblings[1:]{
+		if v.ModTime.After(winner.ModTime) || (v.ModTime.Equal(winner.ModTime) && v.Node > winner.Node){
+			winner = v
+		}
+	}
+	return winner, nil
+}
+
+// KeepAll refuses to pick a winner and surfaces every sibling to the caller, who can read them with GetVersion
+// and resolve the conflict by storing a new version
+func KeepAll(key string, siblings []Version) (Version, error){
+	return Version{}, &ConflictError{Key: key, Siblings: siblings}
+}
+
+// newVersionID returns an ID that sorts in the order versions were created
+func newVersionID(ts int64) string{
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return fmt.Sprintf("%016x%s", ts, hex.EncodeToString(buf))
+}
+
+func versionKey(key string, versionID string) string{
+	return key + "@v" + versionID
+}
+
+// dominates reports whether w supersedes v. Versions with equal clocks (e.g. written before clocks existed) are ordered by ID.
+func dominates(w Version, v Version) bool{
+	if !w.Clock.Descends(v.Clock){
+		return false
+	}
+	return !v.Clock.Descends(w.Clock) || w.ID > v.ID
+}
+
+// heads returns the versions no other version supersedes, more than one head means concurrent writes
+func heads(versions []Version) []Version{
+	result := []Version{}
+	for _, v := range versions{
+		head := true
+		for _, w := range versions{
+			if w.ID != v.ID && dominates(w, v){
+				head = false
+				break
+			}
+		}
+		if head{
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func (s *FileServer) versions(key string) ([]Version, error){
+	versions, _, err := s.readVersions(key)
+	return versions, err
+}
+
+// readVersions reads the index of key and reports whether it was found under the plain key, where indexes were kept
+// before they moved to the hashed key. Such an index is moved over on the next write to it.
+func (s *FileServer) readVersions(key string) ([]Version, bool, error){
+	versions, err := s.store.ReadVersions(s.ID, crypto.HashKey(key))
+	if err != nil || len(versions) != 0{
+		return versions, false, err
+	}
+
+	versions, err = s.store.ReadVersions(s.ID, key)
+	if err != nil || len(versions) == 0{
+		return versions, false, err
+	}
+	for i := range versions{
+		versions[i].Key = key
+	}
+	return versions, true, nil
+}
+
+// keyLocks serializes the updates of the version index of a key. A lock only lives while someone holds or waits for
+// it, so the map doesn't grow with every key ever stored.
+type keyLocks struct{
+	mu sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct{
+	held chan struct{}
+	refs int
+}
+
+// lock takes the lock of key and returns the func that releases it
+func (l *keyLocks) lock(key string) (unlock func()){
+	unlock, _ = l.lockContext(context.Background(), key)
+	return unlock
+}
+
+// lockContext is lock giving up once ctx is done
+func (l *keyLocks) lockContext(ctx context.Context, key string) (unlock func(), err error){
+	l.mu.Lock()
+	if l.locks == nil{
+		l.locks = make(map[string]*keyLock)
+	}
+	kl, ok := l.locks[key]
+	if !ok{
+		kl = &keyLock{held: make(chan struct{}, 1)}
+		l.locks[key] = kl
+	}
+	kl.refs++
+	l.mu.Unlock()
+
+	release := func(){
+		l.mu.Lock()
+		kl.refs--
+		if kl.refs == 0{
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+	select{
+	case kl.held <- struct{}{}:
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+	return func(){
+		<-kl.held
+		release()
+	}, nil
+}
+
+// addVersion appends v to the index of key and returns the versions the retention rules drop. The index is read
+// again under the lock of the key, a Store that ran alongside may have added its own version since we first read it.
+func (s *FileServer) addVersion(key string, v Version) ([]Version, error){
+	hashedKey := crypto.HashKey(key)
+	unlock := s.versionLocks.lock(hashedKey)
+	defer unlock()
+
+	versions, legacy, err := s.readVersions(key)
+	if err != nil{
+		return nil, err
+	}
+	versions = append(versions, v)
+
+	keep, prune := s.retain(versions, time.Now())
+	if err := s.store.WriteVersions(s.ID, hashedKey, keep); err != nil{
+		return nil, err
+	}
+	if legacy{
+		if err := s.store.DeleteVersions(s.ID, key); err != nil{
+			return nil, err
+		}
+	}
+	return prune, nil
+}
+
+// Store writes a new version of key and replicates it, then prunes old versions according to the retention rules.
+// The new version descends from every current head, so storing resolves any conflict on the key.
+func (s *FileServer) Store(key string, r io.Reader, opts ...StoreOption) error{
+	return s.StoreContext(context.Background(), key, r, opts...)
+}
+
+// StoreContext is Store reading r and sending to the peers only until ctx is done. A store cancelled before the new
+// version is on our disk leaves nothing behind, after that it stands and the peers that missed it catch up later.
+func (s *FileServer) StoreContext(ctx context.Context, key string, r io.Reader, opts ...StoreOption) (err error){
+	defer s.metrics.storeDuration.since(time.Now())
+	ctx, span := s.startSpan(ctx, "store", "key", key)
+	defer endSpan(span, &err)
+	if err := ctx.Err(); err != nil{
+		return err
+	}
+	if s.Draining(){
+		return ErrDraining
+	}
+
+	versions, err := s.versions(key)
+	if err != nil{
+		return err
+	}
+
+	parents := []VectorClock{}
+	for _, v := range heads(versions){
+		parents = append(parents, v.Clock)
+	}
+	clock := VectorClock{}.Merge(parents...)
+	clock[s.nodeID()]++
+
+	ts := s.clock.Now()
+	id := newVersionID(ts)
+	vkey := versionKey(key, id)
+
+	if err := s.storeObjectAt(ctx, vkey, r, ts, s.storageMode(key, opts...)); err != nil{
+		return err
+	}
+
+	meta, err := s.store.ReadMeta(s.ID, vkey)
+	if err != nil{
+		return err
+	}
+
+	version := Version{
+		ID: id,
+		Key: key,
+		Digest: meta.Digest,
+		Size: meta.Size,
+		ModTime: time.Unix(0, meta.ModTime),
+		Node: s.nodeID(),
+		Clock: clock,
+		Erasure: meta.Erasure,
+	}
+	prune, err := s.addVersion(key, version)
+	if err != nil{
+		return err
+	}
+	for _, v := range prune{
+		if err := s.deleteObject(ctx, versionKey(key, v.ID)); err != nil{
+			return s.cutShort(ctx, key, err)
+		}
+	}
+
+	return s.cutShort(ctx, key, s.broadcast(ctx, &Message{
+		Payload: MessageVersion{
+			ID: s.ID,
+			Key: crypto.HashKey(key),
+			Version: version,
+		},
+	}))
+}
+
+// Get returns the latest version of the file. If the key has concurrent versions the ConflictResolver decides.
+func (s *FileServer) Get(key string) (io.Reader, error){
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext is Get giving up on fetching the file from the peers once ctx is done
+func (s *FileServer) GetContext(ctx context.Context, key string) (_ io.Reader, err error){
+	defer s.metrics.getDuration.since(time.Now())
+	ctx, span := s.startSpan(ctx, "get", "key", key)
+	defer endSpan(span, &err)
+	if err := ctx.Err(); err != nil{
+		return nil, err
+	}
+	versions, err := s.versions(key)
+	if err != nil{
+		return nil, err
+	}
+
+	// Files written before versioning live under their plain key
+	if len(versions) == 0{
+		return s.getObject(ctx, key)
+	}
+
+	latest, err := s.latest(key, versions)
+	if err != nil{
+		return nil, err
+	}
+	return s.getVersion(ctx, key, latest)
+}
+
+func (s *FileServer) latest(key string, versions []Version) (Version, error){
+	siblings := heads(versions)
+	if len(siblings) == 1{
+		return siblings[0], nil
+	}
+
+	resolve := s.ConflictResolver
+	if resolve == nil{
+		resolve = LastWriterWins
+	}
+	return resolve(key, siblings)
+}
+
+// Conflicts returns the concurrent versions of key, nil if there is no conflict
+func (s *FileServer) Conflicts(key string) ([]Version, error){
+	versions, err := s.versions(key)
+	if err != nil{
+		return nil, err
+	}
+	siblings := heads(versions)
+	if len(siblings) < 2{
+		return nil, nil
+	}
+	return siblings, nil
+}
+
+// GetVersion returns a specific version of the file
+func (s *FileServer) GetVersion(key string, versionID string) (io.Reader, error){
+	v, err := s.version(key, versionID)
+	if err != nil{
+		return nil, err
+	}
+	return s.getVersion(context.Background(), key, v)
+}
+
+// getVersion reads a version, from our local copy or the network
+func (s *FileServer) getVersion(ctx context.Context, key string, v Version) (io.Reader, error){
+	vkey := versionKey(key, v.ID)
+	if v.Erasure != nil && !s.store.Has(s.ID, vkey){
+		if _, err := s.store.ReadMeta(s.ID, vkey); err != nil{
+			return s.getShards(ctx, vkey, Meta{Size: v.Size, ModTime: v.ModTime.UnixNano(), Erasure: v.Erasure})
+		}
+	}
+	return s.getObject(ctx, vkey)
+}
+
+// Versions lists the versions of key that are still retained, oldest first
+func (s *FileServer) Versions(key string) ([]Version, error){
+	return s.versions(key)
+}
+
+// Restore makes an old version the latest one again by storing its contents as a new version
+func (s *FileServer) Restore(key string, versionID string) error{
+	r, err := s.GetVersion(key, versionID)
+	if err != nil{
+		return err
+	}
+	if rc, ok := r.(io.ReadCloser); ok{
+		defer rc.Close()
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, r); err != nil{
+		return err
+	}
+
+	return s.Store(key, buf)
+}
+
+func (s *FileServer) version(key string, versionID string) (Version, error){
+	versions, err := s.versions(key)
+	if err != nil{
+		return Version{}, err
+	}
+	for _, v := range versions{
+		if v.ID == versionID{
+			return v, nil
+		}
+	}
+	return Version{}, ErrVersionNotFound
+}
+
+// removeLocal drops our local copy of the latest version without touching the network, so the next Get fetches it from peers
+func (s *FileServer) removeLocal(key string) error{
+	versions, err := s.versions(key)
+	if err != nil{
+		return err
+	}
+	if len(versions) == 0{
+		return s.store.Delete(s.ID, key)
+	}
+	latest, err := s.latest(key, versions)
+	if err != nil{
+		return err
+	}
+	return s.store.Delete(s.ID, versionKey(key, latest.ID))
+}
+
+// handleMessageVersion merges a version written by another node sharing our owner ID into our index
+func (s *FileServer) handleMessageVersion(from string, msg MessageVersion) error{
+	if err := s.clock.Observe(msg.Version.ModTime.UnixNano()); err != nil{
+		return err
+	}
+
+	if msg.ID != s.ID{
+		return nil
+	}
+
+	unlock := s.versionLocks.lock(msg.Key)
+	defer unlock()
+	versions, err := s.store.ReadVersions(s.ID, msg.Key)
+	if err != nil{
+		return err
+	}
+	for _, v := range versions{
+		if v.ID == msg.Version.ID{
+			return nil
+		}
+	}
+	versions = append(versions, msg.Version)
+
+	// The writer prunes (and deletes) old versions itself, we only drop them from our index
+	keep, _ := s.retain(versions, time.Now())
+	return s.store.WriteVersions(s.ID, msg.Key, keep)
+}
+
+// nodeID identifies this node in vector clocks. It can't be the owner ID, several nodes may share one.
+func (s *FileServer) nodeID() string{
+	pub := s.SigningKey.Public().(ed25519.PublicKey)
+	return hex.EncodeToString(pub[:8])
+}
+
+// retain splits versions into the ones to keep and the ones to prune. A version is kept if any configured rule keeps it,
+// the heads are always kept and without rules nothing is pruned.
+func (s *FileServer) retain(versions []Version, now time.Time) ([]Version, []Version){
+	sort.Slice(versions, func(i, j int) bool{ return versions[i].ID < versions[j].ID })
+
+	if s.KeepVersions <= 0 && s.KeepVersionsFor <= 0{
+		return versions, nil
+	}
+
+	isHead := make(map[string]bool)
+	for _, v := range heads(versions){
+		isHead[v.ID] = true
+	}
+
+	keep, prune := []Version{}, []Version{}
+	for i, v := range versions{
+		newest := len(versions) - i
+		switch{
+		case isHead[v.ID]:
+			keep = append(keep, v)
+		case s.KeepVersions > 0 && newest <= s.KeepVersions:
+			keep = append(keep, v)
+		case s.KeepVersionsFor > 0 && now.Sub(v.ModTime) <= s.KeepVersionsFor:
+			keep = append(keep, v)
+		default:
+			prune = append(prune, v)
+		}
+	}
+	return keep, prune
+}
@@ -0,0 +1,261 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ayushn2/distri_vault.git/crypto"
+)
+
+func readAll(t *testing.T, r io.Reader, err error) string{
+	t.Helper()
+	if err != nil{
+		t.Fatal(err)
+	}
+	if rc, ok := r.(io.ReadCloser); ok{
+		defer rc.Close()
+	}
+	b, err := io.ReadAll(r)
+	if err != nil{
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestVersionHistoryAndRestore(t *testing.T){
+	s := newTestServer(t.TempDir())
+
+	for _, data := range []string{"first", "second"}{
+		if err := s.Store("notes.txt", bytes.NewReader([]byte(data))); err != nil{
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := s.Versions("notes.txt")
+	if err != nil{
+		t.Fatal(err)
+	}
+	if len(versions) != 2{
+		t.Fatalf("have %d versions want 2", len(versions))
+	}
+	if versions[0].Size != int64(len("first")){
+		t.Errorf("have size %d want %d", versions[0].Size, len("first"))
+	}
+
+	r, err := s.Get("notes.txt")
+	if have := readAll(t, r, err); have != "second"{
+		t.Errorf("have %s want second", have)
+	}
+
+	r, err = s.GetVersion("notes.txt", versions[0].ID)
+	if have := readAll(t, r, err); have != "first"{
+		t.Errorf("have %s want first", have)
+	}
+
+	if err := s.Restore("notes.txt", versions[0].ID); err != nil{
+		t.Fatal(err)
+	}
+	r, err = s.Get("notes.txt")
+	if have := readAll(t, r, err); have != "first"{
+		t.Errorf("have %s want first after restore", have)
+	}
+
+	if _, err := s.GetVersion("notes.txt", "nope"); err != ErrVersionNotFound{
+		t.Errorf("have %v want %v", err, ErrVersionNotFound)
+	}
+}
+
+func TestVersionRetention(t *testing.T){
+	s := newTestServer(t.TempDir())
+	s.KeepVersions = 2
+	s.KeepVersionsFor = time.Hour
+
+	now := time.Now()
+	versions := []Version{
+		{ID: "1", ModTime: now.Add(-3 * time.Hour)},
+		{ID: "2", ModTime: now.Add(-2 * time.Hour)},
+		{ID: "3", ModTime: now.Add(-30 * time.Minute)},
+		{ID: "4", ModTime: now.Add(-20 * time.Minute)},
+		{ID: "5", ModTime: now.Add(-10 * time.Minute)},
+	}
+
+	keep, prune := s.retain(versions, now)
+	if len(keep) != 3 || len(prune) != 2{
+		t.Fatalf("have keep=%v prune=%v", keep, prune)
+	}
+	if prune[0].ID != "1" || prune[1].ID != "2"{
+		t.Errorf("expected the two oldest versions to be pruned, have %v", prune)
+	}
+
+	s.KeepVersionsFor = 0
+	keep, _ = s.retain(versions, now)
+	if len(keep) != 2{
+		t.Errorf("have %d versions want the last 2", len(keep))
+	}
+}
+
+func TestConcurrentVersionsAreSiblings(t *testing.T){
+	s := newTestServer(t.TempDir())
+
+	if err := s.Store("shared.txt", bytes.NewReader([]byte("base"))); err != nil{
+		t.Fatal(err)
+	}
+	versions, err := s.Versions("shared.txt")
+	if err != nil{
+		t.Fatal(err)
+	}
+	base := versions[0]
+
+	// Another node sharing our owner ID wrote on top of the same base version without seeing our next write
+	theirs := Version{
+		ID: newVersionID(s.clock.Now()),
+		Node: "othernode",
+		ModTime: time.Now().Add(30 * time.Second),
+		Clock: base.Clock.Merge(VectorClock{"othernode": 1}),
+	}
+	if err := s.Store("shared.txt", bytes.NewReader([]byte("ours"))); err != nil{
+		t.Fatal(err)
+	}
+	if err := s.handleMessageVersion("peer", MessageVersion{ID: s.ID, Key: crypto.HashKey("shared.txt"), Version: theirs}); err != nil{
+		t.Fatal(err)
+	}
+
+	siblings, err := s.Conflicts("shared.txt")
+	if err != nil{
+		t.Fatal(err)
+	}
+	if len(siblings) != 2{
+		t.Fatalf("have %d siblings want 2", len(siblings))
+	}
+
+	winner, err := LastWriterWins("shared.txt", siblings)
+	if err != nil || winner.ID != theirs.ID{
+		t.Errorf("expected the later write to win, have %+v", winner)
+	}
+
+	s.ConflictResolver = KeepAll
+	if _, err := s.Get("shared.txt"); err == nil{
+		t.Fatalf("expected a conflict error")
+	} else if conflict, ok := err.(*ConflictError); !ok || len(conflict.Siblings) != 2{
+		t.Errorf("have %v want a conflict with 2 siblings", err)
+	}
+
+	// Storing again descends from both siblings and resolves the conflict
+	if err := s.Store("shared.txt", bytes.NewReader([]byte("merged"))); err != nil{
+		t.Fatal(err)
+	}
+	r, err := s.Get("shared.txt")
+	if have := readAll(t, r, err); have != "merged"{
+		t.Errorf("have %s want merged", have)
+	}
+}
+
+func TestLegacyVersionIndexIsMoved(t *testing.T){
+	s := newTestServer(t.TempDir())
+	if err := s.Store("old.txt", bytes.NewReader([]byte("before"))); err != nil{
+		t.Fatal(err)
+	}
+
+	// Put the index back where it was kept before indexes were keyed by the hashed key
+	versions, err := s.Versions("old.txt")
+	if err != nil{
+		t.Fatal(err)
+	}
+	for i := range versions{
+		versions[i].Key = ""
+	}
+	if err := s.store.WriteVersions(s.ID, "old.txt", versions); err != nil{
+		t.Fatal(err)
+	}
+	if err := s.store.DeleteVersions(s.ID, crypto.HashKey("old.txt")); err != nil{
+		t.Fatal(err)
+	}
+
+	r, err := s.Get("old.txt")
+	if have := readAll(t, r, err); have != "before"{
+		t.Errorf("have %s want before", have)
+	}
+
+	if err := s.Store("old.txt", bytes.NewReader([]byte("after"))); err != nil{
+		t.Fatal(err)
+	}
+	moved, err := s.store.ReadVersions(s.ID, crypto.HashKey("old.txt"))
+	if err != nil || len(moved) != 2{
+		t.Fatalf("expected both versions under the hashed key, have %v %v", moved, err)
+	}
+	if legacy, err := s.store.ReadVersions(s.ID, "old.txt"); err != nil || len(legacy) != 0{
+		t.Errorf("expected the old index to be removed, have %v %v", legacy, err)
+	}
+}
+
+func TestConcurrentStoresKeepEveryVersion(t *testing.T){
+	s := newTestServer(t.TempDir())
+
+	const n = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++{
+		wg.Add(1)
+		go func(i int){
+			defer wg.Done()
+			errs <- s.Store("busy.txt", bytes.NewReader([]byte(fmt.Sprintf("write %d", i))))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs{
+		if err != nil{
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := s.Versions("busy.txt")
+	if err != nil{
+		t.Fatal(err)
+	}
+	if len(versions) != n{
+		t.Fatalf("have %d versions want %d", len(versions), n)
+	}
+	for _, v := range versions{
+		r, err := s.GetVersion("busy.txt", v.ID)
+		readAll(t, r, err)
+	}
+}
+
+func TestStoreContextCancelled(t *testing.T){
+	s := newTestServer(t.TempDir())
+	if err := s.Store("picture.jpg", bytes.NewReader([]byte("old"))); err != nil{
+		t.Fatal(err)
+	}
+
+	// The client goes away halfway through the upload
+	ctx, cancel := context.WithCancel(context.Background())
+	r := io.MultiReader(bytes.NewReader([]byte("new ")), readerFunc(func(b []byte) (int, error){
+		cancel()
+		return copy(b, "data"), nil
+	}), bytes.NewReader([]byte("never read")))
+	if err := s.StoreContext(ctx, "picture.jpg", r); !errors.Is(err, context.Canceled){
+		t.Fatalf("have %v want %v", err, context.Canceled)
+	}
+
+	versions, err := s.Versions("picture.jpg")
+	if err != nil || len(versions) != 1{
+		t.Fatalf("expected the cancelled store to leave no version, have %+v %v", versions, err)
+	}
+	got, err := s.Get("picture.jpg")
+	if body := readAll(t, got, err); body != "old"{
+		t.Errorf("have %q want %q", body, "old")
+	}
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error){
+	return f(b)
+}
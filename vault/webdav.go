@@ -0,0 +1,420 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// The WebDAV endpoint lets file managers mount the vault as a network drive. It is served by the HTTP gateway under
+// /dav/ and shows the keys as the tree ReadDir builds from them. Writes are buffered in a temporary file and stored as
+// a new version when the file is closed. Renames copy every key to its new name before deleting the old one, they are
+// not atomic.
+
+const davPrefix = "/dav"
+
+// WebDAV returns the WebDAV handler, the gateway serves it under /dav/
+func (s *FileServer) WebDAV() *webdav.Handler{
+	return &webdav.Handler{
+		Prefix: davPrefix,
+		FileSystem: davFS{s: s},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error){
+			if err != nil{
+				s.logger("webdav").Debug("webdav request failed", "method", r.Method, "path", r.URL.Path, "err", err)
+			}
+		},
+	}
+}
+
+// davFS is the webdav.FileSystem of a file server
+type davFS struct{
+	s *FileServer
+}
+
+// davPath turns the slash separated name of the WebDAV handler into a path of the tree view
+func davPath(name string) string{
+	return strings.Trim(name, "/")
+}
+
+// davError maps the errors of the file server to the ones the WebDAV handler knows
+func davError(err error) error{
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrDeleted) || errors.Is(err, ErrNoHolders){
+		return os.ErrNotExist
+	}
+	return err
+}
+
+func (d davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error{
+	path := davPath(name)
+	if _, err := d.s.StatPath(path); err == nil{
+		return os.ErrExist
+	}
+	if err := d.parentExists(path); err != nil{
+		return err
+	}
+	return d.s.StoreContext(ctx, dirMarker(path), strings.NewReader(""))
+}
+
+func parentOf(path string) string{
+	if i := strings.LastIndex(path, "/"); i >= 0{
+		return path[:i]
+	}
+	return ""
+}
+
+// parentExists checks that the directory path would be created in is there
+func (d davFS) parentExists(path string) error{
+	entry, err := d.s.StatPath(parentOf(path))
+	if err != nil{
+		return davError(err)
+	}
+	if !entry.Dir{
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (d davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error){
+	path := davPath(name)
+	entry, err := d.s.StatPath(path)
+	if err != nil && !errors.Is(err, ErrNotFound){
+		return nil, err
+	}
+	exists := err == nil
+
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0{
+		if !exists{
+			return nil, os.ErrNotExist
+		}
+		if entry.Dir{
+			entries, err := d.s.ReadDir(path)
+			if err != nil{
+				return nil, davError(err)
+			}
+			return &davDir{info: davInfo{entry}, entries: entries}, nil
+		}
+		r, err := d.s.GetContext(ctx, path)
+		if err != nil{
+			return nil, davError(err)
+		}
+		f := &davFile{info: davInfo{entry}}
+		if rc, ok := r.(io.Closer); ok{
+			f.closer = rc
+		}
+		if f.ReadSeeker, err = readSeeker(r); err != nil{
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+
+	switch{
+	case exists && entry.Dir:
+		return nil, errors.New("is a directory")
+	case exists && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, os.ErrExist
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, os.ErrNotExist
+	case !exists:
+		if err := d.parentExists(path); err != nil{
+			return nil, err
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "distri_vault_dav")
+	if err != nil{
+		return nil, err
+	}
+	w := &davWriter{ctx: ctx, s: d.s, path: path, tmp: tmp}
+	// Without O_TRUNC the writes go over the current content
+	if exists && flag&os.O_TRUNC == 0{
+		if err := w.load(); err != nil{
+			w.discard()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (d davFS) RemoveAll(ctx context.Context, name string) error{
+	path := davPath(name)
+	if len(path) == 0{
+		return errors.New("can't remove the root")
+	}
+	entry, err := d.s.StatPath(path)
+	if err != nil{
+		return davError(err)
+	}
+	if !entry.Dir{
+		if err := d.s.DeleteContext(ctx, path); err != nil{
+			return err
+		}
+		return d.keepDir(ctx, parentOf(path))
+	}
+
+	objects, err := d.s.List(dirMarker(path))
+	if err != nil{
+		return err
+	}
+	for _, o := range objects{
+		if err := d.s.DeleteContext(ctx, o.Key); err != nil{
+			return err
+		}
+	}
+	return d.keepDir(ctx, parentOf(path))
+}
+
+// keepDir puts a marker in dir if its last key was just removed, so it doesn't vanish with it
+func (d davFS) keepDir(ctx context.Context, dir string) error{
+	if len(dir) == 0{
+		return nil
+	}
+	if _, err := d.s.StatPath(dir); !errors.Is(err, ErrNotFound){
+		return err
+	}
+	return d.s.StoreContext(ctx, dirMarker(dir), strings.NewReader(""))
+}
+
+func (d davFS) Rename(ctx context.Context, oldName, newName string) error{
+	from, to := davPath(oldName), davPath(newName)
+	if len(from) == 0 || len(to) == 0{
+		return errors.New("can't rename the root")
+	}
+	if to == from || strings.HasPrefix(to, dirMarker(from)){
+		return errors.New("can't move a directory into itself")
+	}
+	entry, err := d.s.StatPath(from)
+	if err != nil{
+		return davError(err)
+	}
+	if err := d.parentExists(to); err != nil{
+		return err
+	}
+
+	if !entry.Dir{
+		if err := d.move(ctx, from, to); err != nil{
+			return err
+		}
+		return d.keepDir(ctx, parentOf(from))
+	}
+	objects, err := d.s.List(dirMarker(from))
+	if err != nil{
+		return err
+	}
+	for _, o := range objects{
+		if err := d.move(ctx, o.Key, dirMarker(to)+strings.TrimPrefix(o.Key, dirMarker(from))); err != nil{
+			return err
+		}
+	}
+	return d.keepDir(ctx, parentOf(from))
+}
+
+// move stores the file under key as newKey and deletes key
+func (d davFS) move(ctx context.Context, key string, newKey string) error{
+	r, err := d.s.GetContext(ctx, key)
+	if err != nil{
+		return davError(err)
+	}
+	if rc, ok := r.(io.ReadCloser); ok{
+		defer rc.Close()
+	}
+	if err := d.s.StoreContext(ctx, newKey, r); err != nil{
+		return err
+	}
+	return d.s.DeleteContext(ctx, key)
+}
+
+func (d davFS) Stat(ctx context.Context, name string) (os.FileInfo, error){
+	entry, err := d.s.StatPath(davPath(name))
+	if err != nil{
+		return nil, davError(err)
+	}
+	return davInfo{entry}, nil
+}
+
+// davInfo is the os.FileInfo of an entry in the tree view
+type davInfo struct{
+	entry DirEntry
+}
+
+func (i davInfo) Name() string{
+	if len(i.entry.Name) == 0{
+		return "/"
+	}
+	return i.entry.Name
+}
+
+func (i davInfo) Size() int64{
+	return i.entry.Object.Size
+}
+
+func (i davInfo) Mode() fs.FileMode{
+	if i.entry.Dir{
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (i davInfo) ModTime() time.Time{
+	return i.entry.Object.ModTime
+}
+
+func (i davInfo) IsDir() bool{
+	return i.entry.Dir
+}
+
+func (i davInfo) Sys() any{
+	return nil
+}
+
+// ETag makes the handler use the digest of the file instead of one made up from its size and time
+func (i davInfo) ETag(ctx context.Context) (string, error){
+	if i.entry.Dir || len(i.entry.Object.Digest) == 0{
+		return "", webdav.ErrNotImplemented
+	}
+	return etag(i.entry.Object), nil
+}
+
+// davFile is a file opened for reading
+type davFile struct{
+	io.ReadSeeker
+	info davInfo
+	// closer closes the file Get returned
+	closer io.Closer
+}
+
+func (f *davFile) Close() error{
+	if f.closer != nil{
+		return f.closer.Close()
+	}
+	return nil
+}
+
+func (f *davFile) Readdir(count int) ([]fs.FileInfo, error){
+	return nil, errors.New("not a directory")
+}
+
+func (f *davFile) Stat() (fs.FileInfo, error){
+	return f.info, nil
+}
+
+func (f *davFile) Write(p []byte) (int, error){
+	return 0, errors.New("file is open for reading")
+}
+
+// davDir is a directory, reading it lists its entries
+type davDir struct{
+	info davInfo
+	entries []DirEntry
+	read int
+}
+
+func (d *davDir) Close() error{
+	return nil
+}
+
+func (d *davDir) Read(p []byte) (int, error){
+	return 0, errors.New("is a directory")
+}
+
+func (d *davDir) Seek(offset int64, whence int) (int64, error){
+	return 0, errors.New("is a directory")
+}
+
+// Readdir returns the next count entries, all that are left if count isn't positive
+func (d *davDir) Readdir(count int) ([]fs.FileInfo, error){
+	left := d.entries[d.read:]
+	if count > 0{
+		if len(left) == 0{
+			return nil, io.EOF
+		}
+		left = left[:min(count, len(left))]
+	}
+	d.read += len(left)
+
+	infos := make([]fs.FileInfo, len(left))
+	for i, e := range left{
+		infos[i] = davInfo{e}
+	}
+	return infos, nil
+}
+
+func (d *davDir) Stat() (fs.FileInfo, error){
+	return d.info, nil
+}
+
+func (d *davDir) Write(p []byte) (int, error){
+	return 0, errors.New("is a directory")
+}
+
+// davWriter is a file opened for writing, it is stored when closed
+type davWriter struct{
+	// ctx is the one of the request that opened the file, which also closes it
+	ctx context.Context
+	s *FileServer
+	path string
+	tmp *os.File
+}
+
+// load copies the current content of the file into the buffer
+func (w *davWriter) load() error{
+	r, err := w.s.GetContext(w.ctx, w.path)
+	if err != nil{
+		return davError(err)
+	}
+	if rc, ok := r.(io.ReadCloser); ok{
+		defer rc.Close()
+	}
+	if _, err := io.Copy(w.tmp, r); err != nil{
+		return err
+	}
+	_, err = w.tmp.Seek(0, io.SeekStart)
+	return err
+}
+
+func (w *davWriter) discard(){
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+}
+
+func (w *davWriter) Read(p []byte) (int, error){
+	return w.tmp.Read(p)
+}
+
+func (w *davWriter) Seek(offset int64, whence int) (int64, error){
+	return w.tmp.Seek(offset, whence)
+}
+
+func (w *davWriter) Write(p []byte) (int, error){
+	return w.tmp.Write(p)
+}
+
+func (w *davWriter) Readdir(count int) ([]fs.FileInfo, error){
+	return nil, errors.New("not a directory")
+}
+
+// Stat describes the file as written so far
+func (w *davWriter) Stat() (fs.FileInfo, error){
+	fi, err := w.tmp.Stat()
+	if err != nil{
+		return nil, err
+	}
+	name := w.path[strings.LastIndex(w.path, "/")+1:]
+	return davInfo{DirEntry{Name: name, Object: ObjectInfo{Key: w.path, Size: fi.Size(), ModTime: fi.ModTime()}}}, nil
+}
+
+func (w *davWriter) Close() error{
+	defer w.discard()
+	if _, err := w.tmp.Seek(0, io.SeekStart); err != nil{
+		return err
+	}
+	return w.s.StoreContext(w.ctx, w.path, w.tmp)
+}
@@ -0,0 +1,109 @@
+package vault
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadDir(t *testing.T){
+	s := newTestServer(t.TempDir())
+	for _, key := range []string{"a.txt", "docs/b.txt", "docs/old/c.txt", "docs/old/d.txt", "empty/"}{
+		if err := s.Store(key, strings.NewReader(key)); err != nil{
+			t.Fatal(err)
+		}
+	}
+
+	names := func(dir string) string{
+		entries, err := s.ReadDir(dir)
+		if err != nil{
+			return err.Error()
+		}
+		result := []string{}
+		for _, e := range entries{
+			if e.Dir{
+				e.Name += "/"
+			}
+			result = append(result, e.Name)
+		}
+		return strings.Join(result, ",")
+	}
+	for dir, want := range map[string]string{
+		"": "a.txt,docs/,empty/",
+		"docs": "b.txt,old/",
+		"docs/old": "c.txt,d.txt",
+		"empty": "",
+	}{
+		if got := names(dir); got != want{
+			t.Errorf("ReadDir(%q) = %s, want %s", dir, got, want)
+		}
+	}
+	if _, err := s.ReadDir("missing"); !errors.Is(err, ErrNotFound){
+		t.Errorf("reading a missing directory returned %v", err)
+	}
+
+	if e, err := s.StatPath("docs/old"); err != nil || !e.Dir || e.Name != "old"{
+		t.Errorf("StatPath of a directory returned %+v, %v", e, err)
+	}
+	if e, err := s.StatPath("docs/b.txt"); err != nil || e.Dir || e.Object.Size != 10{
+		t.Errorf("StatPath of a file returned %+v, %v", e, err)
+	}
+	if _, err := s.StatPath("docs/missing"); !errors.Is(err, ErrNotFound){
+		t.Errorf("StatPath of a missing path returned %v", err)
+	}
+}
+
+func TestWebDAV(t *testing.T){
+	s := newTestServer(t.TempDir())
+	srv := httptest.NewServer(s.Gateway())
+	defer srv.Close()
+	dav := srv.URL + "/dav"
+
+	if resp := do(t, "PUT", dav+"/docs/a.txt", "hello webdav"); resp.StatusCode != http.StatusConflict{
+		t.Errorf("put into a missing directory returned %d", resp.StatusCode)
+	}
+	if resp := do(t, "MKCOL", dav+"/docs", ""); resp.StatusCode != http.StatusCreated{
+		t.Fatalf("mkcol returned %d", resp.StatusCode)
+	}
+	if resp := do(t, "PUT", dav+"/docs/a.txt", "hello webdav"); resp.StatusCode != http.StatusCreated{
+		t.Fatalf("put returned %d", resp.StatusCode)
+	}
+
+	resp := do(t, "GET", dav+"/docs/a.txt", "", "Range", "bytes=6-")
+	if body := readBody(t, resp); resp.StatusCode != http.StatusPartialContent || body != "webdav"{
+		t.Errorf("range get returned %d %q", resp.StatusCode, body)
+	}
+
+	resp = do(t, "PROPFIND", dav+"/docs/", "", "Depth", "1")
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusMultiStatus || !strings.Contains(body, "<D:href>/dav/docs/a.txt</D:href>") || !strings.Contains(body, "<D:getcontentlength>12</D:getcontentlength>"){
+		t.Errorf("propfind returned %d %s", resp.StatusCode, body)
+	}
+
+	if resp := do(t, "MOVE", dav+"/docs/a.txt", "", "Destination", dav+"/docs/b.txt"); resp.StatusCode != http.StatusCreated{
+		t.Errorf("move returned %d", resp.StatusCode)
+	}
+	if resp := do(t, "GET", dav+"/docs/a.txt", ""); resp.StatusCode != http.StatusNotFound{
+		t.Errorf("get of the old name returned %d", resp.StatusCode)
+	}
+	// The tree is the keys, the gateway sees the file under its path
+	if resp := do(t, "GET", srv.URL+"/objects/docs/b.txt", ""); readBody(t, resp) != "hello webdav"{
+		t.Errorf("moved file is not stored under its new key")
+	}
+
+	// Removing the last file leaves the directory in place
+	if resp := do(t, "DELETE", dav+"/docs/b.txt", ""); resp.StatusCode != http.StatusNoContent{
+		t.Errorf("delete returned %d", resp.StatusCode)
+	}
+	if resp := do(t, "PROPFIND", dav+"/docs/", "", "Depth", "0"); resp.StatusCode != http.StatusMultiStatus{
+		t.Errorf("propfind of the emptied directory returned %d", resp.StatusCode)
+	}
+	if resp := do(t, "DELETE", dav+"/docs", ""); resp.StatusCode != http.StatusNoContent{
+		t.Errorf("delete of the directory returned %d", resp.StatusCode)
+	}
+	if resp := do(t, "PROPFIND", dav+"/docs/", "", "Depth", "0"); resp.StatusCode != http.StatusNotFound{
+		t.Errorf("propfind of a deleted directory returned %d", resp.StatusCode)
+	}
+}